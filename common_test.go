@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+
+	"simple-web-asr/helper"
+	"simple-web-asr/model"
+)
+
+// Set the config value for the test, the previous value is restored
+// once it is done
+func setConfig(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// A dialect that builds the SQL like PostgreSQL without a connection
+type dryRunDialector struct{}
+
+func (dryRunDialector) Name() string { return "dryrun" }
+
+func (dryRunDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = dryRunPool{}
+	return nil
+}
+
+// The connections of a dry run, which only begin transactions since the
+// statements aren't executed
+type dryRunPool struct{}
+
+var errDryRun = errors.New("dry run")
+
+func (dryRunPool) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return nil, errDryRun
+}
+
+func (dryRunPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return nil, errDryRun
+}
+
+func (dryRunPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return nil, errDryRun
+}
+
+func (dryRunPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return nil
+}
+
+func (p dryRunPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	return &dryRunTx{p}, nil
+}
+
+type dryRunTx struct {
+	dryRunPool
+}
+
+func (*dryRunTx) Commit() error   { return nil }
+func (*dryRunTx) Rollback() error { return nil }
+
+func (dryRunDialector) Migrator(db *gorm.DB) gorm.Migrator { return nil }
+
+func (dryRunDialector) DataTypeOf(*schema.Field) string { return "" }
+
+func (dryRunDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+
+func (dryRunDialector) BindVarTo(writer clause.Writer, stmt *gorm.Statement, v interface{}) {
+	writer.WriteByte('?')
+}
+
+func (dryRunDialector) QuoteTo(writer clause.Writer, str string) {
+	writer.WriteString(str)
+}
+
+func (dryRunDialector) Explain(sql string, vars ...interface{}) string {
+	return logger.ExplainSQL(sql, nil, "'", vars...)
+}
+
+// sqlRecorder logs the statements of a dry run. Queries of a table in
+// rows find those rows, whatever the conditions, and count them. Rows
+// under "table: condition" are found instead by the queries of the table
+// whose SQL, with the values in place, contains the condition.
+type sqlRecorder struct {
+	logger.Interface
+	statements []string
+	rows       map[string]interface{}
+}
+
+func (r *sqlRecorder) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	sql, _ := fc()
+	r.statements = append(r.statements, sql)
+}
+
+// Fill the destination of a query with the rows of its table
+func (r *sqlRecorder) fill(tx *gorm.DB) {
+	rows, ok := r.rows[tx.Statement.Table]
+	sql := tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...)
+	for key, conditional := range r.rows {
+		parts := strings.SplitN(key, ": ", 2)
+		if len(parts) == 2 && parts[0] == tx.Statement.Table && strings.Contains(sql, parts[1]) {
+			rows, ok = conditional, true
+		}
+	}
+	if !ok || !tx.Statement.ReflectValue.IsValid() {
+		return
+	}
+
+	v := reflect.ValueOf(rows)
+	dest := tx.Statement.ReflectValue
+	switch dest.Kind() {
+	case reflect.Slice:
+		dest.Set(reflect.AppendSlice(dest.Slice(0, 0), v))
+	case reflect.Struct:
+		if v.Len() > 0 {
+			dest.Set(v.Index(0))
+		}
+	case reflect.Int64:
+		dest.SetInt(int64(v.Len()))
+	}
+	tx.RowsAffected = int64(v.Len())
+}
+
+// Replace the database for the test by one that only records the SQL of
+// the statements. Queries find nothing, unless rows are added to the
+// recorder.
+func dryRun(t *testing.T) *sqlRecorder {
+	recorder := &sqlRecorder{Interface: logger.Default.LogMode(logger.Silent), rows: map[string]interface{}{}}
+	dryRunDB, err := gorm.Open(dryRunDialector{}, &gorm.Config{DryRun: true, Logger: recorder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRunDB.Callback().Query().After("gorm:query").Register("test:rows", recorder.fill)
+
+	previous, previousHelper := db, helper.DB
+	db, helper.DB = dryRunDB, dryRunDB
+	t.Cleanup(func() {
+		db, helper.DB = previous, previousHelper
+	})
+
+	return recorder
+}
+
+// The confirmed user that the tests act as, unless they need another
+func testUser() model.User {
+	user := model.User{Email: "someone@example.com", Status: 1}
+	user.ID = 1
+	return user
+}
@@ -10,6 +10,8 @@ PYTHONPATH="${PYTHONPATH:-}"
 
 file=$(realpath "$1")
 language=$2
+# Set NORMALIZE=1 to normalize the loudness before decoding
+normalize="${NORMALIZE:-0}"
 recid=$(basename "${file}" | md5sum | awk '{print $1}')
 
 basedir=$(realpath $(dirname $0))
@@ -17,10 +19,15 @@ workdir=$(mktemp -d)
 model=/home/ims/models/${language}
 espnet=/home/ims/espnet
 
+filters=()
+if [ "${normalize}" = "1" ]; then
+	filters=(-af loudnorm=I=-16:TP=-1.5:LRA=11)
+fi
+
 # Segment the audio
 mkdir -p ${workdir}/data/${recid}
 duration=$(
-	ffmpeg -i "${file}" -acodec pcm_s16le -ar 16000 -ac 1 ${workdir}/data/${recid}.wav 2>&1 | \
+	ffmpeg -i "${file}" -vn ${filters[@]+"${filters[@]}"} -acodec pcm_s16le -ar 16000 -ac 1 ${workdir}/data/${recid}.wav 2>&1 | \
 	grep Duration | \
 	perl -p -e 'my ($h, $m, $s) = ($_ =~ /(\d\d):(\d\d):(\d\d\.\d\d)/); $_ = $h * 3600 + $m * 60 + $s;'
 )
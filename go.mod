@@ -7,6 +7,7 @@ require (
 	github.com/gin-gonic/gin v1.6.3 // indirect
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/joho/godotenv v1.3.0
+	github.com/prometheus/client_golang v1.5.1
 	github.com/takama/daemon v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
@@ -0,0 +1,71 @@
+package helper
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disposable email domains loaded from DISPOSABLE_DOMAINS_FILE, reloaded
+// whenever the file changes
+var disposableDomains struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	domains map[string]bool
+}
+
+// Read a list of domains, one per line, ignoring empty lines and comments
+func loadDomains(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains[line] = true
+		}
+	}
+
+	return domains, scanner.Err()
+}
+
+// Check if the domain part of the email address is in the list of
+// disposable email domains. Always false if no list is configured.
+func IsDisposableEmail(email string) bool {
+	path := GetConfig("DISPOSABLE_DOMAINS_FILE")
+	if path == "" {
+		return false
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	disposableDomains.Lock()
+	defer disposableDomains.Unlock()
+
+	if info, err := os.Stat(path); err != nil {
+		log.Println("Failed to read disposable domains list:", err)
+	} else if path != disposableDomains.path || !info.ModTime().Equal(disposableDomains.modTime) {
+		if domains, err := loadDomains(path); err != nil {
+			log.Println("Failed to read disposable domains list:", err)
+		} else {
+			disposableDomains.path = path
+			disposableDomains.modTime = info.ModTime()
+			disposableDomains.domains = domains
+		}
+	}
+
+	return disposableDomains.domains[domain]
+}
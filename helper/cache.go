@@ -0,0 +1,121 @@
+package helper
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	created time.Time
+}
+
+// Cache keeps generated content for a limited time. Small entries are
+// kept in memory up to a total size, evicting the least recently used
+// ones, larger entries are written to a directory if one is configured.
+type Cache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxBytes    int
+	inlineBytes int
+	dir         string
+	size        int
+	lru         *list.List
+	entries     map[string]*list.Element
+}
+
+func NewCache(ttl time.Duration, maxBytes, inlineBytes int, dir string) *Cache {
+	return &Cache{
+		ttl:         ttl,
+		maxBytes:    maxBytes,
+		inlineBytes: inlineBytes,
+		dir:         dir,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{}}
+}
+
+// The largest entry that the cache can store
+func (c *Cache) MaxEntryBytes() int {
+	if c.dir != "" {
+		return c.maxBytes
+	}
+	if c.inlineBytes < c.maxBytes {
+		return c.inlineBytes
+	}
+	return c.maxBytes
+}
+
+func (c *Cache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Remove an in-memory entry. Must be called with the mutex held.
+func (c *Cache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.data)
+}
+
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Since(entry.created) < c.ttl {
+			c.lru.MoveToFront(e)
+			return entry.data, true
+		}
+		c.remove(e)
+	}
+
+	if c.dir != "" {
+		filename := c.filename(key)
+		if info, err := os.Stat(filename); err == nil {
+			if time.Since(info.ModTime()) < c.ttl {
+				if data, err := ioutil.ReadFile(filename); err == nil {
+					return data, true
+				}
+			} else {
+				os.Remove(filename)
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func (c *Cache) Put(key string, data []byte) {
+	if len(data) > c.MaxEntryBytes() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(data) > c.inlineBytes {
+		if err := os.MkdirAll(c.dir, 0700); err == nil {
+			ioutil.WriteFile(c.filename(key), data, 0600)
+		}
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data, created: time.Now()})
+	c.size += len(data)
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
@@ -0,0 +1,70 @@
+package helper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacheInline(t *testing.T) {
+	c := NewCache(time.Minute, 10, 10, "")
+
+	c.Put("a", []byte("aaaa"))
+	c.Put("b", []byte("bbbb"))
+	if data, ok := c.Get("a"); !ok || string(data) != "aaaa" {
+		t.Fatalf("got %q, %v", data, ok)
+	}
+
+	// b is the least recently used entry and makes room for c
+	c.Put("c", []byte("cccc"))
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	// Too large for the cache without a directory
+	c.Put("d", bytes.Repeat([]byte("d"), 11))
+	if _, ok := c.Get("d"); ok {
+		t.Error("an entry over the limit was stored")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(20*time.Millisecond, 10, 10, "")
+
+	c.Put("a", []byte("aaaa"))
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("an expired entry was returned")
+	}
+}
+
+func TestCacheDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewCache(time.Minute, 100, 4, dir)
+	if c.MaxEntryBytes() != 100 {
+		t.Errorf("got MaxEntryBytes %d, want 100", c.MaxEntryBytes())
+	}
+
+	large := bytes.Repeat([]byte("x"), 50)
+	c.Put("large", large)
+	if data, ok := c.Get("large"); !ok || !bytes.Equal(data, large) {
+		t.Errorf("got %q, %v", data, ok)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("got %d files, want 1", len(files))
+	}
+}
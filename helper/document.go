@@ -0,0 +1,207 @@
+package helper
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+</Types>`
+
+const docxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+</Relationships>`
+
+// Write a minimal DOCX document with a bold title followed by one paragraph
+// per line. The document is streamed to w, only the lines themselves are
+// held in memory.
+func WriteDOCX(w io.Writer, title string, lines []string) error {
+	z := zip.NewWriter(w)
+
+	for _, part := range [][2]string{{"[Content_Types].xml", docxContentTypes}, {"_rels/.rels", docxRels}} {
+		f, err := z.Create(part[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part[1]); err != nil {
+			return err
+		}
+	}
+
+	f, err := z.Create("word/document.xml")
+	if err != nil {
+		return err
+	}
+
+	doc := bufio.NewWriter(f)
+	doc.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	doc.WriteString(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>`)
+	doc.WriteString(`<w:p><w:r><w:rPr><w:b/><w:sz w:val="32"/></w:rPr><w:t xml:space="preserve">`)
+	xml.EscapeText(doc, []byte(title))
+	doc.WriteString(`</w:t></w:r></w:p>`)
+
+	for _, line := range lines {
+		doc.WriteString(`<w:p><w:r><w:t xml:space="preserve">`)
+		xml.EscapeText(doc, []byte(line))
+		doc.WriteString(`</w:t></w:r></w:p>`)
+	}
+
+	doc.WriteString(`</w:body></w:document>`)
+
+	if err := doc.Flush(); err != nil {
+		return err
+	}
+
+	return z.Close()
+}
+
+// countingWriter keeps track of the current offset, which the PDF
+// cross-reference table needs
+type countingWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	n, _ := fmt.Fprintf(cw.w, format, args...)
+	cw.n += n
+}
+
+const (
+	pdfLinesPerPage = 50
+	pdfLineWidth    = 90
+)
+
+// Escape a string for a PDF literal string. Only the characters of
+// WinAnsiEncoding that coincide with Latin-1 are kept, everything else
+// is replaced with a question mark.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Split a line into chunks no longer than width runes, breaking at spaces
+// where possible
+func wrapLine(line string, width int) []string {
+	var result []string
+	words := strings.Fields(line)
+	current := ""
+
+	for _, word := range words {
+		for len([]rune(word)) > width {
+			if current != "" {
+				result = append(result, current)
+				current = ""
+			}
+			result = append(result, string([]rune(word)[:width]))
+			word = string([]rune(word)[width:])
+		}
+
+		if current == "" {
+			current = word
+		} else if len([]rune(current))+1+len([]rune(word)) <= width {
+			current += " " + word
+		} else {
+			result = append(result, current)
+			current = word
+		}
+	}
+
+	return append(result, current)
+}
+
+// Write a minimal PDF document with a title followed by the lines, using
+// the built-in Helvetica font. Pages are written out as soon as they are
+// full, so besides the lines only the current page is held in memory.
+func WritePDF(w io.Writer, title string, lines []string) error {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	// Objects 1-3 are the catalog, the page tree and the font,
+	// pages and their contents are numbered from 4 on
+	offsets := map[int]int{}
+	var pages []int
+	next := 4
+
+	cw.printf("%%PDF-1.4\n")
+
+	offsets[1] = cw.n
+	cw.printf("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	offsets[3] = cw.n
+	cw.printf("3 0 obj\n<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	var page []string
+	writePage := func() {
+		var content strings.Builder
+		content.WriteString("BT\n/F1 10 Tf\n12 TL\n50 800 Td\n")
+		for _, l := range page {
+			content.WriteString("(" + pdfEscape(l) + ") Tj T*\n")
+		}
+		content.WriteString("ET\n")
+
+		offsets[next] = cw.n
+		cw.printf("%d 0 obj\n<< /Length %d >>\nstream\n%sendstream\nendobj\n", next, content.Len(), content.String())
+
+		offsets[next+1] = cw.n
+		cw.printf("%d 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] ", next+1)
+		cw.printf("/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>\nendobj\n", next)
+
+		pages = append(pages, next+1)
+		next += 2
+		page = nil
+	}
+
+	page = append(page, wrapLine(title, pdfLineWidth)...)
+	page = append(page, "")
+
+	for _, line := range lines {
+		for _, l := range wrapLine(line, pdfLineWidth) {
+			page = append(page, l)
+			if len(page) == pdfLinesPerPage {
+				writePage()
+			}
+		}
+	}
+
+	if len(page) > 0 || len(pages) == 0 {
+		writePage()
+	}
+
+	offsets[2] = cw.n
+	cw.printf("2 0 obj\n<< /Type /Pages /Kids [")
+	for _, p := range pages {
+		cw.printf("%d 0 R ", p)
+	}
+	cw.printf("] /Count %d >>\nendobj\n", len(pages))
+
+	xref := cw.n
+	cw.printf("xref\n0 %d\n0000000000 65535 f \n", next)
+	for i := 1; i < next; i++ {
+		cw.printf("%010d 00000 n \n", offsets[i])
+	}
+	cw.printf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", next, xref)
+
+	return cw.w.Flush()
+}
@@ -0,0 +1,332 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// EncryptedStorage encrypts the files of another storage with AES-256-GCM.
+//
+// The keys are configured in STORAGE_ENCRYPTION_KEYS as a comma-separated
+// list of id:key pairs, where the key is 32 random bytes in base64, e.g.
+// generated with "openssl rand -base64 32". New files are encrypted with
+// the first key, the others are only used for reading files encrypted
+// before. To rotate the key, prepend a new one and keep the old ones
+// until all files written with them are deleted or re-uploaded. Files
+// stored before the encryption was enabled are read as they are.
+//
+// The file starts with a header with the key ID and a random nonce,
+// followed by chunks of up to encryptionChunkSize bytes, each encrypted
+// separately so that the files are streamed rather than loaded into
+// memory. The nonce of a chunk includes its number and the last chunk
+// is marked, so that chunks can't be reordered or cut off.
+type EncryptedStorage struct {
+	Backend Storage
+	keyID   string
+	keys    map[string]cipher.AEAD
+}
+
+const encryptionMagic = "SWAE1"
+const encryptionChunkSize = 64 << 10
+
+var errTruncated = errors.New("encrypted file is truncated")
+
+func NewEncryptedStorage(backend Storage, keys string) (*EncryptedStorage, error) {
+	s := &EncryptedStorage{Backend: backend, keys: map[string]cipher.AEAD{}}
+
+	for _, pair := range strings.Split(keys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, fmt.Errorf("invalid key entry %q, expected id:base64key", pair)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes in base64", parts[0])
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.keyID == "" {
+			s.keyID = parts[0]
+		}
+		s.keys[parts[0]] = aead
+	}
+
+	return s, nil
+}
+
+// Nonce of the chunk with the given number
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], binary.BigEndian.Uint64(base[len(base)-8:])^n)
+	return nonce
+}
+
+// Additional data of a chunk, marking whether it is the last one
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (s *EncryptedStorage) encrypt(w io.Writer, r io.Reader) error {
+	aead := s.keys[s.keyID]
+	base := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(base); err != nil {
+		return err
+	}
+
+	header := append([]byte(encryptionMagic), byte(len(s.keyID)))
+	header = append(append(header, s.keyID...), base...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// A chunk is only written once the next one was read, since it has
+	// to be known whether it is the last one
+	current := make([]byte, encryptionChunkSize)
+	next := make([]byte, encryptionChunkSize)
+
+	n, err := io.ReadFull(r, current)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	for chunk := uint64(0); ; chunk++ {
+		m := 0
+		if n == encryptionChunkSize {
+			m, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+
+		last := m == 0
+		sealed := aead.Seal(nil, chunkNonce(base, chunk), current[:n], chunkData(last))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+
+		current, next = next, current
+		n = m
+	}
+}
+
+func (s *EncryptedStorage) Save(name string, r io.Reader) error {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(s.encrypt(pw, r))
+	}()
+
+	err := s.Backend.Save(name, pr)
+	pr.CloseWithError(errors.New("storage closed"))
+
+	return err
+}
+
+type decryptReader struct {
+	src     io.ReadCloser
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	base    []byte
+	chunk   uint64
+	buf     []byte
+	plain   []byte
+	done    bool
+	lastErr error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.lastErr != nil {
+			return 0, d.lastErr
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.r, d.buf)
+		if err == io.EOF {
+			d.lastErr = errTruncated
+			continue
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			d.lastErr = err
+			continue
+		}
+
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, err := d.r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		plain, err := d.aead.Open(d.buf[:0], chunkNonce(d.base, d.chunk), d.buf[:n], chunkData(last))
+		if err != nil {
+			d.lastErr = err
+			continue
+		}
+
+		d.plain = plain
+		d.chunk++
+		d.done = last
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.src.Close()
+}
+
+type passthroughReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *EncryptedStorage) Open(name string) (io.ReadCloser, error) {
+	src, err := s.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(src, encryptionChunkSize)
+	aead, base, _, err := s.readHeader(r)
+	if err != nil {
+		src.Close()
+		return nil, err
+	} else if aead == nil {
+		// Files stored before the encryption was enabled are read as they are
+		return passthroughReader{r, src}, nil
+	}
+
+	return &decryptReader{
+		src:  src,
+		r:    r,
+		aead: aead,
+		base: base,
+		buf:  make([]byte, encryptionChunkSize+aead.Overhead())}, nil
+}
+
+// Read the header of the file, which tells its key and the nonce of its
+// first chunk, and return its length. The AEAD is nil for files stored
+// before the encryption was enabled, of which nothing is read.
+func (s *EncryptedStorage) readHeader(r *bufio.Reader) (cipher.AEAD, []byte, int64, error) {
+	if magic, _ := r.Peek(len(encryptionMagic) + 1); !bytes.HasPrefix(magic, []byte(encryptionMagic)) || len(magic) <= len(encryptionMagic) {
+		return nil, nil, 0, nil
+	}
+
+	header := make([]byte, len(encryptionMagic)+1)
+	io.ReadFull(r, header)
+
+	keyID := make([]byte, header[len(header)-1])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, nil, 0, errTruncated
+	}
+
+	aead, ok := s.keys[string(keyID)]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("unknown encryption key %q", keyID)
+	}
+
+	base := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, base); err != nil {
+		return nil, nil, 0, errTruncated
+	}
+
+	return aead, base, int64(len(header) + len(keyID) + len(base)), nil
+}
+
+// Read only the header of the stored file
+func (s *EncryptedStorage) header(name string) (cipher.AEAD, []byte, int64, error) {
+	// The magic, the length of the key ID, the longest key ID and a nonce
+	src, err := openRange(s.Backend, name, 0, int64(len(encryptionMagic)+1+255+12))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer src.Close()
+
+	return s.readHeader(bufio.NewReader(src))
+}
+
+// Size of the decrypted file, worked out from the size of the stored one
+func (s *EncryptedStorage) Size(name string) (int64, error) {
+	size, err := fileSize(s.Backend, name)
+	if err != nil {
+		return 0, err
+	}
+
+	aead, _, headerSize, err := s.header(name)
+	if err != nil || aead == nil {
+		return size, err
+	}
+
+	sealed := int64(encryptionChunkSize + aead.Overhead())
+	chunks := (size - headerSize + sealed - 1) / sealed
+	return size - headerSize - chunks*int64(aead.Overhead()), nil
+}
+
+// Open a part of the decrypted file, fetching only the chunks it is in
+func (s *EncryptedStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	aead, base, headerSize, err := s.header(name)
+	if err != nil {
+		return nil, err
+	} else if aead == nil || length <= 0 {
+		return openRange(s.Backend, name, offset, length)
+	}
+
+	// One byte after the last chunk tells that it isn't the last one of
+	// the file, unless it is
+	sealed := int64(encryptionChunkSize + aead.Overhead())
+	first := offset / encryptionChunkSize
+	last := (offset + length - 1) / encryptionChunkSize
+	from := headerSize + first*sealed
+	src, err := openRange(s.Backend, name, from, (last-first+1)*sealed+1)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		src:   src,
+		r:     bufio.NewReaderSize(src, encryptionChunkSize),
+		aead:  aead,
+		base:  base,
+		chunk: uint64(first),
+		buf:   make([]byte, sealed)}
+	if _, err := io.CopyN(ioutil.Discard, d, offset-first*encryptionChunkSize); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return passthroughReader{io.LimitReader(d, length), d}, nil
+}
+
+func (s *EncryptedStorage) Delete(name string) error {
+	return s.Backend.Delete(name)
+}
@@ -0,0 +1,140 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Return a storage in a temporary directory, removed after the test
+func tempStorage(t *testing.T) *LocalStorage {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &LocalStorage{Dir: dir}
+}
+
+func randomKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func readAll(t *testing.T, s Storage, name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	backend := tempStorage(t)
+	s, err := NewEncryptedStorage(backend, randomKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		if err := s.Save("file", bytes.NewReader(data)); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		stored, _ := ioutil.ReadFile(backend.Path("file"))
+		if size > 0 && bytes.Contains(stored, data) {
+			t.Errorf("size %d: the file is stored in clear", size)
+		}
+
+		got, err := readAll(t, s, "file")
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: got %d different bytes back", size, len(got))
+		}
+	}
+}
+
+func TestEncryptedStorageKeyRotation(t *testing.T) {
+	backend := tempStorage(t)
+	oldKey := randomKey(t, "old")
+
+	old, err := NewEncryptedStorage(backend, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Save("file", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := NewEncryptedStorage(backend, randomKey(t, "new")+","+oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(t, rotated, "file"); err != nil || string(got) != "secret" {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// Without the old key the file can't be read
+	other, _ := NewEncryptedStorage(backend, randomKey(t, "new"))
+	if r, err := other.Open("file"); err == nil {
+		r.Close()
+		t.Error("a file was opened without its key")
+	}
+}
+
+func TestEncryptedStoragePlainFiles(t *testing.T) {
+	backend := tempStorage(t)
+	if err := backend.Save("file", bytes.NewReader([]byte("stored before"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := NewEncryptedStorage(backend, randomKey(t, "k1"))
+	if got, err := readAll(t, s, "file"); err != nil || string(got) != "stored before" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestEncryptedStorageTampering(t *testing.T) {
+	backend := tempStorage(t)
+	s, _ := NewEncryptedStorage(backend, randomKey(t, "k1"))
+
+	data := make([]byte, 2*encryptionChunkSize+10)
+	if err := s.Save("file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadFile(backend.Path("file"))
+
+	// Without the last chunk
+	ioutil.WriteFile(backend.Path("file"), stored[:len(stored)-26], 0600)
+	if _, err := readAll(t, s, "file"); err == nil {
+		t.Error("a truncated file was read without an error")
+	}
+
+	// With a changed byte
+	changed := append([]byte{}, stored...)
+	changed[len(changed)/2] ^= 1
+	ioutil.WriteFile(backend.Path("file"), changed, 0600)
+	if _, err := readAll(t, s, "file"); err == nil {
+		t.Error("a changed file was read without an error")
+	}
+}
+
+func TestNewEncryptedStorageInvalidKeys(t *testing.T) {
+	for _, keys := range []string{"", "nokey", "k1:short", "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := NewEncryptedStorage(&LocalStorage{}, keys); err == nil {
+			t.Errorf("keys %q were accepted", keys)
+		}
+	}
+}
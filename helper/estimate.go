@@ -0,0 +1,81 @@
+package helper
+
+import (
+	"time"
+
+	"simple-web-asr/model"
+)
+
+// Return the average processing time per second of audio over the last
+// ESTIMATE_HISTORY transcribed recordings. ok is false if fewer than
+// ESTIMATE_MIN_SAMPLES of them are known.
+func ProcessingRate() (rate float64, ok bool) {
+	var recordings []model.Recording
+	DB.Where("status = ? AND duration > 0 AND started_at IS NOT NULL AND finished_at IS NOT NULL", model.StatusDone).
+		Order("finished_at desc").Limit(GetConfigInt("ESTIMATE_HISTORY", 20)).Find(&recordings)
+
+	if len(recordings) == 0 || len(recordings) < GetConfigInt("ESTIMATE_MIN_SAMPLES", 3) {
+		return 0, false
+	}
+
+	var processing, audio float64
+	for r := range recordings {
+		processing += recordings[r].FinishedAt.Sub(*recordings[r].StartedAt).Seconds()
+		audio += recordings[r].Duration
+	}
+
+	return processing / audio, true
+}
+
+// Estimate when the transcription of the recording is finished, given
+// the processing rate. A queued recording is assumed to start now and a
+// running one that takes longer than expected to finish any moment.
+// Returns nil if the recording is not waiting or its duration is unknown.
+func EstimateCompletion(recording *model.Recording, rate float64, now time.Time) *time.Time {
+	if recording.Duration <= 0 {
+		return nil
+	}
+
+	processing := time.Duration(recording.Duration * rate * float64(time.Second))
+
+	var estimate time.Time
+	switch {
+	case recording.Status == model.StatusQueued:
+		estimate = now.Add(processing)
+	case recording.Status == model.StatusProcessing && recording.StartedAt != nil:
+		estimate = recording.StartedAt.Add(processing)
+		if estimate.Before(now) {
+			estimate = now
+		}
+	default:
+		return nil
+	}
+
+	return &estimate
+}
+
+// Return how far the transcription of the recording has come in percent,
+// based on its estimated completion or the progress reported by the
+// transcriber, whichever is further. A running recording stays below 100
+// until it is done.
+func Progress(recording *model.Recording, estimate *time.Time, now time.Time) int {
+	switch recording.Status {
+	case model.StatusDone, model.StatusNoSpeech, model.StatusFailed:
+		return 100
+	case model.StatusProcessing:
+		// The transcriber reports the progress of long recordings that
+		// are transcribed in chunks
+		progress := recording.Progress
+		if estimate != nil && recording.StartedAt != nil && estimate.After(*recording.StartedAt) {
+			if estimated := int(100 * now.Sub(*recording.StartedAt) / estimate.Sub(*recording.StartedAt)); estimated > progress {
+				progress = estimated
+			}
+		}
+		if progress > 99 {
+			progress = 99
+		}
+		return progress
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"testing"
+	"time"
+
+	"simple-web-asr/model"
+)
+
+func TestEstimateCompletion(t *testing.T) {
+	now := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+	startedAt := now.Add(-time.Minute)
+	longAgo := now.Add(-time.Hour)
+
+	for _, c := range []struct {
+		name      string
+		recording model.Recording
+		estimate  time.Time
+	}{
+		{"queued", model.Recording{Status: model.StatusQueued, Duration: 600}, now.Add(5 * time.Minute)},
+		{"processing", model.Recording{Status: model.StatusProcessing, Duration: 600, StartedAt: &startedAt}, startedAt.Add(5 * time.Minute)},
+		{"overdue", model.Recording{Status: model.StatusProcessing, Duration: 600, StartedAt: &longAgo}, now},
+	} {
+		estimate := EstimateCompletion(&c.recording, 0.5, now)
+		if estimate == nil || !estimate.Equal(c.estimate) {
+			t.Errorf("%s: got %v, want %v", c.name, estimate, c.estimate)
+		}
+	}
+
+	for _, recording := range []model.Recording{
+		{Status: model.StatusQueued},
+		{Status: model.StatusDone, Duration: 600},
+		{Status: model.StatusProcessing, Duration: 600},
+	} {
+		if estimate := EstimateCompletion(&recording, 0.5, now); estimate != nil {
+			t.Errorf("status %v, duration %v: got %v, want no estimate", recording.Status, recording.Duration, estimate)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	now := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+	startedAt := now.Add(-time.Minute)
+	halfway := now.Add(time.Minute)
+	overdue := now
+
+	for _, c := range []struct {
+		name      string
+		recording model.Recording
+		estimate  *time.Time
+		progress  int
+	}{
+		{"queued", model.Recording{Status: model.StatusQueued}, &halfway, 0},
+		{"done", model.Recording{Status: model.StatusDone}, nil, 100},
+		{"failed", model.Recording{Status: model.StatusFailed}, nil, 100},
+		{"estimated", model.Recording{Status: model.StatusProcessing, StartedAt: &startedAt}, &halfway, 50},
+		{"reported further", model.Recording{Status: model.StatusProcessing, StartedAt: &startedAt, Progress: 80}, &halfway, 80},
+		{"overdue", model.Recording{Status: model.StatusProcessing, StartedAt: &startedAt}, &overdue, 99},
+		{"no estimate", model.Recording{Status: model.StatusProcessing, StartedAt: &startedAt, Progress: 20}, nil, 20},
+	} {
+		if progress := Progress(&c.recording, c.estimate, now); progress != c.progress {
+			t.Errorf("%s: got %d, want %d", c.name, progress, c.progress)
+		}
+	}
+}
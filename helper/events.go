@@ -0,0 +1,31 @@
+package helper
+
+import (
+	"log"
+
+	"simple-web-asr/model"
+)
+
+// Record a step in the processing of the recording. Only the last
+// MAX_RECORDING_EVENTS (100 by default) events of a recording are kept.
+func RecordEvent(recordingID uint, event, details string) {
+	if err := DB.Create(&model.RecordingEvent{RecordingID: recordingID, Event: event, Details: details}).Error; err != nil {
+		log.Println("Failed to record event", event, "of recording", recordingID, err)
+		return
+	}
+
+	limit := GetConfigInt("MAX_RECORDING_EVENTS", 100)
+
+	var expired []model.RecordingEvent
+	DB.Where(&model.RecordingEvent{RecordingID: recordingID}).Order("id desc").Offset(limit).Find(&expired)
+	if len(expired) > 0 {
+		DB.Delete(&expired)
+	}
+}
+
+// Return the events of the recording, oldest first
+func RecordingEvents(recordingID uint) []model.RecordingEvent {
+	var events []model.RecordingEvent
+	DB.Where(&model.RecordingEvent{RecordingID: recordingID}).Order("id asc").Find(&events)
+	return events
+}
@@ -0,0 +1,101 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"simple-web-asr/model"
+)
+
+const maxGlossaryPatternLength = 200
+
+// Check that the rule can be applied. Regular expressions use the RE2
+// syntax, which is matched in linear time, so they cannot backtrack
+// catastrophically; they are limited in length and must not match the
+// empty string, which would insert the replacement everywhere.
+func ValidateGlossaryRule(rule *model.GlossaryRule) error {
+	if rule.Pattern == "" {
+		return errors.New("The pattern is empty")
+	}
+
+	if len(rule.Pattern) > maxGlossaryPatternLength {
+		return fmt.Errorf("The pattern is longer than %d characters", maxGlossaryPatternLength)
+	}
+
+	re, err := compileGlossaryRule(rule)
+	if err != nil {
+		return fmt.Errorf("The pattern is not a valid regular expression: %v", err)
+	}
+
+	if re.MatchString("") {
+		return errors.New("The pattern matches empty text")
+	}
+
+	return nil
+}
+
+func compileGlossaryRule(rule *model.GlossaryRule) (*regexp.Regexp, error) {
+	if rule.Regex {
+		return regexp.Compile(rule.Pattern)
+	}
+	return regexp.Compile(regexp.QuoteMeta(rule.Pattern))
+}
+
+type glossaryRule struct {
+	re          *regexp.Regexp
+	replacement string
+	regex       bool
+}
+
+// Glossary applies the correction rules of a user in their order
+type Glossary struct {
+	rules []glossaryRule
+}
+
+// Compile the rules, invalid ones are skipped
+func NewGlossary(rules []model.GlossaryRule) *Glossary {
+	g := &Glossary{}
+
+	for r := range rules {
+		if ValidateGlossaryRule(&rules[r]) != nil {
+			continue
+		}
+		re, _ := compileGlossaryRule(&rules[r])
+		g.rules = append(g.rules, glossaryRule{re: re, replacement: rules[r].Replacement, regex: rules[r].Regex})
+	}
+
+	return g
+}
+
+// Load the glossary of the user
+func UserGlossary(userID uint) *Glossary {
+	var rules []model.GlossaryRule
+	DB.Where(&model.GlossaryRule{UserID: userID}).Order("id asc").Find(&rules)
+
+	return NewGlossary(rules)
+}
+
+// Return the text with all rules applied. Replacements of regular
+// expression rules can refer to groups as $1.
+func (g *Glossary) Apply(text string) string {
+	for _, rule := range g.rules {
+		if rule.regex {
+			text = rule.re.ReplaceAllString(text, rule.replacement)
+		} else {
+			text = rule.re.ReplaceAllLiteralString(text, rule.replacement)
+		}
+	}
+
+	return text
+}
+
+// Set the corrected text of the utterances that the glossary changes,
+// the original text is kept
+func (g *Glossary) Correct(utterances []model.Utterance) {
+	for u := range utterances {
+		if corrected := g.Apply(utterances[u].Text); corrected != utterances[u].Text {
+			utterances[u].CorrectedText = corrected
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package helper
 
 import (
+	"errors"
 	"fmt"
+	"html"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"gopkg.in/gomail.v2"
@@ -22,6 +26,63 @@ func GetConfig(key string) string {
 	return os.Getenv(key)
 }
 
+// Return the config value parsed as an integer, or the fallback
+// if the value is not set or invalid
+func GetConfigInt(key string, fallback int) int {
+	value, err := strconv.Atoi(GetConfig(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Return the config value parsed as a boolean, false if it is not set
+// or invalid
+func GetConfigBool(key string) bool {
+	value, _ := strconv.ParseBool(GetConfig(key))
+	return value
+}
+
+// Settings without which the web application doesn't work properly
+var requiredConfig = []string{"DB_USER", "DB_NAME", "URL_BASE", "SESSION_KEY", "SMTP_HOST", "SMTP_PORT"}
+
+// Minimum length of SESSION_KEY, the cookie store signs with HMAC-SHA256
+const minSessionKeyLength = 32
+
+// Check the settings of the web application. All problems are reported
+// in one error, so that they can be fixed at once.
+func ValidateConfig() error {
+	var problems []string
+
+	for _, key := range requiredConfig {
+		if strings.TrimSpace(GetConfig(key)) == "" {
+			problems = append(problems, key+" is not set")
+		}
+	}
+
+	if key := GetConfig("SESSION_KEY"); key != "" && len(key) < minSessionKeyLength {
+		problems = append(problems, fmt.Sprintf("SESSION_KEY must be at least %d characters long", minSessionKeyLength))
+	}
+
+	if base := GetConfig("URL_BASE"); base != "" {
+		if u, err := url.Parse(base); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, "URL_BASE must be an absolute URL, e.g. https://asr.example.com")
+		}
+	}
+
+	if port := GetConfig("SMTP_PORT"); port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, "SMTP_PORT must be a port number")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
 var DB *gorm.DB
 
 func ConnectDB() {
@@ -36,16 +97,48 @@ func ConnectDB() {
 	}
 
 	fmt.Println("Connection Opened to Database")
-	DB.AutoMigrate(&model.Recording{}, &model.Utterance{}, &model.User{})
+
+	// Don't start on a schema that doesn't match the code
+	if err := Migrate(); err != nil {
+		panic(fmt.Sprintf("failed to migrate the database: %v", err))
+	}
 	fmt.Println("Database Migrated")
 }
 
+// Return the config value or the fallback if it is not set
+func getConfigDefault(key, fallback string) string {
+	if value := GetConfig(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Name of the service shown in pages and emails
+func BrandName() string {
+	return getConfigDefault("BRAND_NAME", "IMS-Speech")
+}
+
+// Address for support requests and error reports
+func SupportEmail() string {
+	return getConfigDefault("SUPPORT_EMAIL", "pavel.denisov@ims.uni-stuttgart.de")
+}
+
+// Return the branding of the service for the templates
+func Brand() map[string]string {
+	return map[string]string{
+		"brand_name":     BrandName(),
+		"brand_logo_url": GetConfig("BRAND_LOGO_URL"),
+		"brand_color":    getConfigDefault("BRAND_PRIMARY_COLOR", "#007bff"),
+		"support_email":  SupportEmail(),
+	}
+}
+
 func SendEmail(to, subject, body string) error {
 	m := gomail.NewMessage()
-	m.SetHeader("From", "IMS-Speech <pavel.denisov@ims.uni-stuttgart.de>")
-	m.SetHeader("Sender", "st153249@stud.uni-stuttgart.de")
+	m.SetHeader("From", m.FormatAddress(getConfigDefault("EMAIL_FROM", "pavel.denisov@ims.uni-stuttgart.de"), BrandName()))
+	m.SetHeader("Sender", getConfigDefault("EMAIL_SENDER", "st153249@stud.uni-stuttgart.de"))
 	m.SetHeader("To", to)
-	m.SetHeader("Subject", fmt.Sprintf("[IMS-Speech] %v", subject))
+	m.SetHeader("Subject", fmt.Sprintf("[%s] %v", BrandName(), subject))
 	m.SetBody("text/html", body)
 
 	smtpPort, _ := strconv.ParseInt(GetConfig("SMTP_PORT"), 10, 32)
@@ -59,6 +152,36 @@ func SendEmail(to, subject, body string) error {
 	return nil
 }
 
-func RecordingFilename(recordingID uint) string {
-	return fmt.Sprintf("%s/%07d.dat", GetConfig("DATA_DIR"), recordingID)
+// Tell the owner of the recording that its transcription is ready
+func SendTranscriptionNotification(recording *model.Recording) error {
+	var user model.User
+	if err := DB.First(&user, recording.UserID).Error; err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/recording/view/%d", GetConfig("URL_BASE"), recording.ID)
+	body := fmt.Sprintf("To see the transcription, go to:<br/>\n<a href=\"%s\">%s</a>", link, link)
+
+	return SendEmail(user.Email, "Transcription Notification", body)
+}
+
+// Tell the owner of the recording that its transcription failed
+func SendFailureNotification(recording *model.Recording) error {
+	var user model.User
+	if err := DB.First(&user, recording.UserID).Error; err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/recording/view/%d", GetConfig("URL_BASE"), recording.ID)
+	body := fmt.Sprintf("The transcription of \"%s\" failed. To try again, go to:<br/>\n<a href=\"%s\">%s</a>",
+		html.EscapeString(recording.Title), link, link)
+
+	return SendEmail(user.Email, "Transcription Error", body)
+}
+
+// Whether the owner of the recording wants to be emailed about its
+// transcription
+func WantsEmailNotification(recording *model.Recording) bool {
+	var user model.User
+	return DB.First(&user, recording.UserID).Error == nil && user.NotifyByEmail
 }
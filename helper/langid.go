@@ -0,0 +1,112 @@
+package helper
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Languages supported by the decoder, unless LANGUAGES lists them
+var LanguageNames = map[string]string{
+	"de": "German",
+	"en": "English",
+	"ru": "Russian",
+}
+
+// Read the supported languages from LANGUAGES, a comma-separated list of
+// code:name pairs, e.g. "de:German,en:English"
+func LoadLanguages() {
+	config := GetConfig("LANGUAGES")
+	if config == "" {
+		return
+	}
+
+	languages := map[string]string{}
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		code := strings.TrimSpace(parts[0])
+		if code == "" || code == "auto" {
+			continue
+		}
+
+		name := code
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+			name = strings.TrimSpace(parts[1])
+		}
+		languages[code] = name
+	}
+
+	if len(languages) == 0 {
+		log.Println("LANGUAGES doesn't contain any language, using the default ones")
+		return
+	}
+
+	LanguageNames = languages
+}
+
+// A language the recording may be in, with the confidence of the detector
+type LanguageCandidate struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Detect the language of the file with LANGID_CMD, which prints one
+// "language confidence" line per candidate. The candidates are returned
+// with the most likely first.
+func DetectLanguage(filename string) ([]LanguageCandidate, error) {
+	cmd := GetConfig("LANGID_CMD")
+	if cmd == "" {
+		return nil, nil
+	}
+
+	out, err := exec.Command(cmd, filename).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []LanguageCandidate
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		confidence, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid language detection output %q", line)
+		}
+		candidates = append(candidates, LanguageCandidate{Language: fields[0], Confidence: confidence})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+
+	return candidates, nil
+}
+
+// Encode the candidates for storing them with the recording
+func FormatLanguageCandidates(candidates []LanguageCandidate) string {
+	var parts []string
+	for _, candidate := range candidates {
+		parts = append(parts, fmt.Sprintf("%s:%.2f", candidate.Language, candidate.Confidence))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Decode the candidates stored with the recording
+func ParseLanguageCandidates(s string) []LanguageCandidate {
+	var candidates []LanguageCandidate
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		confidence, _ := strconv.ParseFloat(fields[1], 64)
+		candidates = append(candidates, LanguageCandidate{Language: fields[0], Confidence: confidence})
+	}
+	return candidates
+}
@@ -0,0 +1,48 @@
+package helper
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Levels of the structured log, LOG_LEVEL is the lowest one written
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// Writes the structured log lines without the prefix of the default logger
+var jsonLogger = log.New(os.Stderr, "", 0)
+
+// Return whether messages of the level are written, LOG_LEVEL is "info"
+// by default
+func LogEnabled(level string) bool {
+	minimum, ok := logLevels[strings.ToLower(GetConfig("LOG_LEVEL"))]
+	if !ok {
+		minimum = logLevels["info"]
+	}
+	return logLevels[level] >= minimum
+}
+
+// Write a log line as a JSON object with the time, the level, the message
+// and the fields, e.g. the request or recording ID to correlate them
+func LogJSON(level, message string, fields map[string]interface{}) {
+	if !LogEnabled(level) {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["message"] = message
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(message, fields)
+		return
+	}
+	jsonLogger.Println(string(line))
+}
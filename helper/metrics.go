@@ -0,0 +1,61 @@
+package helper
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Return a function that calls value at most once per ttl and returns the
+// last result in between, so that frequent scrapes of a gauge don't run
+// its query every time
+func CachedGauge(ttl time.Duration, value func() float64) func() float64 {
+	var (
+		mu      sync.Mutex
+		last    float64
+		updated time.Time
+	)
+
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if updated.IsZero() || time.Since(updated) >= ttl {
+			last = value()
+			updated = time.Now()
+		}
+		return last
+	}
+}
+
+// Check if the request may read the metrics. Scrapers authenticate with
+// METRICS_TOKEN as a bearer token, if it is set, or else the client must
+// be one of METRICS_ALLOWED_IPS (comma-separated, localhost if not set).
+func MetricsAllowed(r *http.Request, clientIP string) bool {
+	if token := GetConfig("METRICS_TOKEN"); token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	allowed := GetConfig("METRICS_ALLOWED_IPS")
+	if allowed == "" {
+		allowed = "127.0.0.1,::1"
+	}
+	for _, ip := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(ip) == clientIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Serve the registered metrics in the Prometheus text format. The caller
+// checks with MetricsAllowed who may read them.
+var MetricsHandler = promhttp.Handler()
@@ -0,0 +1,29 @@
+package helper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedGauge(t *testing.T) {
+	calls := 0
+	gauge := CachedGauge(time.Hour, func() float64 {
+		calls++
+		return float64(calls)
+	})
+
+	for i := 0; i < 3; i++ {
+		if v := gauge(); v != 1 {
+			t.Errorf("scrape %d: got %v", i+1, v)
+		}
+	}
+
+	expired := CachedGauge(0, func() float64 {
+		calls++
+		return float64(calls)
+	})
+	expired()
+	if v := expired(); v != 3 {
+		t.Errorf("an expired value was kept: %v", v)
+	}
+}
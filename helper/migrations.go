@@ -0,0 +1,402 @@
+package helper
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"simple-web-asr/model"
+)
+
+// SchemaMigration records a migration that has been applied
+type SchemaMigration struct {
+	Version   int `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// A change of the database schema or data. Down undoes it, migrations
+// without Down can't be rolled back.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// The schema before the migrations were introduced, as AutoMigrate
+// created it then. Installations that predate the migrations already
+// have these tables, so only the missing ones are created.
+var initialSchema = []string{
+	`CREATE TABLE IF NOT EXISTS recordings (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		user_id bigint NOT NULL,
+		title text NOT NULL,
+		filename text NOT NULL,
+		language text NOT NULL,
+		status bigint NOT NULL DEFAULT 0,
+		priority bigint NOT NULL DEFAULT 0,
+		sample boolean NOT NULL DEFAULT false,
+		normalize boolean NOT NULL DEFAULT false,
+		delete_after timestamptz,
+		transcript text NOT NULL DEFAULT '',
+		transcript_file text NOT NULL DEFAULT '',
+		peaks_file text NOT NULL DEFAULT '',
+		transcript_truncated boolean NOT NULL DEFAULT false,
+		size_bytes bigint NOT NULL DEFAULT 0,
+		duration decimal NOT NULL DEFAULT 0,
+		sample_rate bigint NOT NULL DEFAULT 0,
+		channels bigint NOT NULL DEFAULT 0,
+		probed boolean NOT NULL DEFAULT false,
+		started_at timestamptz,
+		finished_at timestamptz,
+		storage_path text NOT NULL DEFAULT '',
+		removed_at timestamptz,
+		restore_status bigint NOT NULL DEFAULT 0,
+		language_candidates text NOT NULL DEFAULT '',
+		retry_count bigint NOT NULL DEFAULT 0,
+		confidence decimal,
+		share_token text NOT NULL DEFAULT '',
+		share_expires timestamptz)`,
+	"CREATE INDEX IF NOT EXISTS idx_recordings_share_token ON recordings (share_token)",
+	"CREATE INDEX IF NOT EXISTS idx_recordings_deleted_at ON recordings (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS utterances (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		recording_id bigint NOT NULL,
+		start decimal NOT NULL,
+		"end" decimal NOT NULL,
+		text text,
+		speaker text NOT NULL DEFAULT '',
+		confidence decimal,
+		corrected_text text)`,
+	"CREATE INDEX IF NOT EXISTS idx_utterances_deleted_at ON utterances (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS users (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		email text NOT NULL,
+		password text NOT NULL,
+		names text,
+		status bigint NOT NULL DEFAULT 0,
+		token text,
+		token_created_at timestamptz,
+		used_token text,
+		tier bigint NOT NULL DEFAULT 0,
+		api_rate_limit bigint NOT NULL DEFAULT 0,
+		default_export_format text NOT NULL DEFAULT '',
+		is_admin boolean NOT NULL DEFAULT false,
+		quota_bytes bigint NOT NULL DEFAULT 0,
+		api_key text NOT NULL DEFAULT '',
+		webhook_url text NOT NULL DEFAULT '',
+		webhook_secret text NOT NULL DEFAULT '',
+		notify_by_email boolean NOT NULL DEFAULT false,
+		reset_token text NOT NULL DEFAULT '',
+		reset_token_expires timestamptz,
+		pending_email text NOT NULL DEFAULT '',
+		email_token text NOT NULL DEFAULT '',
+		email_token_expires timestamptz,
+		failed_login_count bigint NOT NULL DEFAULT 0,
+		locked_until timestamptz)`,
+	"CREATE INDEX IF NOT EXISTS idx_users_api_key ON users (api_key)",
+	"CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		user_id bigint NOT NULL,
+		key text NOT NULL,
+		user_agent text,
+		ip text,
+		last_seen timestamptz)`,
+	"CREATE INDEX IF NOT EXISTS idx_sessions_deleted_at ON sessions (deleted_at)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_key ON sessions (key)",
+	`CREATE TABLE IF NOT EXISTS engine_statuses (
+		id bigserial PRIMARY KEY,
+		healthy boolean,
+		message text,
+		checked_at timestamptz)`,
+	`CREATE TABLE IF NOT EXISTS glossary_rules (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		user_id bigint NOT NULL,
+		pattern text NOT NULL,
+		replacement text NOT NULL,
+		regex boolean NOT NULL DEFAULT false)`,
+	"CREATE INDEX IF NOT EXISTS idx_glossary_rules_user_id ON glossary_rules (user_id)",
+	"CREATE INDEX IF NOT EXISTS idx_glossary_rules_deleted_at ON glossary_rules (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS comments (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		recording_id bigint NOT NULL,
+		user_id bigint NOT NULL,
+		text text NOT NULL)`,
+	"CREATE INDEX IF NOT EXISTS idx_comments_recording_id ON comments (recording_id)",
+	"CREATE INDEX IF NOT EXISTS idx_comments_deleted_at ON comments (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS audit_logs (
+		id bigserial PRIMARY KEY,
+		created_at timestamptz,
+		updated_at timestamptz,
+		deleted_at timestamptz,
+		actor_id bigint NOT NULL,
+		target_id bigint NOT NULL,
+		action text NOT NULL,
+		details text,
+		ip text)`,
+	"CREATE INDEX IF NOT EXISTS idx_audit_logs_actor_id ON audit_logs (actor_id)",
+	"CREATE INDEX IF NOT EXISTS idx_audit_logs_target_id ON audit_logs (target_id)",
+	"CREATE INDEX IF NOT EXISTS idx_audit_logs_deleted_at ON audit_logs (deleted_at)",
+	`CREATE TABLE IF NOT EXISTS recording_events (
+		id bigserial PRIMARY KEY,
+		recording_id bigint NOT NULL,
+		event text NOT NULL,
+		details text,
+		created_at timestamptz)`,
+	"CREATE INDEX IF NOT EXISTS idx_recording_events_recording_id ON recording_events (recording_id)",
+	`CREATE TABLE IF NOT EXISTS uploads (
+		id text PRIMARY KEY,
+		user_id bigint NOT NULL,
+		filename text NOT NULL,
+		title text NOT NULL DEFAULT '',
+		language text NOT NULL,
+		normalize boolean NOT NULL DEFAULT false,
+		retention text NOT NULL DEFAULT '',
+		size bigint NOT NULL,
+		chunk_size bigint NOT NULL,
+		received_chunks bigint NOT NULL DEFAULT 0,
+		received_bytes bigint NOT NULL DEFAULT 0,
+		created_at timestamptz,
+		updated_at timestamptz)`,
+	"CREATE INDEX IF NOT EXISTS idx_uploads_user_id ON uploads (user_id)",
+}
+
+// The migrations in the order they are applied. New migrations are
+// appended with the next version, applied ones must not be changed.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      execSQL(initialSchema...),
+		// No Down, the tables of installations that predate the
+		// migrations weren't created by it
+	},
+	addColumns(2, "two-factor authentication", &model.User{}, "TOTPSecret", "TOTPEnabled", "TOTPLastStep", "RecoveryCodes"),
+	addColumns(3, "oauth login", &model.User{}, "OAuthProvider", "OAuthSubject").
+		withSQL("CREATE INDEX IF NOT EXISTS idx_users_o_auth_subject ON users (o_auth_subject)"),
+	{
+		Version: 4,
+		Name:    "recording timestamps",
+		// Rows that were written without the timestamps get the time of
+		// the transcription if there is one, or the time of the migration
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("UPDATE recordings SET created_at = COALESCE(started_at, finished_at, now()) WHERE created_at IS NULL").Error; err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE recordings SET updated_at = COALESCE(finished_at, created_at) WHERE updated_at IS NULL").Error
+		},
+		// The timestamps are kept, there is nothing to undo
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	},
+	addColumns(5, "transcription progress", &model.Recording{}, "Progress"),
+	{
+		Version: 6,
+		Name:    "tags",
+		Up: execSQL(
+			`CREATE TABLE IF NOT EXISTS tags (
+				id bigserial PRIMARY KEY,
+				user_id bigint NOT NULL,
+				name text NOT NULL)`,
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_user_name ON tags (user_id, name)",
+			`CREATE TABLE IF NOT EXISTS recording_tags (
+				recording_id bigint REFERENCES recordings (id),
+				tag_id bigint REFERENCES tags (id),
+				PRIMARY KEY (recording_id, tag_id))`),
+		Down: execSQL("DROP TABLE recording_tags", "DROP TABLE tags"),
+	},
+	{
+		Version: 7,
+		Name:    "disabled users",
+		// Users used to be disabled by resetting them to unconfirmed.
+		// Those that had been confirmed are recognized by the last used
+		// confirmation token or the linked OAuth account.
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&model.User{}, "Disabled") {
+				if err := tx.Migrator().AddColumn(&model.User{}, "Disabled"); err != nil {
+					return err
+				}
+			}
+			return tx.Exec("UPDATE users SET disabled = true, status = 1 WHERE status = 0 AND (used_token <> '' OR o_auth_subject <> '')").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Exec("UPDATE users SET status = 0 WHERE disabled").Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&model.User{}, "Disabled")
+		},
+	},
+	addColumns(8, "worker claims", &model.Recording{}, "WorkerID", "HeartbeatAt"),
+	{
+		Version: 9,
+		Name:    "session expiry",
+		// The existing sessions expire SESSION_MAX_AGE after they started
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&model.Session{}, "ExpiresAt") {
+				if err := tx.Migrator().AddColumn(&model.Session{}, "ExpiresAt"); err != nil {
+					return err
+				}
+			}
+			return tx.Exec("UPDATE sessions SET expires_at = created_at + ? * interval '1 second' WHERE expires_at IS NULL",
+				GetConfigInt("SESSION_MAX_AGE", 30*24*60*60)).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&model.Session{}, "ExpiresAt")
+		},
+	},
+}
+
+// A migration that adds the columns of the fields to the table of the
+// model. Databases created after the fields were added already have them.
+func addColumns(version int, name string, table interface{}, fields ...string) migration {
+	return migration{
+		Version: version,
+		Name:    name,
+		Up: func(tx *gorm.DB) error {
+			for _, field := range fields {
+				if tx.Migrator().HasColumn(table, field) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, field := range fields {
+				if err := tx.Migrator().DropColumn(table, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Run the statements one after the other
+func execSQL(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Run the statements after the migration, e.g. to index the columns that
+// it adds. Dropping the columns drops their indexes, so Down stays as it is.
+func (m migration) withSQL(statements ...string) migration {
+	up := m.Up
+	after := execSQL(statements...)
+	m.Up = func(tx *gorm.DB) error {
+		if err := up(tx); err != nil {
+			return err
+		}
+		return after(tx)
+	}
+	return m
+}
+
+// Key of the PostgreSQL advisory lock that keeps the web application and
+// the worker from migrating at the same time
+const migrationLock = 7420155
+
+// Apply the migrations that haven't been applied yet. Every migration
+// runs in a transaction together with its record in schema_migrations,
+// so a failed migration leaves nothing behind.
+func Migrate() error {
+	if err := DB.AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		applied := false
+
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+
+			var count int64
+			if err := tx.Model(&SchemaMigration{}).Where("version = ?", m.Version).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			applied = true
+
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+
+		if applied {
+			log.Println(fmt.Sprintf("Applied migration %d (%s)", m.Version, m.Name))
+		}
+	}
+
+	return nil
+}
+
+// Undo the latest applied migration
+func RollbackMigration() error {
+	var last SchemaMigration
+	if err := DB.Order("version desc").First(&last).Error; err != nil {
+		return errors.New("no migration has been applied")
+	}
+
+	for _, m := range migrations {
+		if m.Version != last.Version {
+			continue
+		}
+
+		if m.Down == nil {
+			return fmt.Errorf("migration %d (%s) can't be rolled back", m.Version, m.Name)
+		}
+
+		return DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+				return err
+			}
+			if err := m.Down(tx); err != nil {
+				return fmt.Errorf("rolling back migration %d (%s) failed: %v", m.Version, m.Name, err)
+			}
+			return tx.Delete(&last).Error
+		})
+	}
+
+	return fmt.Errorf("migration %d is unknown to this version", last.Version)
+}
@@ -0,0 +1,30 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == nil {
+			t.Errorf("migration %d has no Up", m.Version)
+		}
+	}
+
+	if migrations[0].Down != nil {
+		t.Error("the initial schema can be rolled back")
+	}
+}
+
+// The initial schema also runs on installations that already have the tables
+func TestInitialSchema(t *testing.T) {
+	for _, statement := range initialSchema {
+		if !strings.HasPrefix(statement, "CREATE TABLE IF NOT EXISTS ") && !strings.Contains(statement, "INDEX IF NOT EXISTS ") {
+			t.Errorf("the statement fails on existing installations: %s", statement)
+		}
+	}
+}
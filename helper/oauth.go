@@ -0,0 +1,165 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthProvider logs users in with the OAuth 2.0 authorization code flow
+// of an OpenID Connect provider, e.g. Google
+type OAuthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       string
+	Client       *http.Client
+}
+
+// Endpoints of the providers that work with just a client ID and secret
+var oauthDefaults = map[string][3]string{
+	"google": {
+		"https://accounts.google.com/o/oauth2/v2/auth",
+		"https://oauth2.googleapis.com/token",
+		"https://openidconnect.googleapis.com/v1/userinfo"},
+}
+
+// OAuthUser is the account at the provider, from its userinfo endpoint
+type OAuthUser struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// Return the provider if OAUTH_<NAME>_CLIENT_ID and _CLIENT_SECRET are
+// set. The endpoints can be changed with OAUTH_<NAME>_AUTH_URL,
+// _TOKEN_URL and _USERINFO_URL, and the scopes with _SCOPES.
+func GetOAuthProvider(name string) (*OAuthProvider, bool) {
+	for _, r := range name {
+		if r < 'a' || r > 'z' {
+			return nil, false
+		}
+	}
+
+	prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+	defaults := oauthDefaults[name]
+	p := &OAuthProvider{
+		Name:         name,
+		ClientID:     GetConfig(prefix + "CLIENT_ID"),
+		ClientSecret: GetConfig(prefix + "CLIENT_SECRET"),
+		AuthURL:      getConfigDefault(prefix+"AUTH_URL", defaults[0]),
+		TokenURL:     getConfigDefault(prefix+"TOKEN_URL", defaults[1]),
+		UserInfoURL:  getConfigDefault(prefix+"USERINFO_URL", defaults[2]),
+		Scopes:       getConfigDefault(prefix+"SCOPES", "openid email"),
+		Client:       &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if name == "" || p.ClientID == "" || p.ClientSecret == "" || p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+		return nil, false
+	}
+
+	return p, true
+}
+
+// Return the names of the providers in OAUTH_PROVIDERS (comma-separated)
+// that are configured
+func OAuthProviders() []string {
+	var names []string
+	for _, name := range strings.Split(GetConfig("OAUTH_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := GetOAuthProvider(name); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Return the URL of the provider's login page, which sends the user back
+// to redirectURI with the code and the state
+func (p *OAuthProvider) AuthCodeURL(state, redirectURI string) string {
+	query := url.Values{
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {p.Scopes},
+		"state":         {state},
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.AuthURL + separator + query.Encode()
+}
+
+// Return an error with the beginning of the response body, which
+// usually contains the reason
+func oauthError(op string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("OAuth %s failed with %s: %s", op, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Exchange the code from the redirect for an access token and return
+// the account that it belongs to
+func (p *OAuthProvider) FetchUser(code, redirectURI string) (*OAuthUser, error) {
+	resp, err := p.Client.PostForm(p.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, oauthError("token request", resp)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("OAuth token response without access token")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	infoResp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer infoResp.Body.Close()
+
+	if infoResp.StatusCode != http.StatusOK {
+		return nil, oauthError("userinfo request", infoResp)
+	}
+
+	var user OAuthUser
+	if err := json.NewDecoder(infoResp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	if user.Subject == "" || user.Email == "" {
+		return nil, errors.New("OAuth userinfo response without subject or email")
+	}
+
+	return &user, nil
+}
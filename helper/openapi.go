@@ -0,0 +1,462 @@
+package helper
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A JSON object of the OpenAPI document
+type object = map[string]interface{}
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonResponse(description string, schema object) object {
+	return object{
+		"description": description,
+		"content":     object{"application/json": object{"schema": schema}},
+	}
+}
+
+func pathParameter(name, description string) object {
+	return object{"name": name, "in": "path", "required": true, "description": description,
+		"schema": object{"type": "integer"}}
+}
+
+func queryParameter(name, description string, schema object) object {
+	return object{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+var recordingID = pathParameter("recording_id", "ID of the recording")
+
+// Responses that JSON clients get by sending "Accept: application/json"
+var acceptJSON = object{"name": "Accept", "in": "header", "required": true,
+	"schema": object{"type": "string", "enum": []string{"application/json"}}}
+
+// Form with the name of a tag, for adding and removing tags
+var tagRequest = object{
+	"required": true,
+	"content": object{"application/x-www-form-urlencoded": object{"schema": object{
+		"type":       "object",
+		"required":   []string{"tag"},
+		"properties": object{"tag": object{"type": "string", "maxLength": 50}},
+	}}},
+}
+
+// OpenAPI paths of the documented routes, which the web application
+// checks against its registered routes on startup
+var openAPIPaths = object{
+	"/": object{
+		"get": object{
+			"summary": "List the recordings of the user, newest first",
+			"parameters": []object{
+				acceptJSON,
+				queryParameter("page", "Page, counted from 1", object{"type": "integer", "default": 1}),
+				queryParameter("per_page", "Recordings per page, at most MAX_PER_PAGE", object{"type": "integer", "default": 20}),
+				queryParameter("q", "Text in the title, ignoring case", object{"type": "string"}),
+				queryParameter("language", "Language code", object{"type": "string"}),
+				queryParameter("status", "Status name", object{"type": "string"}),
+				queryParameter("tag", "Name of a tag of the recordings", object{"type": "string"}),
+				queryParameter("sort", "Column to sort by", object{"type": "string", "default": "created_at",
+					"enum": []string{"created_at", "updated_at", "title", "duration", "status"}}),
+				queryParameter("order", "Sort order, by default descending for created_at, updated_at and duration and ascending otherwise",
+					object{"type": "string", "enum": []string{"asc", "desc"}}),
+			},
+			"responses": object{
+				"200": jsonResponse("The recordings", schemaRef("RecordingList")),
+			},
+		},
+	},
+	"/recording/upload": object{
+		"post": object{
+			"summary":    "Upload a recording for transcription",
+			"parameters": []object{acceptJSON},
+			"requestBody": object{
+				"required": true,
+				"content": object{"multipart/form-data": object{"schema": object{
+					"type":     "object",
+					"required": []string{"content"},
+					"properties": object{
+						"content": object{"type": "array", "items": object{"type": "string", "format": "binary"},
+							"description": "One file, or up to MAX_UPLOAD_FILES for a batch"},
+						"title":     object{"type": "string", "description": "Defaults to the file name, prefixes the file names in a batch"},
+						"language":  object{"type": "string", "enum": []string{"auto", "de", "en", "ru"}},
+						"normalize": object{"type": "boolean"},
+						"retention": object{"type": "string", "enum": []string{"default", "forever"}},
+					},
+				}}},
+			},
+			"responses": object{
+				"200": jsonResponse("The queued recording, or for a batch the outcome of every file", object{"oneOf": []object{
+					schemaRef("Recording"),
+					{"type": "array", "items": schemaRef("UploadResult")},
+				}}),
+				"403": object{"description": "The storage quota is exceeded"},
+				"409": object{"description": "The title is taken and titles must be unique"},
+				"413": object{"description": "The file is larger than MAX_UPLOAD_BYTES"},
+				"415": object{"description": "The file is not audio or has no audio track"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}": object{
+		"get": object{
+			"summary":    "Get a recording and its transcription",
+			"parameters": []object{recordingID, acceptJSON},
+			"responses": object{
+				"200": jsonResponse("The recording", object{
+					"type": "object",
+					"properties": object{
+						"recording":  schemaRef("Recording"),
+						"utterances": object{"type": "array", "items": schemaRef("Utterance")},
+					},
+				}),
+				"404": object{"description": "The recording doesn't exist"},
+			},
+		},
+	},
+	"/recording/{recording_id}": object{
+		"delete": object{
+			"summary":    "Delete a recording and its transcription",
+			"parameters": []object{recordingID, acceptJSON},
+			"responses": object{
+				"200": jsonResponse("The deleted recording", schemaRef("Recording")),
+				"404": object{"description": "The recording doesn't exist"},
+			},
+		},
+	},
+	"/recording/status/{recording_id}": object{
+		"get": object{
+			"summary":    "Get the status and the estimated completion time of a recording",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": jsonResponse("The status", schemaRef("RecordingStatus")),
+				"404": object{"description": "The recording doesn't exist"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/audio": object{
+		"get": object{
+			"summary": "Download the uploaded audio of a recording, with range requests for seeking",
+			"parameters": []object{recordingID,
+				object{"name": "Range", "in": "header", "description": "Byte range, e.g. bytes=0-1023", "schema": object{"type": "string"}}},
+			"responses": object{
+				"200": object{"description": "The audio, with the content type of the uploaded file"},
+				"206": object{"description": "The requested range of the audio"},
+				"404": object{"description": "The recording or its audio doesn't exist"},
+				"416": object{"description": "The range is outside of the file"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/events": object{
+		"get": object{
+			"summary":    "Stream the status and the progress of a recording as server-sent events",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": object{
+					"description": "A \"progress\" event with the id, status, progress in percent and whether the status is final, whenever they change. The stream ends after a final status.",
+					"content":     object{"text/event-stream": object{"schema": object{"type": "string"}}},
+				},
+				"404": object{"description": "The recording doesn't exist"},
+			},
+		},
+	},
+	"/recording/download/{recording_id}": object{
+		"get": object{
+			"summary": "Download the transcription",
+			"parameters": []object{
+				recordingID,
+				queryParameter("format", "Export format, defaults to the preference of the user or srt",
+					object{"type": "string", "enum": []string{"srt", "ttml", "vtt", "otr", "docx", "pdf"}}),
+				queryParameter("start", "Start of the time range in seconds", object{"type": "number"}),
+				queryParameter("end", "End of the time range in seconds", object{"type": "number"}),
+				queryParameter("raw", "1 to export the text without glossary corrections", object{"type": "string"}),
+			},
+			"responses": object{
+				"200": object{"description": "The transcription file"},
+				"400": object{"description": "Unsupported format or invalid time range"},
+				"503": object{"description": "Too many exports in progress, see Retry-After"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/rename": object{
+		"post": object{
+			"summary":    "Change the title of a recording",
+			"parameters": []object{recordingID, acceptJSON},
+			"requestBody": object{
+				"required": true,
+				"content": object{"application/x-www-form-urlencoded": object{"schema": object{
+					"type":       "object",
+					"required":   []string{"title"},
+					"properties": object{"title": object{"type": "string"}},
+				}}},
+			},
+			"responses": object{
+				"200": jsonResponse("The renamed recording", schemaRef("Recording")),
+				"400": object{"description": "Empty title"},
+				"404": object{"description": "Recording not found"},
+				"409": object{"description": "The title is taken and UNIQUE_RECORDING_TITLES is set"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/retry": object{
+		"post": object{
+			"summary":    "Queue a recording whose transcription failed again, at most MAX_RETRIES times",
+			"parameters": []object{recordingID, acceptJSON},
+			"responses": object{
+				"200": jsonResponse("The queued recording", schemaRef("Recording")),
+				"404": object{"description": "Recording not found"},
+				"409": object{"description": "The transcription didn't fail or was retried too many times"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/retranscribe": object{
+		"post": object{
+			"summary":    "Discard the transcript and queue the recording again in another language",
+			"parameters": []object{recordingID, acceptJSON},
+			"requestBody": object{
+				"required": true,
+				"content": object{"application/x-www-form-urlencoded": object{"schema": object{
+					"type":       "object",
+					"required":   []string{"language"},
+					"properties": object{"language": object{"type": "string", "description": "Code of a supported language"}},
+				}}},
+			},
+			"responses": object{
+				"200": jsonResponse("The queued recording", schemaRef("Recording")),
+				"400": object{"description": "Unsupported language"},
+				"404": object{"description": "Recording not found"},
+				"409": object{"description": "The recording is being transcribed"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/tags": object{
+		"post": object{
+			"summary":     "Add a tag to a recording, creating the tag if the user doesn't have it yet",
+			"parameters":  []object{recordingID, acceptJSON},
+			"requestBody": tagRequest,
+			"responses": object{
+				"200": jsonResponse("The tagged recording", schemaRef("Recording")),
+				"400": object{"description": "The tag is empty or too long"},
+				"404": object{"description": "Recording not found"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/tags/remove": object{
+		"post": object{
+			"summary":     "Remove a tag from a recording",
+			"parameters":  []object{recordingID, acceptJSON},
+			"requestBody": tagRequest,
+			"responses": object{
+				"200": jsonResponse("The recording", schemaRef("Recording")),
+				"404": object{"description": "Recording not found or it doesn't have the tag"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/transcript.srt": object{
+		"get": object{
+			"summary":    "Download the transcript as SubRip subtitles",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": object{"description": "The subtitles as application/x-subrip"},
+				"404": object{"description": "Recording not found or not transcribed yet"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/transcript.vtt": object{
+		"get": object{
+			"summary":    "Download the transcript as WebVTT subtitles",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": object{"description": "The subtitles as text/vtt"},
+				"404": object{"description": "Recording not found or not transcribed yet"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/status": object{
+		"get": object{
+			"summary":    "Poll the status and progress of the transcription",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": jsonResponse("The status", schemaRef("RecordingProgress")),
+				"404": object{"description": "Recording not found"},
+			},
+		},
+	},
+	"/recording/view/{recording_id}/transcript.txt": object{
+		"get": object{
+			"summary":    "Download the plain text of the transcript",
+			"parameters": []object{recordingID},
+			"responses": object{
+				"200": object{"description": "The transcript as text/plain"},
+				"404": object{"description": "Recording not found or not transcribed yet"},
+			},
+		},
+	},
+	"/api/v1/search": object{
+		"get": object{
+			"summary": "Search the transcriptions of the user",
+			"parameters": []object{
+				queryParameter("q", "Search terms", object{"type": "string"}),
+				queryParameter("limit", "Results per page", object{"type": "integer", "default": 20}),
+				queryParameter("cursor", "Cursor of the next page", object{"type": "string"}),
+			},
+			"responses": object{
+				"200": jsonResponse("A page of results", schemaRef("SearchResults")),
+				"400": object{"description": "Missing query or invalid cursor"},
+				"429": object{"description": "Rate limit exceeded, see the X-RateLimit headers"},
+			},
+		},
+	},
+}
+
+var openAPISchemas = object{
+	"Recording": object{
+		"type": "object",
+		"properties": object{
+			"ID":                   object{"type": "integer"},
+			"CreatedAt":            object{"type": "string", "format": "date-time", "description": "When the recording was uploaded"},
+			"UpdatedAt":            object{"type": "string", "format": "date-time", "description": "When the recording last changed, e.g. its status"},
+			"name":                 object{"type": "string"},
+			"file":                 object{"type": "string"},
+			"language":             object{"type": "string"},
+			"status":               object{"type": "integer", "description": "1 queued, 2 transcribing, 3 done, 4 error, 5 no speech, 6 language confirmation needed"},
+			"duration":             object{"type": "number", "description": "Length in seconds, 0 unless probed"},
+			"sample_rate":          object{"type": "integer"},
+			"channels":             object{"type": "integer"},
+			"probed":               object{"type": "boolean", "description": "Whether the length and the audio format are known"},
+			"size_bytes":           object{"type": "integer"},
+			"delete_after":         object{"type": "string", "format": "date-time", "nullable": true},
+			"transcript_truncated": object{"type": "boolean"},
+			"retry_count":          object{"type": "integer", "description": "How many times the failed transcription was retried"},
+			"confidence":           object{"type": "number", "nullable": true, "description": "Average confidence of the utterances"},
+			"tags":                 object{"type": "array", "items": schemaRef("Tag"), "description": "Only included in the recordings list and the recording"},
+		},
+	},
+	"Tag": object{
+		"type": "object",
+		"properties": object{
+			"id":   object{"type": "integer"},
+			"name": object{"type": "string"},
+		},
+	},
+	"UploadResult": object{
+		"type": "object",
+		"properties": object{
+			"filename":  object{"type": "string"},
+			"recording": schemaRef("Recording"),
+			"error":     object{"type": "string"},
+		},
+	},
+	"RecordingList": object{
+		"type": "object",
+		"properties": object{
+			"recordings":      object{"type": "array", "items": schemaRef("Recording")},
+			"page":            object{"type": "integer"},
+			"per_page":        object{"type": "integer"},
+			"pages":           object{"type": "integer"},
+			"total":           object{"type": "integer"},
+			"prev_page":       object{"type": "integer"},
+			"next_page":       object{"type": "integer"},
+			"has_next":        object{"type": "boolean"},
+			"quota_bytes":     object{"type": "integer"},
+			"remaining_bytes": object{"type": "integer"},
+			"filters": object{"type": "object", "properties": object{
+				"q":        object{"type": "string"},
+				"language": object{"type": "string"},
+				"status":   object{"type": "string"},
+				"sort":     object{"type": "string"},
+				"order":    object{"type": "string"},
+			}},
+		},
+	},
+	"Utterance": object{
+		"type": "object",
+		"properties": object{
+			"start":          object{"type": "number"},
+			"end":            object{"type": "number"},
+			"text":           object{"type": "string"},
+			"corrected_text": object{"type": "string"},
+			"speaker":        object{"type": "string", "description": "Speaker label, only if the decoder did a diarization"},
+			"confidence":     object{"type": "number", "description": "Between 0 and 1, only if the decoder reports it"},
+		},
+	},
+	"RecordingStatus": object{
+		"type": "object",
+		"properties": object{
+			"status":               object{"type": "integer"},
+			"duration":             object{"type": "number"},
+			"estimated_completion": object{"type": "string", "format": "date-time", "nullable": true},
+			"estimating":           object{"type": "boolean"},
+		},
+	},
+	"RecordingProgress": object{
+		"type": "object",
+		"properties": object{
+			"id": object{"type": "integer"},
+			"status": object{"type": "string", "enum": []string{
+				"uploaded", "queued", "processing", "done", "failed", "no_speech", "language_unconfirmed"}},
+			"progress": object{"type": "integer", "minimum": 0, "maximum": 100},
+		},
+	},
+	"SearchResults": object{
+		"type": "object",
+		"properties": object{
+			"query":       object{"type": "string"},
+			"total":       object{"type": "integer"},
+			"next_cursor": object{"type": "string"},
+			"results": object{"type": "array", "items": object{
+				"type": "object",
+				"properties": object{
+					"recording": schemaRef("Recording"),
+					"score":     object{"type": "integer"},
+					"matches":   object{"type": "integer"},
+					"snippets": object{"type": "array", "items": object{
+						"type": "object",
+						"properties": object{
+							"start":       object{"type": "number"},
+							"end":         object{"type": "number"},
+							"text":        object{"type": "string"},
+							"highlighted": object{"type": "string"},
+						},
+					}},
+				},
+			}},
+		},
+	},
+}
+
+// Return the OpenAPI 3 document of the API served at urlBase
+func OpenAPISpec(urlBase string) map[string]interface{} {
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   BrandName() + " API",
+			"version": "1",
+		},
+		"servers": []object{{"url": urlBase + "/"}},
+		"paths":   openAPIPaths,
+		"components": object{
+			"schemas": openAPISchemas,
+			"securitySchemes": object{
+				"sessionCookie": object{"type": "apiKey", "in": "cookie", "name": "ims-speech-session"},
+				"apiKey":        object{"type": "http", "scheme": "bearer", "description": "API key generated at /u/apikey"},
+			},
+		},
+		"security": []object{{"sessionCookie": []string{}}, {"apiKey": []string{}}},
+	}
+}
+
+// Return the documented routes as "METHOD /path" with the path
+// parameters written as :name
+func OpenAPIRoutes() []string {
+	var routes []string
+	for path, operations := range openAPIPaths {
+		for method := range operations.(object) {
+			routes = append(routes, strings.ToUpper(method)+" "+openAPIParameter.ReplaceAllString(path, ":$1"))
+		}
+	}
+	return routes
+}
+
+var openAPIParameter = regexp.MustCompile(`\{(\w+)\}`)
@@ -0,0 +1,83 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+)
+
+// Call check with every value in the document
+func walk(value interface{}, check func(interface{})) {
+	check(value)
+	switch value := value.(type) {
+	case object:
+		for _, v := range value {
+			walk(v, check)
+		}
+	case []object:
+		for _, v := range value {
+			walk(v, check)
+		}
+	case []interface{}:
+		for _, v := range value {
+			walk(v, check)
+		}
+	}
+}
+
+func TestOpenAPIPathParameters(t *testing.T) {
+	for path, operations := range openAPIPaths {
+		names := openAPIParameter.FindAllStringSubmatch(path, -1)
+
+		for method, operation := range operations.(object) {
+			declared := map[string]bool{}
+			parameters, _ := operation.(object)["parameters"].([]object)
+			for _, parameter := range parameters {
+				if parameter["in"] == "path" {
+					declared[parameter["name"].(string)] = true
+				}
+			}
+
+			for _, name := range names {
+				if !declared[name[1]] {
+					t.Errorf("%s %s doesn't declare the path parameter %s", method, path, name[1])
+				}
+			}
+			if len(declared) != len(names) {
+				t.Errorf("%s %s declares %d path parameters, the path has %d", method, path, len(declared), len(names))
+			}
+
+			if responses, _ := operation.(object)["responses"].(object); len(responses) == 0 {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIReferences(t *testing.T) {
+	walk(OpenAPISpec(""), func(value interface{}) {
+		o, ok := value.(object)
+		if !ok {
+			return
+		}
+		ref, ok := o["$ref"].(string)
+		if !ok {
+			return
+		}
+		if _, ok := openAPISchemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+			t.Errorf("no schema for %s", ref)
+		}
+	})
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	routes := map[string]bool{}
+	for _, route := range OpenAPIRoutes() {
+		routes[route] = true
+	}
+
+	for _, route := range []string{"GET /", "POST /recording/upload", "GET /recording/view/:recording_id"} {
+		if !routes[route] {
+			t.Errorf("%s is not documented: %q", route, OpenAPIRoutes())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"simple-web-asr/model"
+)
+
+// Samples per second that the audio is decoded at for the peaks, enough
+// for a waveform overview
+const peaksSampleRate = 8000
+
+// Compute the waveform of a media file as count peaks, the maximum
+// absolute amplitude of each of count equal parts of the audio, between
+// 0 and 1. The duration is probed if it is not known.
+func ComputePeaks(filename string, duration float64, count int) ([]float32, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("invalid number of peaks: %d", count)
+	}
+	if duration <= 0 {
+		var err error
+		if duration, err = ProbeDuration(filename); err != nil {
+			return nil, err
+		}
+	}
+	total := int(duration*peaksSampleRate) + 1
+
+	cmd := exec.Command("ffmpeg", "-v", "error", "-i", filename, "-vn",
+		"-f", "s16le", "-acodec", "pcm_s16le", "-ar", strconv.Itoa(peaksSampleRate), "-ac", "1", "-")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	peaks := make([]float32, count)
+	reader := bufio.NewReader(out)
+	buffer := make([]byte, 2)
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			break
+		}
+
+		// The duration may be slightly off, the rest goes to the last part
+		part := i * count / total
+		if part >= count {
+			part = count - 1
+		}
+
+		sample := int16(binary.LittleEndian.Uint16(buffer))
+		if amplitude := float32(math.Abs(float64(sample))) / 32768; amplitude > peaks[part] {
+			peaks[part] = amplitude
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	return peaks, nil
+}
+
+// Name of the stored waveform peaks of the recording
+func PeaksName(recording *model.Recording) string {
+	return strings.TrimSuffix(RecordingName(recording), ".dat") + ".peaks.json"
+}
+
+// ErrPeaksBusy is returned when too many waveforms are being computed
+var ErrPeaksBusy = errors.New("Too many waveforms are being computed")
+
+// A computation of the peaks of a recording that other requests for the
+// same recording wait for
+type peaksCall struct {
+	done  chan struct{}
+	peaks []float32
+	err   error
+}
+
+var (
+	peaksMu    sync.Mutex
+	peaksCalls = map[uint]*peaksCall{}
+	peaksSlots *Semaphore
+)
+
+// Return the waveform peaks of the recording. They are computed from the
+// audio with PEAKS_COUNT (1000 by default) parts the first time and kept
+// in the storage afterwards. Concurrent requests for the same recording
+// share one computation, and at most PEAKS_CONCURRENCY (2 by default)
+// run at the same time. ErrPeaksBusy is returned if no slot becomes
+// free within PEAKS_QUEUE_SECONDS (10 by default).
+func RecordingPeaks(recording *model.Recording) ([]float32, error) {
+	var peaks []float32
+
+	if recording.PeaksFile != "" {
+		file, err := Store.Open(recording.PeaksFile)
+		if err == nil {
+			defer file.Close()
+			err = json.NewDecoder(file).Decode(&peaks)
+			return peaks, err
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	peaksMu.Lock()
+	if call, ok := peaksCalls[recording.ID]; ok {
+		peaksMu.Unlock()
+		<-call.done
+		return call.peaks, call.err
+	}
+	call := &peaksCall{done: make(chan struct{})}
+	peaksCalls[recording.ID] = call
+	if peaksSlots == nil {
+		peaksSlots = NewSemaphore(GetConfigInt("PEAKS_CONCURRENCY", 2))
+	}
+	slots := peaksSlots
+	peaksMu.Unlock()
+
+	defer func() {
+		peaksMu.Lock()
+		delete(peaksCalls, recording.ID)
+		peaksMu.Unlock()
+		close(call.done)
+	}()
+
+	if !slots.Acquire(context.Background(), time.Duration(GetConfigInt("PEAKS_QUEUE_SECONDS", 10))*time.Second) {
+		call.err = ErrPeaksBusy
+		return nil, call.err
+	}
+	defer slots.Release()
+
+	call.peaks, call.err = storePeaks(recording)
+	return call.peaks, call.err
+}
+
+// Compute the peaks of the recording and store them
+func storePeaks(recording *model.Recording) ([]float32, error) {
+	filename, cleanup, err := FetchLocal(Store, RecordingName(recording))
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	count := GetConfigInt("PEAKS_COUNT", 1000)
+	if count < 1 {
+		count = 1000
+	}
+	peaks, err := ComputePeaks(filename, recording.Duration, count)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(peaks)
+	if err != nil {
+		return nil, err
+	}
+
+	name := PeaksName(recording)
+	if err := Store.Save(name, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	recording.PeaksFile = name
+	return peaks, DB.Model(recording).Update("peaks_file", name).Error
+}
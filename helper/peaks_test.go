@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"simple-web-asr/model"
+)
+
+func TestComputePeaksInvalidCount(t *testing.T) {
+	if _, err := ComputePeaks("missing.wav", 1, 0); err == nil {
+		t.Error("got no error for 0 peaks")
+	}
+}
+
+// Requests for a recording whose peaks are being computed get the result
+// of that computation
+func TestRecordingPeaksShared(t *testing.T) {
+	recording := model.Recording{}
+	recording.ID = 42
+
+	call := &peaksCall{done: make(chan struct{})}
+	peaksMu.Lock()
+	peaksCalls[recording.ID] = call
+	peaksMu.Unlock()
+	t.Cleanup(func() {
+		peaksMu.Lock()
+		delete(peaksCalls, recording.ID)
+		peaksMu.Unlock()
+	})
+
+	go func() {
+		call.peaks = []float32{0.5}
+		close(call.done)
+	}()
+
+	peaks, err := RecordingPeaks(&recording)
+	if err != nil || len(peaks) != 1 || peaks[0] != 0.5 {
+		t.Errorf("got %v, %v", peaks, err)
+	}
+}
+
+func TestRecordingPeaksBusy(t *testing.T) {
+	os.Setenv("PEAKS_QUEUE_SECONDS", "0")
+	previous := peaksSlots
+	peaksSlots = NewSemaphore(1)
+	t.Cleanup(func() {
+		os.Unsetenv("PEAKS_QUEUE_SECONDS")
+		peaksSlots = previous
+	})
+	peaksSlots.Acquire(context.Background(), 0)
+
+	recording := model.Recording{}
+	recording.ID = 43
+	if _, err := RecordingPeaks(&recording); err != ErrPeaksBusy {
+		t.Errorf("got %v", err)
+	}
+
+	peaksMu.Lock()
+	defer peaksMu.Unlock()
+	if _, ok := peaksCalls[recording.ID]; ok {
+		t.Error("the computation wasn't removed")
+	}
+}
@@ -0,0 +1,267 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrNoAudioStream = errors.New("The file has no audio track")
+var ErrUnreadableMedia = errors.New("The file is not a supported audio or video file")
+
+// Extensions and sniffed content types of uploads accepted by default.
+// Files that aren't recognized as media, application/octet-stream, are
+// rejected.
+const (
+	defaultUploadExtensions = "wav,mp3,flac,ogg,oga,opus,m4a,aac,wma,webm,mp4,mkv,mov"
+	defaultUploadTypes      = "audio/,video/,application/ogg"
+)
+
+// Signatures of the media formats that http.DetectContentType doesn't
+// recognize, e.g. FLAC or MP3 without a tag
+var mediaSignatures = []struct {
+	matches     func(head []byte) bool
+	contentType string
+}{
+	{func(h []byte) bool { return bytes.HasPrefix(h, []byte("fLaC")) }, "audio/flac"},
+	// ADTS frames of AAC, before MPEG audio frames whose sync they share
+	{func(h []byte) bool { return len(h) > 1 && h[0] == 0xff && h[1]&0xf6 == 0xf0 }, "audio/aac"},
+	{func(h []byte) bool { return len(h) > 1 && h[0] == 0xff && h[1]&0xe0 == 0xe0 }, "audio/mpeg"},
+	// ASF, the container of WMA
+	{func(h []byte) bool {
+		return bytes.HasPrefix(h, []byte{0x30, 0x26, 0xb2, 0x75, 0x8e, 0x66, 0xcf, 0x11})
+	}, "video/x-ms-asf"},
+	// ISO media files of any brand, e.g. M4A or QuickTime
+	{func(h []byte) bool { return len(h) >= 8 && string(h[4:8]) == "ftyp" }, "video/mp4"},
+}
+
+// Return the content type of a file from its first bytes
+func sniffContentType(head []byte) string {
+	for _, signature := range mediaSignatures {
+		if signature.matches(head) {
+			return signature.contentType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// Check the extension of an uploaded file against UPLOAD_EXTENSIONS and
+// the content type sniffed from its first bytes against the prefixes in
+// UPLOAD_CONTENT_TYPES, both comma-separated
+func CheckUploadType(filename string, head []byte) error {
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	extensions := getConfigDefault("UPLOAD_EXTENSIONS", defaultUploadExtensions)
+	if !inList(extensions, func(e string) bool { return strings.ToLower(e) == extension }) {
+		return fmt.Errorf("Files of this type are not supported, please upload one of: %s",
+			strings.Join(strings.Split(extensions, ","), ", "))
+	}
+
+	contentType := sniffContentType(head)
+	if !inList(getConfigDefault("UPLOAD_CONTENT_TYPES", defaultUploadTypes),
+		func(t string) bool { return strings.HasPrefix(contentType, t) }) {
+		return fmt.Errorf("The file does not look like audio (%s)", contentType)
+	}
+
+	return nil
+}
+
+// Content types of the accepted upload extensions, since the system's
+// MIME table often lacks some of them
+var audioContentTypes = map[string]string{
+	".wav":  "audio/wav",
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".wma":  "audio/x-ms-wma",
+	".webm": "audio/webm",
+	".mp4":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+}
+
+// Return the content type of an uploaded file by its name, for serving
+// it to players
+func AudioContentType(filename string) string {
+	extension := strings.ToLower(filepath.Ext(filename))
+	if contentType, ok := audioContentTypes[extension]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(extension); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// Check if an entry of the comma-separated list matches
+func inList(list string, match func(string) bool) bool {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" && match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check with ffprobe that the file is a readable media container with
+// at least one audio stream. The check is skipped if ffprobe is not
+// installed, the decoder will report such files later anyway.
+func ProbeAudio(filename string) error {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a",
+		"-show_entries", "stream=codec_type", "-of", "csv=p=0", filename).Output()
+
+	if errors.Is(err, exec.ErrNotFound) {
+		log.Println("ffprobe not found, skipping the media check")
+		return nil
+	} else if err != nil {
+		return ErrUnreadableMedia
+	}
+
+	if !strings.Contains(string(out), "audio") {
+		return ErrNoAudioStream
+	}
+
+	return nil
+}
+
+// Return the duration of a media file in seconds
+func ProbeDuration(filename string) (float64, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration",
+		"-of", "csv=p=0", filename).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// AudioInfo is the length of a media file and the format of its first
+// audio stream
+type AudioInfo struct {
+	Duration   float64
+	SampleRate int
+	Channels   int
+}
+
+// Return the length and the audio format of a media file
+func ProbeAudioInfo(filename string) (AudioInfo, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "format=duration:stream=sample_rate,channels", "-of", "json", filename).Output()
+	if err != nil {
+		return AudioInfo{}, err
+	}
+
+	// ffprobe writes the sample rate and the duration as strings
+	var probe struct {
+		Streams []struct {
+			SampleRate string `json:"sample_rate"`
+			Channels   int    `json:"channels"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return AudioInfo{}, err
+	}
+
+	if len(probe.Streams) == 0 {
+		return AudioInfo{}, ErrNoAudioStream
+	}
+
+	var info AudioInfo
+	if info.Duration, err = strconv.ParseFloat(probe.Format.Duration, 64); err != nil {
+		return AudioInfo{}, err
+	}
+	if info.SampleRate, err = strconv.Atoi(probe.Streams[0].SampleRate); err != nil {
+		return AudioInfo{}, err
+	}
+	info.Channels = probe.Streams[0].Channels
+
+	return info, nil
+}
+
+// Check whether the file is already in the format the decoder expects:
+// a WAV file with 16 kHz mono 16-bit PCM audio
+func IsDecoderFormat(filename string) (bool, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "format=format_name:stream=codec_name,sample_rate,channels", "-of", "json", filename).Output()
+	if err != nil {
+		return false, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			SampleRate string `json:"sample_rate"`
+			Channels   int    `json:"channels"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return false, err
+	}
+
+	return probe.Format.FormatName == "wav" && len(probe.Streams) == 1 &&
+		probe.Streams[0].CodecName == "pcm_s16le" && probe.Streams[0].SampleRate == "16000" &&
+		probe.Streams[0].Channels == 1, nil
+}
+
+// Transcode the audio of a media file to a 16 kHz mono 16-bit PCM WAV
+// file, the format the decoder expects
+func ConvertToDecoderFormat(src, dst string) error {
+	out, err := exec.Command("ffmpeg", "-v", "error", "-y", "-i", src,
+		"-vn", "-acodec", "pcm_s16le", "-ar", "16000", "-ac", "1", "-f", "wav", dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Return the peak volume of the audio in dB, -Inf for digital silence
+func ProbeMaxVolume(filename string) (float64, error) {
+	// volumedetect reports on stderr
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", filename,
+		"-vn", "-af", "volumedetect", "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		return 0, err
+	}
+
+	return parseMaxVolume(string(out))
+}
+
+// Read the maximum volume from the output of the volumedetect filter
+func parseMaxVolume(out string) (float64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, "max_volume:"); i >= 0 {
+			value := strings.TrimSuffix(strings.TrimSpace(line[i+len("max_volume:"):]), " dB")
+			return strconv.ParseFloat(value, 64)
+		}
+	}
+
+	return 0, errors.New("no volume in the ffmpeg output")
+}
+
+// Check whether the audio never gets louder than SILENCE_THRESHOLD_DB
+// (-50 dB by default), in which case there is no speech to transcribe
+func IsSilent(filename string) (bool, error) {
+	maxVolume, err := ProbeMaxVolume(filename)
+	if err != nil {
+		return false, err
+	}
+
+	return maxVolume < float64(GetConfigInt("SILENCE_THRESHOLD_DB", -50)), nil
+}
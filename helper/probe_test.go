@@ -0,0 +1,99 @@
+package helper
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMaxVolume(t *testing.T) {
+	for _, c := range []struct {
+		out    string
+		volume float64
+	}{
+		{"[Parsed_volumedetect_0 @ 0x1] n_samples: 16000\n[Parsed_volumedetect_0 @ 0x1] mean_volume: -20.5 dB\n[Parsed_volumedetect_0 @ 0x1] max_volume: -3.2 dB\n", -3.2},
+		{"[Parsed_volumedetect_0 @ 0x1] max_volume: -inf dB\n", math.Inf(-1)},
+	} {
+		if volume, err := parseMaxVolume(c.out); err != nil || volume != c.volume {
+			t.Errorf("got %v, %v, want %v", volume, err, c.volume)
+		}
+	}
+
+	if _, err := parseMaxVolume("Output file is empty, nothing was encoded\n"); err == nil {
+		t.Error("got no error without a volume")
+	}
+}
+
+// Write one second of 16 kHz mono WAV with a sine of the amplitude
+func writeWAV(t *testing.T, amplitude float64) string {
+	const rate = 16000
+
+	samples := make([]int16, rate)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.Sin(2*math.Pi*440*float64(i)/rate))
+	}
+
+	filename := filepath.Join(t.TempDir(), "sample.wav")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	size := uint32(2 * len(samples))
+	header := []interface{}{
+		[]byte("RIFF"), 36 + size, []byte("WAVE"),
+		[]byte("fmt "), uint32(16), uint16(1), uint16(1), uint32(rate), uint32(2 * rate), uint16(2), uint16(16),
+		[]byte("data"), size, samples,
+	}
+	for _, v := range header {
+		if err := binary.Write(file, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return filename
+}
+
+func TestIsSilent(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	for _, c := range []struct {
+		amplitude float64
+		silent    bool
+	}{
+		{0, true},
+		{1, true},
+		{10000, false},
+	} {
+		if silent, err := IsSilent(writeWAV(t, c.amplitude)); err != nil || silent != c.silent {
+			t.Errorf("amplitude %v: got %v, %v, want %v", c.amplitude, silent, err, c.silent)
+		}
+	}
+}
+
+func TestCheckUploadType(t *testing.T) {
+	for _, c := range []struct {
+		filename string
+		head     []byte
+		ok       bool
+	}{
+		{"talk.wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), true},
+		{"talk.flac", []byte("fLaC\x00\x00\x00\x22"), true},
+		{"talk.mp3", []byte{0xff, 0xfb, 0x90, 0x64}, true},
+		{"talk.aac", []byte{0xff, 0xf1, 0x50, 0x80}, true},
+		{"talk.m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), true},
+		{"talk.mp3", []byte("#!/bin/sh\necho hello\n"), false},
+		{"talk.wav", []byte{0x00, 0x01, 0x02, 0x03, 0x04}, false},
+		{"talk.exe", []byte("fLaC"), false},
+	} {
+		if err := CheckUploadType(c.filename, c.head); (err == nil) != c.ok {
+			t.Errorf("%s %q: got %v", c.filename, c.head, err)
+		}
+	}
+}
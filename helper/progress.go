@@ -0,0 +1,151 @@
+package helper
+
+import (
+	"sync"
+	"time"
+
+	"simple-web-asr/model"
+)
+
+// ProgressEvent is the status of a recording and how far its
+// transcription has come in percent
+type ProgressEvent struct {
+	RecordingID uint   `json:"id"`
+	Status      string `json:"status"`
+	Progress    int    `json:"progress"`
+	// The recording won't change anymore without the user
+	Final bool `json:"final"`
+}
+
+// The transcriber runs in its own process and reports the progress in
+// the database. WatchProgress polls the recordings that somebody is
+// subscribed to and publishes their changes to the subscribers in this
+// process, so that the database is queried once per interval no matter
+// how many are listening.
+var (
+	progressMu          sync.Mutex
+	progressSubscribers = map[uint]map[chan ProgressEvent]bool{}
+	lastProgress        = map[uint]ProgressEvent{}
+)
+
+// Subscribe to the progress of the recording. The channel only holds the
+// latest event, older ones are dropped when the subscriber is slow. The
+// returned function must be called once the subscriber is gone.
+func SubscribeProgress(recordingID uint) (<-chan ProgressEvent, func()) {
+	ch := make(chan ProgressEvent, 1)
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	if progressSubscribers[recordingID] == nil {
+		progressSubscribers[recordingID] = map[chan ProgressEvent]bool{}
+	}
+	progressSubscribers[recordingID][ch] = true
+
+	// A new subscriber gets the current state right away
+	if event, ok := lastProgress[recordingID]; ok {
+		ch <- event
+	}
+
+	return ch, func() {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+
+		delete(progressSubscribers[recordingID], ch)
+		if len(progressSubscribers[recordingID]) == 0 {
+			delete(progressSubscribers, recordingID)
+			delete(lastProgress, recordingID)
+		}
+	}
+}
+
+// Send the event to the subscribers of the recording if it differs from
+// the last one
+func PublishProgress(event ProgressEvent) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	if last, ok := lastProgress[event.RecordingID]; ok && last == event {
+		return
+	}
+	lastProgress[event.RecordingID] = event
+
+	for ch := range progressSubscribers[event.RecordingID] {
+		// Replace an event that hasn't been read yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+func subscribedRecordings() []uint {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	var ids []uint
+	for id := range progressSubscribers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Return the progress event of the recording, with the estimate based on
+// the processing rate, if it is known
+func RecordingProgress(recording *model.Recording, rate float64, rateKnown bool, now time.Time) ProgressEvent {
+	var estimate *time.Time
+	if rateKnown {
+		estimate = EstimateCompletion(recording, rate, now)
+	}
+
+	return ProgressEvent{
+		RecordingID: recording.ID,
+		Status:      recording.Status.String(),
+		Progress:    Progress(recording, estimate, now),
+		Final:       recording.Status >= model.StatusDone}
+}
+
+// Publish the progress of the subscribed recordings every interval, until
+// stop is closed. Recordings that are gone are reported as deleted.
+func WatchProgress(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ids := subscribedRecordings()
+		if len(ids) == 0 {
+			continue
+		}
+
+		var recordings []model.Recording
+		if err := DB.Select("id, status, progress, duration, started_at").Where("id IN ?", ids).Find(&recordings).Error; err != nil {
+			continue
+		}
+
+		rate, rateKnown := ProcessingRate()
+		now := time.Now()
+
+		found := map[uint]bool{}
+		for r := range recordings {
+			found[recordings[r].ID] = true
+			PublishProgress(RecordingProgress(&recordings[r], rate, rateKnown, now))
+		}
+
+		for _, id := range ids {
+			if !found[id] {
+				PublishProgress(ProgressEvent{RecordingID: id, Status: model.StatusDeleted.String(), Progress: 0, Final: true})
+			}
+		}
+	}
+}
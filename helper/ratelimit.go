@@ -0,0 +1,149 @@
+package helper
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter counts events per key (e.g. a client IP) in a sliding window
+type RateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+	// When the events of all keys were last pruned
+	swept time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, events: map[string][]time.Time{}}
+}
+
+// Drop the events of the key that are older than the window.
+// Must be called with the mutex held.
+func (l *RateLimiter) prune(key string, now time.Time) []time.Time {
+	events := l.events[key]
+	i := 0
+	for i < len(events) && now.Sub(events[i]) >= l.window {
+		i++
+	}
+	events = events[i:]
+
+	if len(events) == 0 {
+		delete(l.events, key)
+	} else {
+		l.events[key] = events
+	}
+
+	return events
+}
+
+// Drop the keys without events in the window, at most once per window,
+// so that keys which aren't seen again don't stay in the map.
+// Must be called with the mutex held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+
+	for key := range l.events {
+		l.prune(key, now)
+	}
+}
+
+// Check if the key has reached the limit within the current window
+func (l *RateLimiter) Blocked(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	return len(l.prune(key, now)) >= l.limit
+}
+
+// Record an event for the key and return the number of events
+// within the current window
+func (l *RateLimiter) Record(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	events := append(l.prune(key, now), now)
+	l.events[key] = events
+
+	return len(events)
+}
+
+// Record an event for the key unless it has already reached the limit
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	events := l.prune(key, now)
+	if len(events) >= l.limit {
+		return false
+	}
+	l.events[key] = append(events, now)
+
+	return true
+}
+
+// Forget the events of the key, e.g. after a successful login
+func (l *RateLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.events, key)
+}
+
+// WindowCounter counts requests per key in fixed windows, which makes it
+// easy to tell clients how many requests are left and when the count resets
+type WindowCounter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	windows map[string]*windowCount
+}
+
+type windowCount struct {
+	start time.Time
+	count int
+}
+
+func NewWindowCounter(window time.Duration) *WindowCounter {
+	return &WindowCounter{window: window, windows: map[string]*windowCount{}}
+}
+
+// Count a request for the key against the limit. Returns whether the
+// request is allowed, the number of remaining requests and the time when
+// the current window ends.
+func (w *WindowCounter) Hit(key string, limit int) (bool, int, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+
+	// Forget the windows that have ended, so that the map doesn't grow
+	for k, wc := range w.windows {
+		if now.Sub(wc.start) >= w.window {
+			delete(w.windows, k)
+		}
+	}
+
+	wc, ok := w.windows[key]
+	if !ok {
+		wc = &windowCount{start: now}
+		w.windows[key] = wc
+	}
+
+	reset := wc.start.Add(w.window)
+	if wc.count >= limit {
+		return false, 0, reset
+	}
+
+	wc.count++
+	return true, limit - wc.count, reset
+}
@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(3, time.Minute)
+
+	for i := 1; i <= 3; i++ {
+		if l.Blocked("1.2.3.4") {
+			t.Fatalf("blocked after %d events", i-1)
+		}
+		if n := l.Record("1.2.3.4"); n != i {
+			t.Errorf("Record returned %d, want %d", n, i)
+		}
+	}
+
+	if !l.Blocked("1.2.3.4") {
+		t.Error("not blocked at the limit")
+	}
+	if l.Blocked("5.6.7.8") {
+		t.Error("another key is blocked")
+	}
+
+	l.Reset("1.2.3.4")
+	if l.Blocked("1.2.3.4") {
+		t.Error("blocked after Reset")
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	l := NewRateLimiter(1, 50*time.Millisecond)
+
+	if !l.Allow("key") {
+		t.Fatal("the first event was not allowed")
+	}
+	if l.Allow("key") {
+		t.Fatal("an event over the limit was allowed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !l.Allow("key") {
+		t.Error("an event after the window was not allowed")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := NewRateLimiter(1, 50*time.Millisecond)
+
+	// Every attempt comes with a new key, e.g. another email address
+	for i := 0; i < 100; i++ {
+		l.Record(fmt.Sprintf("someone%d@example.com", i))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Record("someone@example.com")
+
+	if len(l.events) != 1 {
+		t.Errorf("got %d keys, want only the last one", len(l.events))
+	}
+}
@@ -0,0 +1,232 @@
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Storage keeps the files in a bucket of an S3-compatible object
+// storage, e.g. AWS S3 or MinIO. Objects are addressed path-style, as
+// ENDPOINT/BUCKET/NAME, and requests are signed with AWS Signature
+// Version 4.
+type S3Storage struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// SHA-256 of an empty payload, for requests without a body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Set up the storage from S3_ENDPOINT, S3_BUCKET, S3_REGION (us-east-1 by
+// default), S3_ACCESS_KEY and S3_SECRET_KEY
+func NewS3Storage() (*S3Storage, error) {
+	s := &S3Storage{
+		Endpoint:  strings.TrimRight(GetConfig("S3_ENDPOINT"), "/"),
+		Bucket:    GetConfig("S3_BUCKET"),
+		Region:    getConfigDefault("S3_REGION", "us-east-1"),
+		AccessKey: GetConfig("S3_ACCESS_KEY"),
+		SecretKey: GetConfig("S3_SECRET_KEY"),
+		Client:    &http.Client{Timeout: 30 * time.Minute},
+	}
+
+	if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT must be a URL, e.g. https://s3.eu-central-1.amazonaws.com")
+	}
+	if s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY must be set")
+	}
+
+	return s, nil
+}
+
+func (s *S3Storage) objectURL(name string) string {
+	return s.Endpoint + "/" + url.PathEscape(s.Bucket) + "/" + url.PathEscape(name)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign the request with AWS Signature Version 4, payloadHash is the
+// hex-encoded SHA-256 of the body
+func (s *S3Storage) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// Return an error with the beginning of the response body, which
+// contains the reason in S3's XML error format
+func s3Error(op, name string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("S3 %s of %s failed with %s: %s", op, name, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Save the object. The content is spooled to a temporary file first,
+// since the request needs its length and hash up front.
+func (s *S3Storage) Save(name string, r io.Reader) error {
+	tmp, err := ioutil.TempFile("", "s3-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(name), tmp)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req, hex.EncodeToString(hash.Sum(nil)))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("upload", name, resp)
+	}
+
+	return nil
+}
+
+// Open the object for reading, a missing object is reported like a
+// missing local file
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	return s.get(name, "")
+}
+
+// Size of the object, from a HEAD request
+func (s *S3Storage) Size(name string) (int64, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	default:
+		return 0, s3Error("stat", name, resp)
+	}
+}
+
+// Open a part of the object with a ranged GET request
+func (s *S3Storage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	return s.get(name, fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+}
+
+// Get the object, or the range of it if there is one
+func (s *S3Storage) get(name, byteRange string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK && byteRange == "", resp.StatusCode == http.StatusPartialContent && byteRange != "":
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error("download", name, resp)
+	}
+}
+
+// Delete the object, an object that doesn't exist is not an error
+func (s *S3Storage) Delete(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, emptyPayloadHash)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error("deletion", name, resp)
+	}
+}
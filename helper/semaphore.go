@@ -0,0 +1,45 @@
+package helper
+
+import (
+	"context"
+	"time"
+)
+
+// Semaphore limits the number of operations running at the same time
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func NewSemaphore(n int) *Semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Take a slot, waiting up to timeout for one to become free. Returns
+// false if no slot was free in time or the context was canceled.
+func (s *Semaphore) Acquire(ctx context.Context, timeout time.Duration) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Give back a slot taken with Acquire
+func (s *Semaphore) Release() {
+	<-s.slots
+}
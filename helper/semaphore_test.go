@@ -0,0 +1,46 @@
+package helper
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	s := NewSemaphore(2)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !s.Acquire(ctx, time.Millisecond) {
+			t.Fatalf("slot %d is not free", i+1)
+		}
+	}
+	if s.Acquire(ctx, 10*time.Millisecond) {
+		t.Fatal("got a third slot")
+	}
+
+	// A slot given back while waiting is taken
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Release()
+	}()
+	if !s.Acquire(ctx, time.Second) {
+		t.Error("the released slot is not taken")
+	}
+}
+
+func TestSemaphoreCanceled(t *testing.T) {
+	s := NewSemaphore(1)
+	s.Acquire(context.Background(), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if s.Acquire(ctx, time.Minute) {
+		t.Error("got a slot")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("waited after the cancellation")
+	}
+}
@@ -0,0 +1,473 @@
+package helper
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"simple-web-asr/model"
+)
+
+// Storage keeps the uploaded recordings, addressed by name
+type Storage interface {
+	Save(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
+}
+
+// LocalStorage keeps the files in a local directory
+type LocalStorage struct {
+	Dir string
+}
+
+func (s *LocalStorage) Path(name string) string {
+	return filepath.Join(s.Dir, name)
+}
+
+func (s *LocalStorage) Save(name string, r io.Reader) error {
+	file, err := os.Create(s.Path(name))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(s.Path(name))
+		return err
+	}
+
+	return file.Close()
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.Path(name))
+}
+
+// Delete the file, a file that doesn't exist is not an error
+func (s *LocalStorage) Delete(name string) error {
+	if err := os.Remove(s.Path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) Size(name string) (int64, error) {
+	info, err := os.Stat(s.Path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *LocalStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.Path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return passthroughReader{io.LimitReader(file, length), file}, nil
+}
+
+// RangeStorage is a Storage that reads a part of a file without fetching
+// the rest of it, which the audio player needs for seeking
+type RangeStorage interface {
+	Storage
+	// Size of the file, as read by Open
+	Size(name string) (int64, error)
+	// Open the length bytes of the file from the offset on
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// Size of the file in the storage, which is read through if it can't
+// tell the size otherwise
+func fileSize(s Storage, name string) (int64, error) {
+	if rs, ok := s.(RangeStorage); ok {
+		return rs.Size(name)
+	}
+
+	r, err := s.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(ioutil.Discard, r)
+}
+
+// Open a part of the file in the storage, skipping the beginning of the
+// file if the storage can't read parts
+func openRange(s Storage, name string, offset, length int64) (io.ReadCloser, error) {
+	if rs, ok := s.(RangeStorage); ok {
+		return rs.OpenRange(name, offset, length)
+	}
+
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return passthroughReader{io.LimitReader(r, length), r}, nil
+}
+
+// ReadSeekCloser is a file of the storage opened by OpenSeeker
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Open the file for reading with seeking, e.g. by http.ServeContent.
+// Seeking doesn't fetch anything, the file is read from the storage from
+// where the reading starts, up to rangeWindow bytes at a time, so that
+// reading a few bytes doesn't fetch the rest of the file.
+func OpenSeeker(s Storage, name string) (ReadSeekCloser, error) {
+	size, err := fileSize(s, name)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{storage: s, name: name, size: size}, nil
+}
+
+const rangeWindow = 1 << 20
+
+type rangeReader struct {
+	storage Storage
+	name    string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+	end     int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		length := r.size - r.offset
+		if length > rangeWindow {
+			length = rangeWindow
+		}
+		body, err := openRange(r.storage, r.name, r.offset, length)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.end = body, r.offset+length
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if r.offset >= r.end {
+		r.body.Close()
+		r.body = nil
+		if err == io.EOF {
+			err = nil
+		}
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// The storage used for the recordings, set up by ConnectStorage
+var Store Storage
+
+// Set up the storage for the recordings, in DATA_DIR or, if STORAGE_BACKEND
+// is "s3", in an S3 bucket, encrypted if STORAGE_ENCRYPTION_KEYS is set
+func ConnectStorage() {
+	switch backend := GetConfig("STORAGE_BACKEND"); backend {
+	case "", "local":
+		Store = &LocalStorage{Dir: GetConfig("DATA_DIR")}
+	case "s3":
+		s3, err := NewS3Storage()
+		if err != nil {
+			panic(fmt.Sprintf("failed to set up the S3 storage: %v", err))
+		}
+		Store = s3
+	default:
+		panic(fmt.Sprintf("unknown STORAGE_BACKEND %q", backend))
+	}
+
+	if keys := GetConfig("STORAGE_ENCRYPTION_KEYS"); keys != "" {
+		encrypted, err := NewEncryptedStorage(Store, keys)
+		if err != nil {
+			panic(fmt.Sprintf("failed to set up storage encryption: %v", err))
+		}
+		Store = encrypted
+	}
+
+	migrateRecordingNames()
+}
+
+// Return a new, unique name for the stored file of a recording. Names
+// are not derived from the recording ID, which may be reused after
+// restoring the database.
+func NewRecordingName() string {
+	return uuid.New().String() + ".dat"
+}
+
+// Name of the stored file of the recording
+func RecordingName(recording *model.Recording) string {
+	if recording.StoragePath != "" {
+		return recording.StoragePath
+	}
+	return legacyRecordingName(recording.ID)
+}
+
+// Name of the stored file of a recording from before the names were
+// stored with the recordings
+func legacyRecordingName(recordingID uint) string {
+	return fmt.Sprintf("%07d.dat", recordingID)
+}
+
+// Store the names of the files of recordings from before the names were
+// stored with the recordings
+func migrateRecordingNames() {
+	var recordings []model.Recording
+	DB.Unscoped().Where("storage_path = ''").Find(&recordings)
+
+	for r := range recordings {
+		name := legacyRecordingName(recordings[r].ID)
+		if err := DB.Unscoped().Model(&recordings[r]).Update("storage_path", name).Error; err != nil {
+			log.Println(fmt.Sprintf("Failed to store the file name of recording %d: %v", recordings[r].ID, err))
+		}
+	}
+}
+
+// Make a stored file available as a local file for external tools.
+// Unencrypted local files are used in place, anything else is copied
+// to a temporary file, which the returned cleanup function removes
+// together with any files the tool wrote next to it.
+func FetchLocal(s Storage, name string) (string, func(), error) {
+	if local, ok := s.(*LocalStorage); ok {
+		return local.Path(name), func() {}, nil
+	}
+
+	src, err := s.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "simple-web-asr")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	filename := filepath.Join(dir, name)
+	dst, err := os.Create(filename)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return filename, cleanup, nil
+}
+
+// Name of the stored copy of the recording in the format of the decoder
+func ConvertedRecordingName(recording *model.Recording) string {
+	return strings.TrimSuffix(RecordingName(recording), ".dat") + ".16k.wav"
+}
+
+// Return a local copy of the recording as 16 kHz mono WAV, which the
+// decoder expects. The file is transcoded the first time and the result
+// is kept next to the original, so that a retry doesn't transcode it
+// again. Files that already have the format are used as they are.
+func FetchDecoderAudio(recording *model.Recording) (string, func(), error) {
+	name := ConvertedRecordingName(recording)
+	if filename, cleanup, err := FetchLocal(Store, name); err == nil {
+		// Local files are not opened by FetchLocal
+		if _, err := os.Stat(filename); err == nil {
+			return filename, cleanup, nil
+		}
+		cleanup()
+	} else if !os.IsNotExist(err) {
+		return "", nil, err
+	}
+
+	filename, cleanup, err := FetchLocal(Store, RecordingName(recording))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if ok, err := IsDecoderFormat(filename); err == nil && ok {
+		return filename, cleanup, nil
+	}
+
+	dir, err := ioutil.TempDir("", "simple-web-asr")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	converted := filepath.Join(dir, name)
+
+	err = ConvertToDecoderFormat(filename, converted)
+	cleanup()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("Failed to convert the audio to 16 kHz mono WAV: %v", err)
+	}
+
+	file, err := os.Open(converted)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	defer file.Close()
+
+	// Without the cached copy, the next attempt just transcodes again
+	if err := Store.Save(name, file); err != nil {
+		log.Println(fmt.Sprintf("Failed to store the converted audio of recording %d: %v", recording.ID, err))
+	}
+
+	return converted, func() { os.RemoveAll(dir) }, nil
+}
+
+// Return how long deleted recordings can be restored, DELETE_GRACE_DAYS
+func DeletionGracePeriod() time.Duration {
+	return time.Duration(GetConfigInt("DELETE_GRACE_DAYS", 7)) * 24 * time.Hour
+}
+
+// Delete the recording together with its files, utterances, comments
+// and events
+func DeleteRecording(recording *model.Recording) error {
+	if err := DeleteRecordingFiles(recording); err != nil {
+		return err
+	}
+
+	return DeleteRecordingRows(DB, recording)
+}
+
+// Delete the stored audio and transcript of the recording
+func DeleteRecordingFiles(recording *model.Recording) error {
+	name := RecordingName(recording)
+	if err := Store.Delete(name); err != nil {
+		return err
+	}
+
+	converted := ConvertedRecordingName(recording)
+	if err := Store.Delete(converted); err != nil {
+		return err
+	}
+
+	// The decoder writes the transcription next to local files
+	if local, ok := Store.(*LocalStorage); ok {
+		os.Remove(local.Path(name) + ".txt")
+		os.Remove(local.Path(converted) + ".txt")
+	}
+
+	if recording.TranscriptFile != "" {
+		if err := Store.Delete(recording.TranscriptFile); err != nil {
+			return err
+		}
+	}
+
+	if recording.PeaksFile != "" {
+		if err := Store.Delete(recording.PeaksFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete the utterances of the recording and clear its transcript, so
+// that it can be transcribed again, tx may be a transaction. A transcript
+// kept in the storage has to be deleted with DeleteTranscriptFile.
+func ClearTranscript(tx *gorm.DB, recording *model.Recording) error {
+	if err := tx.Unscoped().Where("recording_id = ?", recording.ID).Delete(&model.Utterance{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(recording).Updates(map[string]interface{}{
+		"transcript":           "",
+		"transcript_file":      "",
+		"transcript_truncated": false,
+		"confidence":           nil}).Error
+}
+
+// Delete the transcript of the recording that was too large for the
+// database from the storage
+func DeleteTranscriptFile(name string) error {
+	if name == "" {
+		return nil
+	}
+	return Store.Delete(name)
+}
+
+// Delete the recording with its utterances, comments, events and tag
+// assignments from the database, tx may be a transaction. Tags that no
+// recording has anymore are deleted as well.
+func DeleteRecordingRows(tx *gorm.DB, recording *model.Recording) error {
+	if err := tx.Unscoped().Where("recording_id = ?", recording.ID).Delete(&model.Utterance{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().Where("recording_id = ?", recording.ID).Delete(&model.Comment{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("recording_id = ?", recording.ID).Delete(&model.RecordingEvent{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Exec("DELETE FROM recording_tags WHERE recording_id = ?", recording.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Exec("DELETE FROM tags WHERE user_id = ? AND id NOT IN (SELECT tag_id FROM recording_tags)", recording.UserID).Error; err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Delete(recording).Error
+}
@@ -0,0 +1,159 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"simple-web-asr/model"
+)
+
+func TestRecordingNamesDontCollide(t *testing.T) {
+	previous := Store
+	Store = tempStorage(t)
+	t.Cleanup(func() { Store = previous })
+
+	// The ID of the first recording was reused after restoring the database
+	first := model.Recording{StoragePath: NewRecordingName()}
+	first.ID = 1
+	second := model.Recording{StoragePath: NewRecordingName()}
+	second.ID = 1
+
+	for _, name := range []func(*model.Recording) string{RecordingName, ConvertedRecordingName, TranscriptName} {
+		if name(&first) == name(&second) {
+			t.Errorf("both recordings are stored as %q", name(&first))
+		}
+	}
+
+	if err := Store.Save(RecordingName(&first), strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Store.Save(RecordingName(&second), strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAll(t, Store, RecordingName(&first)); err != nil || string(data) != "first" {
+		t.Errorf("got %q, %v, want the first recording", data, err)
+	}
+
+	if err := DeleteRecordingFiles(&first); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAll(t, Store, RecordingName(&second)); err != nil || string(data) != "second" {
+		t.Errorf("got %q, %v, want the second recording", data, err)
+	}
+}
+
+func TestLegacyRecordingName(t *testing.T) {
+	recording := model.Recording{}
+	recording.ID = 42
+
+	if name := RecordingName(&recording); name != "0000042.dat" {
+		t.Errorf("got %q", name)
+	}
+
+	recording.StoragePath = "stored.dat"
+	if name := RecordingName(&recording); name != "stored.dat" {
+		t.Errorf("got %q, want the stored name", name)
+	}
+	if name := ConvertedRecordingName(&recording); name != "stored.16k.wav" {
+		t.Errorf("got converted name %q", name)
+	}
+}
+
+func TestLocalStorageDeleteMissing(t *testing.T) {
+	s := tempStorage(t)
+
+	if err := s.Delete("missing.dat"); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if _, err := s.Open("missing.dat"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file", err)
+	}
+}
+
+// An S3 server that keeps the objects in memory and counts the bytes it
+// sends
+func fakeS3(t *testing.T, objects map[string][]byte, sent *int64) *S3Storage {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		object, ok := objects[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		counter := &countingResponse{ResponseWriter: w, sent: sent}
+		http.ServeContent(counter, r, "", time.Time{}, bytes.NewReader(object))
+	}))
+	t.Cleanup(server.Close)
+
+	return &S3Storage{Endpoint: server.URL, Bucket: "bucket", Region: "us-east-1",
+		AccessKey: "key", SecretKey: "secret", Client: server.Client()}
+}
+
+type countingResponse struct {
+	http.ResponseWriter
+	sent *int64
+}
+
+func (w *countingResponse) Write(p []byte) (int, error) {
+	*w.sent += int64(len(p))
+	return w.ResponseWriter.Write(p)
+}
+
+func TestOpenSeeker(t *testing.T) {
+	data := make([]byte, 2*rangeWindow+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent int64
+	s3 := fakeS3(t, map[string][]byte{"plain": data}, &sent)
+
+	local, _ := NewEncryptedStorage(tempStorage(t), randomKey(t, "k1"))
+	if err := local.Save("plain", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, _ := NewEncryptedStorage(nil, randomKey(t, "k1"))
+	var stored bytes.Buffer
+	if err := encrypted.encrypt(&stored, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	encrypted.Backend = fakeS3(t, map[string][]byte{"plain": stored.Bytes()}, &sent)
+
+	for name, s := range map[string]Storage{"local": local, "s3": s3, "encrypted s3": encrypted} {
+		file, err := OpenSeeker(s, "plain")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if size, err := file.Seek(0, io.SeekEnd); err != nil || size != int64(len(data)) {
+			t.Errorf("%s: got the size %d, %v", name, size, err)
+		}
+
+		for _, part := range [][2]int64{{0, 10}, {encryptionChunkSize - 5, 10}, {2*encryptionChunkSize + 7, 1000}, {rangeWindow - 500, 1000}, {int64(len(data)) - 50, 50}} {
+			sent = 0
+			if _, err := file.Seek(part[0], io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, part[1])
+			if _, err := io.ReadFull(file, got); err != nil || !bytes.Equal(got, data[part[0]:part[0]+part[1]]) {
+				t.Errorf("%s: the %d bytes from %d differ: %v", name, part[1], part[0], err)
+			}
+			if sent > rangeWindow+2*encryptionChunkSize {
+				t.Errorf("%s: %d bytes fetched for %d", name, sent, part[1])
+			}
+		}
+		file.Close()
+	}
+
+	if _, err := OpenSeeker(s3, "missing"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a missing file", err)
+	}
+}
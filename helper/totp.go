@@ -0,0 +1,125 @@
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords as in RFC 6238, with the parameters that
+// authenticator apps use by default: HMAC-SHA1, 6 digits, 30 seconds
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Steps before and after the current one that are accepted, to
+	// tolerate clocks that are a little off
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Return a new random secret for an authenticator app, base32-encoded
+func NewTOTPSecret() (string, error) {
+	random := make([]byte, 20)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(random), nil
+}
+
+// Return the otpauth URL of the secret, which authenticator apps import
+func TOTPURL(secret, account string) string {
+	label := url.PathEscape(BrandName() + ":" + account)
+	query := url.Values{"secret": {secret}, "issuer": {BrandName()}}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Return the code of the secret for the time step
+func totpCode(key []byte, step int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Check the code against the secret. A code is only accepted for a time
+// step after lastStep, so that it can't be used twice. The step of the
+// accepted code is returned.
+func VerifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(code, " ", "")
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Return count new recovery codes and their hashes, comma-separated as
+// they are stored. The codes are only shown once.
+func NewRecoveryCodes(count int) ([]string, string, error) {
+	var codes, hashes []string
+
+	for i := 0; i < count; i++ {
+		random := make([]byte, 5)
+		if _, err := rand.Read(random); err != nil {
+			return nil, "", err
+		}
+		code := hex.EncodeToString(random)
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, strings.Join(hashes, ","), nil
+}
+
+// Check the code against the stored recovery code hashes. A matching
+// code is used up, the remaining hashes are returned.
+func UseRecoveryCode(hashes, code string) (string, bool) {
+	hash := hashRecoveryCode(strings.TrimSpace(code))
+
+	var remaining []string
+	found := false
+	for _, h := range strings.Split(hashes, ",") {
+		if h == "" {
+			continue
+		}
+		if !found && subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			found = true
+			continue
+		}
+		remaining = append(remaining, h)
+	}
+
+	return strings.Join(remaining, ","), found
+}
@@ -0,0 +1,236 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"simple-web-asr/model"
+)
+
+// Read the utterances of a transcription file produced by the decoder,
+// where every line has the form "start-end text" with times in centiseconds.
+// A decoder that does a diarization labels the speaker of each utterance
+// as "start-end:speaker text", utterances without a label are unlabeled.
+// The confidence of an utterance between 0 and 1 can follow the times,
+// as in "start-end@confidence text" or "start-end@confidence:speaker text".
+func ParseTranscription(filename string) ([]model.Utterance, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var utterances []model.Utterance
+
+	reader := bufio.NewReader(file)
+	var line string
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		var speaker string
+		if i := strings.Index(parts[0], ":"); i >= 0 {
+			parts[0], speaker = parts[0][:i], parts[0][i+1:]
+		}
+		var confidence *float32
+		if i := strings.Index(parts[0], "@"); i >= 0 {
+			value, errP := strconv.ParseFloat(parts[0][i+1:], 32)
+			if errP != nil {
+				return nil, errP
+			}
+			parts[0] = parts[0][:i]
+			confidence = new(float32)
+			*confidence = float32(value)
+		}
+		times := strings.SplitN(parts[0], "-", 2)
+
+		var timesParsed []float32
+
+		for t := range times {
+			timeParsed, errP := strconv.ParseFloat(times[t], 32)
+			if errP != nil {
+				return nil, errP
+			}
+			timesParsed = append(timesParsed, float32(timeParsed)/100.0)
+		}
+
+		if parts[1] != "" {
+			utterances = append(utterances, model.Utterance{
+				Start:      timesParsed[0],
+				End:        timesParsed[1],
+				Text:       parts[1],
+				Speaker:    speaker,
+				Confidence: confidence})
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	return utterances, nil
+}
+
+// Marker appended to transcripts that were cut off at MAX_TRANSCRIPT_BYTES
+const TruncationMarker = "[Transcript truncated: the remainder exceeded the maximum transcript size]"
+
+// Name of the stored transcript of the recording
+func TranscriptName(recording *model.Recording) string {
+	return strings.TrimSuffix(RecordingName(recording), ".dat") + ".json"
+}
+
+// Store the utterances for the recording, with the glossary of the user
+// applied, and the plain text of the transcript. Transcripts longer than
+// MAX_TRANSCRIPT_BYTES are either truncated with a marker or, if
+// TRANSCRIPT_OVERFLOW is "external", kept in the storage instead of the
+// database.
+func StoreUtterances(recording *model.Recording, utterances []model.Utterance) error {
+	// Correct the terminology with the glossary of the user
+	UserGlossary(recording.UserID).Correct(utterances)
+
+	if recording.Confidence = averageConfidence(utterances); recording.Confidence != nil {
+		if err := DB.Model(recording).Update("confidence", recording.Confidence).Error; err != nil {
+			return err
+		}
+	}
+
+	maxBytes := GetConfigInt("MAX_TRANSCRIPT_BYTES", 0)
+
+	size := 0
+	for u := range utterances {
+		size += len(utterances[u].Text)
+	}
+
+	if maxBytes > 0 && size > maxBytes {
+		if GetConfig("TRANSCRIPT_OVERFLOW") == "external" {
+			return storeExternalTranscript(recording, utterances)
+		}
+		utterances = truncateUtterances(utterances, maxBytes)
+		recording.TranscriptTruncated = true
+	}
+
+	for u := range utterances {
+		utterances[u].RecordingID = recording.ID
+		if err := DB.Create(&utterances[u]).Error; err != nil {
+			return err
+		}
+	}
+
+	recording.Transcript = TranscriptText(utterances)
+
+	return DB.Model(recording).Updates(map[string]interface{}{
+		"transcript":           recording.Transcript,
+		"transcript_truncated": recording.TranscriptTruncated}).Error
+}
+
+// Return the average confidence of the utterances that have one, nil if
+// none of them has
+func averageConfidence(utterances []model.Utterance) *float64 {
+	var sum float64
+	count := 0
+
+	for u := range utterances {
+		if utterances[u].Confidence != nil {
+			sum += float64(*utterances[u].Confidence)
+			count++
+		}
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	average := sum / float64(count)
+	return &average
+}
+
+// Return the plain text of the transcript, one utterance per line, with
+// the glossary corrections applied
+func TranscriptText(utterances []model.Utterance) string {
+	var text strings.Builder
+
+	for u := range utterances {
+		line := utterances[u].Text
+		if utterances[u].CorrectedText != "" {
+			line = utterances[u].CorrectedText
+		}
+		text.WriteString(strings.TrimSpace(line))
+		text.WriteString("\n")
+	}
+
+	return text.String()
+}
+
+// Keep the utterances that fit into maxBytes and append the marker
+func truncateUtterances(utterances []model.Utterance, maxBytes int) []model.Utterance {
+	var kept []model.Utterance
+	size := 0
+
+	for u := range utterances {
+		size += len(utterances[u].Text)
+		if size > maxBytes {
+			break
+		}
+		kept = append(kept, utterances[u])
+	}
+
+	marker := model.Utterance{Text: TruncationMarker}
+	if len(kept) > 0 {
+		marker.Start = kept[len(kept)-1].End
+		marker.End = marker.Start
+	}
+
+	return append(kept, marker)
+}
+
+func storeExternalTranscript(recording *model.Recording, utterances []model.Utterance) error {
+	for u := range utterances {
+		utterances[u].RecordingID = recording.ID
+	}
+
+	data, err := json.Marshal(utterances)
+	if err != nil {
+		return err
+	}
+
+	name := TranscriptName(recording)
+	if err := Store.Save(name, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	recording.TranscriptFile = name
+	return DB.Model(recording).Update("transcript_file", name).Error
+}
+
+// Read a transcript that was kept in the storage
+func LoadExternalTranscript(recording *model.Recording) ([]model.Utterance, error) {
+	file, err := Store.Open(recording.TranscriptFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var utterances []model.Utterance
+	if err := json.NewDecoder(file).Decode(&utterances); err != nil {
+		return nil, err
+	}
+
+	return utterances, nil
+}
+
+// Store the utterances of a transcription file produced by the decoder
+func LoadTranscription(filename string, recording *model.Recording) error {
+	utterances, err := ParseTranscription(filename)
+	if err != nil {
+		return err
+	}
+
+	return StoreUtterances(recording, utterances)
+}
@@ -0,0 +1,171 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"simple-web-asr/model"
+)
+
+var ErrInvalidWebhookURL = errors.New("The webhook URL must be an http or https URL of a public host")
+
+// The networks that the webhooks must not reach, besides the loopback,
+// link-local, multicast and unspecified addresses
+var privateNetworks = parseNetworks("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Check if the webhooks may call the IP, which must be a public address,
+// so that the users can't make the server call the services behind it
+func publicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that the webhook URL can be called, an empty URL turns the
+// webhook off. Host names are checked again by the dialer, as they may
+// resolve to another address by the time the webhook is sent.
+func ValidateWebhookURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !publicIP(ip)) || host == "localhost" {
+		return ErrInvalidWebhookURL
+	}
+
+	return nil
+}
+
+// Refuse the connections of the webhooks to addresses that aren't public,
+// after the name of the host has been resolved
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicIP(net.ParseIP(host)) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// The client of the webhooks, which only connects to public addresses,
+// redirects included
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: dialPublicOnly,
+		}).DialContext,
+	},
+}
+
+// Return a new random secret for signing webhooks
+func NewWebhookSecret() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Return the HMAC-SHA256 of the body with the secret, as sent in the
+// X-Webhook-Signature header
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post the outcome of the transcription to the webhook of the owner of
+// the recording, if there is one. Failed deliveries are retried up to
+// WEBHOOK_ATTEMPTS times in total, waiting twice as long each time,
+// starting with WEBHOOK_BACKOFF_SECONDS.
+func SendWebhook(recording *model.Recording) {
+	var user model.User
+	if err := DB.First(&user, recording.UserID).Error; err != nil || user.WebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         recording.ID,
+		"status":     recording.Status.String(),
+		"transcript": recording.Transcript})
+	if err != nil {
+		log.Println("Failed to encode the webhook", err)
+		return
+	}
+
+	backoff := time.Duration(GetConfigInt("WEBHOOK_BACKOFF_SECONDS", 5)) * time.Second
+	attempts := GetConfigInt("WEBHOOK_ATTEMPTS", 4)
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = postWebhook(webhookClient, user.WebhookURL, user.WebhookSecret, body); err == nil {
+			return
+		}
+
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Println(fmt.Sprintf("Giving up on the webhook of recording %d after %d attempts: %v", recording.ID, attempts, err))
+}
+
+func postWebhook(client *http.Client, webhookURL, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", SignWebhook(secret, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	for raw, valid := range map[string]bool{
+		"":                                  true,
+		"https://example.com/hook":          true,
+		"http://93.184.216.34:8080/hook":    true,
+		"ftp://example.com/hook":            false,
+		"https://":                          false,
+		"http://localhost/hook":             false,
+		"http://127.0.0.1/hook":             false,
+		"http://10.1.2.3/hook":              false,
+		"http://192.168.0.1/hook":           false,
+		"http://169.254.169.254/latest":     false,
+		"http://[::1]/hook":                 false,
+		"http://[fd00::1]/hook":             false,
+		"http://0.0.0.0/hook":               false,
+		"http://[::ffff:127.0.0.1]:80/hook": false,
+	} {
+		if err := ValidateWebhookURL(raw); (err == nil) != valid {
+			t.Errorf("%q: got %v", raw, err)
+		}
+	}
+}
+
+// A host name may resolve to a private address, which the dialer refuses
+func TestWebhookClientPublicOnly(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	webhookURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := postWebhook(webhookClient, webhookURL, "secret", []byte("{}")); err == nil || called {
+		t.Errorf("got %v, the server was called %v", err, called)
+	}
+}
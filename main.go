@@ -1,27 +1,55 @@
+//go:build !worker
+// +build !worker
+
 package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"html"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
 	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/asticode/go-astisub"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"simple-web-asr/helper"
 	"simple-web-asr/model"
@@ -34,9 +62,18 @@ func showIndexPage(c *gin.Context) {
 	userID := session.Get("user_id")
 
 	if userID != nil {
-		recordings := getAllRecordingsByUserID(userID.(uint))
+		var user model.User
+		db.First(&user, userID)
+
+		list := getRecordingsPage(c, user.ID)
+		list.QuotaBytes = userQuota(&user)
+		list.RemainingBytes = list.QuotaBytes - usedStorage(user.ID)
 		render(c, gin.H{
-			"payload": recordings}, "index.html")
+			"languages": helper.LanguageNames,
+			"statuses":  statusLabels,
+			"sorts":     sortLabels,
+			"tags":      getTagsByUserID(user.ID),
+			"payload":   list}, "index.html")
 	} else {
 		showLoginPage(c)
 	}
@@ -44,6 +81,37 @@ func showIndexPage(c *gin.Context) {
 
 var store cookie.Store
 
+// Names and labels of the statuses to filter the recordings list by
+var statusLabels = [][2]string{
+	{"queued", "In queue"},
+	{"processing", "Transcribing"},
+	{"done", "Transcribed"},
+	{"failed", "Error"},
+	{"no_speech", "No speech"},
+	{"language_unconfirmed", "Confirm language"},
+}
+
+// Return the storage quota of the user in bytes
+func userQuota(user *model.User) int64 {
+	if user.QuotaBytes > 0 {
+		return user.QuotaBytes
+	}
+	return int64(helper.GetConfigInt("DEFAULT_QUOTA_BYTES", 1<<30))
+}
+
+// Return the total size of the recordings of the user in bytes
+func usedStorage(userID uint) int64 {
+	var used int64
+	db.Model(&model.Recording{}).Where(&model.Recording{UserID: userID}).
+		Select("coalesce(sum(size_bytes), 0)").Scan(&used)
+	return used
+}
+
+// Format a number of bytes in megabytes for display
+func formatBytes(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+}
+
 func formatDuration(secondsFloat float32) string {
 	d := time.Duration(int(secondsFloat*1000)) * time.Millisecond
 	hours := int(d.Hours())
@@ -52,9 +120,110 @@ func formatDuration(secondsFloat float32) string {
 	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
 }
 
+// Format the length of a recording for display
+func formatSeconds(seconds float64) string {
+	return formatDuration(float32(seconds))
+}
+
+// Format a time relative to now for display, e.g. "3 days ago". Times
+// older than a month are shown as the date.
+func timeAgo(t time.Time) string {
+	d := time.Since(t)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d.Hours()), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int(d.Hours()/24), "day")
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// Check if the language can be chosen for an upload. "auto" is accepted
+// when the language can be detected.
+func uploadLanguageAllowed(language string) bool {
+	if language == "auto" {
+		return helper.GetConfig("LANGID_CMD") != ""
+	}
+	_, ok := helper.LanguageNames[language]
+	return ok
+}
+
+// Language is a supported language as listed by /languages
+type Language struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// List the languages that recordings can be uploaded in, sorted by code.
+// "auto" is included when the language can be detected.
+func showLanguages(c *gin.Context) {
+	languages := []Language{}
+	if uploadLanguageAllowed("auto") {
+		languages = append(languages, Language{"auto", "Detect automatically"})
+	}
+
+	codes := make([]string, 0, len(helper.LanguageNames))
+	for code := range helper.LanguageNames {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		languages = append(languages, Language{code, helper.LanguageNames[code]})
+	}
+
+	c.JSON(http.StatusOK, languages)
+}
+
+// Add the choices of the upload form to the data of the upload page
+func uploadPageData(data gin.H) gin.H {
+	data["languages"] = helper.LanguageNames
+	data["detect_language"] = helper.GetConfig("LANGID_CMD") != ""
+	data["normalize"] = helper.GetConfigBool("NORMALIZE_AUDIO")
+	data["retention_days"] = helper.GetConfigInt("RETENTION_DAYS", 0)
+	return data
+}
+
 func showRecordingUploadPage(c *gin.Context) {
 	// Call the render function with the name of the template to render
-	render(c, gin.H{}, "upload-recording.html")
+	render(c, uploadPageData(gin.H{}), "upload-recording.html")
+}
+
+// Return the utterances of a transcribed recording, nothing if it is not
+// transcribed yet. The request is aborted if they can't be loaded.
+func getRecordingUtterances(c *gin.Context, recording *model.Recording) ([]model.Utterance, bool) {
+	var utterances []model.Utterance
+	var err error
+
+	if recording.Status == model.StatusDone && recording.TranscriptFile != "" {
+		// The transcript was too large for the database
+		if utterances, err = helper.LoadExternalTranscript(recording); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return nil, false
+		}
+	} else if recording.Status == model.StatusDone {
+		utterances = getAllUtterancesByRecordingID(c.Request.Context(), recording.ID)
+
+		// The query was canceled, the utterances are incomplete
+		if c.Request.Context().Err() != nil {
+			abortWithStatus(c, http.StatusServiceUnavailable)
+			return nil, false
+		}
+	}
+
+	return utterances, true
 }
 
 func getRecording(c *gin.Context) (*model.Recording, []model.Utterance) {
@@ -67,24 +236,25 @@ func getRecording(c *gin.Context) (*model.Recording, []model.Utterance) {
 
 			// Check if the recording is owned by the current user
 			if userID.(uint) == recording.UserID {
-				var utterances []model.Utterance
-
-				if recording.Status == 3 {
-					utterances = getAllUtterancesByRecordingID(recording.ID)
+				utterances, ok := getRecordingUtterances(c, recording)
+				if !ok {
+					return nil, nil
 				}
 
+				db.Model(recording).Association("Tags").Find(&recording.Tags)
+
 				return recording, utterances
 			} else {
-				c.AbortWithStatus(http.StatusUnauthorized)
+				abortWithStatus(c, http.StatusUnauthorized)
 			}
 		} else {
 			// If the recording is not found, abort with an error
-			c.AbortWithError(http.StatusNotFound, err)
+			abortWithError(c, http.StatusNotFound, err)
 		}
 
 	} else {
 		// If an invalid recording ID is specified in the URL, abort with an error
-		c.AbortWithStatus(http.StatusNotFound)
+		abortWithStatus(c, http.StatusNotFound)
 	}
 
 	return nil, nil
@@ -92,421 +262,5503 @@ func getRecording(c *gin.Context) (*model.Recording, []model.Utterance) {
 
 func getRecordingHTML(c *gin.Context) {
 	recording, utterances := getRecording(c)
-	render(c, gin.H{"recording": recording, "utterances": utterances}, "recording.html")
-}
+	if recording == nil {
+		return
+	}
 
-func getRecordingSubtitles(c *gin.Context) (*astisub.Subtitles, string) {
-	recording, utterances := getRecording(c)
+	page := commentsPage(c)
+	comments, pages := getComments(recording.ID, page)
 
-	subtitles := astisub.NewSubtitles()
+	render(c, gin.H{
+		"recording":           recording,
+		"utterances":          utterances,
+		"language_candidates": supportedLanguageCandidates(recording),
+		"languages":           helper.LanguageNames,
+		"events":              helper.RecordingEvents(recording.ID),
+		"comments":            comments,
+		"comments_page":       page,
+		"comments_pages":      pages,
+		"user_id":             sessions.Default(c).Get("user_id"),
+		"retention_days":      helper.GetConfigInt("RETENTION_DAYS", 0),
+		"can_retry":           recording.RetryCount < helper.GetConfigInt("MAX_RETRIES", 3),
+		"has_speakers":        hasSpeakers(utterances),
+		"share_url":           shareURL(recording),
+		"payload":             recordingPayload{Recording: recording, Utterances: utterances}}, "recording.html")
+}
 
-	for u := range utterances {
-		item := &astisub.Item{}
+// Serve the uploaded audio of the recording for the player on the
+// recording page. Range requests are supported, so that the player can
+// seek to an utterance without loading the whole file.
+func getRecordingAudio(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
 
-		item.StartAt = time.Duration(int(utterances[u].Start*1000)) * time.Millisecond
-		item.EndAt = time.Duration(int(utterances[u].End*1000)) * time.Millisecond
-		item.Lines = append(item.Lines, astisub.Line{Items: []astisub.LineItem{{Text: utterances[u].Text}}})
+	serveRecordingAudio(c, recording)
+}
 
-		subtitles.Items = append(subtitles.Items, item)
+func serveRecordingAudio(c *gin.Context, recording *model.Recording) {
+	// The parts of the file that are asked for are fetched from the
+	// storage as they are sent, not the whole file up front
+	file, err := helper.OpenSeeker(helper.Store, helper.RecordingName(recording))
+	if os.IsNotExist(err) {
+		abortWithError(c, http.StatusNotFound, errors.New("The audio of the recording is missing"))
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
 	}
+	defer file.Close()
 
-	return subtitles, recording.Filename
+	// The content type follows from the name of the uploaded file,
+	// ServeContent keeps it and answers range requests for seeking
+	c.Header("Content-Type", helper.AudioContentType(recording.Filename))
+	http.ServeContent(c.Writer, c.Request, recording.Filename, recording.CreatedAt, file)
 }
 
-func getRecordingSRT(c *gin.Context) {
-	subtitles, filename := getRecordingSubtitles(c)
-	buf := &bytes.Buffer{}
-
-	subtitles.WriteToSRT(buf)
+// Send the waveform of the recording for the player, as a JSON array of
+// peaks between 0 and 1. They are computed on the first request.
+func getRecordingPeaks(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
 
-	subtitlesFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".srt"
+	peaks, err := helper.RecordingPeaks(recording)
+	if err == helper.ErrPeaksBusy {
+		c.Header("Retry-After", strconv.Itoa(helper.GetConfigInt("PEAKS_QUEUE_SECONDS", 10)))
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": subtitlesFilename}))
-	c.Data(http.StatusOK, "text/srt", buf.Bytes())
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.JSON(http.StatusOK, peaks)
 }
 
-func getRecordingTTML(c *gin.Context) {
-	subtitles, filename := getRecordingSubtitles(c)
-	buf := &bytes.Buffer{}
-
-	subtitles.WriteToTTML(buf)
+// Whether the decoder was less confident about an utterance than
+// LOW_CONFIDENCE_PERCENT (50 by default)
+func lowConfidence(confidence *float32) bool {
+	return confidence != nil && *confidence*100 < float32(helper.GetConfigInt("LOW_CONFIDENCE_PERCENT", 50))
+}
 
-	subtitlesFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".ttml"
+// Format the confidence of an utterance or a recording with two decimals
+func formatConfidence(confidence interface{}) string {
+	switch c := confidence.(type) {
+	case *float32:
+		if c != nil {
+			return fmt.Sprintf("%.2f", *c)
+		}
+	case *float64:
+		if c != nil {
+			return fmt.Sprintf("%.2f", *c)
+		}
+	}
+	return ""
+}
 
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": subtitlesFilename}))
-	c.Data(http.StatusOK, "text/xml", buf.Bytes())
+// Whether the speakers of the utterances are known
+func hasSpeakers(utterances []model.Utterance) bool {
+	for u := range utterances {
+		if utterances[u].Speaker != "" {
+			return true
+		}
+	}
+	return false
 }
 
-func getRecordingWebVTT(c *gin.Context) {
-	subtitles, filename := getRecordingSubtitles(c)
-	buf := &bytes.Buffer{}
+// Send the plain text of the transcript as a file download
+func getRecordingTranscript(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
 
-	subtitles.WriteToWebVTT(buf)
+	// Transcripts stored outside of the database or before the text was
+	// stored are put together from the utterances
+	transcript := recording.Transcript
+	if transcript == "" {
+		transcript = helper.TranscriptText(utterances)
+	}
 
-	subtitlesFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".vtt"
+	if transcript == "" {
+		abortWithError(c, http.StatusNotFound, errors.New("The recording has no transcript yet"))
+		return
+	}
 
+	filename := strings.TrimSuffix(recording.Filename, filepath.Ext(recording.Filename)) + ".txt"
 	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": subtitlesFilename}))
-	c.Data(http.StatusOK, "text/vtt", buf.Bytes())
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	io.WriteString(c.Writer, transcript)
 }
 
-func getRecordingOTR(c *gin.Context) {
-	recording, utterances := getRecording(c)
-	filename := recording.Filename
-	otrFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".otr"
+// Send the transcript as subtitles, unlike the exports there have to
+// be timed utterances
+func getTranscriptSubtitles(send func(*gin.Context, *model.Recording, []model.Utterance)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		recording, utterances := getRecording(c)
+		if recording == nil {
+			return
+		}
 
-	var text string
+		if len(utterances) == 0 {
+			abortWithError(c, http.StatusNotFound, errors.New("The recording has no transcript yet"))
+			return
+		}
 
-	for u := range utterances {
-		utt := utterances[u]
+		send(c, recording, utterances)
+	}
+}
 
-		text += "<p>"
-		text += fmt.Sprintf("<span class=\"timestamp\" data-timestamp=\"%f\">%s</span>", utt.Start, formatDuration(utt.Start))
-		text += " " + html.EscapeString(utt.Text) + " "
-		text += fmt.Sprintf("<span class=\"timestamp\" data-timestamp=\"%f\">%s</span>", utt.End, formatDuration(utt.End))
-		text += "<br /></p>"
+// Return the processing history of the recording
+func showRecordingEvents(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
 	}
 
-	otr := gin.H{}
-	otr["media"] = recording.Filename
-	otr["text"] = text
+	c.JSON(http.StatusOK, helper.RecordingEvents(recording.ID))
+}
 
-	bytes, _ := json.Marshal(otr)
+// Return the numbers of the pages from 1 to n, for pagination links
+func pageNumbers(n int) []int {
+	numbers := make([]int, n)
+	for i := range numbers {
+		numbers[i] = i + 1
+	}
+	return numbers
+}
 
-	c.Header("Content-Description", "File Transfer")
-	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": otrFilename}))
-	c.Data(http.StatusOK, "text/json", bytes)
+// A comment together with the email of its author
+type commentView struct {
+	model.Comment
+	Author string `json:"author"`
 }
 
-func deleteRecording(c *gin.Context) {
-	recording, utterances := getRecording(c)
+// Return the page of ?comments_page=, counted from 1
+func commentsPage(c *gin.Context) int {
+	page, err := strconv.Atoi(c.DefaultQuery("comments_page", "1"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
 
-	recordingFilename := helper.RecordingFilename(recording.ID)
-	os.Remove(recordingFilename)
-	os.Remove(recordingFilename + ".txt")
+// Return a page of the comments of the recording, oldest first, and the
+// number of pages. COMMENTS_PER_PAGE comments are shown per page.
+func getComments(recordingID uint, page int) ([]commentView, int) {
+	perPage := helper.GetConfigInt("COMMENTS_PER_PAGE", 20)
+	if perPage < 1 {
+		perPage = 20
+	}
 
-	db.Unscoped().Delete(utterances)
-	db.Unscoped().Delete(recording)
+	var total int64
+	db.Model(&model.Comment{}).Where(&model.Comment{RecordingID: recordingID}).Count(&total)
 
-	c.Redirect(http.StatusTemporaryRedirect, "/")
-}
+	var comments []commentView
+	db.Model(&model.Comment{}).
+		Select("comments.*, users.email AS author").
+		Joins("JOIN users ON users.id = comments.user_id").
+		Where("comments.recording_id = ? AND comments.deleted_at IS NULL", recordingID).
+		Order("comments.created_at asc").
+		Offset((page - 1) * perPage).Limit(perPage).
+		Scan(&comments)
 
-func uploadRecording(c *gin.Context) {
-	// Obtain the POSTed title and language values
-	title := c.PostForm("title")
-	language := c.PostForm("language")
+	return comments, int((total + int64(perPage) - 1) / int64(perPage))
+}
 
-	file, err := c.FormFile("content")
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+// Return a page of the comments of the recording
+func showComments(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
 	}
 
-	filename := filepath.Base(file.Filename)
-	if title == "" {
-		title = filename
-	}
+	page := commentsPage(c)
+	comments, pages := getComments(recording.ID, page)
 
-	session := sessions.Default(c)
-	userID := session.Get("user_id")
+	c.JSON(http.StatusOK, gin.H{
+		"comments": comments,
+		"page":     page,
+		"pages":    pages,
+		"has_next": page < pages})
+}
 
-	r, err := createRecording(userID.(uint), title, filename, language)
+// Add a comment of the current user to the recording
+func postComment(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
 
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	text := strings.TrimSpace(c.PostForm("text"))
+	if text == "" || len([]rune(text)) > helper.GetConfigInt("COMMENT_MAX_LENGTH", 2000) {
+		abortWithError(c, http.StatusBadRequest, errors.New("The comment is empty or too long"))
+		return
 	}
 
-	localFilename := helper.RecordingFilename(r.ID)
+	comment := model.Comment{
+		RecordingID: recording.ID,
+		UserID:      sessions.Default(c).Get("user_id").(uint),
+		Text:        text}
 
-	if err := c.SaveUploadedFile(file, localFilename); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	if err := db.Create(&comment).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
 	}
 
-	if err := updateRecordingStatus(r, 1); err == nil {
-		render(c, gin.H{
-			"payload": r}, "submission-successful.html")
-	} else {
-		c.AbortWithError(http.StatusBadRequest, err)
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusCreated, comment)
+		return
 	}
-}
 
-func showLoginPage(c *gin.Context) {
-	// Call the render function with the name of the template to render
-	render(c, gin.H{
-		"title": "Login",
-	}, "login.html")
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d#comments", recording.ID))
 }
 
-func showDPSPage(c *gin.Context) {
-	render(c, gin.H{
-		"title": "Data protection statement",
-	}, "dps.html")
-}
+// Delete a comment, only its author can do that
+func deleteComment(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
+	id, err := strconv.ParseUint(c.Param("comment_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
 
-func performLogin(c *gin.Context) {
-	// Obtain the POSTed email and password values
-	email := strings.ToLower(c.PostForm("email"))
-	password := c.PostForm("password")
-	user := findUser(email, password)
+	result := db.Where(&model.Comment{
+		RecordingID: recording.ID,
+		UserID:      sessions.Default(c).Get("user_id").(uint)}).Delete(&model.Comment{}, id)
+	if result.Error != nil {
+		abortWithError(c, http.StatusInternalServerError, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
 
-	// Check if the email/password combination is valid
-	if user != nil {
-		if user.Status > 0 {
-			// If the email/password is valid, save the user to session
-			session := sessions.Default(c)
-			session.Set("user_id", user.ID)
-			session.Save()
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d#comments", recording.ID))
+}
 
-			// and mark this in context
-			c.Set("is_logged_in", true)
+// Identifies the current state of the transcript, so that cached exports
+// are not served after it was changed
+func transcriptVersion(utterances []model.Utterance) string {
+	var latest time.Time
 
-			showIndexPage(c)
-		} else {
-			c.HTML(http.StatusBadRequest, "login.html", gin.H{
-				"url_base":     helper.GetConfig("URL_BASE"),
-				"ErrorTitle":   "Login Failed",
-				"ErrorMessage": "Please check your mailbox and click the confirmation link"})
+	for u := range utterances {
+		if utterances[u].UpdatedAt.After(latest) {
+			latest = utterances[u].UpdatedAt
 		}
-	} else {
-		// If the email/password combination is invalid,
-		// show the error message on the login page
-		c.HTML(http.StatusBadRequest, "login.html", gin.H{
-			"url_base":     helper.GetConfig("URL_BASE"),
-			"ErrorTitle":   "Login Failed",
-			"ErrorMessage": "Invalid credentials provided"})
 	}
-}
-
-func logout(c *gin.Context) {
-	// Clear the cookie
-	session := sessions.Default(c)
-	session.Delete("user_id")
-	session.Save()
-
-	// Redirect to the home page
-	c.Redirect(http.StatusTemporaryRedirect, "/")
-}
 
-func showRegistrationPage(c *gin.Context) {
-	// Call the render function with the name of the template to render
-	render(c, gin.H{
-		"title": "Register"}, "register.html")
+	return fmt.Sprintf("%d-%d", len(utterances), latest.UnixNano())
 }
 
-func register(c *gin.Context) {
-	// Obtain the POSTed email and password values
-	email := strings.ToLower(c.PostForm("email"))
-	password := c.PostForm("password")
+// Caches generated exports
+var exportCache *helper.Cache
 
-	if _, err := registerNewUser(email, password); err == nil {
-		render(c, gin.H{}, "register-successful.html")
-	} else {
-		// If the email/password combination is invalid,
-		// show the error message on the login page
-		c.HTML(http.StatusBadRequest, "register.html", gin.H{
-			"url_base":     helper.GetConfig("URL_BASE"),
-			"ErrorTitle":   "Registration Failed",
-			"ErrorMessage": err.Error()})
+// captureWriter keeps a copy of the written data as long as it fits
+// into the limit
+type captureWriter struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
 
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(p) > w.limit {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(p)
+		}
 	}
+	return len(p), nil
 }
 
-// Render one of HTML, JSON or CSV based on the 'Accept' header of the request
-// If the header doesn't specify this, HTML is rendered, provided that
-// the template name is present
-func render(c *gin.Context, data gin.H, templateName string) {
-	loggedInInterface, _ := c.Get("is_logged_in")
-	data["is_logged_in"] = loggedInInterface.(bool)
+// Limits the number of exports generated at the same time
+var exportSlots *helper.Semaphore
 
-	data["url_base"] = helper.GetConfig("URL_BASE")
+// Send an export of the recording as a file download. The export is
+// served from the cache if it was generated before for the same
+// recording, transcript and query parameters, otherwise it is written by the
+// generate function while being streamed to the client. At most
+// EXPORT_CONCURRENCY exports are generated at the same time, a request
+// that finds no free slot within EXPORT_QUEUE_SECONDS gets 503.
+func sendExport(c *gin.Context, recording *model.Recording, utterances []model.Utterance, extension, contentType string, generate func(w io.Writer) error) {
+	filename := recording.Filename
+	exportFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + extension
+	// Exports contain the title and the filename of the recording too,
+	// whose changes only show in the time of the last update
+	key := fmt.Sprintf("%d/%d/%s/%s/%s", recording.ID, recording.UpdatedAt.UnixNano(), extension, c.Request.URL.RawQuery, transcriptVersion(utterances))
 
-	switch c.Request.Header.Get("Accept") {
-	case "application/json":
-		// Respond with JSON
-		c.JSON(http.StatusOK, data["payload"])
-	case "application/xml":
-		// Respond with XML
-		c.XML(http.StatusOK, data["payload"])
-	default:
-		// Respond with HTML
-		c.HTML(http.StatusOK, templateName, data)
+	// Don't start an export when the request has already timed out
+	if c.Request.Context().Err() != nil {
+		return
 	}
-}
 
-// This middleware ensures that a request will be aborted with an error
-// if the user is not logged in
-func ensureLoggedIn() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// If there's an error or if the token is empty
-		// the user is not logged in
-		loggedInInterface, _ := c.Get("is_logged_in")
-		loggedIn := loggedInInterface.(bool)
-		if !loggedIn {
-			showLoginPage(c)
-			c.AbortWithStatus(http.StatusUnauthorized)
+	data, cached := exportCache.Get(key)
+
+	if !cached {
+		wait := helper.GetConfigInt("EXPORT_QUEUE_SECONDS", 10)
+		if !exportSlots.Acquire(c.Request.Context(), time.Duration(wait)*time.Second) {
+			c.Header("Retry-After", strconv.Itoa(wait))
+			abortWithError(c, http.StatusServiceUnavailable, errors.New("Too many exports in progress"))
+			return
 		}
+		defer exportSlots.Release()
 	}
-}
 
-// This middleware ensures that a request will be aborted with an error
-// if the user is already logged in
-func ensureNotLoggedIn() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// If there's no error or if the token is not empty
-		// the user is already logged in
-		loggedInInterface, _ := c.Get("is_logged_in")
-		loggedIn := loggedInInterface.(bool)
-		if loggedIn {
-			c.AbortWithStatus(http.StatusUnauthorized)
-		}
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": exportFilename}))
+
+	if cached {
+		c.Data(http.StatusOK, contentType, data)
+		return
 	}
-}
 
-// This middleware sets whether the user is logged in or not
-func setUserStatus() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		session := sessions.Default(c)
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
 
-		if userID := session.Get("user_id"); userID != nil {
-			c.Set("is_logged_in", true)
-		} else {
-			c.Set("is_logged_in", false)
-		}
+	capture := &captureWriter{limit: exportCache.MaxEntryBytes()}
+	if err := generate(io.MultiWriter(c.Writer, capture)); err != nil {
+		log.Printf("Failed to export recording %d as %s: %v", recording.ID, extension, err)
+		return
 	}
-}
 
-// Return a list of all recordings
-func getAllRecordingsByUserID(userID uint) []model.Recording {
-	var recordings []model.Recording
-	db.Where(&model.Recording{UserID: userID}).Not("status = 0").Find(&recordings)
-	return recordings
+	if !capture.overflow {
+		exportCache.Put(key, capture.buf.Bytes())
+	}
 }
 
-// Return a list of all utterances
-func getAllUtterancesByRecordingID(recordingID uint) []model.Utterance {
-	var utterances []model.Utterance
-	db.Where(&model.Utterance{RecordingID: recordingID}).Order("start asc").Find(&utterances)
+func recordingSubtitles(utterances []model.Utterance) *astisub.Subtitles {
+	subtitles := astisub.NewSubtitles()
+
+	for u := range utterances {
+		item := &astisub.Item{}
+
+		item.StartAt = time.Duration(int(utterances[u].Start*1000)) * time.Millisecond
+		item.EndAt = time.Duration(int(utterances[u].End*1000)) * time.Millisecond
+		item.Lines = append(item.Lines, astisub.Line{Items: []astisub.LineItem{{Text: utterances[u].Text}}})
+
+		subtitles.Items = append(subtitles.Items, item)
+	}
+
+	return subtitles
+}
+
+// The subtitle library refuses to write files without subtitles
+const emptyTTML = `<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml"><body><div></div></body></tt>
+`
+
+func getRecordingSRT(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	sendSRT(c, recording, utterances)
+}
+
+// Send the utterances as SubRip subtitles
+func sendSRT(c *gin.Context, recording *model.Recording, utterances []model.Utterance) {
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	sendExport(c, recording, utterances, "srt", "application/x-subrip", func(w io.Writer) error {
+		// An empty file is a valid SRT file
+		if len(utterances) == 0 {
+			return nil
+		}
+		return recordingSubtitles(utterances).WriteToSRT(w)
+	})
+}
+
+func getRecordingTTML(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	sendExport(c, recording, utterances, "ttml", "text/xml", func(w io.Writer) error {
+		if len(utterances) == 0 {
+			_, err := io.WriteString(w, emptyTTML)
+			return err
+		}
+		return recordingSubtitles(utterances).WriteToTTML(w)
+	})
+}
+
+func getRecordingWebVTT(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	sendWebVTT(c, recording, utterances)
+}
+
+// Send the utterances as WebVTT subtitles
+func sendWebVTT(c *gin.Context, recording *model.Recording, utterances []model.Utterance) {
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	sendExport(c, recording, utterances, "vtt", "text/vtt", func(w io.Writer) error {
+		if len(utterances) == 0 {
+			_, err := io.WriteString(w, "WEBVTT\n")
+			return err
+		}
+		return recordingSubtitles(utterances).WriteToWebVTT(w)
+	})
+}
+
+func getRecordingOTR(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	sendExport(c, recording, utterances, "otr", "text/json", func(w io.Writer) error {
+		var text strings.Builder
+
+		for u := range utterances {
+			utt := utterances[u]
+
+			text.WriteString("<p>")
+			fmt.Fprintf(&text, "<span class=\"timestamp\" data-timestamp=\"%f\">%s</span>", utt.Start, formatDuration(utt.Start))
+			text.WriteString(" " + html.EscapeString(utt.Text) + " ")
+			fmt.Fprintf(&text, "<span class=\"timestamp\" data-timestamp=\"%f\">%s</span>", utt.End, formatDuration(utt.End))
+			text.WriteString("<br /></p>")
+		}
+
+		otr := gin.H{}
+		otr["media"] = recording.Filename
+		otr["text"] = text.String()
+
+		return json.NewEncoder(w).Encode(otr)
+	})
+}
+
+// Push the utterances of the recording as server-sent events while they
+// are being stored by the transcriber, and a final "done" event once the
+// transcription is finished or failed
+func streamRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	// Live utterances are tracked by their ID, the ones of a transcript
+	// kept in the storage by how many of them were sent
+	var lastID uint
+	externalSent := 0
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		// Read the status before the utterances, so that none of them
+		// is missed when the transcription finishes in between
+		current, err := getRecordingByID(recording.ID)
+		if err != nil {
+			return false
+		}
+
+		var utterances []model.Utterance
+		if current.TranscriptFile != "" && current.Status == model.StatusDone {
+			// An oversized transcript is stored at once, send the part
+			// that wasn't sent yet
+			if utterances, err = helper.LoadExternalTranscript(current); err != nil {
+				return false
+			}
+			if externalSent < len(utterances) {
+				utterances = utterances[externalSent:]
+			} else {
+				utterances = nil
+			}
+			externalSent += len(utterances)
+		} else {
+			db.Where("recording_id = ? AND id > ?", recording.ID, lastID).Order("id asc").Find(&utterances)
+		}
+
+		for u := range utterances {
+			c.SSEvent("segment", utterances[u])
+			if utterances[u].ID > lastID {
+				lastID = utterances[u].ID
+			}
+		}
+
+		if current.Status >= model.StatusDone {
+			c.SSEvent("done", gin.H{"status": current.Status})
+			return false
+		}
+
+		select {
+		case <-ticker.C:
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Closed when the server shuts down, which ends the event streams that
+// would otherwise keep the shutdown waiting
+var shuttingDown = make(chan struct{})
+
+// Push the status and the progress of the recording as server-sent
+// "progress" events whenever they change, until the recording is done,
+// failed or needs the user. A comment is sent every 15 seconds, so that
+// proxies keep the connection open and a closed one is noticed.
+func getRecordingEvents(c *gin.Context) {
+	// Unlike getRecording, don't load the transcript of finished recordings
+	recordingID, err := strconv.ParseUint(c.Param("recording_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	recording, err := getRecordingByID(uint(recordingID))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+
+	if recording.UserID != sessions.Default(c).Get("user_id").(uint) {
+		abortWithStatus(c, http.StatusUnauthorized)
+		return
+	}
+
+	events, unsubscribe := helper.SubscribeProgress(recording.ID)
+	defer unsubscribe()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	rate, rateKnown := helper.ProcessingRate()
+	event := helper.RecordingProgress(recording, rate, rateKnown, time.Now())
+
+	c.Stream(func(w io.Writer) bool {
+		c.SSEvent("progress", event)
+		if event.Final {
+			return false
+		}
+
+		for {
+			select {
+			case event = <-events:
+				return true
+			case <-keepAlive.C:
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return false
+				}
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return false
+			case <-shuttingDown:
+				return false
+			}
+		}
+	})
+}
+
+// Return the utterances to export, with the text corrected by the
+// glossary unless the raw transcript is requested with ?raw=1. With
+// ?start= and/or ?end= (in seconds) only the utterances overlapping that
+// window are exported, cut to it. An invalid window aborts with 400.
+func exportedUtterances(c *gin.Context, utterances []model.Utterance) []model.Utterance {
+	start, end, err := exportWindow(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return nil
+	}
+
+	exported := []model.Utterance{}
+	for u := range utterances {
+		utt := utterances[u]
+
+		if utt.End <= start || (end >= 0 && utt.Start >= end) {
+			continue
+		}
+		if utt.Start < start {
+			utt.Start = start
+		}
+		if end >= 0 && utt.End > end {
+			utt.End = end
+		}
+
+		if utt.CorrectedText != "" && c.Query("raw") != "1" {
+			utt.Text = utt.CorrectedText
+		}
+
+		exported = append(exported, utt)
+	}
+
+	return exported
+}
+
+// Parse the ?start= and ?end= parameters of an export, end is -1 if the
+// window is open-ended
+func exportWindow(c *gin.Context) (float32, float32, error) {
+	start, end := float32(0), float32(-1)
+
+	if value := c.Query("start"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 32)
+		if err != nil || parsed < 0 {
+			return 0, 0, fmt.Errorf("Invalid start %q", value)
+		}
+		start = float32(parsed)
+	}
+
+	if value := c.Query("end"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 32)
+		if err != nil || float32(parsed) <= start {
+			return 0, 0, fmt.Errorf("Invalid end %q, it must be after the start", value)
+		}
+		end = float32(parsed)
+	}
+
+	return start, end, nil
+}
+
+// Return the transcript as a list of lines, optionally prefixed with
+// the start and end time of each utterance. All lines are built in
+// memory, next to the utterances, so the exports grow with the transcript.
+func transcriptLines(utterances []model.Utterance, timestamps bool) []string {
+	var lines []string
+
+	for u := range utterances {
+		utt := utterances[u]
+
+		if timestamps {
+			lines = append(lines, fmt.Sprintf("[%s - %s] %s", formatDuration(utt.Start), formatDuration(utt.End), utt.Text))
+		} else {
+			lines = append(lines, utt.Text)
+		}
+	}
+
+	return lines
+}
+
+func getRecordingDOCX(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	lines := transcriptLines(utterances, c.DefaultQuery("timestamps", "1") != "0")
+
+	sendExport(c, recording, utterances, "docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", func(w io.Writer) error {
+		return helper.WriteDOCX(w, recording.Title, lines)
+	})
+}
+
+func getRecordingPDF(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+	if utterances = exportedUtterances(c, utterances); c.IsAborted() {
+		return
+	}
+
+	lines := transcriptLines(utterances, c.DefaultQuery("timestamps", "1") != "0")
+
+	sendExport(c, recording, utterances, "pdf", "application/pdf", func(w io.Writer) error {
+		return helper.WritePDF(w, recording.Title, lines)
+	})
+}
+
+// Export formats supported by the /recording/export/:format routes
+var exportFormats = []string{"srt", "ttml", "vtt", "otr", "docx", "pdf"}
+
+// Handlers of the export formats
+var exportHandlers = map[string]gin.HandlerFunc{
+	"srt":  getRecordingSRT,
+	"ttml": getRecordingTTML,
+	"vtt":  getRecordingWebVTT,
+	"otr":  getRecordingOTR,
+	"docx": getRecordingDOCX,
+	"pdf":  getRecordingPDF,
+}
+
+// Export the transcription in the format given by ?format=, or else in
+// the default format of the user, or else as SRT
+func downloadRecording(c *gin.Context) {
+	format := c.Query("format")
+
+	if format == "" {
+		var user model.User
+		db.First(&user, sessions.Default(c).Get("user_id"))
+		format = user.DefaultExportFormat
+	}
+
+	if format == "" {
+		format = "srt"
+	}
+
+	handler, ok := exportHandlers[format]
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("Unsupported export format %q", format))
+		return
+	}
+
+	handler(c)
+}
+
+// Video containers whose audio track can be transcribed
+var videoFormats = []string{"mp4", "mkv", "webm", "mov", "avi"}
+
+// Describe what this instance supports, so that clients don't have to
+// hardcode it
+func showCapabilities(c *gin.Context) {
+	capabilities := gin.H{
+		"export_formats": exportFormats,
+		"video_formats":  videoFormats,
+	}
+
+	// Include the preference of the user, if logged in
+	if userID := sessions.Default(c).Get("user_id"); userID != nil {
+		var user model.User
+		db.First(&user, userID)
+		capabilities["default_export_format"] = user.DefaultExportFormat
+	}
+
+	c.JSON(http.StatusOK, capabilities)
+}
+
+// Report the length of the transcription queue and the state of the ASR
+// engine as last checked by the transcriber
+func showQueueStatus(c *gin.Context) {
+	var queued, processing int64
+	db.Model(&model.Recording{}).Where(&model.Recording{Status: model.StatusQueued}).Count(&queued)
+	db.Model(&model.Recording{}).Where(&model.Recording{Status: model.StatusProcessing}).Count(&processing)
+
+	c.JSON(http.StatusOK, gin.H{
+		"queued":     queued,
+		"processing": processing,
+		"engine":     getEngineStatus(processing)})
+}
+
+// Return the state of the ASR engine as last checked by the transcriber,
+// given the number of recordings being processed
+func getEngineStatus(processing int64) model.EngineStatus {
+	var engine model.EngineStatus
+	db.First(&engine, 1)
+
+	// The transcriber checks the engine before every job and at least
+	// every ENGINE_RETRY_SECONDS, an old result while no job is being
+	// processed means that it is not running
+	if processing == 0 && time.Since(engine.CheckedAt) > 5*time.Minute {
+		engine.Healthy = false
+		engine.Message = "The transcriber is not running"
+	}
+
+	return engine
+}
+
+// Metrics of the web application, the transcriber serves its own
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asr_uploads_total", Help: "Recordings uploaded for transcription"})
+	loginsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asr_logins_total", Help: "Successful logins"})
+	registrationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asr_registrations_total", Help: "Registered users"})
+	// The queue is counted at most every METRICS_CACHE_SECONDS, however
+	// often the metrics are scraped
+	pendingJobs = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "asr_pending_jobs", Help: "Recordings waiting in the transcription queue"},
+		helper.CachedGauge(time.Duration(helper.GetConfigInt("METRICS_CACHE_SECONDS", 15))*time.Second, func() float64 {
+			var queued int64
+			db.Model(&model.Recording{}).Where(&model.Recording{Status: model.StatusQueued}).Count(&queued)
+			return float64(queued)
+		}))
+)
+
+// This middleware only lets through the scrapers that may read the
+// metrics, see helper.MetricsAllowed
+func ensureMetricsAllowed() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !helper.MetricsAllowed(c.Request, clientIP(c)) {
+			abortWithStatus(c, http.StatusForbidden)
+		}
+	}
+}
+
+// Report that the web application is running, without touching the database
+func showHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Report whether the database and the ASR engine can be used. The engine
+// isn't contacted, its state is the one last recorded by the transcriber.
+func showReadiness(c *gin.Context) {
+	down := gin.H{}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+
+	if err != nil {
+		down["database"] = err.Error()
+	} else {
+		var processing int64
+		db.Model(&model.Recording{}).Where(&model.Recording{Status: model.StatusProcessing}).Count(&processing)
+
+		if engine := getEngineStatus(processing); !engine.Healthy {
+			down["asr"] = engine.Message
+		}
+	}
+
+	if len(down) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "down": down})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Report the status of the recording and, while it is queued or being
+// transcribed, when it is expected to be finished. The estimate is null
+// until enough recordings have been transcribed to know the processing rate.
+func showRecordingStatus(c *gin.Context) {
+	// Unlike getRecording, don't load the transcript of finished recordings
+	recordingID, err := strconv.ParseUint(c.Param("recording_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	recording, err := getRecordingByID(uint(recordingID))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+
+	if recording.UserID != sessions.Default(c).Get("user_id").(uint) {
+		abortWithStatus(c, http.StatusUnauthorized)
+		return
+	}
+
+	var estimate *time.Time
+	rate, ok := helper.ProcessingRate()
+	if ok {
+		estimate = helper.EstimateCompletion(recording, rate, time.Now())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":               recording.Status,
+		"duration":             recording.Duration,
+		"estimated_completion": estimate,
+		"estimating":           !ok && (recording.Status == model.StatusQueued || recording.Status == model.StatusProcessing)})
+}
+
+// Report the status of the recording by name with its progress in percent,
+// for pages that wait for the transcription to finish
+func showRecordingProgress(c *gin.Context) {
+	recordingID, err := strconv.ParseUint(c.Param("recording_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	recording, err := getRecordingByID(uint(recordingID))
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+
+	if recording.UserID != sessions.Default(c).Get("user_id").(uint) {
+		abortWithStatus(c, http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	var estimate *time.Time
+	if rate, ok := helper.ProcessingRate(); ok {
+		estimate = helper.EstimateCompletion(recording, rate, now)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":       recording.ID,
+		"status":   recording.Status.String(),
+		"progress": helper.Progress(recording, estimate, now)})
+}
+
+// Statuses of recordings that are not listed
+var hiddenStatuses = []model.RecordingStatus{model.StatusUploaded, model.StatusDeleted}
+
+// Mark the recording as deleted, the transcriber removes it with its
+// files once the grace period has passed
+func softDeleteRecording(recording *model.Recording) error {
+	now := time.Now()
+	recording.RestoreStatus = recording.Status
+	recording.Status = model.StatusDeleted
+	recording.RemovedAt = &now
+
+	return db.Model(recording).Select("Status", "RestoreStatus", "RemovedAt").Updates(recording).Error
+}
+
+// Delete the recording, which can be restored within DELETE_GRACE_DAYS.
+// Without a grace period the file and the transcription are removed
+// right away, a file that is already missing is not an error. JSON and
+// XML clients get the deleted recording, browsers are sent back to the
+// list.
+func deleteRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	if helper.DeletionGracePeriod() <= 0 {
+		if err := helper.DeleteRecording(recording); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	} else if err := softDeleteRecording(recording); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	} else {
+		helper.RecordEvent(recording.ID, "deleted", "")
+	}
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json":
+		c.JSON(http.StatusOK, recording)
+	case "application/xml":
+		c.XML(http.StatusOK, recording)
+	default:
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// BulkDeleteResult lists which of the requested recordings were deleted
+// and which were skipped because they don't exist or belong to somebody
+// else
+type BulkDeleteResult struct {
+	XMLName xml.Name `xml:"bulk-delete" json:"-"`
+	Deleted []uint   `xml:"deleted>id" json:"deleted"`
+	Skipped []string `xml:"skipped>id" json:"skipped"`
+}
+
+// Delete the recordings in the recording_id fields at once, like
+// deleteRecording does for one. The rows are changed in one transaction,
+// files are only removed once it has been committed. Recordings that
+// don't exist, are already deleted or belong to somebody else are
+// skipped, so the request can be repeated safely. JSON and XML clients
+// get the result, browsers are sent back to the list.
+func bulkDeleteRecordings(c *gin.Context) {
+	userID := sessions.Default(c).Get("user_id").(uint)
+	result := BulkDeleteResult{Deleted: []uint{}, Skipped: []string{}}
+
+	requested := map[uint]string{}
+	var ids []uint
+	for _, value := range c.PostFormArray("recording_id") {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			result.Skipped = append(result.Skipped, value)
+			continue
+		}
+		if _, ok := requested[uint(id)]; !ok {
+			requested[uint(id)] = value
+			ids = append(ids, uint(id))
+		}
+	}
+
+	var recordings []model.Recording
+	if len(ids) > 0 {
+		db.Where("id IN ? AND user_id = ? AND status <> ?", ids, userID, model.StatusDeleted).Find(&recordings)
+	}
+
+	grace := helper.DeletionGracePeriod()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for r := range recordings {
+			if grace <= 0 {
+				if err := helper.DeleteRecordingRows(tx, &recordings[r]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			recordings[r].RestoreStatus = recordings[r].Status
+			recordings[r].Status = model.StatusDeleted
+			recordings[r].RemovedAt = &now
+			if err := tx.Model(&recordings[r]).Select("Status", "RestoreStatus", "RemovedAt").Updates(&recordings[r]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	for r := range recordings {
+		if grace <= 0 {
+			if err := helper.DeleteRecordingFiles(&recordings[r]); err != nil {
+				log.Println(fmt.Sprintf("Failed to delete the files of recording %d: %v", recordings[r].ID, err))
+			}
+		} else {
+			helper.RecordEvent(recordings[r].ID, "deleted", "")
+		}
+		result.Deleted = append(result.Deleted, recordings[r].ID)
+		delete(requested, recordings[r].ID)
+	}
+
+	for _, id := range ids {
+		if value, ok := requested[id]; ok {
+			result.Skipped = append(result.Skipped, value)
+		}
+	}
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json":
+		c.JSON(http.StatusOK, result)
+	case "application/xml":
+		c.XML(http.StatusOK, result)
+	default:
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+// Restore a deleted recording of the user before the grace period ends
+func restoreRecording(c *gin.Context) {
+	recordingID, err := strconv.ParseUint(c.Param("recording_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	var recording model.Recording
+	db.First(&recording, recordingID)
+
+	if recording.Title == "" || recording.Status != model.StatusDeleted ||
+		recording.RemovedAt == nil || time.Since(*recording.RemovedAt) > helper.DeletionGracePeriod() {
+		abortWithError(c, http.StatusNotFound, errors.New("Recording not found"))
+		return
+	}
+
+	if recording.UserID != sessions.Default(c).Get("user_id").(uint) {
+		abortWithStatus(c, http.StatusUnauthorized)
+		return
+	}
+
+	recording.Status = recording.RestoreStatus
+	recording.RemovedAt = nil
+	if err := titleError(db.Model(&recording).Select("Status", "RemovedAt").Updates(&recording).Error); err == errDuplicateTitle {
+		abortWithError(c, http.StatusConflict, errors.New("A recording with this title exists, please rename it first"))
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	helper.RecordEvent(recording.ID, "restored", "")
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+}
+
+// List the deleted recordings of the user that can still be restored
+func showTrashPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var recordings []model.Recording
+	db.Where(&model.Recording{UserID: userID.(uint), Status: model.StatusDeleted}).
+		Where("removed_at > ?", time.Now().Add(-helper.DeletionGracePeriod())).
+		Order("removed_at desc").Find(&recordings)
+
+	render(c, gin.H{
+		"title":      "Deleted recordings",
+		"grace_days": helper.GetConfigInt("DELETE_GRACE_DAYS", 7),
+		"payload":    recordings}, "trash.html")
+}
+
+// Limits how often a user can have notifications re-sent
+var notificationLimiter *helper.RateLimiter
+
+// Send the transcription notification of a finished recording again
+func resendNotification(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	if recording.Status != model.StatusDone {
+		abortWithError(c, http.StatusConflict, errors.New("The recording is not transcribed yet"))
+		return
+	}
+
+	if !notificationLimiter.Allow(fmt.Sprint(recording.UserID)) {
+		renderHTML(c, http.StatusTooManyRequests, "recording.html", gin.H{
+			"ErrorTitle":   "Too many requests",
+			"ErrorMessage": "Please wait before requesting the notification again",
+			"recording":    recording,
+			"utterances":   utterances})
+		return
+	}
+
+	if err := helper.SendTranscriptionNotification(recording); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+}
+
+// Return the detected language candidates that the decoder supports
+func supportedLanguageCandidates(recording *model.Recording) []helper.LanguageCandidate {
+	var candidates []helper.LanguageCandidate
+	for _, candidate := range helper.ParseLanguageCandidates(recording.LanguageCandidates) {
+		if _, ok := helper.LanguageNames[candidate.Language]; ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// Set the language of a recording whose detected language has to be
+// confirmed and queue it again
+func confirmLanguage(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	if recording.Status != model.StatusLanguageUnconfirmed {
+		abortWithError(c, http.StatusConflict, errors.New("The language of the recording doesn't need confirmation"))
+		return
+	}
+
+	language := c.PostForm("language")
+	if _, ok := helper.LanguageNames[language]; !ok {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("Unsupported language %q", language))
+		return
+	}
+
+	err := db.Model(recording).Updates(map[string]interface{}{
+		"language":            language,
+		"language_candidates": "",
+		"status":              model.StatusQueued}).Error
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	helper.RecordEvent(recording.ID, "queued", "Language confirmed as "+language)
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+}
+
+// Return the time when a recording uploaded now is deleted: never if
+// the user asks to keep it or RETENTION_DAYS is not set, otherwise after
+// RETENTION_DAYS
+func retentionDeadline(retention string) *time.Time {
+	days := helper.GetConfigInt("RETENTION_DAYS", 0)
+	if retention == "forever" || days <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().AddDate(0, 0, days)
+	return &deadline
+}
+
+// Change whether the recording is kept forever or deleted after the
+// default retention period, counted from the upload
+func updateRecordingRetention(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	retention := c.PostForm("retention")
+	if retention != "forever" && retention != "default" {
+		abortWithError(c, http.StatusBadRequest, errors.New("Retention must be forever or default"))
+		return
+	}
+
+	recording.DeleteAfter = nil
+	if days := helper.GetConfigInt("RETENTION_DAYS", 0); retention == "default" && days > 0 {
+		deadline := recording.CreatedAt.AddDate(0, 0, days)
+		recording.DeleteAfter = &deadline
+	}
+
+	if err := db.Model(recording).Select("DeleteAfter").Updates(recording).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+}
+
+// The address of the public page of a shared recording
+func shareURL(recording *model.Recording) string {
+	return fmt.Sprintf("%s/s/%s", helper.GetConfig("URL_BASE"), recording.ShareToken)
+}
+
+// Create a link that shows the transcript and the audio of the recording
+// to anybody who has it, without logging in. The link expires after
+// expires_days if it is set, and it replaces an earlier link.
+func shareRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	var expires *time.Time
+	if days := c.PostForm("expires_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("Invalid number of days %q", days))
+			return
+		}
+		deadline := time.Now().AddDate(0, 0, n)
+		expires = &deadline
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	recording.ShareToken = hex.EncodeToString(random)
+	recording.ShareExpires = expires
+	err := db.Model(recording).Updates(map[string]interface{}{
+		"share_token":   recording.ShareToken,
+		"share_expires": recording.ShareExpires}).Error
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	helper.RecordEvent(recording.ID, "shared", "")
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		render(c, gin.H{"payload": gin.H{"share_url": shareURL(recording), "expires": recording.ShareExpires}}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+	}
+}
+
+// Revoke the share link of the recording
+func unshareRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	err := db.Model(recording).Updates(map[string]interface{}{
+		"share_token":   "",
+		"share_expires": nil}).Error
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	helper.RecordEvent(recording.ID, "unshared", "")
+
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+}
+
+// Return the recording shared with the token of the request, unless the
+// link was revoked or expired
+func getSharedRecording(c *gin.Context) *model.Recording {
+	token := c.Param("token")
+
+	var recording model.Recording
+	if token == "" || db.Where(&model.Recording{ShareToken: token}).First(&recording).Error != nil ||
+		recording.Status == model.StatusDeleted ||
+		(recording.ShareExpires != nil && time.Now().After(*recording.ShareExpires)) {
+		abortWithStatus(c, http.StatusNotFound)
+		return nil
+	}
+
+	return &recording
+}
+
+// Show the read-only page of a shared recording. Only the recording
+// itself is shown, nothing about its owner.
+func showSharedRecording(c *gin.Context) {
+	recording := getSharedRecording(c)
+	if recording == nil {
+		return
+	}
+
+	utterances, ok := getRecordingUtterances(c, recording)
+	if !ok {
+		return
+	}
+
+	renderHTML(c, http.StatusOK, "shared.html", gin.H{
+		"title":        recording.Title,
+		"token":        recording.ShareToken,
+		"recording":    recording,
+		"utterances":   utterances,
+		"has_speakers": hasSpeakers(utterances)})
+}
+
+// Serve the audio of a shared recording
+func getSharedRecordingAudio(c *gin.Context) {
+	recording := getSharedRecording(c)
+	if recording == nil {
+		return
+	}
+
+	serveRecordingAudio(c, recording)
+}
+
+// Queue a recording whose transcription failed again, at most
+// MAX_RETRIES (3 by default) times. JSON and XML clients get the queued
+// recording, browsers are sent back to the recording.
+func retryRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	if recording.Status != model.StatusFailed {
+		abortWithError(c, http.StatusConflict, errors.New("Only a failed transcription can be retried"))
+		return
+	}
+
+	if recording.RetryCount >= helper.GetConfigInt("MAX_RETRIES", 3) {
+		abortWithError(c, http.StatusConflict, errors.New("The transcription has been retried too many times, please upload the recording again"))
+		return
+	}
+
+	// The status is checked again, so that two retries at once queue
+	// the recording only once
+	result := db.Model(recording).Where("status = ?", model.StatusFailed).Updates(map[string]interface{}{
+		"status":      model.StatusQueued,
+		"retry_count": gorm.Expr("retry_count + 1"),
+		"started_at":  nil,
+		"finished_at": nil})
+	if result.Error != nil {
+		abortWithError(c, http.StatusInternalServerError, result.Error)
+		return
+	} else if result.RowsAffected == 0 {
+		abortWithError(c, http.StatusConflict, errors.New("Only a failed transcription can be retried"))
+		return
+	}
+	recording.Status = model.StatusQueued
+	recording.RetryCount++
+	recording.StartedAt, recording.FinishedAt = nil, nil
+	helper.RecordEvent(recording.ID, "queued", fmt.Sprintf("Retry %d", recording.RetryCount))
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		render(c, gin.H{"payload": recording}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+	}
+}
+
+// Recordings whose transcription has ended, successfully or not, which
+// can be transcribed again
+var retranscribableStatuses = []model.RecordingStatus{model.StatusDone, model.StatusNoSpeech, model.StatusFailed}
+
+// Transcribe the recording again in another language. The transcript is
+// discarded and the recording is queued again, if its transcription has
+// ended.
+func retranscribeRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	language := c.PostForm("language")
+	if _, ok := helper.LanguageNames[language]; !ok {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("Unsupported language %q", language))
+		return
+	}
+
+	errBusy := errors.New("The recording can only be transcribed again once its transcription has ended")
+	ended := false
+	for _, status := range retranscribableStatuses {
+		ended = ended || recording.Status == status
+	}
+	if !ended {
+		abortWithError(c, http.StatusConflict, errBusy)
+		return
+	}
+
+	transcriptFile := recording.TranscriptFile
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The status is checked again, in case it has changed in the
+		// meantime
+		result := tx.Model(recording).Where("status IN ?", retranscribableStatuses).Updates(map[string]interface{}{
+			"language":            language,
+			"language_candidates": "",
+			"status":              model.StatusQueued,
+			"started_at":          nil,
+			"finished_at":         nil})
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return errBusy
+		}
+
+		return helper.ClearTranscript(tx, recording)
+	})
+	if err == errBusy {
+		abortWithError(c, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := helper.DeleteTranscriptFile(transcriptFile); err != nil {
+		log.Println("Failed to delete the transcript file", transcriptFile, err)
+	}
+
+	recording.Language = language
+	recording.LanguageCandidates = ""
+	recording.Status = model.StatusQueued
+	recording.StartedAt, recording.FinishedAt = nil, nil
+	recording.Transcript, recording.TranscriptFile, recording.TranscriptTruncated = "", "", false
+	recording.Confidence = nil
+	helper.RecordEvent(recording.ID, "queued", "Transcribing again in "+helper.LanguageNames[language])
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		render(c, gin.H{"payload": recording}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+	}
+}
+
+// Longest name of a tag in characters
+const maxTagLength = 50
+
+// Return the tags of the user, sorted by name
+func getTagsByUserID(userID uint) []model.Tag {
+	var tags []model.Tag
+	db.Where(&model.Tag{UserID: userID}).Order("name asc").Find(&tags)
+	return tags
+}
+
+// Respond with the recording to JSON and XML clients and send browsers
+// back to the recording
+func showChangedRecording(c *gin.Context, recording *model.Recording) {
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		render(c, gin.H{"payload": recording}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+	}
+}
+
+// Add the tag to the recording. The tag is created if the user doesn't
+// have it yet.
+func tagRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("tag"))
+	if name == "" || utf8.RuneCountInString(name) > maxTagLength {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("The tag must have 1 to %d characters", maxTagLength))
+		return
+	}
+
+	tag := model.Tag{UserID: recording.UserID, Name: name}
+	if err := db.Where(&tag).FirstOrCreate(&tag).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := db.Model(recording).Association("Tags").Append(&tag); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	showChangedRecording(c, recording)
+}
+
+// Remove the tag from the recording. Tags that no recording has anymore
+// are deleted.
+func untagRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	var tag model.Tag
+	db.Where(&model.Tag{UserID: recording.UserID, Name: strings.TrimSpace(c.PostForm("tag"))}).First(&tag)
+	if tag.ID == 0 {
+		abortWithError(c, http.StatusNotFound, errors.New("The recording doesn't have this tag"))
+		return
+	}
+
+	if err := db.Model(recording).Association("Tags").Delete(&tag); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	var uses int64
+	db.Table("recording_tags").Where("tag_id = ?", tag.ID).Count(&uses)
+	if uses == 0 {
+		db.Delete(&tag)
+	}
+
+	showChangedRecording(c, recording)
+}
+
+// Change the title of the recording. JSON and XML clients get the
+// updated recording, browsers are sent back to the recording.
+func renameRecording(c *gin.Context) {
+	recording, _ := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	title := strings.TrimSpace(c.PostForm("title"))
+	if title == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("The title must not be empty"))
+		return
+	}
+
+	if title != recording.Title && helper.GetConfigBool("UNIQUE_RECORDING_TITLES") && titleTaken(recording.UserID, title) {
+		abortWithError(c, http.StatusConflict, errDuplicateTitle)
+		return
+	}
+
+	recording.Title = title
+	if err := titleError(db.Model(recording).Update("title", title).Error); err == errDuplicateTitle {
+		abortWithError(c, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		render(c, gin.H{"payload": recording}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, fmt.Sprintf("/recording/view/%d", recording.ID))
+	}
+}
+
+// Copy a local file into the storage
+func storeFile(name, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return helper.Store.Save(name, file)
+}
+
+// Room for the other form fields and the multipart encoding on top of
+// MAX_UPLOAD_BYTES
+const uploadFormOverhead = 1 << 20
+
+// Reject an upload larger than MAX_UPLOAD_BYTES
+func uploadTooLarge(c *gin.Context, maxBytes int64) {
+	renderHTML(c, http.StatusRequestEntityTooLarge, "upload-recording.html", uploadPageData(gin.H{
+		"ErrorTitle":   "Upload Failed",
+		"ErrorMessage": fmt.Sprintf("The file is too large, the limit is %d MB", maxBytes>>20)}))
+}
+
+// uploadError is the reason an uploaded file was not accepted, together
+// with the HTTP status for it
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+// The settings of an upload that apply to all of its files
+type uploadOptions struct {
+	userID      uint
+	title       string
+	language    string
+	normalize   bool
+	deleteAfter *time.Time
+	maxBytes    int64
+	// ID of the upload request, logged with the recording
+	requestID string
+}
+
+// The outcome of one file of a batch upload
+type uploadResult struct {
+	Filename  string           `json:"filename" xml:"filename,attr"`
+	Recording *model.Recording `json:"recording,omitempty" xml:"recording,omitempty"`
+	Error     string           `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// The outcomes of the files of a batch upload
+type uploadResults []uploadResult
+
+// Wrap the results in a root element in XML
+func (results uploadResults) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Uploads []uploadResult `xml:"upload"`
+	}{results}, xml.StartElement{Name: xml.Name{Local: "uploads"}})
+}
+
+// Check an uploaded file and store it as a new queued recording
+func storeUpload(c *gin.Context, file *multipart.FileHeader, title string, options *uploadOptions) (*model.Recording, error) {
+	if options.maxBytes > 0 && file.Size > options.maxBytes {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("The file is too large, the limit is %d MB", options.maxBytes>>20)}
+	}
+
+	// Keep the upload in a temporary file until it is checked and stored
+	tmp, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	localFilename := tmp.Name()
+	defer os.Remove(localFilename)
+
+	if err := c.SaveUploadedFile(file, localFilename); err != nil {
+		log.Println("Failed to receive the upload:", err)
+		return nil, &uploadError{http.StatusBadRequest, "The file could not be received, please try again"}
+	}
+
+	return storeLocalUpload(localFilename, filepath.Base(file.Filename), file.Size, title, options)
+}
+
+// Check an uploaded file that was saved to localFilename and create
+// a queued recording for it. The file is left for the caller to remove.
+func storeLocalUpload(localFilename, filename string, size int64, title string, options *uploadOptions) (*model.Recording, error) {
+	if title == "" {
+		title = filename
+	}
+
+	// Reject files that are obviously not audio before anything is stored
+	head := make([]byte, 512)
+	f, err := os.Open(localFilename)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	if err := helper.CheckUploadType(filename, head[:n]); err != nil {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, err.Error()}
+	}
+
+	var user model.User
+	db.First(&user, options.userID)
+	if quota := userQuota(&user); usedStorage(user.ID)+size > quota {
+		return nil, &uploadError{http.StatusForbidden,
+			fmt.Sprintf("The file doesn't fit into your storage quota of %s, please delete some recordings first", formatBytes(quota))}
+	}
+
+	r, err := createRecording(options.userID, title, filename, options.language, options.normalize, options.deleteAfter)
+
+	if err == errDuplicateTitle {
+		return nil, &uploadError{http.StatusConflict,
+			fmt.Sprintf("You already have a recording titled %q, please choose another title, e.g. %q",
+				title, suggestTitle(options.userID, title))}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Video files are accepted as well, the decoder extracts the audio
+	// track, but there has to be one
+	if err := helper.ProbeAudio(localFilename); err != nil {
+		db.Unscoped().Delete(r)
+		return nil, &uploadError{http.StatusUnsupportedMediaType, err.Error()}
+	}
+
+	db.Model(r).Update("size_bytes", size)
+
+	// The duration is used for estimating the completion time. A file that
+	// can't be probed is still transcribed, its length is shown as unknown.
+	if info, err := helper.ProbeAudioInfo(localFilename); err == nil {
+		db.Model(r).Updates(map[string]interface{}{
+			"duration":    info.Duration,
+			"sample_rate": info.SampleRate,
+			"channels":    info.Channels,
+			"probed":      true})
+	} else {
+		log.Println(fmt.Sprintf("Failed to probe recording %d: %v", r.ID, err))
+	}
+
+	if err := storeFile(helper.RecordingName(r), localFilename); err != nil {
+		db.Unscoped().Delete(r)
+		return nil, err
+	}
+	helper.RecordEvent(r.ID, "uploaded", filename)
+
+	// Another upload may have taken the title in the meantime
+	if err := titleError(updateRecordingStatus(r, model.StatusQueued)); err != nil {
+		db.Unscoped().Delete(r)
+		helper.Store.Delete(helper.RecordingName(r))
+		if err == errDuplicateTitle {
+			return nil, &uploadError{http.StatusConflict,
+				fmt.Sprintf("You already have a recording titled %q, please choose another title, e.g. %q",
+					title, suggestTitle(options.userID, title))}
+		}
+		return nil, err
+	}
+	helper.RecordEvent(r.ID, "queued", "")
+	r.Status = model.StatusQueued
+	uploadsTotal.Inc()
+
+	// The worker logs the recording ID, which connects the transcription
+	// to the upload request
+	helper.LogJSON("info", "recording queued", map[string]interface{}{
+		"request_id":   options.requestID,
+		"recording_id": r.ID,
+		"user_id":      r.UserID,
+		"size_bytes":   size})
+
+	return r, nil
+}
+
+// Accept one or, for a batch, several files in the content field. The
+// title, language and other settings apply to all of them. A batch is
+// answered with the outcome of every file, so that one bad file doesn't
+// reject the others.
+func uploadRecording(c *gin.Context) {
+	// Stop reading the request once it is clearly too large, the size
+	// of each file is checked below
+	maxBytes := int64(helper.GetConfigInt("MAX_UPLOAD_BYTES", 0))
+	maxFiles := helper.GetConfigInt("MAX_UPLOAD_FILES", 10)
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	if maxBytes > 0 {
+		limit := maxBytes*int64(maxFiles) + uploadFormOverhead
+		if c.Request.ContentLength > limit {
+			uploadTooLarge(c, maxBytes)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		uploadTooLarge(c, maxBytes)
+		return
+	} else if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "The upload could not be read", err)
+		return
+	}
+
+	files := form.File["content"]
+	if len(files) == 0 {
+		abortWithError(c, http.StatusBadRequest, errors.New("Please choose a file to upload"))
+		return
+	} else if len(files) > maxFiles {
+		renderHTML(c, http.StatusBadRequest, "upload-recording.html", uploadPageData(gin.H{
+			"ErrorTitle":   "Upload Failed",
+			"ErrorMessage": fmt.Sprintf("Please upload at most %d files at once", maxFiles)}))
+		return
+	}
+
+	// Obtain the POSTed title, language and normalization values
+	normalize, err := strconv.ParseBool(c.DefaultPostForm("normalize", strconv.FormatBool(helper.GetConfigBool("NORMALIZE_AUDIO"))))
+	if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "Invalid value of normalize, it must be true or false", err)
+		return
+	}
+
+	options := uploadOptions{
+		userID:      sessions.Default(c).Get("user_id").(uint),
+		title:       c.PostForm("title"),
+		language:    c.PostForm("language"),
+		normalize:   normalize,
+		deleteAfter: retentionDeadline(c.PostForm("retention")),
+		maxBytes:    maxBytes,
+		requestID:   c.GetString("request_id")}
+
+	// Without a language, it is detected if possible
+	if options.language == "" {
+		options.language = "auto"
+	}
+
+	if !uploadLanguageAllowed(options.language) {
+		renderHTML(c, http.StatusBadRequest, "upload-recording.html", uploadPageData(gin.H{
+			"ErrorTitle":   "Upload Failed",
+			"ErrorMessage": fmt.Sprintf("Unsupported language %q", options.language)}))
+		return
+	}
+
+	if len(files) == 1 {
+		r, err := storeUpload(c, files[0], options.title, &options)
+
+		var uploadErr *uploadError
+		if errors.As(err, &uploadErr) {
+			renderHTML(c, uploadErr.status, "upload-recording.html", uploadPageData(gin.H{
+				"ErrorTitle":   "Upload Failed",
+				"ErrorMessage": uploadErr.message}))
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+		} else {
+			render(c, gin.H{
+				"payload": r}, "submission-successful.html")
+		}
+		return
+	}
+
+	// The titles of a batch are the file names, after the given title
+	results := make(uploadResults, len(files))
+	for i, file := range files {
+		title := ""
+		if options.title != "" {
+			title = options.title + " - " + filepath.Base(file.Filename)
+		}
+
+		results[i].Filename = filepath.Base(file.Filename)
+		var uploadErr *uploadError
+		if r, err := storeUpload(c, file, title, &options); errors.As(err, &uploadErr) {
+			results[i].Error = uploadErr.message
+		} else if err != nil {
+			log.Println(fmt.Sprintf("Failed to store the upload %q: %v", results[i].Filename, err))
+			results[i].Error = "The file could not be stored, please try again"
+		} else {
+			results[i].Recording = r
+		}
+	}
+
+	render(c, gin.H{
+		"results": results,
+		"payload": results}, "submission-successful.html")
+}
+
+// Directory of the partial files of chunked uploads, UPLOAD_DIR. It has
+// to be shared if several instances of the application serve the uploads.
+func chunkedUploadDir() string {
+	dir := helper.GetConfig("UPLOAD_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "simple-web-asr-uploads")
+	}
+	return dir
+}
+
+func chunkedUploadPath(upload *model.Upload) string {
+	return filepath.Join(chunkedUploadDir(), upload.ID+".part")
+}
+
+// Locks the row of the query until the end of the transaction, e.g. of
+// an upload while a chunk is appended to it
+var lockForUpdate = clause.Locking{Strength: "UPDATE"}
+
+// Start an upload in chunks of CHUNK_SIZE_BYTES (8 MB by default) for
+// large files and unreliable connections. The form has the file name and
+// size and the same settings as a regular upload. The size limit and the
+// quota are checked up front, the content once the upload is finalized.
+// A user has at most MAX_OPEN_UPLOADS (5 by default) unfinished uploads,
+// which count against the quota with their full size.
+func startChunkedUpload(c *gin.Context) {
+	size, err := strconv.ParseInt(c.PostForm("size"), 10, 64)
+	if err != nil || size <= 0 {
+		abortWithError(c, http.StatusBadRequest, errors.New("The size of the file is missing"))
+		return
+	}
+
+	filename := filepath.Base(c.PostForm("filename"))
+	if filename == "." || filename == "/" {
+		abortWithError(c, http.StatusBadRequest, errors.New("The name of the file is missing"))
+		return
+	}
+
+	if maxBytes := int64(helper.GetConfigInt("MAX_UPLOAD_BYTES", 0)); maxBytes > 0 && size > maxBytes {
+		abortWithError(c, http.StatusRequestEntityTooLarge, fmt.Errorf("The file is too large, the limit is %d MB", maxBytes>>20))
+		return
+	}
+
+	userID := sessions.Default(c).Get("user_id").(uint)
+
+	language := c.PostForm("language")
+	if language == "" {
+		language = "auto"
+	}
+	if !uploadLanguageAllowed(language) {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("Unsupported language %q", language))
+		return
+	}
+
+	normalize, err := strconv.ParseBool(c.DefaultPostForm("normalize", strconv.FormatBool(helper.GetConfigBool("NORMALIZE_AUDIO"))))
+	if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, "Invalid value of normalize, it must be true or false", err)
+		return
+	}
+
+	if err := os.MkdirAll(chunkedUploadDir(), 0700); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	upload := model.Upload{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Filename:  filename,
+		Title:     c.PostForm("title"),
+		Language:  language,
+		Normalize: normalize,
+		Retention: c.PostForm("retention"),
+		Size:      size,
+		ChunkSize: int64(helper.GetConfigInt("CHUNK_SIZE_BYTES", 8<<20))}
+
+	// The row of the user is locked, so that concurrent uploads are
+	// counted against the limits one after the other
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var user model.User
+		if err := tx.Clauses(lockForUpdate).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var open struct {
+			Count int64
+			Size  int64
+		}
+		if err := tx.Model(&model.Upload{}).Where(&model.Upload{UserID: userID}).
+			Select("count(*) AS count, coalesce(sum(size), 0) AS size").Scan(&open).Error; err != nil {
+			return err
+		}
+
+		if open.Count >= int64(helper.GetConfigInt("MAX_OPEN_UPLOADS", 5)) {
+			return &uploadError{http.StatusTooManyRequests, "Too many unfinished uploads, please finish the others first"}
+		}
+		if quota := userQuota(&user); usedStorage(user.ID)+open.Size+size > quota {
+			return &uploadError{http.StatusForbidden, fmt.Sprintf("The file doesn't fit into your storage quota of %s", formatBytes(quota))}
+		}
+
+		return tx.Create(&upload).Error
+	})
+
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		abortWithError(c, uploadErr.status, err)
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusCreated, upload)
+	}
+}
+
+// Return the chunked upload of the request if it belongs to the user
+func getChunkedUpload(c *gin.Context) *model.Upload {
+	var upload model.Upload
+	userID := sessions.Default(c).Get("user_id").(uint)
+	if err := db.Where(&model.Upload{ID: c.Param("upload_id"), UserID: userID}).First(&upload).Error; err != nil {
+		abortWithMessage(c, http.StatusNotFound, "The upload doesn't exist", err)
+		return nil
+	}
+	return &upload
+}
+
+// Report how much of a chunked upload has been received, so that an
+// interrupted upload can continue with the next chunk
+func showChunkedUpload(c *gin.Context) {
+	upload := getChunkedUpload(c)
+	if upload == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, upload)
+}
+
+// Append a chunk to the upload. Chunks have to be sent in order; a chunk
+// that has already been received is acknowledged again, so that it can be
+// resent when the response was lost.
+func uploadChunk(c *gin.Context) {
+	upload := getChunkedUpload(c)
+	if upload == nil {
+		return
+	}
+
+	chunk, err := strconv.Atoi(c.Param("chunk"))
+	if err != nil || chunk < 0 {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	// Read the chunk completely before appending it, so that a broken
+	// connection doesn't leave a partial chunk behind
+	data, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, upload.ChunkSize))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New("The chunk couldn't be read completely"))
+		return
+	}
+
+	// Chunks of the same upload are appended one at a time, its row stays
+	// locked until the chunk is stored. Another request may have appended
+	// a chunk or finished the upload in the meantime.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(lockForUpdate).First(upload, "id = ?", upload.ID).Error; err != nil {
+			return &uploadError{http.StatusNotFound, "The upload doesn't exist anymore"}
+		}
+
+		if chunk < upload.ReceivedChunks {
+			return nil
+		} else if chunk > upload.ReceivedChunks {
+			return &uploadError{http.StatusConflict, fmt.Sprintf("Expected chunk %d", upload.ReceivedChunks)}
+		}
+
+		if len(data) == 0 || upload.ReceivedBytes+int64(len(data)) > upload.Size {
+			return &uploadError{http.StatusBadRequest, "The chunk doesn't fit the size of the file"}
+		}
+
+		file, err := os.OpenFile(chunkedUploadPath(upload), os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// Drop anything written by a failed earlier attempt
+		if err := file.Truncate(upload.ReceivedBytes); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(data, upload.ReceivedBytes); err != nil {
+			return err
+		}
+
+		upload.ReceivedChunks++
+		upload.ReceivedBytes += int64(len(data))
+		return tx.Save(upload).Error
+	})
+
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		abortWithError(c, uploadErr.status, err)
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+	} else {
+		c.JSON(http.StatusOK, upload)
+	}
+}
+
+// Create the recording from a completely received chunked upload
+func finishChunkedUpload(c *gin.Context) {
+	upload := getChunkedUpload(c)
+	if upload == nil {
+		return
+	}
+
+	// The upload is taken over by deleting its row, so that no chunk is
+	// appended and no other request finishes it in the meantime
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(lockForUpdate).First(upload, "id = ?", upload.ID).Error; err != nil {
+			return &uploadError{http.StatusNotFound, "The upload doesn't exist anymore"}
+		}
+
+		if upload.ReceivedBytes != upload.Size {
+			return &uploadError{http.StatusConflict, fmt.Sprintf("Received %d of %d bytes", upload.ReceivedBytes, upload.Size)}
+		}
+
+		return tx.Delete(upload).Error
+	})
+
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		abortWithError(c, uploadErr.status, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	options := uploadOptions{
+		userID:      upload.UserID,
+		title:       upload.Title,
+		language:    upload.Language,
+		normalize:   upload.Normalize,
+		deleteAfter: retentionDeadline(upload.Retention),
+		maxBytes:    int64(helper.GetConfigInt("MAX_UPLOAD_BYTES", 0)),
+		requestID:   c.GetString("request_id")}
+
+	r, err := storeLocalUpload(chunkedUploadPath(upload), upload.Filename, upload.Size, upload.Title, &options)
+
+	// The upload is done either way, a rejected file has to be sent again
+	os.Remove(chunkedUploadPath(upload))
+
+	if errors.As(err, &uploadErr) {
+		abortWithError(c, uploadErr.status, err)
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+	} else {
+		render(c, gin.H{
+			"payload": r}, "submission-successful.html")
+	}
+}
+
+// Delete a chunked upload with its partial file. The row goes first, it
+// waits for a chunk that is being appended, and no chunk comes after it.
+func removeChunkedUpload(upload *model.Upload) {
+	if err := db.Delete(upload).Error; err != nil {
+		log.Println(fmt.Sprintf("Failed to delete upload %s: %v", upload.ID, err))
+		return
+	}
+	os.Remove(chunkedUploadPath(upload))
+}
+
+// Delete the chunked uploads that haven't received a chunk for
+// UPLOAD_ABANDON_HOURS (24 by default)
+func purgeAbandonedUploads() {
+	hours := helper.GetConfigInt("UPLOAD_ABANDON_HOURS", 24)
+
+	var uploads []model.Upload
+	db.Where("updated_at < ?", time.Now().Add(-time.Duration(hours)*time.Hour)).Find(&uploads)
+
+	for u := range uploads {
+		removeChunkedUpload(&uploads[u])
+		log.Println("Removed abandoned upload", uploads[u].ID)
+	}
+}
+
+func showLoginPage(c *gin.Context) {
+	// Call the render function with the name of the template to render
+	render(c, gin.H{
+		"title":           "Login",
+		"oauth_providers": helper.OAuthProviders(),
+	}, "login.html")
+}
+
+func showDPSPage(c *gin.Context) {
+	render(c, gin.H{
+		"title": "Data protection statement",
+	}, "dps.html")
+}
+
+func hashPassword(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	return string(bytes), err
+}
+
+// Disabled users can't log in or confirm their email address again
+var errAccountDisabled = errors.New("This account has been disabled")
+
+func performLogin(c *gin.Context) {
+	// Obtain the POSTed email and password values
+	email := strings.ToLower(c.PostForm("email"))
+	password := c.PostForm("password")
+	user := findUser(email, password)
+
+	// Check if the email/password combination is valid
+	if user != nil {
+		if user.Disabled {
+			renderHTML(c, http.StatusForbidden, "login.html", gin.H{
+				"ErrorTitle":   "Login Failed",
+				"ErrorMessage": errAccountDisabled.Error()})
+		} else if user.Status > 0 {
+			// Typos before this login don't count against the next ones
+			loginEmailLimiter.Reset(email)
+
+			remember, _ := strconv.ParseBool(c.PostForm("remember"))
+			if user.TOTPEnabled {
+				startTwoFactorLogin(c, user.ID, remember)
+				return
+			}
+
+			// If the email/password is valid, save the user to session
+			completeLogin(c, user.ID, remember)
+		} else {
+			renderHTML(c, http.StatusBadRequest, "login.html", gin.H{
+				"ErrorTitle":   "Login Failed",
+				"ErrorMessage": "Please check your mailbox and click the confirmation link",
+				"resend":       true})
+		}
+	} else {
+		// If the email/password combination is invalid,
+		// show the error message on the login page
+		renderHTML(c, http.StatusBadRequest, "login.html", gin.H{
+			"ErrorTitle":   "Login Failed",
+			"ErrorMessage": "Invalid credentials provided"})
+	}
+}
+
+// Start the session of the user whose credentials were checked and show
+// the index page
+func completeLogin(c *gin.Context, userID uint, remember bool) {
+	if err := startSession(c, userID, remember); err == errTooManySessions {
+		renderHTML(c, http.StatusForbidden, "login.html", gin.H{
+			"ErrorTitle":   "Login Failed",
+			"ErrorMessage": err.Error()})
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// The failed logins only count until the user gets past every factor
+	db.Model(&model.User{}).Where("id = ? AND (failed_login_count > 0 OR locked_until IS NOT NULL)", userID).
+		Updates(map[string]interface{}{"failed_login_count": 0, "locked_until": nil})
+
+	// and mark this in context
+	c.Set("is_logged_in", true)
+	loginsTotal.Inc()
+
+	showIndexPage(c)
+}
+
+func oauthRedirectURI(provider *helper.OAuthProvider) string {
+	return fmt.Sprintf("%s/u/oauth/%s/callback", helper.GetConfig("URL_BASE"), provider.Name)
+}
+
+// Pages of users without a password, who log in with OAuth, that ask
+// them to log in at their provider again to confirm a change of the
+// account, instead of asking for the password
+var reauthPages = map[string]bool{"/u/account": true, "/u/2fa": true}
+
+// How long a new login at the provider confirms a change of the account
+const reauthTimeout = 5 * time.Minute
+
+// Send the user to the login page of the OAuth provider. The state in
+// the session cookie ties the callback to this browser. Logged in users
+// come back to the page of ?next= once they are confirmed.
+func startOAuthLogin(c *gin.Context) {
+	provider, ok := helper.GetOAuthProvider(c.Param("provider"))
+	if !ok {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	state, err := uuid.NewRandom()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set("oauth_state", state.String())
+	if c.GetBool("is_logged_in") {
+		if !reauthPages[c.Query("next")] {
+			abortWithStatus(c, http.StatusBadRequest)
+			return
+		}
+		session.Set("oauth_reauth", c.Query("next"))
+	}
+	if err := session.Save(); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, provider.AuthCodeURL(state.String(), oauthRedirectURI(provider)))
+}
+
+// Find the user of the OAuth account. An account that isn't linked yet
+// is linked to the user with the same email address, or a new confirmed
+// user without a password is registered for it.
+func findOAuthUser(provider string, account *helper.OAuthUser) (*model.User, error) {
+	var user model.User
+	db.Where(&model.User{OAuthProvider: provider, OAuthSubject: account.Subject}).First(&user)
+	if user.Disabled {
+		return nil, errAccountDisabled
+	} else if user.ID != 0 {
+		return &user, nil
+	}
+
+	email := strings.ToLower(account.Email)
+	db.Where(&model.User{Email: email}).First(&user)
+
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+
+	if user.ID == 0 {
+		if message := registrationDisabledMessage(); message != "" {
+			return nil, errors.New(message)
+		}
+
+		user = model.User{
+			Email:         email,
+			Status:        1,
+			OAuthProvider: provider,
+			OAuthSubject:  account.Subject}
+		if err := db.Create(&user).Error; err != nil {
+			log.Println("Failed to create the user of an OAuth login:", err)
+			return nil, errors.New("The account could not be created, please try again")
+		}
+
+		registrationsTotal.Inc()
+		return &user, nil
+	}
+
+	if user.OAuthSubject != "" {
+		return nil, fmt.Errorf("The account %s is linked to another %s account", email, user.OAuthProvider)
+	}
+
+	// The provider has verified the address, which confirms a pending
+	// registration as well. Whoever registered it may not own the
+	// address though, so their password and sessions don't carry over.
+	updates := map[string]interface{}{"o_auth_provider": provider, "o_auth_subject": account.Subject}
+	if user.Status == 0 {
+		updates["status"] = 1
+		updates["token"] = ""
+		updates["password"] = ""
+		if err := db.Unscoped().Where(&model.Session{UserID: user.ID}).Delete(&model.Session{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Log in the user that the OAuth provider sent back, like performLogin
+// does after checking the password, or confirm the identity of the user
+// that is logged in already
+func finishOAuthLogin(c *gin.Context) {
+	provider, ok := helper.GetOAuthProvider(c.Param("provider"))
+	if !ok {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	fail := func(status int, message string) {
+		renderHTML(c, status, "login.html", gin.H{
+			"title":           "Login",
+			"oauth_providers": helper.OAuthProviders(),
+			"ErrorTitle":      "Login Failed",
+			"ErrorMessage":    message})
+	}
+
+	session := sessions.Default(c)
+	state, _ := session.Get("oauth_state").(string)
+	next, reauth := session.Get("oauth_reauth").(string)
+	session.Delete("oauth_state")
+	session.Delete("oauth_reauth")
+	session.Save()
+
+	if c.GetBool("is_logged_in") && !reauth {
+		abortWithStatus(c, http.StatusUnauthorized)
+		return
+	}
+
+	if state == "" || c.Query("state") != state || reauth && !c.GetBool("is_logged_in") {
+		fail(http.StatusBadRequest, "The login has expired, please try again")
+		return
+	}
+
+	if c.Query("error") != "" {
+		fail(http.StatusForbidden, "The login was cancelled")
+		return
+	}
+
+	account, err := provider.FetchUser(c.Query("code"), oauthRedirectURI(provider))
+	if err != nil {
+		log.Println("OAuth login failed:", err)
+		fail(http.StatusBadGateway, "The login provider could not be reached")
+		return
+	}
+
+	if !account.EmailVerified {
+		fail(http.StatusForbidden, "The email address of the account is not verified")
+		return
+	}
+
+	if reauth {
+		var user model.User
+		db.Where(&model.User{OAuthProvider: provider.Name, OAuthSubject: account.Subject}).First(&user)
+		if user.ID == 0 || user.ID != session.Get("user_id").(uint) {
+			abortWithError(c, http.StatusForbidden, errors.New("The account at the provider is not linked to this one"))
+			return
+		}
+
+		session.Set("reauth_at", time.Now().Unix())
+		if err := session.Save(); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, next)
+		return
+	}
+
+	user, err := findOAuthUser(provider.Name, account)
+	if err != nil {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		fail(http.StatusForbidden, fmt.Sprintf("Too many failed logins, the account is locked until %s", user.LockedUntil.Format("15:04")))
+		return
+	}
+
+	if user.TOTPEnabled {
+		startTwoFactorLogin(c, user.ID, false)
+		return
+	}
+
+	completeLogin(c, user.ID, false)
+}
+
+// How long the code of the authenticator app may be entered after the
+// password was checked
+const twoFactorLoginTimeout = 5 * time.Minute
+
+// Remember in the session cookie that the password of the user was right
+// and ask for the code of the authenticator app. The user isn't logged in
+// until the code is checked.
+func startTwoFactorLogin(c *gin.Context, userID uint, remember bool) {
+	session := sessions.Default(c)
+	session.Set("pending_user_id", userID)
+	session.Set("pending_remember", remember)
+	session.Set("pending_expires", time.Now().Add(twoFactorLoginTimeout).Unix())
+	if err := session.Save(); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title": "Login"}, "login-code.html")
+}
+
+func clearTwoFactorLogin(session sessions.Session) {
+	session.Delete("pending_user_id")
+	session.Delete("pending_remember")
+	session.Delete("pending_expires")
+}
+
+// Log in the user whose password was checked by performLogin if the code
+// of the authenticator app or one of the recovery codes is right
+func performTwoFactorLogin(c *gin.Context) {
+	session := sessions.Default(c)
+	userID, ok := session.Get("pending_user_id").(uint)
+	expires, _ := session.Get("pending_expires").(int64)
+	if !ok || time.Now().Unix() > expires {
+		clearTwoFactorLogin(session)
+		session.Save()
+		renderHTML(c, http.StatusBadRequest, "login.html", gin.H{
+			"ErrorTitle":   "Login Failed",
+			"ErrorMessage": "The login has expired, please enter your password again"})
+		return
+	}
+	remember, _ := session.Get("pending_remember").(bool)
+
+	var user model.User
+	if err := db.First(&user, userID).Error; err != nil || !user.TOTPEnabled || user.Disabled {
+		clearTwoFactorLogin(session)
+		session.Save()
+		abortWithStatus(c, http.StatusBadRequest)
+		return
+	}
+
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		clearTwoFactorLogin(session)
+		session.Save()
+		renderHTML(c, http.StatusForbidden, "login.html", gin.H{
+			"ErrorTitle":   "Login Failed",
+			"ErrorMessage": fmt.Sprintf("Too many failed logins, the account is locked until %s", user.LockedUntil.Format("15:04"))})
+		return
+	}
+
+	code := strings.TrimSpace(c.PostForm("code"))
+	if step, ok := helper.VerifyTOTP(user.TOTPSecret, code, user.TOTPLastStep); ok {
+		db.Model(&user).Update("totp_last_step", step)
+	} else if remaining, ok := helper.UseRecoveryCode(user.RecoveryCodes, code); ok {
+		db.Model(&user).Update("recovery_codes", remaining)
+		log.Println(fmt.Sprintf("User %d logged in with a recovery code", user.ID))
+	} else {
+		recordFailedLogin(&user)
+		renderHTML(c, http.StatusBadRequest, "login-code.html", gin.H{
+			"title":        "Login",
+			"ErrorTitle":   "Login Failed",
+			"ErrorMessage": "The code is wrong"})
+		return
+	}
+
+	clearTwoFactorLogin(session)
+	completeLogin(c, user.ID, remember)
+}
+
+var errTooManySessions = errors.New("Too many active sessions, please log out on another device first")
+
+// Make room for a new session of the user if MAX_SESSIONS is set, either
+// by rejecting the login or by evicting the oldest sessions, depending
+// on SESSION_LIMIT_POLICY
+func enforceSessionLimit(userID uint) error {
+	maxSessions := helper.GetConfigInt("MAX_SESSIONS", 0)
+	if maxSessions <= 0 {
+		return nil
+	}
+
+	var userSessions []model.Session
+	db.Where(&model.Session{UserID: userID}).Where("expires_at > ?", time.Now()).Order("created_at asc").Find(&userSessions)
+
+	excess := len(userSessions) - maxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+
+	if helper.GetConfig("SESSION_LIMIT_POLICY") == "reject" {
+		return errTooManySessions
+	}
+
+	for _, s := range userSessions[:excess] {
+		if err := db.Unscoped().Delete(&s).Error; err != nil {
+			return err
+		}
+
+		if helper.GetConfigBool("SESSION_EVICTION_EMAIL") {
+			var user model.User
+			db.First(&user, userID)
+
+			body := fmt.Sprintf("You were logged out on the device %s (last seen %s from %s), because you logged in on another device.",
+				html.EscapeString(s.UserAgent), s.LastSeen.Format("2006-01-02 15:04"), s.IP)
+			if err := helper.SendEmail(user.Email, "Session Ended", body); err != nil {
+				log.Println("Failed to send email", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Create a server-side session record for the user and save its key
+// together with the user ID in the session cookie
+func startSession(c *gin.Context, userID uint, remember bool) error {
+	if err := enforceSessionLimit(userID); err != nil {
+		return err
+	}
+
+	key, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(sessionLifetime())
+	s := model.Session{
+		UserID:    userID,
+		Key:       key.String(),
+		UserAgent: c.Request.UserAgent(),
+		IP:        clientIP(c),
+		LastSeen:  time.Now(),
+		ExpiresAt: &expires}
+
+	if err := db.Create(&s).Error; err != nil {
+		return err
+	}
+
+	session := sessions.Default(c)
+	session.Set("user_id", userID)
+	session.Set("session_key", s.Key)
+	session.Set("remember", remember)
+	session.Options(sessionOptions(remember))
+	return session.Save()
+}
+
+// How long a session lasts on the server, SESSION_MAX_AGE seconds (30
+// days by default), whether the cookie is remembered or not
+func sessionLifetime() time.Duration {
+	return time.Duration(helper.GetConfigInt("SESSION_MAX_AGE", 30*24*60*60)) * time.Second
+}
+
+// Delete the sessions that have expired
+func purgeExpiredSessions() {
+	if err := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&model.Session{}).Error; err != nil {
+		log.Println("Failed to delete the expired sessions:", err)
+	}
+}
+
+// Options of the session cookie. A remembered cookie expires after
+// SESSION_MAX_AGE seconds (30 days by default), otherwise when the browser
+// is closed. The cookie isn't readable by scripts, isn't sent along with
+// cross-site POST requests and, with FORCE_HTTPS or SESSION_SECURE, isn't
+// sent over plain HTTP.
+func sessionOptions(remember bool) sessions.Options {
+	maxAge := 0
+	if remember {
+		maxAge = int(sessionLifetime().Seconds())
+	}
+
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   helper.GetConfigBool("FORCE_HTTPS") || helper.GetConfigBool("SESSION_SECURE"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode}
+}
+
+// Remove the user from the session cookie
+func clearSession(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Delete("user_id")
+	session.Delete("session_key")
+	session.Delete("impersonator_id")
+	session.Delete("impersonation_expires")
+	session.Delete("last_activity")
+	session.Delete("csrf_token")
+	session.Delete("remember")
+	clearTwoFactorLogin(session)
+	session.Save()
+}
+
+func logout(c *gin.Context) {
+	// Remove the server-side session and clear the cookie
+	if sessionID, ok := c.Get("session_id"); ok {
+		db.Unscoped().Delete(&model.Session{}, sessionID)
+	}
+	clearSession(c)
+
+	// Redirect to the home page
+	c.Redirect(http.StatusTemporaryRedirect, "/")
+}
+
+// Return the message to show instead of the registration form if
+// REGISTRATION_MODE is set to "disabled", or an empty string
+func registrationDisabledMessage() string {
+	if helper.GetConfig("REGISTRATION_MODE") != "disabled" {
+		return ""
+	}
+
+	if message := helper.GetConfig("REGISTRATION_DISABLED_MESSAGE"); message != "" {
+		return message
+	}
+
+	return "Registration is currently closed."
+}
+
+func showRegistrationPage(c *gin.Context) {
+	// Call the render function with the name of the template to render
+	render(c, gin.H{
+		"title":                 "Register",
+		"registration_disabled": registrationDisabledMessage()}, "register.html")
+}
+
+func register(c *gin.Context) {
+	// Obtain the POSTed email and password values
+	email := strings.ToLower(c.PostForm("email"))
+	password := c.PostForm("password")
+
+	if message := registrationDisabledMessage(); message != "" {
+		renderHTML(c, http.StatusForbidden, "register.html", gin.H{
+			"registration_disabled": message})
+		return
+	}
+
+	if helper.IsDisposableEmail(email) {
+		renderHTML(c, http.StatusBadRequest, "register.html", gin.H{
+			"ErrorTitle":   "Registration Failed",
+			"ErrorMessage": "Please use a permanent email address"})
+		return
+	}
+
+	if _, err := registerNewUser(email, password); err == nil {
+		registrationsTotal.Inc()
+		render(c, gin.H{}, "register-successful.html")
+	} else {
+		// If the email/password combination is invalid,
+		// show the error message on the login page
+		renderHTML(c, http.StatusBadRequest, "register.html", gin.H{
+			"ErrorTitle":   "Registration Failed",
+			"ErrorMessage": err.Error()})
+
+	}
+}
+
+// RecordingList is a page of the recordings of a user with the quota
+type RecordingList struct {
+	XMLName        xml.Name          `xml:"recordings" json:"-"`
+	Recordings     []model.Recording `xml:"recording" json:"recordings"`
+	Page           int               `xml:"page,attr" json:"page"`
+	PerPage        int               `xml:"per_page,attr" json:"per_page"`
+	Pages          int               `xml:"pages,attr" json:"pages"`
+	Total          int64             `xml:"total,attr" json:"total"`
+	PrevPage       int               `xml:"prev_page,attr,omitempty" json:"prev_page,omitempty"`
+	NextPage       int               `xml:"next_page,attr,omitempty" json:"next_page,omitempty"`
+	HasNext        bool              `xml:"has_next,attr" json:"has_next"`
+	QuotaBytes     int64             `xml:"quota_bytes,attr" json:"quota_bytes"`
+	RemainingBytes int64             `xml:"remaining_bytes,attr" json:"remaining_bytes"`
+	Filters        RecordingFilters  `xml:"filters" json:"filters"`
+	// The filters as query parameters, for links to other pages
+	FilterQuery template.URL `xml:"-" json:"-"`
+}
+
+// RecordingFilters are the active filters and the order of the
+// recordings list
+type RecordingFilters struct {
+	Query    string `xml:"q,omitempty" json:"q"`
+	Language string `xml:"language,omitempty" json:"language"`
+	Status   string `xml:"status,omitempty" json:"status"`
+	Tag      string `xml:"tag,omitempty" json:"tag"`
+	Sort     string `xml:"sort,omitempty" json:"sort"`
+	Order    string `xml:"order,omitempty" json:"order"`
+}
+
+// Columns that the recordings list can be sorted by, with their default
+// order. Only these are put into the query.
+var sortColumns = map[string]string{
+	"created_at": "desc",
+	"updated_at": "desc",
+	"title":      "asc",
+	"duration":   "desc",
+	"status":     "asc",
+}
+
+// Names and labels of the columns to sort the recordings list by
+var sortLabels = [][2]string{
+	{"created_at", "Upload date"},
+	{"updated_at", "Last change"},
+	{"title", "Title"},
+	{"duration", "Length"},
+	{"status", "Status"},
+}
+
+// Return the ORDER BY clause of the sort column and order, newest first
+// by default. Ties are broken by the ID, so that pages don't overlap.
+func (f RecordingFilters) orderBy() string {
+	return fmt.Sprintf("%s %s, id %s", f.Sort, f.Order, f.Order)
+}
+
+// Restrict the query to the recordings that match the filters: the title
+// contains the search text, ignoring case, and the language and status
+// are equal to the given ones
+func (f RecordingFilters) apply(query *gorm.DB) *gorm.DB {
+	if f.Query != "" {
+		escaper := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+		query = query.Where("title ILIKE ?", "%"+escaper.Replace(f.Query)+"%")
+	}
+	if f.Language != "" {
+		query = query.Where("language = ?", f.Language)
+	}
+	if status, ok := model.ParseStatus(f.Status); ok {
+		query = query.Where("status = ?", status)
+	}
+	if f.Tag != "" {
+		query = query.Where("id IN (SELECT recording_tags.recording_id FROM recording_tags JOIN tags ON tags.id = recording_tags.tag_id "+
+			"WHERE tags.name = ? AND tags.user_id = recordings.user_id)", f.Tag)
+	}
+	return query
+}
+
+// recordingPayload is a recording with its transcription, the fields of
+// the recording are the root element in XML
+type recordingPayload struct {
+	XMLName          xml.Name `xml:"recording" json:"-"`
+	*model.Recording `json:"recording"`
+	Utterances       []model.Utterance `xml:"utterances>utterance" json:"utterances"`
+}
+
+// Render one of HTML, JSON, XML or CSV based on the 'Accept' header of the request
+// If the header doesn't specify this, HTML is rendered, provided that
+// the template name is present
+func render(c *gin.Context, data gin.H, templateName string) {
+	switch c.Request.Header.Get("Accept") {
+	case "application/json":
+		// Respond with JSON
+		c.JSON(http.StatusOK, data["payload"])
+	case "application/xml":
+		// Respond with XML, lists need a root element
+		payload := data["payload"]
+		if recordings, ok := payload.([]model.Recording); ok {
+			payload = RecordingList{Recordings: recordings}
+		}
+		c.XML(http.StatusOK, payload)
+	case "text/csv":
+		// Respond with CSV
+		renderCSV(c, data["payload"])
+	default:
+		// Respond with HTML
+		renderHTML(c, http.StatusOK, templateName, data)
+	}
+}
+
+// apiError is the body of an error response for JSON and XML clients
+type apiError struct {
+	XMLName xml.Name `xml:"error" json:"-"`
+	Message string   `xml:"message" json:"error"`
+	Status  int      `xml:"status,attr" json:"status"`
+}
+
+// Abort the request with the status and show the error in the format
+// that the client accepts, like render does for data. The details of
+// server errors are only logged, the client just gets the status text.
+// The message of a client error is shown as is, errors from elsewhere go
+// through abortWithMessage instead.
+func abortWithError(c *gin.Context, status int, err error) {
+	c.Error(err)
+
+	message := err.Error()
+	if status >= http.StatusInternalServerError {
+		message = http.StatusText(status)
+	}
+
+	renderError(c, status, message)
+}
+
+// Abort the request with the status and the message, which is shown
+// instead of the error that caused it. The cause is only logged, since its
+// text may reveal internals, e.g. of the database.
+func abortWithMessage(c *gin.Context, status int, message string, cause error) {
+	log.Println(message+":", cause)
+	c.Error(cause)
+	renderError(c, status, message)
+}
+
+// Abort the request with the status, with its text as the message
+func abortWithStatus(c *gin.Context, status int) {
+	renderError(c, status, http.StatusText(status))
+}
+
+func renderError(c *gin.Context, status int, message string) {
+	c.Abort()
+
+	// A response that has been started, e.g. a download, can't be
+	// replaced by the error anymore
+	if c.Writer.Written() {
+		return
+	}
+
+	accept := c.Request.Header.Get("Accept")
+	if c.GetBool("json_api") {
+		accept = "application/json"
+	}
+
+	switch accept {
+	case "application/json":
+		c.JSON(status, apiError{Message: message, Status: status})
+	case "application/xml":
+		c.XML(status, apiError{Message: message, Status: status})
+	case "text/csv":
+		c.String(status, message)
+	default:
+		// Routes that are served before the session is set up
+		if _, ok := c.Get("is_logged_in"); !ok {
+			c.String(status, message)
+			return
+		}
+
+		renderHTML(c, status, "error.html", gin.H{
+			"title":        http.StatusText(status),
+			"ErrorTitle":   http.StatusText(status),
+			"ErrorMessage": message})
+	}
+}
+
+// Write the recordings of the payload as CSV with a header row. Payloads
+// without recordings result in just the header, lists of users are written
+// by renderUsersCSV and other kinds of data are not available as CSV.
+func renderCSV(c *gin.Context, payload interface{}) {
+	var recordings []model.Recording
+	filename := "recordings.csv"
+
+	switch p := payload.(type) {
+	case nil:
+	case []model.Recording:
+		recordings = p
+	case RecordingList:
+		recordings = p.Recordings
+	case *model.Recording:
+		recordings = []model.Recording{*p}
+		filename = fmt.Sprintf("recording-%d.csv", p.ID)
+	case recordingPayload:
+		recordings = []model.Recording{*p.Recording}
+		filename = fmt.Sprintf("recording-%d.csv", p.ID)
+	case UserList:
+		renderUsersCSV(c, p)
+		return
+	default:
+		abortWithStatus(c, http.StatusNotAcceptable)
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "title", "language", "status", "created_at", "updated_at"})
+	for _, r := range recordings {
+		w.Write([]string{strconv.FormatUint(uint64(r.ID), 10), r.Title, r.Language,
+			r.Status.String(), r.CreatedAt.Format(time.RFC3339), r.UpdatedAt.Format(time.RFC3339)})
+	}
+	w.Flush()
+}
+
+// Write the users of the list as CSV with a header row
+func renderUsersCSV(c *gin.Context, list UserList) {
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "users.csv"}))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "email", "names", "status", "disabled", "is_admin", "created_at", "recordings"})
+	for _, u := range list.Users {
+		w.Write([]string{strconv.FormatUint(uint64(u.ID), 10), u.Email, u.Names,
+			strconv.FormatUint(uint64(u.Status), 10), strconv.FormatBool(u.Disabled), strconv.FormatBool(u.IsAdmin),
+			u.CreatedAt.Format(time.RFC3339), strconv.FormatInt(u.Recordings, 10)})
+	}
+	w.Flush()
+}
+
+// Render an HTML template with the data that every page needs:
+// the login state, the base URL and the branding
+func renderHTML(c *gin.Context, status int, templateName string, data gin.H) {
+	loggedInInterface, _ := c.Get("is_logged_in")
+	data["is_logged_in"] = loggedInInterface.(bool)
+
+	data["url_base"] = helper.GetConfig("URL_BASE")
+	data["csrf_token"] = csrfToken(c)
+
+	if expires, ok := c.Get("impersonation_expires"); ok {
+		var user model.User
+		db.First(&user, sessions.Default(c).Get("user_id"))
+		data["impersonating"] = user.Email
+		data["impersonation_expires"] = expires
+	}
+
+	for key, value := range helper.Brand() {
+		data[key] = value
+	}
+
+	c.HTML(status, templateName, data)
+}
+
+var errAuthenticationRequired = errors.New("Authentication required")
+
+// This middleware ensures that a request will be aborted with an error
+// if the user is not logged in
+func ensureLoggedIn() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// If there's an error or if the token is empty
+		// the user is not logged in
+		loggedInInterface, _ := c.Get("is_logged_in")
+		loggedIn := loggedInInterface.(bool)
+		if !loggedIn {
+			// Browsers are shown the login form, other clients the error
+			if strings.Contains(c.GetHeader("Accept"), "text/html") {
+				c.Abort()
+				renderHTML(c, http.StatusUnauthorized, "login.html", gin.H{
+					"title":           "Login",
+					"oauth_providers": helper.OAuthProviders()})
+				return
+			}
+
+			abortWithError(c, http.StatusUnauthorized, errAuthenticationRequired)
+		}
+	}
+}
+
+// This middleware ensures that a request will be aborted with an error
+// if the user is already logged in
+func ensureNotLoggedIn() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// If there's no error or if the token is not empty
+		// the user is already logged in
+		loggedInInterface, _ := c.Get("is_logged_in")
+		loggedIn := loggedInInterface.(bool)
+		if loggedIn {
+			abortWithStatus(c, http.StatusUnauthorized)
+		}
+	}
+}
+
+// This middleware redirects plain HTTP requests to HTTPS when FORCE_HTTPS
+// is enabled and sets the HSTS header on HTTPS responses when HSTS_MAX_AGE
+// is positive. The scheme is taken from the X-Forwarded-Proto header set
+// by the TLS-terminating proxy.
+func enforceHTTPS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+
+		// Health checks and ACME challenges must keep working over HTTP
+		if path == "/healthz" || path == "/readyz" || strings.HasPrefix(path, "/.well-known/acme-challenge/") {
+			return
+		}
+
+		proto := c.GetHeader("X-Forwarded-Proto")
+		if proto == "" && c.Request.TLS != nil {
+			proto = "https"
+		}
+
+		if proto == "http" && helper.GetConfigBool("FORCE_HTTPS") {
+			c.Redirect(http.StatusMovedPermanently, "https://"+c.Request.Host+c.Request.URL.RequestURI())
+			c.Abort()
+			return
+		}
+
+		if maxAge := helper.GetConfigInt("HSTS_MAX_AGE", 0); proto == "https" && maxAge > 0 {
+			hsts := fmt.Sprintf("max-age=%d", maxAge)
+			if helper.GetConfigBool("HSTS_INCLUDE_SUBDOMAINS") {
+				hsts += "; includeSubDomains"
+			}
+			c.Header("Strict-Transport-Security", hsts)
+		}
+	}
+}
+
+// This middleware hides the profiling endpoints unless PPROF_ENABLED is
+// set, and only lets through clients whose IP is in PPROF_ALLOWED_IPS
+// (comma-separated, localhost if not set)
+func ensureProfilingAllowed() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !helper.GetConfigBool("PPROF_ENABLED") {
+			abortWithStatus(c, http.StatusNotFound)
+			return
+		}
+
+		allowed := helper.GetConfig("PPROF_ALLOWED_IPS")
+		if allowed == "" {
+			allowed = "127.0.0.1,::1"
+		}
+
+		client := clientIP(c)
+		for _, ip := range strings.Split(allowed, ",") {
+			if strings.TrimSpace(ip) == client {
+				return
+			}
+		}
+
+		abortWithStatus(c, http.StatusForbidden)
+	}
+}
+
+// Serve a profile of net/http/pprof. The router doesn't allow static
+// routes next to the parameter, so the special ones are dispatched here.
+func showProfile(c *gin.Context) {
+	switch profile := c.Param("profile"); profile {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Handler(profile).ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// Content types that are not compressed by default, because they are
+// compressed already or streamed
+const defaultCompressionExclusions = "audio/,video/,image/,application/zip,application/gzip,application/pdf," +
+	"application/vnd.openxmlformats-officedocument,text/event-stream"
+
+// compressWriter holds back the start of the response until it is known
+// whether it reaches the minimum size for compression
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding   string
+	minSize    int
+	buf        []byte
+	headerNow  bool
+	decided    bool
+	compressor compressor
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	if w.decided {
+		w.ResponseWriter.WriteHeaderNow()
+	} else {
+		w.headerNow = true
+	}
+}
+
+func (w *compressWriter) Written() bool {
+	return w.headerNow || len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) >= w.minSize {
+			if err := w.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flushing, as streams do, ends the holding back
+func (w *compressWriter) Flush() {
+	w.decide(len(w.buf) >= w.minSize)
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Decide whether the response is compressed and write out what was held back
+func (w *compressWriter) decide(compress bool) error {
+	if w.decided {
+		return nil
+	}
+	w.decided = true
+
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" && compressibleType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+
+		if w.encoding == "gzip" {
+			w.compressor = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.compressor = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	if len(w.buf) == 0 {
+		if w.headerNow {
+			w.ResponseWriter.WriteHeaderNow()
+		}
+		return nil
+	}
+
+	buf := w.buf
+	w.buf = nil
+
+	if w.compressor != nil {
+		_, err := w.compressor.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Write out the rest of the response
+func (w *compressWriter) finish() {
+	w.decide(len(w.buf) >= w.minSize)
+	if w.compressor != nil {
+		w.compressor.Close()
+	}
+}
+
+// Check whether the content type is not excluded from compression by
+// COMPRESSION_EXCLUDED_TYPES, a comma-separated list of prefixes
+func compressibleType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+
+	exclusions := helper.GetConfig("COMPRESSION_EXCLUDED_TYPES")
+	if exclusions == "" {
+		exclusions = defaultCompressionExclusions
+	}
+
+	for _, prefix := range strings.Split(exclusions, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Pick gzip or deflate from the Accept-Encoding header, preferring gzip
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		accepted[encoding] = true
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if value, err := strconv.ParseFloat(q[2:], 64); err == nil && value == 0 {
+					accepted[encoding] = false
+				}
+			}
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// This middleware compresses responses of at least COMPRESSION_MIN_BYTES
+// with gzip or deflate if COMPRESSION_ENABLED is set and the client
+// accepts it. Smaller responses and excluded content types are sent as
+// they are.
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !helper.GetConfigBool("COMPRESSION_ENABLED") || c.Request.Method == http.MethodHead {
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := acceptedEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" {
+			return
+		}
+
+		w := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       encoding,
+			minSize:        helper.GetConfigInt("COMPRESSION_MIN_BYTES", 1024)}
+		c.Writer = w
+
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// Routes that may take longer than the request timeout, like streams,
+// uploads and audio files, keyed by the method and the full path
+var untimedRoutes = map[string]bool{}
+
+// Register a long-running route on the group, which requestTimeout
+// leaves without a deadline
+func untimed(group *gin.RouterGroup, method, path string, handlers ...gin.HandlerFunc) {
+	untimedRoutes[method+" "+group.BasePath()+path] = true
+	group.Handle(method, path, handlers...)
+}
+
+// This middleware sets a deadline on the request context, which handlers
+// pass on to their database queries. If a handler gives up because the
+// deadline was exceeded without writing a response, 503 is returned.
+// Routes registered with untimed are exempt.
+func requestTimeout(seconds int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if seconds <= 0 || untimedRoutes[c.Request.Method+" "+c.FullPath()] {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(seconds)*time.Second)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if ctx.Err() == context.DeadlineExceeded && !c.Writer.Written() {
+			abortWithError(c, http.StatusServiceUnavailable, errors.New("The request took too long"))
+		}
+	}
+}
+
+// This middleware gives every request an ID, which is sent back in the
+// X-Request-ID header, and logs the request as JSON once it is handled.
+// A UUID set by a proxy in front of the application is kept.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if _, err := uuid.Parse(requestID); err != nil {
+			requestID = uuid.New().String()
+		}
+		c.Set("request_id", requestID)
+		c.Header("X-Request-ID", requestID)
+
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := "info"
+		if status >= http.StatusInternalServerError {
+			level = "error"
+		} else if status >= http.StatusBadRequest {
+			level = "warn"
+		} else if c.FullPath() == "/healthz" || c.FullPath() == "/readyz" || c.FullPath() == "/metrics" {
+			// Probes and scrapes would drown the other requests
+			level = "debug"
+		}
+
+		fields := map[string]interface{}{
+			"request_id": requestID,
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  clientIP(c)}
+		// Routes registered before the session middleware have no session
+		if _, ok := c.Get(sessions.DefaultKey); ok {
+			if userID := sessions.Default(c).Get("user_id"); userID != nil {
+				fields["user_id"] = userID
+			}
+		}
+		if len(c.Errors) > 0 {
+			fields["errors"] = c.Errors.String()
+		}
+
+		helper.LogJSON(level, "request", fields)
+	}
+}
+
+// Return the entries of a comma-separated config value, or of the
+// fallback if it is not set
+func configList(key, fallback string) []string {
+	value := helper.GetConfig(key)
+	if value == "" {
+		value = fallback
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// This middleware makes errors JSON, whatever the client accepts, for
+// routes that don't answer with anything else
+func jsonAPI() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("json_api", true)
+	}
+}
+
+// This middleware lets pages on the origins in CORS_ALLOWED_ORIGINS
+// (comma-separated, "*" for any) call the routes, and answers the
+// preflight requests of browsers. Without CORS_ALLOWED_ORIGINS no
+// headers are sent, so only the same origin can call the routes. With
+// CORS_ALLOW_CREDENTIALS the session cookie is sent along, which is
+// never allowed for "*".
+func cors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+
+		wildcard := false
+		allowed := false
+		for _, o := range configList("CORS_ALLOWED_ORIGINS", "") {
+			if o == "*" {
+				wildcard = true
+			} else if strings.EqualFold(o, origin) {
+				allowed = true
+			}
+		}
+
+		if allowed {
+			c.Header("Access-Control-Allow-Origin", origin)
+			if helper.GetConfigBool("CORS_ALLOW_CREDENTIALS") {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+		} else if wildcard {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", "X-Request-ID, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", strings.Join(configList("CORS_ALLOWED_METHODS", "GET,POST,PUT,DELETE"), ", "))
+			c.Header("Access-Control-Allow-Headers", strings.Join(
+				configList("CORS_ALLOWED_HEADERS", "Authorization,Content-Type,X-CSRF-Token,X-Request-ID"), ", "))
+			c.Header("Access-Control-Max-Age", strconv.Itoa(helper.GetConfigInt("CORS_MAX_AGE_SECONDS", 600)))
+			c.AbortWithStatus(http.StatusNoContent)
+		}
+	}
+}
+
+// Counts the API requests per client
+var apiRequests = helper.NewWindowCounter(time.Minute)
+
+// This middleware ensures that API requests are authenticated and
+// limited by limitAPIRequests.
+func ensureAPIAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loggedInInterface, _ := c.Get("is_logged_in")
+		if !loggedInInterface.(bool) {
+			abortWithError(c, http.StatusUnauthorized, errAuthenticationRequired)
+			return
+		}
+
+		session := sessions.Default(c)
+		userID := session.Get("user_id").(uint)
+
+		// Requests with an API key have been counted by setAPIKeyUser
+		if c.GetBool("api_key") {
+			return
+		}
+
+		var user model.User
+		db.First(&user, userID)
+
+		limitAPIRequests(c, &user)
+	}
+}
+
+// Limit the API requests of the user to API_RATE_LIMIT per minute, unless
+// the user has a limit of their own. Requests with an API key are counted
+// by the key, those with a session by the user. The limit and the state
+// of the current window are reported in the X-RateLimit headers. Returns
+// false, after aborting with 429, once the limit is exceeded.
+func limitAPIRequests(c *gin.Context, user *model.User) bool {
+	limit := helper.GetConfigInt("API_RATE_LIMIT", 60)
+	if user.APIRateLimit > 0 {
+		limit = int(user.APIRateLimit)
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	// The key is stored hashed, so it doesn't end up in memory in clear
+	key := fmt.Sprintf("user:%d", user.ID)
+	if c.GetBool("api_key") {
+		key = "token:" + user.APIKey
+	}
+
+	allowed, remaining, reset := apiRequests.Hit(key, limit)
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+		abortWithError(c, http.StatusTooManyRequests, errors.New("Rate limit exceeded"))
+	}
+
+	return allowed
+}
+
+// This middleware sets whether the user is logged in or not
+func setUserStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		userID := session.Get("user_id")
+
+		if userID == nil {
+			c.Set("is_logged_in", false)
+			return
+		}
+
+		// Without "remember me" the cookie ends with the browser session.
+		// Sessions from before the choice existed are remembered.
+		remember, ok := session.Get("remember").(bool)
+		session.Options(sessionOptions(remember || !ok))
+
+		// While an administrator impersonates a user, the server-side
+		// session is the one of the administrator
+		owner := userID.(uint)
+		impersonatorID, impersonating := session.Get("impersonator_id").(uint)
+		if impersonating {
+			owner = impersonatorID
+		}
+
+		// The session is only valid as long as its server-side record
+		// exists, so that it can be revoked from another device, hasn't
+		// expired and its user isn't disabled
+		var s model.Session
+		if key, ok := session.Get("session_key").(string); ok {
+			db.Where(&model.Session{Key: key}).Where("expires_at > ?", time.Now()).
+				Not("user_id IN (SELECT id FROM users WHERE disabled)").First(&s)
+		}
+
+		if s.ID == 0 || s.UserID != owner {
+			clearSession(c)
+			c.Set("is_logged_in", false)
+			return
+		}
+
+		// Log out after SESSION_IDLE_MINUTES without requests
+		now := time.Now().Unix()
+		lastActivity, _ := session.Get("last_activity").(int64)
+		if idle := int64(helper.GetConfigInt("SESSION_IDLE_MINUTES", 0)) * 60; idle > 0 && lastActivity > 0 && now-lastActivity > idle {
+			db.Unscoped().Delete(&s)
+			clearSession(c)
+			c.Set("is_logged_in", false)
+			return
+		}
+		session.Set("last_activity", now)
+		session.Save()
+
+		if impersonating {
+			expires, _ := session.Get("impersonation_expires").(int64)
+			if time.Now().Unix() < expires {
+				c.Set("impersonator_id", impersonatorID)
+				c.Set("impersonation_expires", time.Unix(expires, 0))
+			} else {
+				endImpersonation(c, "impersonation expired")
+			}
+		}
+
+		// Don't write to the database on every single request
+		if time.Since(s.LastSeen) > time.Minute || s.IP != clientIP(c) {
+			db.Model(&s).Updates(model.Session{LastSeen: time.Now(), IP: clientIP(c)})
+		}
+
+		c.Set("session_id", s.ID)
+		c.Set("is_logged_in", true)
+	}
+}
+
+// Return the hash of an API key as stored with the user
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate requests with an "Authorization: Bearer <key>" header by
+// the API key of the user, for scripts that can't log in. The user is
+// set in the session for this request only, the session is not saved.
+// The requests are limited like those of the API. Requests without the
+// header keep the session of setUserStatus.
+func setAPIKeyUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authorization := c.GetHeader("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return
+		}
+
+		// A cookie sent along is ignored
+		session := sessions.Default(c)
+		session.Delete("impersonator_id")
+		session.Delete("impersonation_expires")
+		for _, key := range []string{"session_id", "impersonator_id", "impersonation_expires"} {
+			delete(c.Keys, key)
+		}
+
+		var user model.User
+		if key := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer ")); key != "" {
+			db.Where(&model.User{APIKey: hashAPIKey(key)}).First(&user)
+		}
+
+		if user.ID == 0 || user.Status == 0 || user.Disabled {
+			session.Delete("user_id")
+			c.Set("is_logged_in", false)
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			return
+		}
+
+		session.Set("user_id", user.ID)
+		c.Set("is_logged_in", true)
+		c.Set("api_key", true)
+
+		// Every route can be used with a key, not just those of the API
+		limitAPIRequests(c, &user)
+	}
+}
+
+// Return the CSRF token of the session, creating one if there is none yet.
+// Requests authenticated with an API key don't have a session to store it in.
+func csrfToken(c *gin.Context) string {
+	if c.GetBool("api_key") {
+		return ""
+	}
+
+	session := sessions.Default(c)
+	if token, ok := session.Get("csrf_token").(string); ok {
+		return token
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		log.Println("Failed to generate a CSRF token:", err)
+		return ""
+	}
+	token := hex.EncodeToString(random)
+
+	session.Set("csrf_token", token)
+	session.Save()
+
+	return token
+}
+
+// This middleware rejects state-changing requests that don't carry the CSRF
+// token of the session, either in the X-CSRF-Token header or in the
+// csrf_token form field. Multipart forms pass it in the query string instead,
+// so that the body isn't parsed before the upload size limit applies.
+func verifyCSRFToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+
+		// Scripts using an API key can't be tricked by another site, and
+		// the profiles are only served to the configured addresses
+		if c.GetBool("api_key") || strings.HasPrefix(c.Request.URL.Path, "/debug/pprof/") {
+			return
+		}
+
+		token := c.GetHeader("X-CSRF-Token")
+		if token == "" {
+			if strings.HasPrefix(c.ContentType(), "multipart/") {
+				token = c.Query("csrf_token")
+			} else {
+				token = c.PostForm("csrf_token")
+			}
+		}
+
+		expected, _ := sessions.Default(c).Get("csrf_token").(string)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			abortWithError(c, http.StatusForbidden, errors.New("missing or invalid CSRF token"))
+		}
+	}
+}
+
+func showAPIKeyPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	render(c, gin.H{
+		"title":   "API key",
+		"has_key": user.APIKey != ""}, "apikey.html")
+}
+
+// Generate a new API key for the user, replacing the previous one. The
+// key is shown only now, just its hash is stored.
+func generateAPIKey(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	key := hex.EncodeToString(random)
+
+	if err := db.Model(&model.User{}).Where("id = ?", userID).Update("api_key", hashAPIKey(key)).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title":   "API key",
+		"has_key": true,
+		"key":     key,
+		"payload": gin.H{"api_key": key}}, "apikey.html")
+}
+
+// The account data shown to the user, without the credentials
+func accountPayload(user *model.User) gin.H {
+	return gin.H{
+		"email":                 user.Email,
+		"names":                 user.Names,
+		"default_export_format": user.DefaultExportFormat,
+		"webhook_url":           user.WebhookURL,
+		"notify_by_email":       user.NotifyByEmail}
+}
+
+func showAccountPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	render(c, identityForm(c, &user, gin.H{
+		"title":          "Account",
+		"export_formats": exportFormats,
+		"webhook_secret": user.WebhookSecret,
+		"payload":        accountPayload(&user)}), "account.html")
+}
+
+// Update the preferences of the user
+func updateAccount(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	invalid := func(message string) {
+		renderHTML(c, http.StatusBadRequest, "account.html", identityForm(c, &user, gin.H{
+			"title":          "Account",
+			"ErrorTitle":     "Invalid preference",
+			"ErrorMessage":   message,
+			"export_formats": exportFormats,
+			"webhook_secret": user.WebhookSecret,
+			"payload":        accountPayload(&user)}))
+	}
+
+	format := c.PostForm("default_export_format")
+	if _, ok := exportHandlers[format]; format != "" && !ok {
+		invalid(fmt.Sprintf("Unsupported export format %q", format))
+		return
+	}
+
+	webhookURL := strings.TrimSpace(c.PostForm("webhook_url"))
+	if err := helper.ValidateWebhookURL(webhookURL); err != nil {
+		invalid(err.Error())
+		return
+	}
+
+	notify, err := strconv.ParseBool(c.DefaultPostForm("notify_by_email", "false"))
+	if err != nil {
+		invalid(fmt.Sprintf("Invalid email notification setting %q", c.PostForm("notify_by_email")))
+		return
+	}
+
+	// The webhook secret is generated along with the first webhook
+	updates := map[string]interface{}{"default_export_format": format, "webhook_url": webhookURL, "notify_by_email": notify}
+	if webhookURL != "" && user.WebhookSecret == "" {
+		secret, err := helper.NewWebhookSecret()
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+		updates["webhook_secret"] = secret
+	}
+
+	if err := db.Model(&user).Updates(updates).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/u/account")
+}
+
+// Check that the change of the account is asked for by the user: by the
+// password, or for users without one, who log in with OAuth, by a new
+// login at the provider within reauthTimeout, which is used up by the
+// change. Returns what is wrong, or "" if the user is confirmed.
+func confirmIdentity(c *gin.Context, user *model.User) string {
+	if user.Password != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(c.PostForm("password"))) != nil {
+			return "The password is wrong"
+		}
+		return ""
+	}
+
+	session := sessions.Default(c)
+	at, _ := session.Get("reauth_at").(int64)
+	session.Delete("reauth_at")
+	session.Save()
+
+	if time.Since(time.Unix(at, 0)) > reauthTimeout {
+		return "Please log in with your provider again to confirm"
+	}
+	return ""
+}
+
+// Add what the forms that confirm a change of the account need to the
+// template data: whether to ask for the password, or else the OAuth
+// provider to log in at again and whether that was done recently
+func identityForm(c *gin.Context, user *model.User, data gin.H) gin.H {
+	at, _ := sessions.Default(c).Get("reauth_at").(int64)
+
+	data["has_password"] = user.Password != ""
+	data["oauth_provider"] = user.OAuthProvider
+	data["reauthenticated"] = time.Since(time.Unix(at, 0)) <= reauthTimeout
+	return data
+}
+
+// Delete the account of the user after checking the password: the user,
+// their recordings with everything attached to them, sessions and glossary.
+// The rows are deleted in one transaction, the files only once it has been
+// committed, so that a failure doesn't leave recordings without an owner.
+func deleteAccount(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	if message := confirmIdentity(c, &user); message != "" {
+		renderHTML(c, http.StatusBadRequest, "account.html", identityForm(c, &user, gin.H{
+			"title":          "Account",
+			"ErrorTitle":     "Account not deleted",
+			"ErrorMessage":   message,
+			"export_formats": exportFormats,
+			"webhook_secret": user.WebhookSecret,
+			"payload":        accountPayload(&user)}))
+		return
+	}
+
+	var recordings []model.Recording
+	db.Unscoped().Where(&model.Recording{UserID: user.ID}).Find(&recordings)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for r := range recordings {
+			if err := helper.DeleteRecordingRows(tx, &recordings[r]); err != nil {
+				return err
+			}
+		}
+
+		for _, table := range []interface{}{&model.Comment{}, &model.GlossaryRule{}, &model.Session{}, &model.Tag{}} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(table).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	for r := range recordings {
+		if err := helper.DeleteRecordingFiles(&recordings[r]); err != nil {
+			log.Println(fmt.Sprintf("Failed to delete the files of recording %d: %v", recordings[r].ID, err))
+		}
+	}
+
+	log.Println("Deleted the account of user", user.ID)
+
+	clearSession(c)
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// Return an error message if the new password is not acceptable
+func checkNewPassword(password string) string {
+	if minLength := helper.GetConfigInt("MIN_PASSWORD_LENGTH", 8); len([]rune(password)) < minLength {
+		return fmt.Sprintf("The new password must be at least %d characters long", minLength)
+	}
+	return ""
+}
+
+func showPasswordPage(c *gin.Context) {
+	render(c, gin.H{
+		"title": "Change password"}, "password.html")
+}
+
+// Number of recovery codes that are handed out when two-factor
+// authentication is enabled
+const recoveryCodeCount = 10
+
+func showTwoFactorPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	render(c, identityForm(c, &user, gin.H{
+		"title":   "Two-factor authentication",
+		"enabled": user.TOTPEnabled}), "two-factor.html")
+}
+
+// Generate a new secret for the authenticator app of the user. It is
+// only used for logins once a code was confirmed with enableTwoFactor.
+// The otpauth URL is marked as safe, since html/template only allows
+// http(s) and mailto links.
+func setupTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	if user.TOTPEnabled {
+		abortWithError(c, http.StatusBadRequest, errors.New("Two-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := helper.NewTOTPSecret()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title":       "Two-factor authentication",
+		"secret":      secret,
+		"otpauth_url": template.URL(helper.TOTPURL(secret, user.Email))}, "two-factor.html")
+}
+
+// Enable two-factor authentication if the code of the authenticator app
+// matches the secret from setupTwoFactor, and show the recovery codes
+func enableTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("Two-factor authentication is not being set up"))
+		return
+	}
+
+	step, ok := helper.VerifyTOTP(user.TOTPSecret, c.PostForm("code"), 0)
+	if !ok {
+		renderHTML(c, http.StatusBadRequest, "two-factor.html", gin.H{
+			"title":        "Two-factor authentication",
+			"secret":       user.TOTPSecret,
+			"otpauth_url":  template.URL(helper.TOTPURL(user.TOTPSecret, user.Email)),
+			"ErrorTitle":   "Not enabled",
+			"ErrorMessage": "The code is wrong, please check the time of your device"})
+		return
+	}
+
+	codes, hashes, err := helper.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_enabled":   true,
+		"totp_last_step": step,
+		"recovery_codes": hashes}).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title":          "Two-factor authentication",
+		"enabled":        true,
+		"recovery_codes": codes}, "two-factor.html")
+}
+
+// Disable two-factor authentication after checking the password
+func disableTwoFactor(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	if message := confirmIdentity(c, &user); message != "" {
+		renderHTML(c, http.StatusBadRequest, "two-factor.html", identityForm(c, &user, gin.H{
+			"title":        "Two-factor authentication",
+			"enabled":      user.TOTPEnabled,
+			"ErrorTitle":   "Not disabled",
+			"ErrorMessage": message}))
+		return
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+		"recovery_codes": ""}).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title":    "Two-factor authentication",
+		"disabled": true}, "two-factor.html")
+}
+
+// Change the password of the user after checking the current one.
+// The session stays valid.
+func changePassword(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	fail := func(message string) {
+		renderHTML(c, http.StatusBadRequest, "password.html", gin.H{
+			"title":        "Change password",
+			"ErrorTitle":   "Password not changed",
+			"ErrorMessage": message})
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(c.PostForm("current_password"))) != nil {
+		fail("The current password is wrong")
+		return
+	}
+
+	password := c.PostForm("password")
+	if message := checkNewPassword(password); message != "" {
+		fail(message)
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := db.Model(&user).Update("password", hash).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Whoever knew the old password may still be logged in elsewhere,
+	// only the session that changed it stays
+	others := db.Unscoped().Where(&model.Session{UserID: user.ID})
+	if sessionID, ok := c.Get("session_id"); ok {
+		others = others.Where("id <> ?", sessionID)
+	}
+	if err := others.Delete(&model.Session{}).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title": "Change password",
+		"done":  true}, "password.html")
+}
+
+// Record an action of an administrator in the audit log
+func audit(c *gin.Context, actorID, targetID uint, action, details string) {
+	entry := model.AuditLog{
+		ActorID:  actorID,
+		TargetID: targetID,
+		Action:   action,
+		Details:  details,
+		IP:       clientIP(c)}
+
+	log.Println(fmt.Sprintf("Audit: user %d, %s of user %d from %s: %s", actorID, action, targetID, entry.IP, details))
+
+	if err := db.Create(&entry).Error; err != nil {
+		log.Println("Failed to write the audit log:", err)
+	}
+}
+
+// This middleware ensures that the user is an administrator
+func ensureAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user model.User
+		db.First(&user, sessions.Default(c).Get("user_id"))
+
+		if !user.IsAdmin {
+			abortWithStatus(c, http.StatusForbidden)
+		}
+	}
+}
+
+// Act as another user for IMPERSONATION_MINUTES (30 by default). The
+// administrator keeps their server-side session and can return to their
+// own account at any time.
+func startImpersonation(c *gin.Context) {
+	session := sessions.Default(c)
+	adminID := session.Get("user_id").(uint)
+
+	targetID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	var target model.User
+	if err := db.First(&target, targetID).Error; err != nil {
+		abortWithMessage(c, http.StatusNotFound, "The user doesn't exist", err)
+		return
+	}
+
+	if target.IsAdmin {
+		abortWithError(c, http.StatusForbidden, errors.New("Administrators cannot be impersonated"))
+		return
+	}
+
+	minutes := helper.GetConfigInt("IMPERSONATION_MINUTES", 30)
+	expires := time.Now().Add(time.Duration(minutes) * time.Minute)
+
+	session.Set("user_id", target.ID)
+	session.Set("impersonator_id", adminID)
+	session.Set("impersonation_expires", expires.Unix())
+	if err := session.Save(); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit(c, adminID, target.ID, "impersonation started", fmt.Sprintf("until %s", expires.Format(time.RFC3339)))
+
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// Switch the session back to the administrator
+func endImpersonation(c *gin.Context, action string) {
+	session := sessions.Default(c)
+	adminID, ok := session.Get("impersonator_id").(uint)
+	if !ok {
+		return
+	}
+	targetID := session.Get("user_id").(uint)
+
+	session.Set("user_id", adminID)
+	session.Delete("impersonator_id")
+	session.Delete("impersonation_expires")
+	session.Save()
+
+	audit(c, adminID, targetID, action, "")
+}
+
+// Return to the account of the administrator
+func stopImpersonation(c *gin.Context) {
+	endImpersonation(c, "impersonation stopped")
+
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// adminUser is a user as listed for administrators, without the password
+// hash and the tokens
+type adminUser struct {
+	ID         uint      `xml:"id,attr" json:"id"`
+	Email      string    `xml:"email" json:"email"`
+	Names      string    `xml:"names" json:"names"`
+	Status     uint      `xml:"status,attr" json:"status"`
+	Disabled   bool      `xml:"disabled,attr" json:"disabled"`
+	IsAdmin    bool      `xml:"is_admin,attr" json:"is_admin"`
+	CreatedAt  time.Time `xml:"created_at,attr" json:"created_at"`
+	Recordings int64     `xml:"recordings,attr" json:"recordings"`
+}
+
+func newAdminUser(u *model.User, recordings int64) adminUser {
+	return adminUser{
+		ID:         u.ID,
+		Email:      u.Email,
+		Names:      u.Names,
+		Status:     u.Status,
+		Disabled:   u.Disabled,
+		IsAdmin:    u.IsAdmin,
+		CreatedAt:  u.CreatedAt,
+		Recordings: recordings}
+}
+
+// UserList is the list of all users for administrators
+type UserList struct {
+	XMLName xml.Name    `xml:"users" json:"-"`
+	Users   []adminUser `xml:"user" json:"users"`
+}
+
+// List all users with the number of their recordings, newest first
+func showUsers(c *gin.Context) {
+	var users []model.User
+	db.Order("created_at desc").Find(&users)
+
+	counts := map[uint]int64{}
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	db.Model(&model.Recording{}).Select("user_id, count(*) as count").Group("user_id").Scan(&rows)
+	for _, row := range rows {
+		counts[row.UserID] = row.Count
+	}
+
+	list := UserList{Users: []adminUser{}}
+	for u := range users {
+		list.Users = append(list.Users, newAdminUser(&users[u], counts[users[u].ID]))
+	}
+
+	render(c, gin.H{
+		"title":   "Users",
+		"self_id": sessions.Default(c).Get("user_id"),
+		"payload": list}, "admin-users.html")
+}
+
+// Return the user of the user_id parameter, or abort with 404
+func getAdminTarget(c *gin.Context) *model.User {
+	targetID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return nil
+	}
+
+	var target model.User
+	if err := db.First(&target, targetID).Error; err != nil {
+		abortWithMessage(c, http.StatusNotFound, "The user doesn't exist", err)
+		return nil
+	}
+
+	return &target
+}
+
+// Answer an administration action with the changed user for data formats,
+// browsers go back to the list of users
+func adminActionDone(c *gin.Context, target *model.User) {
+	switch c.Request.Header.Get("Accept") {
+	case "application/json", "application/xml", "text/csv":
+		var recordings int64
+		db.Model(&model.Recording{}).Where(&model.Recording{UserID: target.ID}).Count(&recordings)
+		render(c, gin.H{"payload": UserList{Users: []adminUser{newAdminUser(target, recordings)}}}, "")
+	default:
+		c.Redirect(http.StatusSeeOther, "/admin/users")
+	}
+}
+
+// Enable a disabled user, or disable an enabled one, which also ends their
+// sessions. Unconfirmed users are confirmed instead. Administrators can't
+// disable themselves.
+func toggleUserStatus(c *gin.Context) {
+	adminID := sessions.Default(c).Get("user_id").(uint)
+
+	target := getAdminTarget(c)
+	if target == nil {
+		return
+	}
+
+	if target.ID == adminID {
+		abortWithError(c, http.StatusForbidden, errors.New("Administrators cannot disable their own account"))
+		return
+	}
+
+	action := "user enabled"
+	if target.Disabled {
+		target.Disabled = false
+	} else if target.Status == 0 {
+		target.Status = 1
+		action = "user confirmed"
+	} else {
+		target.Disabled = true
+		action = "user disabled"
+	}
+
+	if err := db.Model(target).Select("Status", "Disabled").Updates(target).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if target.Disabled {
+		db.Unscoped().Where(&model.Session{UserID: target.ID}).Delete(&model.Session{})
+	}
+
+	audit(c, adminID, target.ID, action, "")
+
+	adminActionDone(c, target)
+}
+
+// Permanently delete all recordings of a user, e.g. abusive uploads
+func deleteUserRecordings(c *gin.Context) {
+	adminID := sessions.Default(c).Get("user_id").(uint)
+
+	target := getAdminTarget(c)
+	if target == nil {
+		return
+	}
+
+	var recordings []model.Recording
+	db.Where(&model.Recording{UserID: target.ID}).Find(&recordings)
+
+	for r := range recordings {
+		if err := helper.DeleteRecording(&recordings[r]); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	audit(c, adminID, target.ID, "recordings deleted", fmt.Sprintf("%d recordings", len(recordings)))
+
+	adminActionDone(c, target)
+}
+
+// This middleware logs every request made while impersonating a user and,
+// if IMPERSONATION_READ_ONLY is set, rejects the ones that change data
+func restrictImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		impersonatorID, ok := c.Get("impersonator_id")
+		if !ok || c.Request.URL.Path == "/u/impersonation/stop" {
+			return
+		}
+
+		userID := sessions.Default(c).Get("user_id").(uint)
+		request := c.Request.Method + " " + c.Request.URL.Path
+
+		changing := c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead
+
+		if !changing {
+			log.Println(fmt.Sprintf("Impersonation: user %d as user %d: %s", impersonatorID, userID, request))
+			return
+		}
+
+		if helper.GetConfigBool("IMPERSONATION_READ_ONLY") {
+			audit(c, impersonatorID.(uint), userID, "impersonated request rejected", request)
+			abortWithError(c, http.StatusForbidden, errors.New("Changes are disabled while impersonating a user"))
+			return
+		}
+
+		audit(c, impersonatorID.(uint), userID, "impersonated request", request)
+	}
+}
+
+// Show the active sessions of the user
+func showSessionsPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	var userSessions []model.Session
+	db.Where(&model.Session{UserID: userID.(uint)}).Where("expires_at > ?", time.Now()).Order("last_seen desc").Find(&userSessions)
+
+	render(c, gin.H{
+		"title":      "Sessions",
+		"session_id": sessionID,
+		"payload":    userSessions}, "sessions.html")
+}
+
+// Revoke one of the sessions of the user, which logs out the device
+// that uses it on its next request
+func revokeSession(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	id, err := strconv.ParseUint(c.Param("session_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	result := db.Unscoped().Where(&model.Session{UserID: userID.(uint)}).Delete(&model.Session{}, id)
+	if result.Error != nil {
+		abortWithError(c, http.StatusInternalServerError, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/u/sessions")
+}
+
+// Log out on all devices by deleting every server-side session of the user,
+// which invalidates their cookies, including the one of this request
+func logoutEverywhere(c *gin.Context) {
+	if _, ok := c.Get("impersonator_id"); ok {
+		abortWithError(c, http.StatusForbidden, errors.New("Cannot log out the user while impersonating them"))
+		return
+	}
+
+	userID := sessions.Default(c).Get("user_id").(uint)
+
+	if err := db.Unscoped().Where(&model.Session{UserID: userID}).Delete(&model.Session{}).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	clearSession(c)
+
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+func showGlossaryPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var rules []model.GlossaryRule
+	db.Where(&model.GlossaryRule{UserID: userID.(uint)}).Order("id asc").Find(&rules)
+
+	render(c, gin.H{
+		"title":      "Glossary",
+		"recordings": getAllRecordingsByUserID(userID.(uint)),
+		"payload":    rules}, "glossary.html")
+}
+
+// Add a correction rule to the glossary of the user, it is applied to
+// recordings transcribed from now on
+func addGlossaryRule(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	rule := model.GlossaryRule{
+		UserID:      userID.(uint),
+		Pattern:     c.PostForm("pattern"),
+		Replacement: c.PostForm("replacement"),
+		Regex:       c.PostForm("regex") == "true"}
+
+	if err := helper.ValidateGlossaryRule(&rule); err != nil {
+		var rules []model.GlossaryRule
+		db.Where(&model.GlossaryRule{UserID: userID.(uint)}).Order("id asc").Find(&rules)
+
+		renderHTML(c, http.StatusBadRequest, "glossary.html", gin.H{
+			"title":        "Glossary",
+			"ErrorTitle":   "Invalid rule",
+			"ErrorMessage": err.Error(),
+			"recordings":   getAllRecordingsByUserID(userID.(uint)),
+			"payload":      rules})
+		return
+	}
+
+	if err := db.Create(&rule).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/u/glossary")
+}
+
+func deleteGlossaryRule(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	id, err := strconv.ParseUint(c.Param("rule_id"), 10, 32)
+	if err != nil {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	result := db.Unscoped().Where(&model.GlossaryRule{UserID: userID.(uint)}).Delete(&model.GlossaryRule{}, id)
+	if result.Error != nil {
+		abortWithError(c, http.StatusInternalServerError, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		abortWithStatus(c, http.StatusNotFound)
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, "/u/glossary")
+}
+
+// Show the utterances of a transcribed recording that the current
+// glossary would change
+func previewGlossary(c *gin.Context) {
+	recording, utterances := getRecording(c)
+	if recording == nil {
+		return
+	}
+
+	glossary := helper.UserGlossary(recording.UserID)
+
+	changes := []gin.H{}
+	for u := range utterances {
+		if corrected := glossary.Apply(utterances[u].Text); corrected != utterances[u].Text {
+			changes = append(changes, gin.H{
+				"start":     utterances[u].Start,
+				"end":       utterances[u].End,
+				"text":      utterances[u].Text,
+				"corrected": corrected})
+		}
+	}
+
+	render(c, gin.H{
+		"title":     "Glossary preview",
+		"recording": recording,
+		"payload":   changes}, "glossary-preview.html")
+}
+
+// Return the page of the recordings of the user given by ?page= and
+// ?per_page=, filtered by ?q=, ?language= and ?status= and sorted by
+// ?sort= in the ?order= "asc" or "desc", newest first by default.
+// There are 20 recordings per page by default and at most MAX_PER_PAGE.
+func getRecordingsPage(c *gin.Context, userID uint) RecordingList {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", "20"))
+	if err != nil || perPage < 1 {
+		perPage = 20
+	}
+	if maxPerPage := helper.GetConfigInt("MAX_PER_PAGE", 100); perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	filters := RecordingFilters{
+		Query:    strings.TrimSpace(c.Query("q")),
+		Language: c.Query("language"),
+		Status:   c.Query("status"),
+		Tag:      strings.TrimSpace(c.Query("tag")),
+		Sort:     c.DefaultQuery("sort", "created_at"),
+		Order:    c.Query("order")}
+	if _, ok := model.ParseStatus(filters.Status); !ok {
+		filters.Status = ""
+	}
+	if _, ok := sortColumns[filters.Sort]; !ok {
+		filters.Sort = "created_at"
+	}
+	if filters.Order != "asc" && filters.Order != "desc" {
+		filters.Order = sortColumns[filters.Sort]
+	}
+
+	values := url.Values{}
+	for key, value := range map[string]string{"q": filters.Query, "language": filters.Language, "status": filters.Status,
+		"tag": filters.Tag, "sort": filters.Sort, "order": filters.Order} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	list := RecordingList{Page: page, PerPage: perPage, Filters: filters, FilterQuery: template.URL(values.Encode())}
+
+	filters.apply(db.Model(&model.Recording{}).Where(&model.Recording{UserID: userID}).Not("status IN ?", hiddenStatuses)).Count(&list.Total)
+	filters.apply(db.Where(&model.Recording{UserID: userID}).Not("status IN ?", hiddenStatuses)).
+		Order(filters.orderBy()).Offset((page - 1) * perPage).Limit(perPage).Preload("Tags").Find(&list.Recordings)
+
+	list.Pages = int((list.Total + int64(perPage) - 1) / int64(perPage))
+	if page > 1 {
+		list.PrevPage = page - 1
+	}
+	if page < list.Pages {
+		list.NextPage = page + 1
+		list.HasNext = true
+	}
+
+	return list
+}
+
+// Return a list of all recordings, newest first
+func getAllRecordingsByUserID(userID uint) []model.Recording {
+	var recordings []model.Recording
+	db.Where(&model.Recording{UserID: userID}).Not("status IN ?", hiddenStatuses).Order("created_at desc").Find(&recordings)
+	return recordings
+}
+
+// Return a list of all utterances, the query is canceled with the context
+func getAllUtterancesByRecordingID(ctx context.Context, recordingID uint) []model.Utterance {
+	var utterances []model.Utterance
+	db.WithContext(ctx).Where(&model.Utterance{RecordingID: recordingID}).Order("start asc").Find(&utterances)
 	return utterances
 }
 
-// Fetch a recording based on the ID supplied
-func getRecordingByID(id uint) (*model.Recording, error) {
-	var recording model.Recording
-	db.First(&recording, id)
+// Fetch a recording based on the ID supplied
+func getRecordingByID(id uint) (*model.Recording, error) {
+	var recording model.Recording
+	db.First(&recording, id)
+
+	if recording.Title == "" || recording.Status == model.StatusDeleted {
+		return nil, errors.New("Recording not found")
+	} else {
+		return &recording, nil
+	}
+}
+
+// Recording titles are unique per user with UNIQUE_RECORDING_TITLES
+var errDuplicateTitle = errors.New("A recording with this title already exists")
+
+// The partial unique index that keeps concurrent uploads, renames and
+// restores from giving two visible recordings of a user the same title
+const titleIndex = "idx_recordings_unique_title"
+
+// Create the unique index of the titles if UNIQUE_RECORDING_TITLES is set,
+// or drop it otherwise. Without the index, for example because there are
+// duplicates already, the titles are only checked before they are saved.
+func syncTitleIndex() {
+	if !helper.GetConfigBool("UNIQUE_RECORDING_TITLES") {
+		if err := db.Exec("DROP INDEX IF EXISTS " + titleIndex).Error; err != nil {
+			log.Println("Failed to drop the unique index of the titles:", err)
+		}
+		return
+	}
+
+	// Statements that change the schema take no parameters
+	hidden := make([]string, len(hiddenStatuses))
+	for i, status := range hiddenStatuses {
+		hidden[i] = strconv.Itoa(int(status))
+	}
+	err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + titleIndex + " ON recordings (user_id, title) " +
+		"WHERE status NOT IN (" + strings.Join(hidden, ", ") + ") AND deleted_at IS NULL").Error
+	if err != nil {
+		log.Println("Failed to create the unique index of the titles:", err)
+	}
+}
+
+// Return errDuplicateTitle if the error is a violation of the unique
+// index of the titles, or else the error itself
+func titleError(err error) error {
+	if err != nil && strings.Contains(err.Error(), titleIndex) {
+		return errDuplicateTitle
+	}
+	return err
+}
+
+// Check if the user has a recording with the title. Deleted recordings
+// and those still being uploaded are not listed, so their titles are free.
+func titleTaken(userID uint, title string) bool {
+	var count int64
+	db.Model(&model.Recording{}).Where(&model.Recording{UserID: userID, Title: title}).
+		Not("status IN ?", hiddenStatuses).Count(&count)
+	return count > 0
+}
+
+// Return the title with the lowest number appended that is not taken
+func suggestTitle(userID uint, title string) string {
+	for n := 2; ; n++ {
+		if suggestion := fmt.Sprintf("%s (%d)", title, n); !titleTaken(userID, suggestion) {
+			return suggestion
+		}
+	}
+}
+
+// Create a new recording, the title must be unique among the recordings
+// of the user if UNIQUE_RECORDING_TITLES is set
+func createRecording(userID uint, title, filename, language string, normalize bool, deleteAfter *time.Time) (*model.Recording, error) {
+	if helper.GetConfigBool("UNIQUE_RECORDING_TITLES") && titleTaken(userID, title) {
+		return nil, errDuplicateTitle
+	}
+
+	var user model.User
+	db.First(&user, userID)
+
+	r := model.Recording{
+		UserID:      userID,
+		Title:       title,
+		Filename:    filename,
+		Language:    language,
+		Priority:    int(user.Tier),
+		Normalize:   normalize,
+		DeleteAfter: deleteAfter,
+		StoragePath: helper.NewRecordingName()}
+	err := db.Create(&r).Error
+	return &r, err
+}
+
+// Update status of the recording record
+func updateRecordingStatus(r *model.Recording, status model.RecordingStatus) error {
+	var recording model.Recording
+
+	db.First(&recording, r.ID)
+	recording.Status = status
+	err := db.Save(&recording).Error
+
+	return err
+}
+
+// Check if the username and password combination is valid
+// Return the user with the email address if the password is right. After
+// LOCKOUT_ATTEMPTS (5 by default) wrong passwords in a row, the account is
+// locked for LOCKOUT_MINUTES (15 by default), even for the right password.
+func findUser(email, password string) *model.User {
+	var user model.User
+	db.Where(&model.User{Email: email}).First(&user)
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+
+	// A locked account fails like a wrong password, so that the response
+	// doesn't tell whether the email address is registered
+	if user.ID != 0 && user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		return nil
+	}
+
+	if err != nil {
+		if user.ID != 0 {
+			recordFailedLogin(&user)
+		}
+		return nil
+	}
+
+	return &user
+}
+
+// Count a wrong password for the user and lock the account once there
+// were too many in a row. The count is checked by the same statement
+// that increments it, so that concurrent attempts can't slip past the
+// limit.
+func recordFailedLogin(user *model.User) {
+	limit := helper.GetConfigInt("LOCKOUT_ATTEMPTS", 5)
+	lockedUntil := time.Now().Add(time.Duration(helper.GetConfigInt("LOCKOUT_MINUTES", 15)) * time.Minute)
+
+	var result struct {
+		FailedLoginCount int
+		LockedUntil      *time.Time
+	}
+	db.Raw(`UPDATE users SET
+		failed_login_count = CASE WHEN failed_login_count + 1 >= ? THEN 0 ELSE failed_login_count + 1 END,
+		locked_until = CASE WHEN failed_login_count + 1 >= ? THEN ? ELSE locked_until END
+		WHERE id = ? RETURNING failed_login_count, locked_until`,
+		limit, limit, lockedUntil, user.ID).Scan(&result)
+
+	// The count only drops back to zero when the account gets locked
+	if result.FailedLoginCount == 0 && result.LockedUntil != nil {
+		log.Println(fmt.Sprintf("Locked user %d after too many failed logins", user.ID))
+	}
+}
+
+// Register a new user with the given username and password
+func registerNewUser(email, password string) (*model.User, error) {
+	user := model.User{Email: email, Password: password}
+
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not hash password: %v", err))
+	}
+
+	user.Password = hash
+	if err := db.Create(&user).Error; err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not create user: %v", err))
+	}
+
+	if err := sendConfirmation(user.ID); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not send confirmation link: %v", err))
+	}
+
+	return &user, nil
+}
+
+func sendConfirmation(userID uint) error {
+	var user model.User
+
+	token, err := uuid.NewRandom()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	db.First(&user, userID)
+	user.Token = token.String()
+	user.TokenCreatedAt = &now
+	err = db.Save(&user).Error
+
+	if err != nil {
+		return err
+	}
+
+	confirmationLink := fmt.Sprintf("%s/u/confirm/%s", helper.GetConfig("URL_BASE"), token)
+	messageBody := fmt.Sprintf("To confirm this email address, go to:<br/>\n<a href=\"%s\">%s</a>", confirmationLink, confirmationLink)
+	if err := helper.SendEmail(user.Email, "Email Confirmation", messageBody); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Limits failed confirmation attempts per client IP
+var confirmationLimiter *helper.RateLimiter
+
+// Limit login attempts per client IP and per email address, and
+// registrations per client IP
+var loginIPLimiter, loginEmailLimiter, registrationLimiter *helper.RateLimiter
+
+// Create a limiter of MAX_ATTEMPTS requests per WINDOW_MINUTES from the
+// settings with the prefix
+func newAttemptLimiter(prefix string, maxAttempts, windowMinutes int) *helper.RateLimiter {
+	return helper.NewRateLimiter(
+		helper.GetConfigInt(prefix+"_MAX_ATTEMPTS", maxAttempts),
+		time.Duration(helper.GetConfigInt(prefix+"_WINDOW_MINUTES", windowMinutes))*time.Minute)
+}
+
+// The address of the client. X-Forwarded-For is only believed when the
+// request comes from one of TRUSTED_PROXIES (comma-separated IPs or
+// networks), since any client can send the header to pick the address
+// that the limits count.
+func clientIP(c *gin.Context) string {
+	peer, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		peer = c.Request.RemoteAddr
+	}
+	if !trustedProxy(peer) {
+		return peer
+	}
+
+	// Every proxy appends the address it got the request from, so the
+	// client is the last one that isn't a trusted proxy
+	forwarded := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+	}
+
+	return peer
+}
+
+// Check if the IP is one of TRUSTED_PROXIES
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, proxy := range strings.Split(helper.GetConfig("TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func postedEmail(c *gin.Context) string {
+	return strings.ToLower(c.PostForm("email"))
+}
+
+// This middleware rejects requests once the limiter has counted too many
+// for the key of the request. The window slides, so the requests are
+// allowed again as soon as the old ones have left it.
+func limitAttempts(limiter *helper.RateLimiter, key func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := key(c)
+		if k == "" {
+			return
+		}
+
+		if !limiter.Allow(k) {
+			abortWithError(c, http.StatusTooManyRequests, errors.New("Too many attempts, please try again later"))
+		}
+	}
+}
+
+// Record a failed confirmation attempt and log it once it repeats
+func confirmationFailed(c *gin.Context) {
+	ip := clientIP(c)
+	if attempts := confirmationLimiter.Record(ip); attempts > 1 {
+		log.Printf("%d failed confirmation attempts from %s", attempts, ip)
+	}
+}
+
+func performConfirmation(c *gin.Context) {
+	token := c.Param("token")
+
+	if confirmationLimiter.Blocked(clientIP(c)) {
+		abortWithError(c, http.StatusTooManyRequests, errors.New("Too many confirmation attempts"))
+		return
+	}
+
+	// A UUID in its canonical form is 36 characters long
+	if len(token) > 36 {
+		confirmationFailed(c)
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid confirmation link"))
+		return
+	}
+
+	if _, err := uuid.Parse(token); err != nil {
+		confirmationFailed(c)
+		abortWithMessage(c, http.StatusBadRequest, "Invalid confirmation link", err)
+		return
+	}
+
+	var user model.User
+	db.Where(&model.User{Token: token}).First(&user)
+
+	// The token is cleared on confirmation, so a second click on the
+	// same link is recognized by the last used token
+	if user.Email == "" {
+		db.Where(&model.User{UsedToken: token}).First(&user)
+
+		if user.Email != "" && user.Status > 0 && !user.Disabled {
+			render(c, gin.H{"already_confirmed": true}, "confirmation.html")
+			return
+		}
+	}
+
+	if user.Email == "" {
+		confirmationFailed(c)
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid confirmation link"))
+		return
+	}
+
+	if user.Disabled {
+		abortWithError(c, http.StatusForbidden, errAccountDisabled)
+		return
+	}
+
+	// Tokens sent before they had a time are expired as well
+	ttl := time.Duration(helper.GetConfigInt("CONFIRM_TOKEN_HOURS", 48)) * time.Hour
+	if user.TokenCreatedAt == nil || time.Since(*user.TokenCreatedAt) > ttl {
+		db.Model(&user).Updates(map[string]interface{}{"token": "", "token_created_at": nil})
+		renderHTML(c, http.StatusBadRequest, "confirmation.html", gin.H{"expired": true})
+		return
+	}
+
+	firstConfirmation := user.Status == 0
+
+	user.Status = 1
+	user.UsedToken = user.Token
+	user.Token = ""
+	user.FailedLoginCount = 0
+	user.LockedUntil = nil
+	if err := db.Save(&user).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if firstConfirmation {
+		if err := seedSampleRecording(user.ID); err != nil {
+			log.Println("Failed to add the sample recording", err)
+		}
+	}
+
+	render(c, gin.H{}, "confirmation.html")
+}
+
+// Limits re-sent confirmation emails per email address
+var resendLimiter *helper.RateLimiter
+
+func showResendConfirmationPage(c *gin.Context) {
+	render(c, gin.H{
+		"title": "Resend confirmation"}, "resend.html")
+}
+
+// Send a new confirmation link if the user with the email address hasn't
+// confirmed it yet. The response is the same either way, so that it
+// doesn't tell which addresses are registered.
+func resendConfirmation(c *gin.Context) {
+	email := strings.ToLower(c.PostForm("email"))
+
+	if email != "" && resendLimiter.Allow(email) {
+		var user model.User
+		db.Where(&model.User{Email: email}).First(&user)
+
+		if user.Email != "" && user.Status == 0 && !user.Disabled {
+			if err := sendConfirmation(user.ID); err != nil {
+				log.Println("Failed to resend the confirmation link", err)
+			}
+		}
+	}
+
+	render(c, gin.H{
+		"title":     "Resend confirmation",
+		"requested": true}, "resend.html")
+}
+
+func showForgotPasswordPage(c *gin.Context) {
+	render(c, gin.H{
+		"title": "Forgot password"}, "forgot.html")
+}
+
+// Email a password reset link if there is a confirmed user with the
+// email address. The response is the same either way, so that it doesn't
+// tell which addresses are registered.
+func requestPasswordReset(c *gin.Context) {
+	email := strings.ToLower(c.PostForm("email"))
+
+	var user model.User
+	db.Where(&model.User{Email: email}).First(&user)
+
+	if user.Email != "" && user.Status > 0 && !user.Disabled {
+		if err := sendPasswordReset(&user); err != nil {
+			log.Println("Failed to send the password reset link", err)
+		}
+	}
+
+	render(c, gin.H{
+		"title":     "Forgot password",
+		"requested": true}, "forgot.html")
+}
+
+// Generate a reset token for the user, valid for RESET_TOKEN_MINUTES,
+// and email the reset link
+func sendPasswordReset(user *model.User) error {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(time.Duration(helper.GetConfigInt("RESET_TOKEN_MINUTES", 60)) * time.Minute)
+	user.ResetToken = token.String()
+	user.ResetTokenExpires = &expires
+	if err := db.Save(user).Error; err != nil {
+		return err
+	}
+
+	resetLink := fmt.Sprintf("%s/u/reset/%s", helper.GetConfig("URL_BASE"), token)
+	messageBody := fmt.Sprintf("To choose a new password, go to:<br/>\n<a href=\"%s\">%s</a><br/>\n"+
+		"If you did not ask for this, you can ignore this email.", resetLink, resetLink)
+	return helper.SendEmail(user.Email, "Password Reset", messageBody)
+}
+
+func showEmailPage(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	render(c, gin.H{
+		"title":         "Change email",
+		"email":         user.Email,
+		"pending_email": user.PendingEmail}, "email.html")
+}
+
+// Send a confirmation link to the new email address of the user. The
+// address only changes once the link is followed, so that a typo doesn't
+// lock the user out.
+func requestEmailChange(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
+
+	var user model.User
+	db.First(&user, userID)
+
+	email := strings.ToLower(strings.TrimSpace(c.PostForm("email")))
+
+	fail := func(status int, message string) {
+		renderHTML(c, status, "email.html", gin.H{
+			"title":         "Change email",
+			"email":         user.Email,
+			"pending_email": user.PendingEmail,
+			"ErrorTitle":    "Email not changed",
+			"ErrorMessage":  message})
+	}
+
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		fail(http.StatusBadRequest, "Please enter a valid email address")
+		return
+	} else if email == user.Email {
+		fail(http.StatusBadRequest, "This is already your email address")
+		return
+	} else if helper.IsDisposableEmail(email) {
+		fail(http.StatusBadRequest, "Please use a permanent email address")
+		return
+	} else if emailTaken(email) {
+		fail(http.StatusConflict, errEmailTaken.Error())
+		return
+	}
+
+	if err := sendEmailChange(&user, email); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	render(c, gin.H{
+		"title": "Change email",
+		"sent":  email}, "email.html")
+}
+
+var errEmailTaken = errors.New("This email address is already registered")
+
+// Check if an account uses the email address
+func emailTaken(email string) bool {
+	var count int64
+	db.Model(&model.User{}).Where("email = ?", email).Count(&count)
+	return count > 0
+}
+
+// Email a link to the new address that confirms it for the user, valid
+// for EMAIL_TOKEN_HOURS (48 by default)
+func sendEmailChange(user *model.User, email string) error {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(time.Duration(helper.GetConfigInt("EMAIL_TOKEN_HOURS", 48)) * time.Hour)
+	user.PendingEmail = email
+	user.EmailToken = token.String()
+	user.EmailTokenExpires = &expires
+	if err := db.Save(user).Error; err != nil {
+		return err
+	}
+
+	confirmationLink := fmt.Sprintf("%s/u/email/confirm/%s", helper.GetConfig("URL_BASE"), token)
+	messageBody := fmt.Sprintf("To use this email address for your account, go to:<br/>\n<a href=\"%s\">%s</a><br/>\n"+
+		"If you did not ask for this, you can ignore this email.", confirmationLink, confirmationLink)
+	return helper.SendEmail(email, "Email Change", messageBody)
+}
+
+// Switch the user to the new email address of the confirmation link and
+// tell the old address about it
+func confirmEmailChange(c *gin.Context) {
+	token := c.Param("token")
+
+	if _, err := uuid.Parse(token); err != nil || len(token) > 36 {
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid confirmation link"))
+		return
+	}
+
+	var user model.User
+	db.Where(&model.User{EmailToken: token}).First(&user)
+
+	if user.Email == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid confirmation link"))
+		return
+	}
+
+	reset := map[string]interface{}{"pending_email": "", "email_token": "", "email_token_expires": nil}
+
+	if user.EmailTokenExpires == nil || user.EmailTokenExpires.Before(time.Now()) {
+		db.Model(&user).Updates(reset)
+		renderHTML(c, http.StatusBadRequest, "email.html", gin.H{
+			"title":   "Change email",
+			"expired": true})
+		return
+	}
+
+	// The address may have been registered since the link was sent
+	if emailTaken(user.PendingEmail) {
+		db.Model(&user).Updates(reset)
+		renderHTML(c, http.StatusConflict, "email.html", gin.H{
+			"title":        "Change email",
+			"ErrorTitle":   "Email not changed",
+			"ErrorMessage": errEmailTaken.Error()})
+		return
+	}
+
+	oldEmail, newEmail := user.Email, user.PendingEmail
+	reset["email"] = newEmail
+	if err := db.Model(&user).Updates(reset).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	messageBody := fmt.Sprintf("The email address of your account has been changed to %s. "+
+		"If you did not do this, please contact %s.", html.EscapeString(newEmail), html.EscapeString(helper.SupportEmail()))
+	if err := helper.SendEmail(oldEmail, "Email Changed", messageBody); err != nil {
+		log.Println("Failed to send email", err)
+	}
+
+	render(c, gin.H{
+		"title":     "Change email",
+		"confirmed": newEmail}, "email.html")
+}
+
+// Return the user with the valid reset token of the request, or abort
+func getResetUser(c *gin.Context) *model.User {
+	token := c.Param("token")
+
+	if _, err := uuid.Parse(token); err != nil || len(token) > 36 {
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid password reset link"))
+		return nil
+	}
+
+	var user model.User
+	db.Where(&model.User{ResetToken: token}).First(&user)
+
+	if user.Email == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("Invalid password reset link"))
+		return nil
+	}
+
+	if user.ResetTokenExpires == nil || user.ResetTokenExpires.Before(time.Now()) {
+		db.Model(&user).Updates(map[string]interface{}{"reset_token": "", "reset_token_expires": nil})
+		renderHTML(c, http.StatusBadRequest, "reset.html", gin.H{"expired": true})
+		c.Abort()
+		return nil
+	}
+
+	return &user
+}
+
+func showResetPasswordPage(c *gin.Context) {
+	if getResetUser(c) == nil {
+		return
+	}
+
+	render(c, gin.H{
+		"title": "Reset password",
+		"token": c.Param("token")}, "reset.html")
+}
+
+// Set the new password of the user with the reset token. The token is
+// cleared and the sessions of the user are ended.
+func resetPassword(c *gin.Context) {
+	user := getResetUser(c)
+	if user == nil {
+		return
+	}
 
-	if recording.Title == "" {
-		return nil, errors.New("Recording not found")
-	} else {
-		return &recording, nil
+	password := c.PostForm("password")
+	if message := checkNewPassword(password); message != "" {
+		renderHTML(c, http.StatusBadRequest, "reset.html", gin.H{
+			"token":        c.Param("token"),
+			"ErrorTitle":   "Reset Failed",
+			"ErrorMessage": message})
+		return
 	}
-}
 
-// Create a new recording record
-func createRecording(userID uint, title, filename, language string) (*model.Recording, error) {
-	r := model.Recording{UserID: userID, Title: title, Filename: filename, Language: language}
-	err := db.Create(&r).Error
-	return &r, err
-}
+	hash, err := hashPassword(password)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-// Update status of the recording record
-func updateRecordingStatus(r *model.Recording, status uint) error {
-	var recording model.Recording
+	user.Password = hash
+	user.ResetToken = ""
+	user.ResetTokenExpires = nil
+	user.FailedLoginCount = 0
+	user.LockedUntil = nil
+	if err := db.Save(user).Error; err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-	db.First(&recording, r.ID)
-	recording.Status = status
-	err := db.Save(&recording).Error
+	db.Unscoped().Where(&model.Session{UserID: user.ID}).Delete(&model.Session{})
 
-	return err
+	render(c, gin.H{
+		"title": "Reset password",
+		"done":  true}, "reset.html")
 }
 
-// Check if the username and password combination is valid
-func findUser(email, password string) *model.User {
-	var user model.User
-	db.Where(&model.User{Email: email}).First(&user)
-
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+// Add an already transcribed sample recording to a new account if
+// SAMPLE_RECORDING is set. The transcription is read from the file
+// with the same name and the .txt extension, as written by the decoder.
+func seedSampleRecording(userID uint) error {
+	sampleFilename := helper.GetConfig("SAMPLE_RECORDING")
+	if sampleFilename == "" {
 		return nil
-	} else {
-		return &user
 	}
+
+	language := helper.GetConfig("SAMPLE_RECORDING_LANGUAGE")
+	if language == "" {
+		language = "en"
+	}
+
+	r := model.Recording{
+		UserID:      userID,
+		Title:       "Sample recording",
+		Filename:    filepath.Base(sampleFilename),
+		Language:    language,
+		Sample:      true,
+		StoragePath: helper.NewRecordingName()}
+
+	if err := db.Create(&r).Error; err != nil {
+		return err
+	}
+
+	if err := storeFile(helper.RecordingName(&r), sampleFilename); err != nil {
+		return err
+	}
+
+	if err := helper.LoadTranscription(sampleFilename+".txt", &r); err != nil {
+		return err
+	}
+
+	return updateRecordingStatus(&r, model.StatusDone)
 }
 
-// Register a new user with the given username and password
-func registerNewUser(email, password string) (*model.User, error) {
-	user := model.User{Email: email, Password: password}
+// A matching utterance in the search results
+type searchSnippet struct {
+	Start       float32 `json:"start"`
+	End         float32 `json:"end"`
+	Text        string  `json:"text"`
+	Highlighted string  `json:"highlighted"`
+}
 
-	hash, err := hashPassword(user.Password)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not hash password: %v", err))
+// A recording in the search results
+type searchResult struct {
+	Recording model.Recording `json:"recording"`
+	Score     int             `json:"score"`
+	Matches   int             `json:"matches"`
+	Snippets  []searchSnippet `json:"snippets"`
+}
+
+// Wrap every occurrence of the terms in the escaped text into <mark> tags
+func highlightTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		return html.EscapeString(text)
 	}
+	marked := make([]bool, len(text))
 
-	user.Password = hash
-	if err := db.Create(&user).Error; err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not create user: %v", err))
+	for _, term := range terms {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], term)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(term); k++ {
+				marked[k] = true
+			}
+			i += j + len(term)
+		}
 	}
 
-	if err := sendConfirmation(user.ID); err != nil {
-		return nil, errors.New(fmt.Sprintf("Could not send confirmation link: %v", err))
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			b.WriteString("<mark>" + html.EscapeString(text[i:j]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(text[i:j]))
+		}
+		i = j
 	}
 
-	return &user, nil
+	return b.String()
 }
 
-func sendConfirmation(userID uint) error {
-	var user model.User
+// The rank of a recording in the search, before it is loaded
+type searchRank struct {
+	RecordingID uint
+	Score       int
+	Matches     int
+	Total       int
+}
 
-	token, err := uuid.NewRandom()
+// Search the transcripts of the user's recordings and return a page of
+// the results with the total number of them. Recordings are ranked by the
+// number of occurrences of the query terms, utterances that contain all
+// terms or the whole query count extra.
+func searchTranscripts(ctx context.Context, userID uint, query string, offset, limit int) ([]searchResult, int) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return nil, 0
+	}
 
-	if err != nil {
-		return err
+	escaper := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	var conditions []string
+	var patterns []interface{}
+	var scores []string
+	var scoreArgs []interface{}
+	for _, term := range terms {
+		conditions = append(conditions, "utterances.text ILIKE ?")
+		patterns = append(patterns, "%"+escaper.Replace(term)+"%")
+		scores = append(scores, "(length(lower(utterances.text)) - length(replace(lower(utterances.text), ?, ''))) / length(?)")
+		scoreArgs = append(scoreArgs, term, term)
+	}
+	if len(terms) > 1 {
+		scores = append(scores, "CASE WHEN "+strings.Join(conditions, " AND ")+" THEN 2 ELSE 0 END",
+			"CASE WHEN strpos(lower(utterances.text), ?) > 0 THEN 3 ELSE 0 END")
+		scoreArgs = append(append(scoreArgs, patterns...), query)
+	}
+	matching := "(" + strings.Join(conditions, " OR ") + ")"
+
+	args := append(scoreArgs, userID, hiddenStatuses)
+	args = append(append(args, patterns...), limit, offset)
+	var ranks []searchRank
+	db.WithContext(ctx).Raw(`SELECT recording_id, sum(score) AS score, count(*) AS matches, count(*) OVER () AS total
+		FROM (SELECT utterances.recording_id, `+strings.Join(scores, " + ")+` AS score
+			FROM utterances JOIN recordings ON recordings.id = utterances.recording_id
+			WHERE recordings.user_id = ? AND recordings.status NOT IN ? AND recordings.deleted_at IS NULL
+				AND utterances.deleted_at IS NULL AND `+matching+`) AS matches
+		GROUP BY recording_id
+		ORDER BY score DESC, recording_id DESC
+		LIMIT ? OFFSET ?`, args...).Scan(&ranks)
+	if len(ranks) == 0 {
+		return nil, 0
 	}
 
-	db.First(&user, userID)
-	user.Token = token.String()
-	err = db.Save(&user).Error
+	ids := make([]uint, len(ranks))
+	for i, rank := range ranks {
+		ids[i] = rank.RecordingID
+	}
 
-	if err != nil {
-		return err
+	var recordings []model.Recording
+	db.WithContext(ctx).Find(&recordings, ids)
+	byID := map[uint]model.Recording{}
+	for _, recording := range recordings {
+		byID[recording.ID] = recording
 	}
 
-	confirmationLink := fmt.Sprintf("%s/u/confirm/%s", helper.GetConfig("URL_BASE"), token)
-	messageBody := fmt.Sprintf("To confirm this email address, go to:<br/>\n<a href=\"%s\">%s</a>", confirmationLink, confirmationLink)
-	if err := helper.SendEmail(user.Email, "Email Confirmation", messageBody); err != nil {
-		return err
+	// The first three matches of every recording are shown
+	var utterances []model.Utterance
+	db.WithContext(ctx).Raw(`SELECT * FROM (
+			SELECT utterances.*, row_number() OVER (PARTITION BY recording_id ORDER BY start) AS n
+			FROM utterances
+			WHERE recording_id IN ? AND deleted_at IS NULL AND `+matching+`) AS matches
+		WHERE n <= 3
+		ORDER BY start`, append([]interface{}{ids}, patterns...)...).Scan(&utterances)
+	snippets := map[uint][]searchSnippet{}
+	for _, utt := range utterances {
+		snippets[utt.RecordingID] = append(snippets[utt.RecordingID], searchSnippet{
+			Start:       utt.Start,
+			End:         utt.End,
+			Text:        utt.Text,
+			Highlighted: highlightTerms(utt.Text, terms)})
 	}
 
-	return nil
+	results := make([]searchResult, 0, len(ranks))
+	for _, rank := range ranks {
+		results = append(results, searchResult{
+			Recording: byID[rank.RecordingID],
+			Score:     rank.Score,
+			Matches:   rank.Matches,
+			Snippets:  snippets[rank.RecordingID]})
+	}
+
+	return results, ranks[0].Total
 }
 
-func performConfirmation(c *gin.Context) {
-	token := c.Param("token")
+// Handle the search API. The cursor is an opaque token, which is returned
+// as next_cursor when there are more results.
+func apiSearch(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id")
 
-	if _, err := uuid.Parse(token); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	query := c.Query("q")
+	if strings.TrimSpace(query) == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("The query parameter q is required"))
 		return
 	}
 
-	var user model.User
-	db.Where(&model.User{Token: token}).First(&user)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 {
+		limit = 20
+	} else if limit > 100 {
+		limit = 100
+	}
 
-	if user.Email == "" {
-		c.AbortWithError(http.StatusBadRequest, errors.New("Invalid confirmation link"))
-		return
+	offset := 0
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(decoded))
+		}
+		if err != nil || offset < 0 {
+			abortWithError(c, http.StatusBadRequest, errors.New("Invalid cursor"))
+			return
+		}
 	}
 
-	user.Status = 1
-	if err := db.Save(&user).Error; err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	results, total := searchTranscripts(c.Request.Context(), userID.(uint), query, offset, limit)
+	if c.Request.Context().Err() != nil {
 		return
 	}
+	if results == nil {
+		results = []searchResult{}
+	}
 
-	render(c, gin.H{}, "confirmation.html")
+	response := gin.H{
+		"query":   query,
+		"total":   total,
+		"results": results}
+
+	if offset+limit < total {
+		response["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + limit)))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Serve the OpenAPI document of the API
+func showOpenAPISpec(c *gin.Context) {
+	c.JSON(http.StatusOK, helper.OpenAPISpec(helper.GetConfig("URL_BASE")))
+}
+
+// Return the routes in the OpenAPI document that are not registered,
+// so that the document is kept in sync with the handlers
+func missingOpenAPIRoutes(app *gin.Engine) []string {
+	registered := map[string]bool{}
+	for _, route := range app.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+
+	var missing []string
+	for _, route := range helper.OpenAPIRoutes() {
+		if !registered[route] {
+			missing = append(missing, route)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
 }
 
 func initializeRoutes(app *gin.Engine) {
@@ -515,14 +5767,38 @@ func initializeRoutes(app *gin.Engine) {
 	// indicating whether the request was from an authenticated user or not
 	app.Use(setUserStatus())
 
+	// Let scripts authenticate with an API key instead of a session
+	app.Use(setAPIKeyUser())
+
+	// Reject form submissions from other sites
+	app.Use(verifyCSRFToken())
+
+	// Log and optionally restrict the requests of impersonating administrators
+	app.Use(restrictImpersonation())
+
 	// Handle the index route
 	app.GET("/", showIndexPage)
 
 	// Handle the Data protection statement
 	app.GET("/dps", showDPSPage)
 
+	// Handle the list of supported features
+	app.GET("/capabilities", showCapabilities)
+
+	// Handle the list of languages that recordings can be uploaded in
+	app.GET("/languages", showLanguages)
+
+	// Handle the state of the transcription queue
+	app.GET("/queue/status", ensureLoggedIn(), showQueueStatus)
+
+	// Handle the public pages of shared recordings, which don't need a login
+	app.GET("/s/:token", showSharedRecording)
+	app.GET("/s/:token/audio", getSharedRecordingAudio)
+
+	timeout := helper.GetConfigInt("REQUEST_TIMEOUT_SECONDS", 30)
+
 	// Group user related routes together
-	userRoutes := app.Group("/u")
+	userRoutes := app.Group("/u", requestTimeout(timeout))
 	{
 		// Handle the GET requests at /u/login
 		// Show the login page
@@ -531,12 +5807,36 @@ func initializeRoutes(app *gin.Engine) {
 
 		// Handle POST requests at /u/login
 		// Ensure that the user is not logged in by using the middleware
-		userRoutes.POST("/login", ensureNotLoggedIn(), performLogin)
+		userRoutes.POST("/login", ensureNotLoggedIn(),
+			limitAttempts(loginIPLimiter, clientIP), limitAttempts(loginEmailLimiter, postedEmail), performLogin)
+
+		// Handle GET requests at /u/oauth/:provider
+		// Log in with an account of an OAuth provider, e.g. Google, or
+		// confirm a change of the account of a user without a password
+		userRoutes.GET("/oauth/:provider", startOAuthLogin)
+
+		// Handle GET requests at /u/oauth/:provider/callback
+		// The OAuth provider sends the user back here
+		userRoutes.GET("/oauth/:provider/callback",
+			limitAttempts(loginIPLimiter, clientIP), finishOAuthLogin)
+
+		// Handle POST requests at /u/login/code
+		// Check the code of the authenticator app after the password
+		userRoutes.POST("/login/code", ensureNotLoggedIn(),
+			limitAttempts(loginIPLimiter, clientIP), performTwoFactorLogin)
+
+		// Handle POST requests at /u/impersonation/stop
+		// Return from impersonating a user to the administrator account
+		userRoutes.POST("/impersonation/stop", ensureLoggedIn(), stopImpersonation)
 
 		// Handle GET requests at /u/logout
 		// Ensure that the user is logged in by using the middleware
 		userRoutes.GET("/logout", ensureLoggedIn(), logout)
 
+		// Handle POST requests at /u/logout-all
+		// End all sessions of the user
+		userRoutes.POST("/logout-all", ensureLoggedIn(), logoutEverywhere)
+
 		// Handle the GET requests at /u/register
 		// Show the registration page
 		// Ensure that the user is not logged in by using the middleware
@@ -544,18 +5844,132 @@ func initializeRoutes(app *gin.Engine) {
 
 		// Handle POST requests at /u/register
 		// Ensure that the user is not logged in by using the middleware
-		userRoutes.POST("/register", ensureNotLoggedIn(), register)
+		userRoutes.POST("/register", ensureNotLoggedIn(), limitAttempts(registrationLimiter, clientIP), register)
+
+		// Handle GET requests at /u/account
+		// Show the preferences of the user
+		userRoutes.GET("/account", ensureLoggedIn(), showAccountPage)
+
+		// Handle POST requests at /u/account
+		userRoutes.POST("/account", ensureLoggedIn(), updateAccount)
+
+		// Handle POST requests at /u/delete
+		// Delete the account after confirming the password
+		userRoutes.POST("/delete", ensureLoggedIn(), deleteAccount)
+
+		// Handle GET requests at /u/email
+		// Show the page to change the email address
+		userRoutes.GET("/email", ensureLoggedIn(), showEmailPage)
+
+		// Handle POST requests at /u/email
+		// Send a confirmation link to the new email address
+		userRoutes.POST("/email", ensureLoggedIn(), requestEmailChange)
+
+		// Handle GET requests at /u/email/confirm/some_token
+		// Switch to the new email address, with or without a session
+		userRoutes.GET("/email/confirm/:token", confirmEmailChange)
+
+		// Handle GET requests at /u/password
+		userRoutes.GET("/password", ensureLoggedIn(), showPasswordPage)
+
+		// Handle POST requests at /u/password
+		userRoutes.POST("/password", ensureLoggedIn(), changePassword)
+
+		// Handle GET requests at /u/2fa
+		// Show the settings of two-factor authentication
+		userRoutes.GET("/2fa", ensureLoggedIn(), showTwoFactorPage)
+
+		// Handle POST requests at /u/2fa/setup
+		// Generate a secret for the authenticator app
+		userRoutes.POST("/2fa/setup", ensureLoggedIn(), setupTwoFactor)
+
+		// Handle POST requests at /u/2fa/enable
+		// Enable two-factor authentication with a code of the app
+		userRoutes.POST("/2fa/enable", ensureLoggedIn(), enableTwoFactor)
+
+		// Handle POST requests at /u/2fa/disable
+		// Disable two-factor authentication with the password
+		userRoutes.POST("/2fa/disable", ensureLoggedIn(), disableTwoFactor)
+
+		// Handle GET requests at /u/sessions
+		// Show the active sessions of the user
+		userRoutes.GET("/sessions", ensureLoggedIn(), showSessionsPage)
+
+		// Handle POST requests at /u/sessions/some_session_id/revoke
+		userRoutes.POST("/sessions/:session_id/revoke", ensureLoggedIn(), revokeSession)
+
+		// Handle GET requests at /u/glossary
+		// Show the correction rules of the user
+		userRoutes.GET("/glossary", ensureLoggedIn(), showGlossaryPage)
+
+		// Handle POST requests at /u/glossary
+		userRoutes.POST("/glossary", ensureLoggedIn(), addGlossaryRule)
+
+		// Handle GET requests at /u/apikey
+		userRoutes.GET("/apikey", ensureLoggedIn(), showAPIKeyPage)
+
+		// Handle POST requests at /u/apikey
+		userRoutes.POST("/apikey", ensureLoggedIn(), generateAPIKey)
+
+		// Handle GET requests at /u/trash
+		userRoutes.GET("/trash", ensureLoggedIn(), showTrashPage)
+
+		// Handle POST requests at /u/glossary/some_rule_id/delete
+		userRoutes.POST("/glossary/:rule_id/delete", ensureLoggedIn(), deleteGlossaryRule)
 
 		// Handle GET requests at /u/confirm/some_token
 		userRoutes.GET("/confirm/:token", ensureNotLoggedIn(), performConfirmation)
+
+		// Handle the GET requests at /u/resend
+		userRoutes.GET("/resend", ensureNotLoggedIn(), showResendConfirmationPage)
+
+		// Handle POST requests at /u/resend
+		userRoutes.POST("/resend", ensureNotLoggedIn(), resendConfirmation)
+
+		// Handle the GET requests at /u/forgot
+		userRoutes.GET("/forgot", ensureNotLoggedIn(), showForgotPasswordPage)
+
+		// Handle POST requests at /u/forgot
+		userRoutes.POST("/forgot", ensureNotLoggedIn(), requestPasswordReset)
+
+		// Handle GET requests at /u/reset/some_token
+		userRoutes.GET("/reset/:token", ensureNotLoggedIn(), showResetPasswordPage)
+
+		// Handle POST requests at /u/reset/some_token
+		userRoutes.POST("/reset/:token", ensureNotLoggedIn(), resetPassword)
+	}
+
+	// Group the JSON API routes together
+	apiRoutes := app.Group("/api/v1", jsonAPI(), cors(), requestTimeout(helper.GetConfigInt("API_REQUEST_TIMEOUT_SECONDS", timeout)))
+	{
+		// Handle the CORS preflight requests of browsers
+		apiRoutes.OPTIONS("/*path", func(c *gin.Context) {
+			c.AbortWithStatus(http.StatusNoContent)
+		})
+
+		// Handle GET requests at /api/v1/search?q=some_query
+		// Search the transcripts of the user's recordings
+		apiRoutes.GET("/search", ensureAPIAuth(), apiSearch)
+
+		// Handle GET requests at /api/v1/openapi.json
+		// Describe the API for client generators
+		apiRoutes.GET("/openapi.json", showOpenAPISpec)
 	}
 
 	// Group recording related routes together
-	recordingRoutes := app.Group("/recording")
+	recordingRoutes := app.Group("/recording", requestTimeout(timeout))
 	{
 		// Handle GET requests at /recording/view/some_recording_id
 		recordingRoutes.GET("/view/:recording_id", ensureLoggedIn(), getRecordingHTML)
 
+		// Handle GET requests at /recording/stream/some_recording_id
+		// Push the transcription results as server-sent events
+		untimed(recordingRoutes, http.MethodGet, "/stream/:recording_id", ensureLoggedIn(), streamRecording)
+
+		// Handle GET requests at /recording/view/:recording_id/events
+		// Push the status and the progress as server-sent events
+		untimed(recordingRoutes, http.MethodGet, "/view/:recording_id/events", ensureLoggedIn(), getRecordingEvents)
+
 		// Handle the GET requests at /recording/upload
 		// Show the recording upload page
 		// Ensure that the user is logged in by using the middleware
@@ -563,7 +5977,93 @@ func initializeRoutes(app *gin.Engine) {
 
 		// Handle POST requests at /recording/upload
 		// Ensure that the user is logged in by using the middleware
-		recordingRoutes.POST("/upload", ensureLoggedIn(), uploadRecording)
+		untimed(recordingRoutes, http.MethodPost, "/upload", ensureLoggedIn(), uploadRecording)
+
+		// Handle POST requests at /recording/upload/chunked
+		// Start an upload in chunks
+		recordingRoutes.POST("/upload/chunked", ensureLoggedIn(), startChunkedUpload)
+
+		// Handle GET requests at /recording/upload/chunked/some_upload_id
+		// Show how much of the upload has been received
+		recordingRoutes.GET("/upload/chunked/:upload_id", ensureLoggedIn(), showChunkedUpload)
+
+		// Handle PUT requests at /recording/upload/chunked/some_upload_id/some_chunk
+		// Append the chunk to the upload
+		untimed(recordingRoutes, http.MethodPut, "/upload/chunked/:upload_id/:chunk", ensureLoggedIn(), uploadChunk)
+
+		// Handle POST requests at /recording/upload/chunked/some_upload_id/finish
+		// Create the recording from the complete upload
+		recordingRoutes.POST("/upload/chunked/:upload_id/finish", ensureLoggedIn(), finishChunkedUpload)
+
+		// Handle GET requests at /recording/comments/some_recording_id
+		recordingRoutes.GET("/comments/:recording_id", ensureLoggedIn(), showComments)
+
+		// Handle POST requests at /recording/comments/some_recording_id
+		recordingRoutes.POST("/comments/:recording_id", ensureLoggedIn(), postComment)
+
+		// Handle POST requests at /recording/comments/some_recording_id/delete/some_comment_id
+		recordingRoutes.POST("/comments/:recording_id/delete/:comment_id", ensureLoggedIn(), deleteComment)
+
+		// Handle GET requests at /recording/events/some_recording_id
+		recordingRoutes.GET("/events/:recording_id", ensureLoggedIn(), showRecordingEvents)
+
+		// Handle GET requests at /recording/glossary/some_recording_id
+		// Preview the effect of the glossary on the transcription
+		recordingRoutes.GET("/glossary/:recording_id", ensureLoggedIn(), previewGlossary)
+
+		// Handle GET requests at /recording/view/some_recording_id/transcript.txt
+		recordingRoutes.GET("/view/:recording_id/transcript.txt", ensureLoggedIn(), getRecordingTranscript)
+
+		// Handle POST requests at /recording/view/some_recording_id/rename
+		recordingRoutes.POST("/view/:recording_id/rename", ensureLoggedIn(), renameRecording)
+
+		// Handle POST requests at /recording/view/some_recording_id/share
+		// Create a public link to the recording
+		recordingRoutes.POST("/view/:recording_id/share", ensureLoggedIn(), shareRecording)
+
+		// Handle POST requests at /recording/view/some_recording_id/unshare
+		// Revoke the public link to the recording
+		recordingRoutes.POST("/view/:recording_id/unshare", ensureLoggedIn(), unshareRecording)
+
+		// Handle POST requests at /recording/view/some_recording_id/retry
+		// Queue a failed recording again
+		recordingRoutes.POST("/view/:recording_id/retry", ensureLoggedIn(), retryRecording)
+
+		// Handle POST requests at /recording/view/:recording_id/retranscribe
+		// Transcribe the recording again in another language
+		recordingRoutes.POST("/view/:recording_id/retranscribe", ensureLoggedIn(), retranscribeRecording)
+
+		// Handle POST requests at /recording/view/:recording_id/tags
+		// Add a tag to the recording
+		recordingRoutes.POST("/view/:recording_id/tags", ensureLoggedIn(), tagRecording)
+
+		// Handle POST requests at /recording/view/:recording_id/tags/remove
+		// Remove a tag from the recording
+		recordingRoutes.POST("/view/:recording_id/tags/remove", ensureLoggedIn(), untagRecording)
+
+		// Handle GET requests at /recording/view/some_recording_id/transcript.srt
+		recordingRoutes.GET("/view/:recording_id/transcript.srt", ensureLoggedIn(), getTranscriptSubtitles(sendSRT))
+
+		// Handle GET requests at /recording/view/some_recording_id/transcript.vtt
+		recordingRoutes.GET("/view/:recording_id/transcript.vtt", ensureLoggedIn(), getTranscriptSubtitles(sendWebVTT))
+
+		// Handle GET requests at /recording/view/some_recording_id/peaks.json
+		// Send the waveform of the recording
+		recordingRoutes.GET("/view/:recording_id/peaks.json", ensureLoggedIn(), getRecordingPeaks)
+
+		// Handle GET requests at /recording/view/some_recording_id/status
+		recordingRoutes.GET("/view/:recording_id/status", ensureLoggedIn(), showRecordingProgress)
+
+		// Handle GET requests at /recording/status/some_recording_id
+		recordingRoutes.GET("/status/:recording_id", ensureLoggedIn(), showRecordingStatus)
+
+		// Handle GET requests at /recording/download/some_recording_id
+		// Export in the requested or the preferred format
+		recordingRoutes.GET("/download/:recording_id", ensureLoggedIn(), downloadRecording)
+
+		// Handle GET requests at /recording/view/some_recording_id/audio
+		// Play the audio of the recording, with range requests for seeking
+		untimed(recordingRoutes, http.MethodGet, "/view/:recording_id/audio", ensureLoggedIn(), getRecordingAudio)
 
 		// Handle GET requests at /recording/export/srt/some_recording_id
 		recordingRoutes.GET("/export/srt/:recording_id", ensureLoggedIn(), getRecordingSRT)
@@ -577,36 +6077,224 @@ func initializeRoutes(app *gin.Engine) {
 		// Handle GET requests at /recording/export/otr/some_recording_id
 		recordingRoutes.GET("/export/otr/:recording_id", ensureLoggedIn(), getRecordingOTR)
 
-		// Handle GET requests at /recording/delete/some_recording_id
-		recordingRoutes.GET("/delete/:recording_id", ensureLoggedIn(), deleteRecording)
+		// Handle GET requests at /recording/export/docx/some_recording_id
+		recordingRoutes.GET("/export/docx/:recording_id", ensureLoggedIn(), getRecordingDOCX)
+
+		// Handle GET requests at /recording/export/pdf/some_recording_id
+		recordingRoutes.GET("/export/pdf/:recording_id", ensureLoggedIn(), getRecordingPDF)
+
+		// Handle POST requests at /recording/language/some_recording_id
+		// Confirm the language of the recording
+		recordingRoutes.POST("/language/:recording_id", ensureLoggedIn(), confirmLanguage)
+
+		// Handle POST requests at /recording/notify/some_recording_id
+		// Send the transcription notification again
+		recordingRoutes.POST("/notify/:recording_id", ensureLoggedIn(), resendNotification)
+
+		// Handle POST requests at /recording/retention/some_recording_id
+		// Keep the recording forever or delete it after the default period
+		recordingRoutes.POST("/retention/:recording_id", ensureLoggedIn(), updateRecordingRetention)
+
+		// Handle POST requests at /recording/delete/some_recording_id
+		recordingRoutes.POST("/delete/:recording_id", ensureLoggedIn(), deleteRecording)
+
+		// Handle POST requests at /recording/bulk-delete
+		// Delete the selected recordings
+		recordingRoutes.POST("/bulk-delete", ensureLoggedIn(), bulkDeleteRecordings)
+
+		// Handle DELETE requests at /recording/some_recording_id
+		recordingRoutes.DELETE("/:recording_id", ensureLoggedIn(), deleteRecording)
+
+		// Handle POST requests at /recording/restore/some_recording_id
+		recordingRoutes.POST("/restore/:recording_id", ensureLoggedIn(), restoreRecording)
 	}
-}
 
-func main() {
-	// Set Gin to production mode
-	gin.SetMode(gin.ReleaseMode)
+	// Group the administration routes together
+	adminRoutes := app.Group("/admin", requestTimeout(timeout), ensureLoggedIn(), ensureAdmin())
+	{
+		// Handle POST requests at /admin/impersonate/some_user_id
+		// Act as the user for support
+		adminRoutes.POST("/impersonate/:user_id", startImpersonation)
 
-	// Connect to the database
-	helper.ConnectDB()
-	db = helper.DB
+		// Handle GET requests at /admin/users
+		// List all users
+		adminRoutes.GET("/users", showUsers)
+
+		// Handle POST requests at /admin/users/some_user_id/status
+		// Enable or disable the user
+		adminRoutes.POST("/users/:user_id/status", toggleUserStatus)
+
+		// Handle POST requests at /admin/users/some_user_id/recordings/delete
+		// Delete all recordings of the user
+		adminRoutes.POST("/users/:user_id/recordings/delete", deleteUserRecordings)
+	}
+
+	// Group the profiling endpoints together, they are disabled by default
+	profilingRoutes := app.Group("/debug/pprof", ensureProfilingAllowed())
+	{
+		// Handle GET requests at /debug/pprof/
+		profilingRoutes.GET("/", gin.WrapF(pprof.Index))
+
+		// Handle GET and POST requests at /debug/pprof/some_profile
+		profilingRoutes.GET("/:profile", showProfile)
+		profilingRoutes.POST("/:profile", showProfile)
+	}
+}
 
+// Set up the router with the middleware, the templates and the routes of
+// the application
+func setupRouter() *gin.Engine {
 	// Set the router as the default one provided by Gin
-	app := gin.Default()
+	app := gin.New()
+
+	// Gin believes X-Forwarded-For from anyone, the address of the client
+	// is taken from clientIP instead
+	app.ForwardedByClientIP = false
+
+	// Recover from panics and log every request as JSON
+	app.Use(gin.Recovery(), requestLogger())
+
+	// Handle the liveness and readiness probes. They are registered before
+	// any other middleware, so that they don't depend on the session.
+	app.GET("/healthz", showHealth)
+	app.GET("/readyz", showReadiness)
+
+	// Serve the metrics for Prometheus, also without the session, to the
+	// scrapers with the token or from the allowed addresses
+	app.GET("/metrics", ensureMetricsAllowed(), gin.WrapH(helper.MetricsHandler))
 
-	// Set custom function to format Start and End of utterance
-	app.SetFuncMap(template.FuncMap{"formatDuration": formatDuration})
+	// Set custom functions to format Start and End of utterance, lengths and sizes,
+	// and to number pages
+	app.SetFuncMap(template.FuncMap{"formatDuration": formatDuration, "formatSeconds": formatSeconds, "formatBytes": formatBytes, "pageNumbers": pageNumbers,
+		"lowConfidence": lowConfidence, "formatConfidence": formatConfidence,
+		"timeAgo": timeAgo})
 
 	// Process the templates at the start so that they don't have to be loaded
 	// from the disk again. This makes serving HTML pages very fast.
 	app.LoadHTMLGlob("templates/*.html")
 
+	// Limit failed confirmation attempts per IP
+	confirmationLimiter = helper.NewRateLimiter(
+		helper.GetConfigInt("CONFIRM_MAX_ATTEMPTS", 10),
+		time.Duration(helper.GetConfigInt("CONFIRM_WINDOW_MINUTES", 15))*time.Minute)
+
+	// Limit login attempts and registrations
+	loginIPLimiter = newAttemptLimiter("LOGIN_IP", 30, 15)
+	loginEmailLimiter = newAttemptLimiter("LOGIN_EMAIL", 10, 15)
+	registrationLimiter = newAttemptLimiter("REGISTRATION", 5, 60)
+
+	// Allow one re-sent confirmation email per address and minute
+	resendLimiter = helper.NewRateLimiter(1, time.Minute)
+
+	// Limit re-sent transcription notifications per user
+	notificationLimiter = helper.NewRateLimiter(
+		helper.GetConfigInt("NOTIFY_RESEND_MAX", 3),
+		time.Duration(helper.GetConfigInt("NOTIFY_RESEND_WINDOW_MINUTES", 60))*time.Minute)
+
+	// Redirect to HTTPS and set HSTS if configured
+	app.Use(enforceHTTPS())
+
+	// Compress large responses if configured
+	app.Use(compressResponses())
+
+	// Limit concurrent export generation
+	exportSlots = helper.NewSemaphore(helper.GetConfigInt("EXPORT_CONCURRENCY", 4))
+
+	// Cache generated exports
+	exportCache = helper.NewCache(
+		time.Duration(helper.GetConfigInt("EXPORT_CACHE_TTL_MINUTES", 60))*time.Minute,
+		helper.GetConfigInt("EXPORT_CACHE_BYTES", 16<<20),
+		helper.GetConfigInt("EXPORT_CACHE_INLINE_BYTES", 256<<10),
+		helper.GetConfig("EXPORT_CACHE_DIR"))
+
 	// Enable cookie session
 	store = cookie.NewStore([]byte(helper.GetConfig("SESSION_KEY")))
+	store.Options(sessionOptions(true))
 	app.Use(sessions.Sessions("ims-speech-session", store))
 
 	// Initialize the routes
 	initializeRoutes(app)
 
-	// Start serving the application
-	app.Run()
+	// Warn about documented routes that don't exist
+	for _, route := range missingOpenAPIRoutes(app) {
+		log.Println("The OpenAPI document describes a route that doesn't exist:", route)
+	}
+
+	return app
+}
+
+func main() {
+	// Refuse to start with missing or insecure settings
+	if err := helper.ValidateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Set Gin to production mode
+	gin.SetMode(gin.ReleaseMode)
+
+	// Connect to the database
+	helper.ConnectDB()
+	db = helper.DB
+
+	// Undo the latest migration before starting an older version
+	if len(os.Args) == 2 && os.Args[1] == "rollback-migration" {
+		if err := helper.RollbackMigration(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Rolled back the latest migration")
+		return
+	}
+
+	// Enforce the unique titles in the database, if they are configured
+	syncTitleIndex()
+
+	// Set up the storage of the recordings
+	helper.ConnectStorage()
+
+	// Read the supported languages
+	helper.LoadLanguages()
+
+	// Clean up the chunked uploads that were never finished and the
+	// sessions that have expired
+	go func() {
+		for {
+			purgeAbandonedUploads()
+			purgeExpiredSessions()
+			time.Sleep(time.Hour)
+		}
+	}()
+
+	// Publish the progress of the recordings to their event streams
+	go helper.WatchProgress(time.Duration(helper.GetConfigInt("PROGRESS_POLL_SECONDS", 2))*time.Second, shuttingDown)
+
+	app := setupRouter()
+
+	// Start serving the application on PORT, like gin does by default
+	port := helper.GetConfig("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	server := &http.Server{Addr: ":" + port, Handler: app}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGINT or SIGTERM, stop accepting connections and give the
+	// requests in progress, e.g. uploads, SHUTDOWN_TIMEOUT_SECONDS to finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(helper.GetConfigInt("SHUTDOWN_TIMEOUT_SECONDS", 30))*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Failed to finish the requests in progress:", err)
+	}
 }
@@ -0,0 +1,2081 @@
+//go:build !worker
+// +build !worker
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"simple-web-asr/helper"
+	"simple-web-asr/model"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Send a request to the router and return the recorded response
+func serve(router http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testClient sends requests to the router of the application like a
+// browser: it keeps the cookies and sends the CSRF token of the last page
+// along with forms. It accepts HTML unless accept is set.
+type testClient struct {
+	router  *gin.Engine
+	cookies map[string]*http.Cookie
+	csrf    string
+	accept  string
+}
+
+// The CSRF token in a form field or, for uploads, in the form action
+var csrfField = regexp.MustCompile(`(?:name="csrf_token" value="|csrf_token=)([0-9a-f]+)`)
+
+// Set up the router of the application on a dry-run database
+func newTestClient(t *testing.T) (*testClient, *sqlRecorder) {
+	setConfig(t, "SESSION_KEY", strings.Repeat("k", 32))
+	recorder := dryRun(t)
+	return &testClient{router: setupRouter(), cookies: map[string]*http.Cookie{}}, recorder
+}
+
+// Log in as the user, whose session the database finds from then on
+func (tc *testClient) login(recorder *sqlRecorder, user model.User) {
+	session := model.Session{UserID: user.ID, LastSeen: time.Now(), IP: "192.0.2.1"}
+	session.ID = 1
+	recorder.rows["sessions"] = []model.Session{session}
+	recorder.rows["users"] = []model.User{user}
+
+	tc.router.GET("/test/login", func(c *gin.Context) {
+		startSession(c, user.ID, false)
+	})
+	tc.do(http.MethodGet, "/test/login", nil)
+}
+
+// Send a request, with the form, if any, as its body
+func (tc *testClient) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		form.Set("csrf_token", tc.csrf)
+		body = strings.NewReader(form.Encode())
+	}
+
+	req := httptest.NewRequest(method, path, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return tc.send(req)
+}
+
+// Send the request with the cookies and the CSRF token
+func (tc *testClient) send(req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Accept", "text/html")
+	if tc.accept != "" {
+		req.Header.Set("Accept", tc.accept)
+	}
+	req.Header.Set("X-CSRF-Token", tc.csrf)
+	for _, cookie := range tc.cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	tc.router.ServeHTTP(w, req)
+
+	for _, cookie := range w.Result().Cookies() {
+		tc.cookies[cookie.Name] = cookie
+	}
+	if match := csrfField.FindStringSubmatch(w.Body.String()); match != nil {
+		tc.csrf = match[1]
+	}
+	return w
+}
+
+func TestRequestTimeout(t *testing.T) {
+	router := gin.New()
+	group := router.Group("/recording", requestTimeout(1))
+
+	// A handler that waits for its query to be cancelled, if there is
+	// a deadline at all
+	slow := func(c *gin.Context) {
+		if _, ok := c.Request.Context().Deadline(); !ok {
+			c.String(http.StatusOK, "done")
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+		case <-time.After(3 * time.Second):
+			c.String(http.StatusOK, "done")
+		}
+	}
+	group.GET("/view/:recording_id", slow)
+	untimed(group, http.MethodGet, "/stream/:recording_id", slow)
+	untimed(group, http.MethodPut, "/upload/chunked/:upload_id/:chunk", slow)
+
+	w := serve(router, http.MethodGet, "/recording/view/1", http.Header{"Accept": {"application/json"}})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("slow handler: got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	for _, r := range []struct{ method, path string }{
+		{http.MethodGet, "/recording/stream/1"},
+		{http.MethodPut, "/recording/upload/chunked/abc/0"},
+	} {
+		w := serve(router, r.method, r.path, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d, want %d", r.method, r.path, w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestRequestTimeoutDisabled(t *testing.T) {
+	router := gin.New()
+	router.GET("/", requestTimeout(0), func(c *gin.Context) {
+		if _, ok := c.Request.Context().Deadline(); ok {
+			t.Error("a timeout of 0 set a deadline")
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	if w := serve(router, http.MethodGet, "/", nil); w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestLimitAPIRequests(t *testing.T) {
+	user := model.User{APIRateLimit: 2, APIKey: "hashed-key"}
+	user.ID = 1
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		c.Set("api_key", true)
+		if limitAPIRequests(c, &user) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	for i, remaining := range []string{"1", "0"} {
+		w := serve(router, http.MethodGet, "/", nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: got status %d, want %d", i+1, w.Code, http.StatusNoContent)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Errorf("request %d: got X-RateLimit-Remaining %q, want %q", i+1, got, remaining)
+		}
+	}
+
+	w := serve(router, http.MethodGet, "/", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("X-RateLimit-Limit"); got != "2" {
+		t.Errorf("got X-RateLimit-Limit %q, want \"2\"", got)
+	}
+	for _, header := range []string{"X-RateLimit-Reset", "Retry-After"} {
+		if w.Header().Get(header) == "" {
+			t.Errorf("%s is missing", header)
+		}
+	}
+
+	// Another key of the same user has its own count
+	user.APIKey = "other-hashed-key"
+	if w := serve(router, http.MethodGet, "/", nil); w.Code != http.StatusNoContent {
+		t.Errorf("other key: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestEnsureLoggedIn(t *testing.T) {
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		c.Set("is_logged_in", false)
+	}, ensureLoggedIn(), func(c *gin.Context) {
+		t.Error("the handler ran without a login")
+	})
+
+	w := serve(router, http.MethodGet, "/", http.Header{"Accept": {"application/json"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if want := `{"error":"Authentication required","status":401}`; w.Body.String() != want {
+		t.Errorf("got body %s, want %s", w.Body, want)
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	router := gin.New()
+	router.GET("/", jsonAPI(), func(c *gin.Context) {
+		abortWithStatus(c, http.StatusNotFound)
+	})
+
+	w := serve(router, http.MethodGet, "/", http.Header{"Accept": {"*/*"}})
+	if want := `{"error":"Not Found","status":404}`; w.Body.String() != want {
+		t.Errorf("got body %s, want %s", w.Body, want)
+	}
+}
+
+func TestPerformConfirmationRejectsInvalidTokens(t *testing.T) {
+	confirmationLimiter = helper.NewRateLimiter(2, time.Minute)
+
+	router := gin.New()
+	router.GET("/u/confirm/:token", performConfirmation)
+
+	// Every attempt claims to come from another address
+	header := func(i int) http.Header {
+		return http.Header{"Accept": {"application/json"}, "X-Forwarded-For": {fmt.Sprintf("198.51.100.%d", i)}}
+	}
+	for i, token := range []string{strings.Repeat("a", 100), "not-a-uuid"} {
+		if w := serve(router, http.MethodGet, "/u/confirm/"+token, header(i)); w.Code != http.StatusBadRequest {
+			t.Errorf("token %q: got status %d, want %d", token, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// The failed attempts count against the IP of the connection
+	if w := serve(router, http.MethodGet, "/u/confirm/"+uuid.New().String(), header(2)); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestEnforceHTTPS(t *testing.T) {
+	setConfig(t, "FORCE_HTTPS", "true")
+	setConfig(t, "HSTS_MAX_AGE", "31536000")
+	setConfig(t, "HSTS_INCLUDE_SUBDOMAINS", "true")
+
+	router := gin.New()
+	router.Use(enforceHTTPS())
+	ok := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	router.GET("/recording/view/:recording_id", ok)
+	router.GET("/healthz", ok)
+	router.GET("/.well-known/acme-challenge/:token", ok)
+
+	w := serve(router, http.MethodGet, "/recording/view/1?format=srt", http.Header{"X-Forwarded-Proto": {"http"}})
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("HTTP: got status %d, want %d", w.Code, http.StatusMovedPermanently)
+	}
+	if want := "https://example.com/recording/view/1?format=srt"; w.Header().Get("Location") != want {
+		t.Errorf("HTTP: got location %q, want %q", w.Header().Get("Location"), want)
+	}
+
+	for _, path := range []string{"/healthz", "/.well-known/acme-challenge/abc"} {
+		if w := serve(router, http.MethodGet, path, http.Header{"X-Forwarded-Proto": {"http"}}); w.Code != http.StatusNoContent {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, http.StatusNoContent)
+		}
+	}
+
+	w = serve(router, http.MethodGet, "/recording/view/1", http.Header{"X-Forwarded-Proto": {"https"}})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("HTTPS: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if want := "max-age=31536000; includeSubDomains"; w.Header().Get("Strict-Transport-Security") != want {
+		t.Errorf("got HSTS header %q, want %q", w.Header().Get("Strict-Transport-Security"), want)
+	}
+}
+
+func TestEnforceHTTPSDisabled(t *testing.T) {
+	setConfig(t, "FORCE_HTTPS", "")
+	setConfig(t, "HSTS_MAX_AGE", "")
+
+	router := gin.New()
+	router.Use(enforceHTTPS())
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	w := serve(router, http.MethodGet, "/", http.Header{"X-Forwarded-Proto": {"http"}})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w = serve(router, http.MethodGet, "/", http.Header{"X-Forwarded-Proto": {"https"}})
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("got HSTS header %q without HSTS_MAX_AGE", hsts)
+	}
+}
+
+func TestEnforceSessionLimit(t *testing.T) {
+	setConfig(t, "MAX_SESSIONS", "2")
+	setConfig(t, "SESSION_EVICTION_EMAIL", "")
+
+	userSessions := make([]model.Session, 3)
+	for s := range userSessions {
+		userSessions[s].ID = uint(s + 1)
+		userSessions[s].UserID = 7
+	}
+
+	setConfig(t, "SESSION_LIMIT_POLICY", "reject")
+	recorder := dryRun(t)
+	recorder.rows["sessions"] = userSessions
+	if err := enforceSessionLimit(7); err != errTooManySessions {
+		t.Errorf("reject: got %v, want %v", err, errTooManySessions)
+	}
+	for _, sql := range recorder.statements {
+		if strings.HasPrefix(sql, "DELETE") {
+			t.Errorf("reject: a session was deleted: %s", sql)
+		}
+	}
+
+	// The two oldest sessions make room for the new one
+	setConfig(t, "SESSION_LIMIT_POLICY", "evict")
+	recorder = dryRun(t)
+	recorder.rows["sessions"] = userSessions
+	if err := enforceSessionLimit(7); err != nil {
+		t.Fatalf("evict: %v", err)
+	}
+	var deleted []string
+	for _, sql := range recorder.statements {
+		if strings.HasPrefix(sql, "DELETE") {
+			deleted = append(deleted, sql)
+		}
+	}
+	want := []string{"DELETE FROM sessions WHERE sessions.id = 1", "DELETE FROM sessions WHERE sessions.id = 2"}
+	if strings.Join(deleted, "\n") != strings.Join(want, "\n") {
+		t.Errorf("evict: got %q, want %q", deleted, want)
+	}
+	if !strings.Contains(recorder.statements[0], "ORDER BY created_at asc") {
+		t.Errorf("evict: the sessions are not ordered by age: %s", recorder.statements[0])
+	}
+}
+
+func TestEnforceSessionLimitDisabled(t *testing.T) {
+	setConfig(t, "MAX_SESSIONS", "")
+	recorder := dryRun(t)
+
+	if err := enforceSessionLimit(7); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if len(recorder.statements) > 0 {
+		t.Errorf("queried the sessions without MAX_SESSIONS: %q", recorder.statements)
+	}
+}
+
+func TestSendExportCache(t *testing.T) {
+	exportSlots = helper.NewSemaphore(1)
+	exportCache = helper.NewCache(time.Minute, 1024, 1024, "")
+
+	recording := model.Recording{Filename: "talk.wav"}
+	recording.ID = 1
+	utterances := []model.Utterance{{Text: "hello"}}
+
+	generated := 0
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		sendExport(c, &recording, utterances, "txt", "text/plain", func(w io.Writer) error {
+			generated++
+			_, err := io.WriteString(w, utterances[0].Text)
+			return err
+		})
+	})
+
+	for i := 0; i < 2; i++ {
+		w := serve(router, http.MethodGet, "/", nil)
+		if w.Body.String() != "hello" {
+			t.Errorf("request %d: got %q", i+1, w.Body)
+		}
+		if want := `attachment; filename=talk.txt`; w.Header().Get("Content-Disposition") != want {
+			t.Errorf("request %d: got Content-Disposition %q, want %q", i+1, w.Header().Get("Content-Disposition"), want)
+		}
+	}
+	if generated != 1 {
+		t.Errorf("generated %d times, want once", generated)
+	}
+
+	// An edited transcript is a new version
+	utterances[0].Text = "hello again"
+	utterances[0].UpdatedAt = time.Now()
+	if w := serve(router, http.MethodGet, "/", nil); w.Body.String() != "hello again" {
+		t.Errorf("after the edit: got %q", w.Body)
+	}
+
+	// So are other query parameters
+	serve(router, http.MethodGet, "/?start=10", nil)
+	if generated != 3 {
+		t.Errorf("generated %d times, want 3", generated)
+	}
+
+	// And a renamed recording
+	recording.Title, recording.UpdatedAt = "Renamed", time.Now()
+	serve(router, http.MethodGet, "/?start=10", nil)
+	if generated != 4 {
+		t.Errorf("generated %d times after the rename, want 4", generated)
+	}
+}
+
+func TestRegistrationDisabled(t *testing.T) {
+	setConfig(t, "REGISTRATION_MODE", "disabled")
+	setConfig(t, "REGISTRATION_DISABLED_MESSAGE", "Come back in spring.")
+	client, recorder := newTestClient(t)
+
+	w := client.do(http.MethodGet, "/u/register", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Come back in spring.") {
+		t.Errorf("registration page: got %d %q", w.Code, w.Body)
+	}
+
+	// A form that was opened before registration was closed, the page
+	// above has none
+	client.do(http.MethodGet, "/u/login", nil)
+	w = client.do(http.MethodPost, "/u/register", url.Values{
+		"email": {"someone@example.com"}, "password": {"correct horse battery"}})
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Come back in spring.") {
+		t.Errorf("registration: got %d %q", w.Code, w.Body)
+	}
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "INSERT") {
+			t.Errorf("registered a user: %s", statement)
+		}
+	}
+}
+
+func TestRegistrationDisabledDefaultMessage(t *testing.T) {
+	setConfig(t, "REGISTRATION_MODE", "disabled")
+	setConfig(t, "REGISTRATION_DISABLED_MESSAGE", "")
+	client, _ := newTestClient(t)
+
+	if w := client.do(http.MethodGet, "/u/register", nil); !strings.Contains(w.Body.String(), "Registration is currently closed.") {
+		t.Errorf("got %q", w.Body)
+	}
+}
+
+func TestPerformConfirmationTwice(t *testing.T) {
+	setConfig(t, "SAMPLE_RECORDING", "")
+	client, recorder := newTestClient(t)
+
+	token := uuid.New().String()
+	sent := time.Now()
+	user := model.User{Email: "someone@example.com", Token: token, TokenCreatedAt: &sent}
+	user.ID = 1
+	recorder.rows["users: users.token"] = []model.User{user}
+
+	w := client.do(http.MethodGet, "/u/confirm/"+token, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "The email address is confirmed.") {
+		t.Fatalf("first click: got %d %q", w.Code, w.Body)
+	}
+	saved := false
+	for _, statement := range recorder.statements {
+		saved = saved || strings.Contains(statement, "used_token='"+token+"'")
+	}
+	if !saved {
+		t.Errorf("the used token isn't saved: %q", recorder.statements)
+	}
+
+	// The token is cleared now, only the used token finds the user
+	delete(recorder.rows, "users: users.token")
+	user.Status, user.Token, user.UsedToken = 1, "", token
+	recorder.rows["users: users.used_token"] = []model.User{user}
+
+	w = client.do(http.MethodGet, "/u/confirm/"+token, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "The email address has already been confirmed.") {
+		t.Errorf("second click: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestBranding(t *testing.T) {
+	setConfig(t, "BRAND_NAME", "Acme Transcripts")
+	setConfig(t, "BRAND_LOGO_URL", "https://example.com/logo.png")
+	setConfig(t, "BRAND_PRIMARY_COLOR", "#336699")
+	setConfig(t, "SUPPORT_EMAIL", "help@example.com")
+	client, _ := newTestClient(t)
+
+	body := client.do(http.MethodGet, "/u/login", nil).Body.String()
+	for _, want := range []string{
+		"<title>Acme Transcripts</title>",
+		`<img src="https://example.com/logo.png"`,
+		"background-color: #336699",
+		"mailto:help@example.com",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the page has no %q", want)
+		}
+	}
+	if strings.Contains(body, "IMS-Speech") {
+		t.Error("the page has the default brand name")
+	}
+}
+
+func TestBrandingDefaults(t *testing.T) {
+	for _, key := range []string{"BRAND_NAME", "BRAND_LOGO_URL", "BRAND_PRIMARY_COLOR"} {
+		setConfig(t, key, "")
+	}
+	client, _ := newTestClient(t)
+
+	body := client.do(http.MethodGet, "/u/login", nil).Body.String()
+	if !strings.Contains(body, "<title>IMS-Speech</title>") || !strings.Contains(body, "#007bff") {
+		t.Errorf("the page doesn't have the default branding: %q", body)
+	}
+	if strings.Contains(body, "<img") {
+		t.Error("the page has a logo")
+	}
+}
+
+func TestTranscriptSizeLimitTruncate(t *testing.T) {
+	setConfig(t, "MAX_TRANSCRIPT_BYTES", "20")
+	setConfig(t, "TRANSCRIPT_OVERFLOW", "")
+	recorder := dryRun(t)
+
+	recording := model.Recording{UserID: 1}
+	recording.ID = 5
+	utterances := []model.Utterance{{Text: "hello world", End: 1}, {Text: "hello again", Start: 1, End: 2}, {Text: "goodbye", Start: 2, End: 3}}
+	if err := helper.StoreUtterances(&recording, utterances); err != nil {
+		t.Fatal(err)
+	}
+
+	if !recording.TranscriptTruncated || recording.TranscriptFile != "" {
+		t.Errorf("got truncated %v and file %q", recording.TranscriptTruncated, recording.TranscriptFile)
+	}
+	if want := "hello world\n" + helper.TruncationMarker + "\n"; recording.Transcript != want {
+		t.Errorf("got transcript %q, want %q", recording.Transcript, want)
+	}
+
+	var inserted []string
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "INSERT INTO utterances") {
+			inserted = append(inserted, statement)
+		}
+	}
+	if len(inserted) != 2 || !strings.Contains(inserted[1], helper.TruncationMarker) {
+		t.Errorf("got %q, want the first utterance and the marker", inserted)
+	}
+}
+
+func TestTranscriptSizeLimitExternal(t *testing.T) {
+	setConfig(t, "MAX_TRANSCRIPT_BYTES", "20")
+	setConfig(t, "TRANSCRIPT_OVERFLOW", "external")
+	client, recorder := newTestClient(t)
+
+	previous := helper.Store
+	helper.Store = &helper.LocalStorage{Dir: t.TempDir()}
+	t.Cleanup(func() { helper.Store = previous })
+
+	recording := model.Recording{UserID: 1, Title: "talk", Filename: "talk.wav", Status: model.StatusDone}
+	recording.ID = 5
+	utterances := []model.Utterance{{Text: "hello world", End: 1}, {Text: "hello again", Start: 1, End: 2}, {Text: "goodbye", Start: 2, End: 3}}
+	if err := helper.StoreUtterances(&recording, utterances); err != nil {
+		t.Fatal(err)
+	}
+
+	if recording.TranscriptTruncated || recording.TranscriptFile == "" {
+		t.Fatalf("got truncated %v and file %q", recording.TranscriptTruncated, recording.TranscriptFile)
+	}
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "INSERT INTO utterances") {
+			t.Errorf("stored an utterance in the database: %s", statement)
+		}
+	}
+
+	// The download reads the whole transcript from the storage
+	client.login(recorder, testUser())
+	recorder.rows["recordings"] = []model.Recording{recording}
+
+	w := client.do(http.MethodGet, "/recording/view/5/transcript.txt", nil)
+	if want := "hello world\nhello again\ngoodbye\n"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got %d %q, want %q", w.Code, w.Body, want)
+	}
+}
+
+// Run an SMTP server that accepts all messages and configure it for the
+// emails of the test, the messages are sent on the returned channel
+func fakeSMTP(t *testing.T) <-chan string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	setConfig(t, "SMTP_HOST", host)
+	setConfig(t, "SMTP_PORT", port)
+	setConfig(t, "SMTP_USER", "")
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, "220 localhost\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.TrimSpace(line)); {
+					case command == "DATA":
+						io.WriteString(conn, "354 go ahead\r\n")
+						var message strings.Builder
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							message.WriteString(line)
+						}
+						messages <- message.String()
+						io.WriteString(conn, "250 ok\r\n")
+					case command == "QUIT":
+						io.WriteString(conn, "221 bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return messages
+}
+
+func TestResendNotification(t *testing.T) {
+	messages := fakeSMTP(t)
+	setConfig(t, "NOTIFY_RESEND_MAX", "2")
+	client, recorder := newTestClient(t)
+
+	user := testUser()
+	client.login(recorder, user)
+
+	recording := model.Recording{UserID: 1, Title: "talk", Status: model.StatusDone}
+	recording.ID = 5
+	recorder.rows["recordings"] = []model.Recording{recording}
+	client.do(http.MethodGet, "/recording/view/5", nil)
+
+	for i := 0; i < 2; i++ {
+		if w := client.do(http.MethodPost, "/recording/notify/5", url.Values{}); w.Code != http.StatusSeeOther {
+			t.Fatalf("request %d: got %d", i+1, w.Code)
+		}
+		select {
+		case message := <-messages:
+			if !strings.Contains(message, "To: someone@example.com") || !strings.Contains(message, "/recording/view/5") {
+				t.Errorf("request %d: got %q", i+1, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d: no email was sent", i+1)
+		}
+	}
+
+	// NOTIFY_RESEND_MAX is reached
+	if w := client.do(http.MethodPost, "/recording/notify/5", url.Values{}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// Only transcribed recordings have a notification
+	recording.Status = model.StatusQueued
+	recorder.rows["recordings"] = []model.Recording{recording}
+	if w := client.do(http.MethodPost, "/recording/notify/5", url.Values{}); w.Code != http.StatusConflict {
+		t.Errorf("queued recording: got %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	// And only the owner can ask for it
+	recording.UserID = 2
+	recording.Status = model.StatusDone
+	recorder.rows["recordings"] = []model.Recording{recording}
+	if w := client.do(http.MethodPost, "/recording/notify/5", url.Values{}); w.Code != http.StatusUnauthorized {
+		t.Errorf("other user's recording: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if len(messages) > 0 {
+		t.Errorf("sent %d more emails", len(messages))
+	}
+}
+
+func TestProfilingEndpoints(t *testing.T) {
+	for _, c := range []struct {
+		enabled string
+		allowed string
+		client  string
+		status  int
+	}{
+		{"", "", "127.0.0.1:1234", http.StatusNotFound},
+		{"false", "", "127.0.0.1:1234", http.StatusNotFound},
+		{"true", "", "192.0.2.1:1234", http.StatusForbidden},
+		{"true", "", "127.0.0.1:1234", http.StatusOK},
+		{"true", "192.0.2.7, 192.0.2.1", "192.0.2.1:1234", http.StatusOK},
+		{"true", "192.0.2.7", "127.0.0.1:1234", http.StatusForbidden},
+	} {
+		setConfig(t, "PPROF_ENABLED", c.enabled)
+		setConfig(t, "PPROF_ALLOWED_IPS", c.allowed)
+		client, _ := newTestClient(t)
+
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = c.client
+			w := httptest.NewRecorder()
+			client.router.ServeHTTP(w, req)
+
+			if w.Code != c.status {
+				t.Errorf("enabled %q, allowed %q, client %s, %s: got %d, want %d", c.enabled, c.allowed, c.client, path, w.Code, c.status)
+			}
+		}
+	}
+}
+
+func TestProfilingForwardedFor(t *testing.T) {
+	setConfig(t, "PPROF_ENABLED", "true")
+
+	for _, c := range []struct {
+		trusted string
+		status  int
+	}{
+		{"", http.StatusForbidden},
+		{"192.0.2.1", http.StatusOK},
+	} {
+		setConfig(t, "TRUSTED_PROXIES", c.trusted)
+		client, _ := newTestClient(t)
+
+		// A remote client claims to be local
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		w := httptest.NewRecorder()
+		client.router.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("trusted %q: got %d, want %d", c.trusted, w.Code, c.status)
+		}
+	}
+}
+
+func TestProcessingRate(t *testing.T) {
+	setConfig(t, "ESTIMATE_MIN_SAMPLES", "2")
+	recorder := dryRun(t)
+
+	finishedAt := time.Now()
+	startedAt := finishedAt.Add(-time.Minute)
+	recorder.rows["recordings"] = []model.Recording{{Duration: 60, StartedAt: &startedAt, FinishedAt: &finishedAt}}
+
+	// Not enough history
+	if _, ok := helper.ProcessingRate(); ok {
+		t.Error("got a rate from one recording")
+	}
+
+	slowStart := finishedAt.Add(-3 * time.Minute)
+	recorder.rows["recordings"] = []model.Recording{
+		{Duration: 60, StartedAt: &startedAt, FinishedAt: &finishedAt},
+		{Duration: 60, StartedAt: &slowStart, FinishedAt: &finishedAt}}
+	if rate, ok := helper.ProcessingRate(); !ok || rate != 2 {
+		t.Errorf("got %v, %v, want 2", rate, ok)
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	setConfig(t, "COMPRESSION_ENABLED", "true")
+	setConfig(t, "COMPRESSION_MIN_BYTES", "100")
+	setConfig(t, "COMPRESSION_EXCLUDED_TYPES", "")
+
+	large := strings.Repeat("hello ", 100)
+	router := gin.New()
+	router.Use(compressResponses())
+	router.GET("/large", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"text": large}) })
+	router.GET("/small", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"text": "hello"}) })
+	router.GET("/audio", func(c *gin.Context) { c.Data(http.StatusOK, "audio/wav", []byte(large)) })
+	router.GET("/stream", func(c *gin.Context) {
+		c.SSEvent("segment", large)
+		c.Writer.Flush()
+	})
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		w := serve(router, http.MethodGet, "/large", http.Header{"Accept-Encoding": {encoding}})
+		if w.Header().Get("Content-Encoding") != encoding {
+			t.Errorf("%s: got Content-Encoding %q", encoding, w.Header().Get("Content-Encoding"))
+			continue
+		}
+		if w.Body.Len() >= len(large) {
+			t.Errorf("%s: the body of %d bytes isn't compressed", encoding, w.Body.Len())
+		}
+		r, err := decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, err := ioutil.ReadAll(r); err != nil || !strings.Contains(string(body), large) {
+			t.Errorf("%s: got %q, %v", encoding, body, err)
+		}
+	}
+
+	for _, c := range []struct {
+		path     string
+		encoding string
+	}{
+		{"/small", "gzip"},
+		{"/large", ""},
+		{"/large", "br"},
+		{"/audio", "gzip"},
+		{"/stream", "gzip"},
+	} {
+		w := serve(router, http.MethodGet, c.path, http.Header{"Accept-Encoding": {c.encoding}})
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with %q: compressed with %s", c.path, c.encoding, w.Header().Get("Content-Encoding"))
+		}
+		if !strings.Contains(w.Body.String(), "hello") {
+			t.Errorf("%s with %q: got %q", c.path, c.encoding, w.Body)
+		}
+	}
+}
+
+func TestCompressResponsesDisabled(t *testing.T) {
+	setConfig(t, "COMPRESSION_ENABLED", "")
+
+	router := gin.New()
+	router.Use(compressResponses())
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("hello ", 1000)) })
+
+	if w := serve(router, http.MethodGet, "/", http.Header{"Accept-Encoding": {"gzip"}}); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("compressed with %s", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestDefaultExportFormat(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	user := testUser()
+	user.DefaultExportFormat = "vtt"
+	client.login(recorder, user)
+
+	recording := model.Recording{UserID: 1, Title: "talk", Filename: "talk.wav", Status: model.StatusDone}
+	recording.ID = 5
+	recorder.rows["recordings"] = []model.Recording{recording}
+
+	for _, c := range []struct {
+		query    string
+		filename string
+	}{
+		{"", "talk.vtt"},
+		{"?format=srt", "talk.srt"},
+	} {
+		w := client.do(http.MethodGet, "/recording/download/5"+c.query, nil)
+		if want := "attachment; filename=" + c.filename; w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != want {
+			t.Errorf("format %q: got %d %q, want %q", c.query, w.Code, w.Header().Get("Content-Disposition"), want)
+		}
+	}
+
+	// Without a preference, SRT is the default
+	user.DefaultExportFormat = ""
+	recorder.rows["users"] = []model.User{user}
+	if w := client.do(http.MethodGet, "/recording/download/5", nil); w.Header().Get("Content-Disposition") != "attachment; filename=talk.srt" {
+		t.Errorf("no preference: got %d %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+
+	if w := client.do(http.MethodGet, "/recording/download/5?format=mp3", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported format: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUpdateAccountExportFormat(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	client.login(recorder, testUser())
+	client.do(http.MethodGet, "/u/account", nil)
+
+	if w := client.do(http.MethodPost, "/u/account", url.Values{"default_export_format": {"mp3"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported format: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	recorder.statements = nil
+	client.do(http.MethodPost, "/u/account", url.Values{"default_export_format": {"vtt"}})
+	saved := false
+	for _, statement := range recorder.statements {
+		saved = saved || strings.Contains(statement, "default_export_format='vtt'")
+	}
+	if !saved {
+		t.Errorf("the preference isn't saved: %q", recorder.statements)
+	}
+}
+
+func TestUniqueRecordingTitles(t *testing.T) {
+	setConfig(t, "UNIQUE_RECORDING_TITLES", "true")
+	recorder := dryRun(t)
+
+	// The title is only taken by recordings that are listed
+	titleTaken(1, "talk")
+	if want := fmt.Sprintf("NOT status IN (%d,%d)", model.StatusUploaded, model.StatusDeleted); len(recorder.statements) != 1 || !strings.Contains(recorder.statements[0], want) {
+		t.Errorf("got %q, want %s", recorder.statements, want)
+	}
+
+	recorder.rows["recordings"] = []model.Recording{{UserID: 1, Title: "talk"}}
+	if _, err := createRecording(1, "talk", "talk.wav", "en", false, nil); err != errDuplicateTitle {
+		t.Errorf("got %v, want %v", err, errDuplicateTitle)
+	}
+
+	recorder.rows["recordings"] = []model.Recording{}
+	if _, err := createRecording(1, "talk", "talk.wav", "en", false, nil); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUniqueRecordingTitlesDisabled(t *testing.T) {
+	setConfig(t, "UNIQUE_RECORDING_TITLES", "")
+	recorder := dryRun(t)
+
+	recorder.rows["recordings"] = []model.Recording{{UserID: 1, Title: "talk"}}
+	if _, err := createRecording(1, "talk", "talk.wav", "en", false, nil); err != nil {
+		t.Errorf("got %v", err)
+	}
+	for _, statement := range recorder.statements {
+		if strings.Contains(statement, "count(1)") {
+			t.Errorf("checked the title: %s", statement)
+		}
+	}
+}
+
+func TestRenameRecordingUniqueTitle(t *testing.T) {
+	for _, c := range []struct {
+		unique string
+		status int
+	}{
+		{"true", http.StatusConflict},
+		{"", http.StatusSeeOther},
+	} {
+		setConfig(t, "UNIQUE_RECORDING_TITLES", c.unique)
+		client, recorder := newTestClient(t)
+
+		client.login(recorder, testUser())
+
+		// The other recording with the title is found as well
+		recording := model.Recording{UserID: 1, Title: "talk", Status: model.StatusDone}
+		recording.ID = 5
+		recorder.rows["recordings"] = []model.Recording{recording}
+		client.do(http.MethodGet, "/recording/view/5", nil)
+
+		if w := client.do(http.MethodPost, "/recording/view/5/rename", url.Values{"title": {"interview"}}); w.Code != c.status {
+			t.Errorf("unique %q: got %d, want %d", c.unique, w.Code, c.status)
+		}
+	}
+}
+
+func TestRetranscribeRecordingStatus(t *testing.T) {
+	for _, c := range []struct {
+		status model.RecordingStatus
+		queued bool
+	}{
+		{model.StatusUploaded, false},
+		{model.StatusQueued, false},
+		{model.StatusProcessing, false},
+		{model.StatusLanguageUnconfirmed, false},
+		{model.StatusDone, true},
+		{model.StatusFailed, true},
+		{model.StatusNoSpeech, true},
+	} {
+		client, recorder := newTestClient(t)
+
+		client.login(recorder, testUser())
+
+		recording := model.Recording{UserID: 1, Title: "talk", Status: c.status}
+		recording.ID = 5
+		recorder.rows["recordings"] = []model.Recording{recording}
+		client.do(http.MethodGet, "/recording/view/5", nil)
+
+		recorder.statements = nil
+		w := client.do(http.MethodPost, "/recording/view/5/retranscribe", url.Values{"language": {"en"}})
+		if !c.queued && w.Code != http.StatusConflict {
+			t.Errorf("%s: got %d, want %d", c.status, w.Code, http.StatusConflict)
+		}
+		updated := false
+		for _, statement := range recorder.statements {
+			updated = updated || strings.Contains(statement, "UPDATE recordings SET") && strings.Contains(statement, "status IN (3,5,4)")
+		}
+		if updated != c.queued {
+			t.Errorf("%s: queued again %v, want %v: %q", c.status, updated, c.queued, recorder.statements)
+		}
+	}
+}
+
+func TestSyncTitleIndex(t *testing.T) {
+	for _, c := range []struct {
+		unique    string
+		statement string
+	}{
+		{"true", "CREATE UNIQUE INDEX IF NOT EXISTS idx_recordings_unique_title ON recordings (user_id, title) WHERE status NOT IN (0, 7) AND deleted_at IS NULL"},
+		{"", "DROP INDEX IF EXISTS idx_recordings_unique_title"},
+	} {
+		setConfig(t, "UNIQUE_RECORDING_TITLES", c.unique)
+		recorder := dryRun(t)
+
+		syncTitleIndex()
+		if len(recorder.statements) != 1 || recorder.statements[0] != c.statement {
+			t.Errorf("unique %q: got %q", c.unique, recorder.statements)
+		}
+	}
+}
+
+// A title taken by a concurrent request is only found by the index
+func TestTitleError(t *testing.T) {
+	violation := errors.New(`ERROR: duplicate key value violates unique constraint "idx_recordings_unique_title" (SQLSTATE 23505)`)
+	if err := titleError(violation); err != errDuplicateTitle {
+		t.Errorf("got %v", err)
+	}
+
+	other := errors.New("connection refused")
+	if err := titleError(other); err != other {
+		t.Errorf("got %v", err)
+	}
+	if err := titleError(nil); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	setConfig(t, "IMPERSONATION_READ_ONLY", "true")
+	client, recorder := newTestClient(t)
+
+	admin := model.User{Email: "admin@example.com", Status: 1, IsAdmin: true}
+	admin.ID = 1
+	target := testUser()
+	target.ID = 2
+	client.login(recorder, admin)
+	recorder.rows["users: users.id = 1"] = []model.User{admin}
+	recorder.rows["users: users.id = 2"] = []model.User{target}
+	client.do(http.MethodGet, "/", nil)
+
+	audited := func(action string) bool {
+		for _, statement := range recorder.statements {
+			if strings.HasPrefix(statement, "INSERT INTO audit_logs") && strings.Contains(statement, "'"+action+"'") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if w := client.do(http.MethodPost, "/admin/impersonate/2", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if !audited("impersonation started") {
+		t.Errorf("the impersonation isn't audited: %q", recorder.statements)
+	}
+
+	banner := "Impersonating <strong>someone@example.com</strong>"
+	if w := client.do(http.MethodGet, "/", nil); !strings.Contains(w.Body.String(), banner) {
+		t.Errorf("the page has no banner: %q", w.Body)
+	}
+
+	// Changes are rejected with IMPERSONATION_READ_ONLY
+	if w := client.do(http.MethodPost, "/u/account", url.Values{"default_export_format": {"vtt"}}); w.Code != http.StatusForbidden {
+		t.Errorf("change: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if !audited("impersonated request rejected") {
+		t.Errorf("the rejected change isn't audited: %q", recorder.statements)
+	}
+
+	if w := client.do(http.MethodPost, "/u/impersonation/stop", url.Values{}); w.Code != http.StatusSeeOther {
+		t.Errorf("stop: got %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if !audited("impersonation stopped") {
+		t.Errorf("the end of the impersonation isn't audited: %q", recorder.statements)
+	}
+	if w := client.do(http.MethodGet, "/", nil); strings.Contains(w.Body.String(), "Impersonating") {
+		t.Errorf("the page still has the banner: %q", w.Body)
+	}
+}
+
+func TestImpersonationExpires(t *testing.T) {
+	setConfig(t, "IMPERSONATION_MINUTES", "0")
+	client, recorder := newTestClient(t)
+
+	admin := model.User{Email: "admin@example.com", Status: 1, IsAdmin: true}
+	admin.ID = 1
+	target := testUser()
+	target.ID = 2
+	client.login(recorder, admin)
+	recorder.rows["users: users.id = 1"] = []model.User{admin}
+	recorder.rows["users: users.id = 2"] = []model.User{target}
+	client.do(http.MethodGet, "/", nil)
+
+	client.do(http.MethodPost, "/admin/impersonate/2", url.Values{})
+	if w := client.do(http.MethodGet, "/", nil); strings.Contains(w.Body.String(), "Impersonating") {
+		t.Errorf("the expired impersonation goes on: %q", w.Body)
+	}
+	expired := false
+	for _, statement := range recorder.statements {
+		expired = expired || strings.Contains(statement, "'impersonation expired'")
+	}
+	if !expired {
+		t.Errorf("the expiry isn't audited: %q", recorder.statements)
+	}
+}
+
+func TestImpersonationRequiresAdmin(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	client.login(recorder, testUser())
+	client.do(http.MethodGet, "/", nil)
+
+	if w := client.do(http.MethodPost, "/admin/impersonate/2", url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestConnectStorageStoresLegacyNames(t *testing.T) {
+	setConfig(t, "STORAGE_BACKEND", "")
+	setConfig(t, "STORAGE_ENCRYPTION_KEYS", "")
+	setConfig(t, "DATA_DIR", t.TempDir())
+	recorder := dryRun(t)
+
+	previous := helper.Store
+	t.Cleanup(func() { helper.Store = previous })
+
+	recording := model.Recording{}
+	recording.ID = 3
+	recorder.rows["recordings"] = []model.Recording{recording}
+
+	helper.ConnectStorage()
+
+	stored := false
+	for _, statement := range recorder.statements {
+		stored = stored || strings.Contains(statement, "storage_path='0000003.dat'")
+	}
+	if !stored {
+		t.Errorf("the name isn't stored: %q", recorder.statements)
+	}
+}
+
+func TestExportedUtterancesWindow(t *testing.T) {
+	utterances := []model.Utterance{
+		{Start: 0, End: 4, Text: "before"},
+		{Start: 4, End: 12, Text: "across the start"},
+		{Start: 12, End: 18, Text: "inside"},
+		{Start: 18, End: 25, Text: "across the end"},
+		{Start: 25, End: 30, Text: "after"},
+	}
+
+	var exported []model.Utterance
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		exported = exportedUtterances(c, utterances)
+	})
+
+	serve(router, http.MethodGet, "/?start=10&end=20", nil)
+	want := []model.Utterance{
+		{Start: 10, End: 12, Text: "across the start"},
+		{Start: 12, End: 18, Text: "inside"},
+		{Start: 18, End: 20, Text: "across the end"},
+	}
+	if !reflect.DeepEqual(exported, want) {
+		t.Errorf("got %v, want %v", exported, want)
+	}
+
+	// Utterances that only touch the window are not in it
+	serve(router, http.MethodGet, "/?start=4&end=12", nil)
+	if len(exported) != 1 || exported[0].Text != "across the start" {
+		t.Errorf("got %v, want the utterance from 4 to 12", exported)
+	}
+
+	serve(router, http.MethodGet, "/?start=20", nil)
+	if len(exported) != 2 || exported[0].Start != 20 || exported[1].End != 30 {
+		t.Errorf("open end: got %v", exported)
+	}
+
+	serve(router, http.MethodGet, "/?start=40&end=50", nil)
+	if exported == nil || len(exported) != 0 {
+		t.Errorf("empty window: got %#v, want no utterances", exported)
+	}
+
+	for _, query := range []string{"start=-1", "start=abc", "start=10&end=10", "start=10&end=5", "end=0"} {
+		if w := serve(router, http.MethodGet, "/?"+query, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestExportEmptyWindow(t *testing.T) {
+	exportSlots = helper.NewSemaphore(1)
+	exportCache = helper.NewCache(time.Minute, 1024, 1024, "")
+
+	recording := model.Recording{Filename: "talk.wav"}
+	recording.ID = 1
+	utterances := []model.Utterance{{Start: 0, End: 4, Text: "hello"}}
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		sendWebVTT(c, &recording, utterances)
+	})
+
+	if w := serve(router, http.MethodGet, "/?start=10&end=20", nil); w.Code != http.StatusOK || w.Body.String() != "WEBVTT\n" {
+		t.Errorf("got %d %q, want an empty WebVTT file", w.Code, w.Body)
+	}
+}
+
+func TestSendExportConcurrency(t *testing.T) {
+	setConfig(t, "EXPORT_QUEUE_SECONDS", "1")
+	exportSlots = helper.NewSemaphore(1)
+	exportCache = helper.NewCache(time.Minute, 1024, 1024, "")
+
+	recording := model.Recording{Filename: "talk.wav"}
+	recording.ID = 1
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		sendExport(c, &recording, nil, "txt", "text/plain", func(w io.Writer) error {
+			if c.Query("slow") != "" {
+				close(started)
+				<-finish
+			}
+			_, err := io.WriteString(w, "hello")
+			return err
+		})
+	})
+
+	// The only slot is taken by a slow export
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- serve(router, http.MethodGet, "/?slow=1", nil) }()
+	<-started
+
+	w := serve(router, http.MethodGet, "/?start=1", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q, want %d with 1", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+
+	close(finish)
+	if w := <-slow; w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("slow export: got %d %q", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodGet, "/?start=2", nil); w.Code != http.StatusOK {
+		t.Errorf("after the slow export: got %d", w.Code)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	setConfig(t, "MAX_RECORDING_EVENTS", "2")
+	recorder := dryRun(t)
+
+	for _, event := range []string{"uploaded", "queued", "processing started"} {
+		helper.RecordEvent(5, event, "")
+	}
+
+	var recorded []string
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "INSERT INTO recording_events") {
+			recorded = append(recorded, statement)
+		}
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("got %q, want 3 events", recorded)
+	}
+	for i, event := range []string{"uploaded", "queued", "processing started"} {
+		if !strings.Contains(recorded[i], "'"+event+"'") {
+			t.Errorf("event %d: got %s, want %s", i+1, recorded[i], event)
+		}
+	}
+
+	// Older events than the last MAX_RECORDING_EVENTS are deleted
+	recorder.statements = nil
+	expired := model.RecordingEvent{RecordingID: 5, Event: "uploaded"}
+	expired.ID = 1
+	recorder.rows["recording_events"] = []model.RecordingEvent{expired}
+	helper.RecordEvent(5, "transcribed", "")
+
+	want := []string{"ORDER BY id desc OFFSET 2", "DELETE FROM recording_events WHERE recording_events.id = 1"}
+	for _, want := range want {
+		found := false
+		for _, statement := range recorder.statements {
+			found = found || strings.Contains(statement, want)
+		}
+		if !found {
+			t.Errorf("got %q, want %s", recorder.statements, want)
+		}
+	}
+}
+
+func TestShowRecordingEvents(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	user := testUser()
+	client.login(recorder, user)
+
+	recording := model.Recording{UserID: 1, Title: "talk", Status: model.StatusQueued}
+	recording.ID = 5
+	recorder.rows["recordings"] = []model.Recording{recording}
+	recorder.rows["recording_events"] = []model.RecordingEvent{
+		{RecordingID: 5, Event: "uploaded"},
+		{RecordingID: 5, Event: "queued"}}
+
+	recorder.statements = nil
+	w := client.do(http.MethodGet, "/recording/events/5", nil)
+	if w.Code != http.StatusOK || !regexp.MustCompile(`"event":"uploaded".*"event":"queued"`).MatchString(w.Body.String()) {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	ordered := false
+	for _, statement := range recorder.statements {
+		ordered = ordered || strings.Contains(statement, "FROM recording_events WHERE recording_events.recording_id = 5 ORDER BY id asc")
+	}
+	if !ordered {
+		t.Errorf("the events aren't queried oldest first: %q", recorder.statements)
+	}
+
+	// Only the owner sees them
+	recording.UserID = 2
+	recorder.rows["recordings"] = []model.Recording{recording}
+	if w := client.do(http.MethodGet, "/recording/events/5", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("other user's recording: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOpenAPIRoutesRegistered(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	if missing := missingOpenAPIRoutes(client.router); len(missing) > 0 {
+		t.Errorf("documented routes that don't exist: %q", missing)
+	}
+
+	// A router without the routes has none of them
+	if missing := missingOpenAPIRoutes(gin.New()); len(missing) != len(helper.OpenAPIRoutes()) {
+		t.Errorf("got %d missing routes, want %d", len(missing), len(helper.OpenAPIRoutes()))
+	}
+}
+
+func TestShowOpenAPISpec(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+	w := httptest.NewRecorder()
+	client.router.ServeHTTP(w, req)
+
+	var spec struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("got %d %q: %v", w.Code, w.Body, err)
+	}
+	if spec.OpenAPI != "3.0.3" || spec.Paths["/recording/view/{recording_id}"] == nil {
+		t.Errorf("got %q", w.Body)
+	}
+}
+
+func TestRecordingsXML(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	client.login(recorder, testUser())
+
+	recordings := []model.Recording{{UserID: 1, Title: "first"}, {UserID: 1, Title: "second"}}
+	recordings[0].ID, recordings[1].ID = 1, 2
+	recorder.rows["recordings"] = recordings
+	client.accept = "application/xml"
+
+	for _, path := range []string{"/", "/u/trash"} {
+		w := client.do(http.MethodGet, path, nil)
+
+		var list RecordingList
+		if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Errorf("%s: got %d %q: %v", path, w.Code, w.Body, err)
+			continue
+		}
+		if list.XMLName.Local != "recordings" || len(list.Recordings) != 2 || list.Recordings[1].Title != "second" {
+			t.Errorf("%s: got %+v", path, list)
+		}
+	}
+}
+
+func TestRecordingXML(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	client.login(recorder, testUser())
+
+	recording := model.Recording{UserID: 1, Title: "talk", Status: model.StatusDone}
+	recording.ID = 5
+	recorder.rows["recordings"] = []model.Recording{recording}
+	recorder.rows["utterances"] = []model.Utterance{{Text: "hello"}, {Text: "world"}}
+	client.accept = "application/xml"
+
+	w := client.do(http.MethodGet, "/recording/view/5", nil)
+
+	var payload recordingPayload
+	if err := xml.Unmarshal(w.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("got %d %q: %v", w.Code, w.Body, err)
+	}
+	if payload.XMLName.Local != "recording" || payload.Recording == nil || payload.Title != "talk" || len(payload.Utterances) != 2 {
+		t.Errorf("got %q", w.Body)
+	}
+}
+
+// Return a multipart upload of a WAV file of size bytes
+func uploadBody(t *testing.T, size int) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+
+	file, err := form.CreateFormFile("content", "talk.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	copy(data, "RIFF\x00\x00\x00\x00WAVEfmt ")
+	file.Write(data)
+	form.WriteField("language", "en")
+	form.Close()
+
+	return body, form.FormDataContentType()
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	setConfig(t, "MAX_UPLOAD_BYTES", "1000")
+	setConfig(t, "MAX_UPLOAD_FILES", "1")
+	client, recorder := newTestClient(t)
+
+	previous := helper.Store
+	dir := t.TempDir()
+	helper.Store = &helper.LocalStorage{Dir: dir}
+	t.Cleanup(func() { helper.Store = previous })
+
+	client.login(recorder, testUser())
+	client.do(http.MethodGet, "/recording/upload", nil)
+
+	for _, c := range []struct {
+		name    string
+		size    int
+		chunked bool
+	}{
+		{"file", 2000, false},
+		{"request", 2 << 20, false},
+		{"chunked request", 2 << 20, true},
+	} {
+		recorder.statements = nil
+		body, contentType := uploadBody(t, c.size)
+		req := httptest.NewRequest(http.MethodPost, "/recording/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		if c.chunked {
+			req.ContentLength = -1
+		}
+
+		w := client.send(req)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "The file is too large") {
+			t.Errorf("%s: got %d %q", c.name, w.Code, w.Body)
+		}
+		for _, statement := range recorder.statements {
+			if strings.HasPrefix(statement, "INSERT INTO recordings") {
+				t.Errorf("%s: created a recording: %s", c.name, statement)
+			}
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+			t.Errorf("%s: stored %d files", c.name, len(files))
+		}
+	}
+}
+
+func TestUploadErrorMessages(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	client.login(recorder, testUser())
+	client.do(http.MethodGet, "/recording/upload", nil)
+	client.accept = "application/json"
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, _ := form.CreateFormFile("content", "talk.wav")
+	file.Write([]byte("RIFF\x00\x00\x00\x00WAVEfmt "))
+	form.WriteField("normalize", "maybe")
+	form.Close()
+
+	for _, c := range []struct {
+		name        string
+		body        io.Reader
+		contentType string
+		want        string
+	}{
+		{"normalize", body, form.FormDataContentType(), `{"error":"Invalid value of normalize, it must be true or false","status":400}`},
+		{"form", strings.NewReader("content"), "text/plain", `{"error":"The upload could not be read","status":400}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/recording/upload", c.body)
+		req.Header.Set("Content-Type", c.contentType)
+
+		// The cause, e.g. of strconv, isn't shown to the client
+		if w := client.send(req); w.Code != http.StatusBadRequest || w.Body.String() != c.want {
+			t.Errorf("%s: got %d %s, want %s", c.name, w.Code, w.Body, c.want)
+		}
+	}
+}
+
+func TestConfirmationTokenExpiry(t *testing.T) {
+	setConfig(t, "CONFIRM_TOKEN_HOURS", "48")
+	setConfig(t, "SAMPLE_RECORDING", "")
+
+	withinWindow := time.Now().Add(-47 * time.Hour)
+	expired := time.Now().Add(-49 * time.Hour)
+	for _, c := range []struct {
+		name   string
+		sent   *time.Time
+		status int
+		page   string
+	}{
+		{"within the window", &withinWindow, http.StatusOK, "The email address is confirmed."},
+		{"expired", &expired, http.StatusBadRequest, "The confirmation link has expired."},
+		{"sent without a time", nil, http.StatusBadRequest, "The confirmation link has expired."},
+	} {
+		client, recorder := newTestClient(t)
+
+		token := uuid.New().String()
+		user := model.User{Email: "someone@example.com", Token: token, TokenCreatedAt: c.sent}
+		user.ID = 1
+		recorder.rows["users: users.token = '"+token+"'"] = []model.User{user}
+
+		w := client.do(http.MethodGet, "/u/confirm/"+token, nil)
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.page) {
+			t.Errorf("%s: got %d %q", c.name, w.Code, w.Body)
+		}
+
+		cleared := false
+		for _, statement := range recorder.statements {
+			cleared = cleared || strings.Contains(statement, "token=''")
+		}
+		if !cleared {
+			t.Errorf("%s: the token isn't cleared: %q", c.name, recorder.statements)
+		}
+	}
+}
+
+func TestResetTokenExpiry(t *testing.T) {
+	withinWindow := time.Now().Add(time.Minute)
+	expired := time.Now().Add(-time.Minute)
+	for _, c := range []struct {
+		name    string
+		expires *time.Time
+		status  int
+		page    string
+	}{
+		{"within the window", &withinWindow, http.StatusOK, "Change password"},
+		{"expired", &expired, http.StatusBadRequest, "The password reset link has expired."},
+		{"without expiry", nil, http.StatusBadRequest, "The password reset link has expired."},
+	} {
+		client, recorder := newTestClient(t)
+
+		token := uuid.New().String()
+		user := testUser()
+		user.ResetToken, user.ResetTokenExpires = token, c.expires
+		recorder.rows["users: users.reset_token = '"+token+"'"] = []model.User{user}
+
+		w := client.do(http.MethodGet, "/u/reset/"+token, nil)
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.page) {
+			t.Errorf("%s: got %d %q", c.name, w.Code, w.Body)
+		}
+
+		cleared := false
+		for _, statement := range recorder.statements {
+			cleared = cleared || strings.Contains(statement, "reset_token=''")
+		}
+		if cleared != (c.status != http.StatusOK) {
+			t.Errorf("%s: got the token cleared %v: %q", c.name, cleared, recorder.statements)
+		}
+	}
+}
+
+// A request for the recordings list with the query of the path
+func recordingsRequest(path string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, path, nil)
+	return c
+}
+
+func TestRecordingsPagination(t *testing.T) {
+	recorder := dryRun(t)
+
+	user := testUser()
+	recordings := make([]model.Recording, 5)
+	for i := range recordings {
+		recordings[i] = model.Recording{UserID: user.ID, Title: fmt.Sprintf("talk %d", i+1)}
+		recordings[i].ID = uint(i + 1)
+	}
+	recorder.rows["recordings"] = recordings
+
+	list := getRecordingsPage(recordingsRequest("/?page=2&per_page=2"), user.ID)
+
+	if list.Page != 2 || list.PerPage != 2 || list.Pages != 3 || list.Total != 5 || list.PrevPage != 1 || list.NextPage != 3 || !list.HasNext {
+		t.Errorf("got %+v", list)
+	}
+	paged := false
+	for _, statement := range recorder.statements {
+		paged = paged || strings.Contains(statement, "LIMIT 2 OFFSET 2")
+	}
+	if !paged {
+		t.Errorf("the second page isn't queried: %q", recorder.statements)
+	}
+
+	// The keys of the payload are what the API clients rely on
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"recordings", "page", "per_page", "pages", "total", "prev_page", "next_page", "has_next", "filters"} {
+		if _, ok := payload[key]; !ok {
+			t.Errorf("got %s, want the key %s", data, key)
+		}
+	}
+}
+
+func TestRecordingsLastPage(t *testing.T) {
+	recorder := dryRun(t)
+
+	user := testUser()
+	recorder.rows["recordings"] = []model.Recording{{UserID: user.ID, Title: "talk"}}
+
+	list := getRecordingsPage(recordingsRequest("/"), user.ID)
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["has_next"] != false || payload["pages"] != 1.0 {
+		t.Errorf("got %s", data)
+	}
+	for _, key := range []string{"prev_page", "next_page"} {
+		if _, ok := payload[key]; ok {
+			t.Errorf("got %s, want no %s on the only page", data, key)
+		}
+	}
+}
+
+func TestTimeAgo(t *testing.T) {
+	old := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		time time.Time
+		ago  string
+	}{
+		{time.Now().Add(-10 * time.Second), "just now"},
+		{time.Now().Add(-time.Minute), "1 minute ago"},
+		{time.Now().Add(-5 * time.Minute), "5 minutes ago"},
+		{time.Now().Add(-3 * time.Hour), "3 hours ago"},
+		{time.Now().Add(-3 * 24 * time.Hour), "3 days ago"},
+		{old, "2020-01-02"},
+	} {
+		if ago := timeAgo(c.time); ago != c.ago {
+			t.Errorf("%v: got %q, want %q", c.time, ago, c.ago)
+		}
+	}
+}
+
+func TestRecordingTimestamps(t *testing.T) {
+	recorder := dryRun(t)
+
+	user := testUser()
+	recording := model.Recording{UserID: user.ID, Title: "talk"}
+	recording.ID = 5
+	recording.CreatedAt = time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+	recording.UpdatedAt = time.Date(2020, 9, 2, 8, 30, 0, 0, time.UTC)
+	recorder.rows["recordings"] = []model.Recording{recording}
+
+	data, err := json.Marshal(getRecordingsPage(recordingsRequest("/"), user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Recordings []map[string]interface{} `json:"recordings"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil || len(list.Recordings) != 1 {
+		t.Fatalf("got %s: %v", data, err)
+	}
+
+	// The keys of the embedded gorm.Model, which the clients already use
+	if created := list.Recordings[0]["CreatedAt"]; created != "2020-09-01T12:00:00Z" {
+		t.Errorf("got CreatedAt %v", created)
+	}
+	if updated := list.Recordings[0]["UpdatedAt"]; updated != "2020-09-02T08:30:00Z" {
+		t.Errorf("got UpdatedAt %v", updated)
+	}
+}
+
+func TestRecordingsSort(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		order string
+	}{
+		{"", "ORDER BY created_at desc, id desc"},
+		{"?sort=updated_at", "ORDER BY updated_at desc, id desc"},
+		{"?sort=updated_at&order=asc", "ORDER BY updated_at asc, id asc"},
+		{"?sort=password", "ORDER BY created_at desc, id desc"},
+	} {
+		recorder := dryRun(t)
+
+		getRecordingsPage(recordingsRequest("/"+c.query), testUser().ID)
+
+		sorted := false
+		for _, statement := range recorder.statements {
+			sorted = sorted || strings.Contains(statement, "FROM recordings") && strings.Contains(statement, c.order)
+		}
+		if !sorted {
+			t.Errorf("%q: got %q, want %s", c.query, recorder.statements, c.order)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, c := range []struct {
+		trusted   string
+		peer      string
+		forwarded string
+		ip        string
+	}{
+		{"", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"192.0.2.1", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1:1234", "unknown", "192.0.2.1"},
+		{"192.0.2.7", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		// The client may send its own header, which the proxies append to
+		{"192.0.2.0/24", "192.0.2.1:1234", "203.0.113.9, 198.51.100.7, 192.0.2.2", "198.51.100.7"},
+	} {
+		setConfig(t, "TRUSTED_PROXIES", c.trusted)
+
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Request.RemoteAddr = c.peer
+		if c.forwarded != "" {
+			ctx.Request.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		if ip := clientIP(ctx); ip != c.ip {
+			t.Errorf("trusted %q, peer %s, forwarded %q: got %s, want %s", c.trusted, c.peer, c.forwarded, ip, c.ip)
+		}
+	}
+}
+
+func TestTwoFactorLoginFailedLogins(t *testing.T) {
+	client, recorder := newTestClient(t)
+
+	codes, hashes, err := helper.NewRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testUser()
+	user.Password, user.TOTPEnabled, user.RecoveryCodes = string(hash), true, hashes
+	user.FailedLoginCount = 3
+	recorder.rows["users"] = []model.User{user}
+
+	reset := func() bool {
+		for _, statement := range recorder.statements {
+			if strings.Contains(statement, "failed_login_count=0") {
+				return true
+			}
+		}
+		return false
+	}
+
+	client.do(http.MethodGet, "/u/login", nil)
+	w := client.do(http.MethodPost, "/u/login", url.Values{"email": {user.Email}, "password": {"secret password"}})
+	if w.Code != http.StatusOK || reset() {
+		t.Fatalf("the password reset the failed logins: %d %q", w.Code, recorder.statements)
+	}
+
+	recorder.statements = nil
+	w = client.do(http.MethodPost, "/u/login/code", url.Values{"code": {"000000"}})
+	counted := false
+	for _, statement := range recorder.statements {
+		counted = counted || strings.Contains(statement, "failed_login_count + 1")
+	}
+	if w.Code != http.StatusBadRequest || !counted || reset() {
+		t.Errorf("a wrong code: got %d %q", w.Code, recorder.statements)
+	}
+
+	recorder.statements = nil
+	w = client.do(http.MethodPost, "/u/login/code", url.Values{"code": {codes[0]}})
+	if w.Code != http.StatusOK || !reset() {
+		t.Errorf("the right code: got %d %q", w.Code, recorder.statements)
+	}
+}
+
+func TestLoginFailuresLookAlike(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedUntil := time.Now().Add(time.Hour)
+
+	var pages []string
+	for _, c := range []struct {
+		name     string
+		user     *model.User
+		password string
+	}{
+		{"unknown email", nil, "secret password"},
+		{"wrong password", &model.User{Password: string(hash), Status: 1}, "wrong password"},
+		{"locked account", &model.User{Password: string(hash), Status: 1, LockedUntil: &lockedUntil}, "secret password"},
+	} {
+		client, recorder := newTestClient(t)
+		if c.user != nil {
+			c.user.ID = 1
+			recorder.rows["users"] = []model.User{*c.user}
+		}
+
+		client.do(http.MethodGet, "/u/login", nil)
+		w := client.do(http.MethodPost, "/u/login", url.Values{"email": {"someone@example.com"}, "password": {c.password}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", c.name, w.Code)
+		}
+		pages = append(pages, csrfField.ReplaceAllString(w.Body.String(), ""))
+
+		for _, statement := range recorder.statements {
+			if strings.Contains(statement, "failed_login_count + 1") && !strings.Contains(statement, "RETURNING") {
+				t.Errorf("%s: the failed login isn't counted atomically: %q", c.name, statement)
+			}
+		}
+	}
+
+	for i := range pages[1:] {
+		if pages[i+1] != pages[0] {
+			t.Errorf("the responses differ: %q, %q", pages[0], pages[i+1])
+		}
+	}
+}
+
+func TestOAuthLoginConfirmsPendingRegistration(t *testing.T) {
+	for _, status := range []uint{0, 1} {
+		recorder := dryRun(t)
+		user := testUser()
+		user.Status, user.Password = status, "hash"
+		recorder.rows["users: users.email = 'someone@example.com'"] = []model.User{user}
+
+		if _, err := findOAuthUser("google", &helper.OAuthUser{Subject: "42", Email: user.Email}); err != nil {
+			t.Fatal(err)
+		}
+
+		cleared, loggedOut := false, false
+		for _, statement := range recorder.statements {
+			cleared = cleared || strings.Contains(statement, "password=''")
+			loggedOut = loggedOut || strings.HasPrefix(statement, "DELETE FROM sessions")
+		}
+		if pending := status == 0; cleared != pending || loggedOut != pending {
+			t.Errorf("status %d: got the password cleared %v, the sessions deleted %v: %q", status, cleared, loggedOut, recorder.statements)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	setConfig(t, "SESSION_MAX_AGE", "3600")
+	client, recorder := newTestClient(t)
+	client.login(recorder, testUser())
+
+	var created string
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "INSERT INTO sessions") {
+			created = statement
+		}
+	}
+	expires := time.Now().Add(time.Hour).Format("2006-01-02 15:04")
+	if !strings.Contains(created, expires) {
+		t.Errorf("the session doesn't expire at %s: %s", expires, created)
+	}
+
+	recorder.statements = nil
+	client.do(http.MethodGet, "/", nil)
+	checked := false
+	for _, statement := range recorder.statements {
+		checked = checked || strings.Contains(statement, "FROM sessions") && strings.Contains(statement, "expires_at >")
+	}
+	if !checked {
+		t.Errorf("the expiry of the session isn't checked: %q", recorder.statements)
+	}
+
+	recorder.statements = nil
+	purgeExpiredSessions()
+	if len(recorder.statements) != 1 || !strings.HasPrefix(recorder.statements[0], "DELETE FROM sessions WHERE expires_at <") {
+		t.Errorf("got %q", recorder.statements)
+	}
+}
+
+func TestChunkedUploadLimits(t *testing.T) {
+	setConfig(t, "UPLOAD_DIR", t.TempDir())
+	for _, c := range []struct {
+		maxOpen string
+		quota   string
+		status  int
+	}{
+		{"0", "", http.StatusTooManyRequests},
+		{"", "1000", http.StatusForbidden},
+		{"", "", http.StatusCreated},
+	} {
+		setConfig(t, "MAX_OPEN_UPLOADS", c.maxOpen)
+		setConfig(t, "DEFAULT_QUOTA_BYTES", c.quota)
+		client, recorder := newTestClient(t)
+		client.login(recorder, testUser())
+		client.do(http.MethodGet, "/recording/upload", nil)
+
+		recorder.statements = nil
+		w := client.do(http.MethodPost, "/recording/upload/chunked", url.Values{
+			"filename": {"talk.wav"}, "size": {"2000"}, "language": {"en"}})
+		if w.Code != c.status {
+			t.Errorf("open %q, quota %q: got %d %q", c.maxOpen, c.quota, w.Code, w.Body)
+		}
+
+		locked, counted := false, false
+		for _, statement := range recorder.statements {
+			locked = locked || strings.Contains(statement, "FROM users") && strings.HasSuffix(statement, "FOR UPDATE")
+			counted = counted || strings.Contains(statement, "sum(size)") && strings.Contains(statement, "FROM uploads")
+		}
+		if !locked || !counted {
+			t.Errorf("open %q, quota %q: the open uploads aren't counted under a lock: %q", c.maxOpen, c.quota, recorder.statements)
+		}
+	}
+}
+
+func TestUploadChunkLocksTheUpload(t *testing.T) {
+	setConfig(t, "UPLOAD_DIR", t.TempDir())
+	client, recorder := newTestClient(t)
+	client.login(recorder, testUser())
+	client.do(http.MethodGet, "/recording/upload", nil)
+
+	upload := model.Upload{ID: uuid.New().String(), UserID: 1, Size: 5, ChunkSize: 5}
+	recorder.rows["uploads"] = []model.Upload{upload}
+
+	recorder.statements = nil
+	req := httptest.NewRequest(http.MethodPut, "/recording/upload/chunked/"+upload.ID+"/0", strings.NewReader("hello"))
+	if w := client.send(req); w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+
+	var locked bool
+	for _, statement := range recorder.statements {
+		locked = locked || strings.Contains(statement, "FROM uploads") && strings.HasSuffix(statement, "FOR UPDATE")
+	}
+	if !locked {
+		t.Errorf("the upload isn't locked: %q", recorder.statements)
+	}
+	if data, err := ioutil.ReadFile(chunkedUploadPath(&upload)); err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("old password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := testUser()
+	user.Password = string(hash)
+
+	client, recorder := newTestClient(t)
+	client.login(recorder, user)
+	client.do(http.MethodGet, "/u/password", nil)
+
+	recorder.statements = nil
+	w := client.do(http.MethodPost, "/u/password", url.Values{
+		"current_password": {"old password"}, "password": {"a new long password"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+
+	revoked := false
+	for _, statement := range recorder.statements {
+		revoked = revoked || statement == "DELETE FROM sessions WHERE sessions.user_id = 1 AND id <> 1"
+	}
+	if !revoked {
+		t.Errorf("the other sessions weren't revoked: %q", recorder.statements)
+	}
+}
+
+func TestSearchTranscripts(t *testing.T) {
+	client, recorder := newTestClient(t)
+	client.login(recorder, testUser())
+
+	recording := model.Recording{UserID: 1, Title: "Meeting", Status: model.StatusDone}
+	recording.ID = 7
+	recorder.rows["search_ranks"] = []searchRank{{RecordingID: 7, Score: 5, Matches: 2, Total: 3}}
+	recorder.rows["recordings"] = []model.Recording{recording}
+	recorder.rows["utterances"] = []model.Utterance{{RecordingID: 7, Start: 1, End: 2, Text: "Hello world"}}
+
+	recorder.statements = nil
+	w := client.do(http.MethodGet, "/api/v1/search?q=Hello+World&limit=1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+
+	var response struct {
+		Total      int            `json:"total"`
+		Results    []searchResult `json:"results"`
+		NextCursor string         `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Total != 3 || response.NextCursor == "" || len(response.Results) != 1 {
+		t.Fatalf("got %s", w.Body)
+	}
+	result := response.Results[0]
+	if result.Recording.Title != "Meeting" || result.Score != 5 || result.Matches != 2 ||
+		len(result.Snippets) != 1 || result.Snippets[0].Highlighted != "<mark>Hello</mark> <mark>world</mark>" {
+		t.Errorf("got %+v", result)
+	}
+
+	// The results are ranked and paginated by the database, the
+	// recordings of the page are loaded at once
+	var queries []string
+	for _, statement := range recorder.statements {
+		if strings.Contains(statement, "utterances") || strings.HasPrefix(statement, "SELECT * FROM recordings") {
+			queries = append(queries, statement)
+		}
+	}
+	if len(queries) != 3 || !strings.Contains(queries[0], "LIMIT 1 OFFSET 0") ||
+		!strings.Contains(queries[1], "recordings.id = 7") && !strings.Contains(queries[1], "IN (7)") {
+		t.Errorf("got %q", queries)
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		token         string
+		allowed       string
+		authorization string
+		status        int
+	}{
+		{"not allowed", "", "", "", http.StatusForbidden},
+		{"allowed address", "", "192.0.2.1", "", http.StatusOK},
+		{"token", "secret", "", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", "", "Bearer guess", http.StatusForbidden},
+	} {
+		setConfig(t, "METRICS_TOKEN", c.token)
+		setConfig(t, "METRICS_ALLOWED_IPS", c.allowed)
+		client, _ := newTestClient(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		w := client.send(req)
+		if w.Code != c.status {
+			t.Errorf("%s: got %d", c.name, w.Code)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "asr_uploads_total") {
+			t.Errorf("%s: got %q", c.name, w.Body)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 // User struct
 type User struct {
@@ -9,17 +16,176 @@ type User struct {
 	Password string `gorm:"not null" json:"password" form: "password"`
 	Names    string `json:"names"`
 	Status   uint   `gorm:"not null;default:0" json:"status"`
+	// Disabled by an administrator, independent of the confirmation
+	Disabled bool   `gorm:"not null;default:false" json:"disabled"`
 	Token    string `json:"token"`
+	// When the confirmation token was sent, it expires after CONFIRM_TOKEN_HOURS
+	TokenCreatedAt *time.Time `json:"-"`
+	UsedToken      string     `json:"-"`
+	Tier           uint       `gorm:"not null;default:0" json:"tier"`
+	APIRateLimit   uint       `gorm:"not null;default:0" json:"api_rate_limit"`
+	// Export format used when a download doesn't specify one
+	DefaultExportFormat string `gorm:"not null;default:''" json:"default_export_format"`
+	IsAdmin             bool   `gorm:"not null;default:false" json:"is_admin"`
+	// Storage quota in bytes, 0 for the DEFAULT_QUOTA_BYTES setting
+	QuotaBytes int64 `gorm:"not null;default:0" json:"quota_bytes"`
+	// SHA-256 hash of the API key, the key itself is only shown once
+	APIKey string `gorm:"index;not null;default:''" json:"-"`
+	// URL notified when a transcription is finished, with the secret
+	// that the notifications are signed with
+	WebhookURL    string `gorm:"not null;default:''" json:"webhook_url"`
+	WebhookSecret string `gorm:"not null;default:''" json:"-"`
+	// Email the user when a transcription is finished or failed
+	NotifyByEmail bool `gorm:"not null;default:false" json:"notify_by_email"`
+	// Token of the last password reset link and when it expires
+	ResetToken        string     `gorm:"not null;default:''" json:"-"`
+	ResetTokenExpires *time.Time `json:"-"`
+	// New email address until it is confirmed with the token, the current
+	// one stays in use until then
+	PendingEmail      string     `gorm:"not null;default:''" json:"-"`
+	EmailToken        string     `gorm:"not null;default:''" json:"-"`
+	EmailTokenExpires *time.Time `json:"-"`
+	// Consecutive failed logins, the account is locked until LockedUntil
+	// once there are too many
+	FailedLoginCount int        `gorm:"not null;default:0" json:"-"`
+	LockedUntil      *time.Time `json:"-"`
+	// Secret of the authenticator app, which is only asked for once
+	// TOTPEnabled is set, and the time step of the last code used
+	TOTPSecret   string `gorm:"not null;default:''" json:"-"`
+	TOTPEnabled  bool   `gorm:"not null;default:false" json:"totp_enabled"`
+	TOTPLastStep int64  `gorm:"not null;default:0" json:"-"`
+	// Hashes of the unused recovery codes, comma-separated
+	RecoveryCodes string `gorm:"type:text;not null;default:''" json:"-"`
+	// Account at the OAuth provider that the user logs in with
+	OAuthProvider string `gorm:"not null;default:''" json:"oauth_provider"`
+	OAuthSubject  string `gorm:"index;not null;default:''" json:"-"`
+}
+
+// RecordingStatus is the state of a recording in the transcription
+// pipeline. It is stored as an integer, the values are the ones that were
+// used before the type was introduced, so existing rows need no migration.
+type RecordingStatus uint
+
+const (
+	// Uploaded but not queued yet, or hidden
+	StatusUploaded RecordingStatus = iota
+	StatusQueued
+	StatusProcessing
+	StatusDone
+	StatusFailed
+	// The audio or the transcription is empty
+	StatusNoSpeech
+	// The detected language has to be confirmed by the user
+	StatusLanguageUnconfirmed
+	// Deleted by the user, but still restorable
+	StatusDeleted
+)
+
+var statusNames = map[RecordingStatus]string{
+	StatusUploaded:            "uploaded",
+	StatusQueued:              "queued",
+	StatusProcessing:          "processing",
+	StatusDone:                "done",
+	StatusFailed:              "failed",
+	StatusNoSpeech:            "no_speech",
+	StatusLanguageUnconfirmed: "language_unconfirmed",
+	StatusDeleted:             "deleted",
+}
+
+// Return the name of the status
+func (s RecordingStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Read the status from the integer column
+func (s *RecordingStatus) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		*s = RecordingStatus(v)
+	case []byte:
+		n, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return err
+		}
+		*s = RecordingStatus(n)
+	default:
+		return fmt.Errorf("cannot scan %T into a recording status", value)
+	}
+	return nil
+}
+
+// Write the status to the integer column
+func (s RecordingStatus) Value() (driver.Value, error) {
+	return int64(s), nil
+}
+
+// Return the recording status with the name
+func ParseStatus(name string) (RecordingStatus, bool) {
+	for status, n := range statusNames {
+		if n == name {
+			return status, true
+		}
+	}
+	return 0, false
 }
 
 // Recording struct
 type Recording struct {
 	gorm.Model
-	UserID   uint   `gorm:"not null" json:"user_id"`
-	Title    string `gorm:"not null" json:"name"`
-	Filename string `gorm:"not null" json:"file"`
-	Language string `gorm:"not null" json:"language"`
-	Status   uint   `gorm:"not null;default:0" json:"status"`
+	UserID    uint            `gorm:"not null" json:"user_id"`
+	Title     string          `gorm:"not null" json:"name"`
+	Filename  string          `gorm:"not null" json:"file"`
+	Language  string          `gorm:"not null" json:"language"`
+	Status    RecordingStatus `gorm:"not null;default:0" json:"status"`
+	Priority  int             `gorm:"not null;default:0" json:"priority"`
+	Sample    bool            `gorm:"not null;default:false" json:"sample"`
+	Normalize bool            `gorm:"not null;default:false" json:"normalize"`
+	// The recording is deleted automatically after this time, if set
+	DeleteAfter *time.Time `json:"delete_after"`
+	// Plain text of the transcript, empty until it is transcribed
+	Transcript string `gorm:"type:text;not null;default:''" json:"transcript"`
+	// Name of the stored transcript if it was too large for the database
+	TranscriptFile string `gorm:"not null;default:''" json:"-"`
+	// Name of the stored waveform peaks, once they have been computed
+	PeaksFile string `gorm:"not null;default:''" json:"-"`
+	// The transcript was cut off at MAX_TRANSCRIPT_BYTES
+	TranscriptTruncated bool `gorm:"not null;default:false" json:"transcript_truncated"`
+	// Size of the uploaded file, counted against the quota of the user
+	SizeBytes int64 `gorm:"not null;default:0" json:"size_bytes"`
+	// Length of the audio in seconds, 0 if unknown
+	Duration float64 `gorm:"not null;default:0" json:"duration"`
+	// Format of the first audio stream, 0 if unknown
+	SampleRate int `gorm:"not null;default:0" json:"sample_rate"`
+	Channels   int `gorm:"not null;default:0" json:"channels"`
+	// The duration and the audio format were read from the file
+	Probed     bool       `gorm:"not null;default:false" json:"probed"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	// Name of the stored file of the recording
+	StoragePath string `gorm:"not null;default:''" json:"-"`
+	// When the user deleted the recording and its status before that
+	RemovedAt     *time.Time      `json:"removed_at"`
+	RestoreStatus RecordingStatus `gorm:"not null;default:0" json:"-"`
+	// Likely languages, if the detected one has to be confirmed
+	LanguageCandidates string `gorm:"not null;default:''" json:"language_candidates"`
+	// How many times the user queued the recording again after a failure
+	RetryCount int `gorm:"not null;default:0" json:"retry_count"`
+	// Percentage of the chunks that the transcriber has finished
+	Progress int `gorm:"not null;default:0" json:"-"`
+	// The worker that claimed the recording and when it last reported
+	// that it is still transcribing it
+	WorkerID    string     `gorm:"not null;default:''" json:"-"`
+	HeartbeatAt *time.Time `json:"-"`
+	// Average confidence of the utterances, if the decoder reports it
+	Confidence *float64 `json:"confidence"`
+	// Token of the public link to the recording and when it expires
+	ShareToken   string     `gorm:"index;not null;default:''" json:"-"`
+	ShareExpires *time.Time `json:"-"`
+	// Labels given by the user, only loaded where they are shown
+	Tags []Tag `gorm:"many2many:recording_tags" json:"tags"`
 }
 
 // Utterance struct
@@ -29,4 +195,94 @@ type Utterance struct {
 	Start       float32 `gorm:"not null" json:"start"`
 	End         float32 `gorm:"not null" json:"end"`
 	Text        string  `json:"text"`
+	// Label of the speaker if the decoder did a diarization, e.g. "S1"
+	Speaker string `gorm:"not null;default:''" json:"speaker,omitempty"`
+	// Confidence of the decoder between 0 and 1, if it reports one
+	Confidence *float32 `json:"confidence,omitempty"`
+	// Text after applying the glossary of the user, empty if unchanged
+	CorrectedText string `json:"corrected_text,omitempty"`
+}
+
+// Upload struct, a file that is uploaded in chunks. The chunks are
+// appended to a partial file until the upload is finalized.
+type Upload struct {
+	ID        string `gorm:"primarykey" json:"id"`
+	UserID    uint   `gorm:"not null;index" json:"-"`
+	Filename  string `gorm:"not null" json:"filename"`
+	Title     string `gorm:"not null;default:''" json:"-"`
+	Language  string `gorm:"not null" json:"-"`
+	Normalize bool   `gorm:"not null;default:false" json:"-"`
+	Retention string `gorm:"not null;default:''" json:"-"`
+	// Announced size of the file and the maximum size of a chunk
+	Size      int64 `gorm:"not null" json:"size"`
+	ChunkSize int64 `gorm:"not null" json:"chunk_size"`
+	// Chunks received so far, which is the number of the next one
+	ReceivedChunks int       `gorm:"not null;default:0" json:"next_chunk"`
+	ReceivedBytes  int64     `gorm:"not null;default:0" json:"received_bytes"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Tag struct, a label of recordings. The names are unique per user.
+type Tag struct {
+	ID     uint   `gorm:"primarykey" json:"id"`
+	UserID uint   `gorm:"not null;uniqueIndex:idx_tags_user_name" json:"-"`
+	Name   string `gorm:"not null;uniqueIndex:idx_tags_user_name" json:"name"`
+}
+
+// Comment struct
+type Comment struct {
+	gorm.Model
+	RecordingID uint   `gorm:"not null;index" json:"recording_id"`
+	UserID      uint   `gorm:"not null" json:"user_id"`
+	Text        string `gorm:"not null" json:"text"`
+}
+
+// RecordingEvent struct, a step in the processing of a recording
+type RecordingEvent struct {
+	ID          uint      `gorm:"primarykey" json:"-"`
+	RecordingID uint      `gorm:"not null;index" json:"recording_id"`
+	Event       string    `gorm:"not null" json:"event"`
+	Details     string    `json:"details"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GlossaryRule struct
+type GlossaryRule struct {
+	gorm.Model
+	UserID      uint   `gorm:"not null;index" json:"user_id"`
+	Pattern     string `gorm:"not null" json:"pattern"`
+	Replacement string `gorm:"not null" json:"replacement"`
+	Regex       bool   `gorm:"not null;default:false" json:"regex"`
+}
+
+// Session struct
+type Session struct {
+	gorm.Model
+	UserID    uint      `gorm:"not null" json:"user_id"`
+	Key       string    `gorm:"uniqueIndex;not null" json:"-"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	LastSeen  time.Time `json:"last_seen"`
+	// The session ends at this time, even if it is still in use
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// EngineStatus struct, the result of the last health check of the
+// ASR engine by the transcriber
+type EngineStatus struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	Healthy   bool      `json:"healthy"`
+	Message   string    `json:"message"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// AuditLog struct, an action taken by an administrator
+type AuditLog struct {
+	gorm.Model
+	ActorID  uint   `gorm:"not null;index" json:"actor_id"`
+	TargetID uint   `gorm:"not null;index" json:"target_id"`
+	Action   string `gorm:"not null" json:"action"`
+	Details  string `json:"details"`
+	IP       string `json:"ip"`
 }
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestRecordingStatusString(t *testing.T) {
+	for status, name := range map[RecordingStatus]string{
+		StatusUploaded:            "uploaded",
+		StatusQueued:              "queued",
+		StatusProcessing:          "processing",
+		StatusDone:                "done",
+		StatusFailed:              "failed",
+		StatusNoSpeech:            "no_speech",
+		StatusLanguageUnconfirmed: "language_unconfirmed",
+		StatusDeleted:             "deleted",
+		RecordingStatus(99):       "unknown",
+	} {
+		if got := status.String(); got != name {
+			t.Errorf("status %d: got %q, want %q", uint(status), got, name)
+		}
+	}
+}
+
+// The values are stored in the database, they must not change
+func TestRecordingStatusValues(t *testing.T) {
+	for status, value := range map[RecordingStatus]int64{
+		StatusUploaded:            0,
+		StatusQueued:              1,
+		StatusProcessing:          2,
+		StatusDone:                3,
+		StatusFailed:              4,
+		StatusNoSpeech:            5,
+		StatusLanguageUnconfirmed: 6,
+		StatusDeleted:             7,
+	} {
+		if v, err := status.Value(); err != nil || v != value {
+			t.Errorf("%s: got %v, %v, want %d", status, v, err, value)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	for _, status := range []RecordingStatus{StatusUploaded, StatusQueued, StatusDone, StatusDeleted} {
+		if parsed, ok := ParseStatus(status.String()); !ok || parsed != status {
+			t.Errorf("%s: got %v, %v", status, parsed, ok)
+		}
+	}
+
+	if _, ok := ParseStatus("unknown"); ok {
+		t.Error("parsed an unknown status")
+	}
+}
+
+func TestRecordingStatusScan(t *testing.T) {
+	for _, c := range []struct {
+		value  interface{}
+		status RecordingStatus
+	}{
+		{int64(3), StatusDone},
+		{[]byte("4"), StatusFailed},
+	} {
+		var status RecordingStatus
+		if err := status.Scan(c.value); err != nil || status != c.status {
+			t.Errorf("%v: got %v, %v, want %v", c.value, status, err, c.status)
+		}
+	}
+
+	for _, value := range []interface{}{"done", []byte("x"), nil} {
+		var status RecordingStatus
+		if err := status.Scan(value); err == nil {
+			t.Errorf("%#v: got no error", value)
+		}
+	}
+}
@@ -1,16 +1,31 @@
+//go:build worker
+// +build worker
+
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gorm.io/gorm"
 
 	"simple-web-asr/helper"
@@ -19,54 +34,279 @@ import (
 
 var db *gorm.DB
 
-func loadTranscription(filename string, recordingID uint) error {
+// Metrics of the transcriber, served at WORKER_METRICS_ADDR
+var (
+	transcriptionsDone = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asr_transcriptions_done_total", Help: "Recordings transcribed successfully"})
+	transcriptionsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "asr_transcriptions_failed_total", Help: "Recordings whose transcription failed"})
+	transcriptionSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "asr_transcription_duration_seconds", Help: "Time taken to transcribe a recording",
+		Buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}})
+)
+
+// Run the decoder, which writes the transcription next to the file.
+// Loudness normalization is requested through the environment.
+func decode(recording *model.Recording, filename string) error {
+	if endpoint := helper.GetConfig("ASR_ENDPOINT"); endpoint != "" {
+		return decodeHTTP(endpoint, recording, filename)
+	}
+
+	cmd := exec.Command(helper.GetConfig("DECODE_CMD"), filename, recording.Language)
+
+	if recording.Normalize {
+		cmd.Env = append(os.Environ(), "NORMALIZE=1")
+	}
+
+	return cmd.Run()
+}
+
+// Send the file to the ASR service at ASR_ENDPOINT, with the language and
+// the normalization as query parameters. The response is expected in
+// the format of the decoder and written next to the file like it does.
+func decodeHTTP(endpoint string, recording *model.Recording, filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	var line string
-	for {
-		line, err = reader.ReadString('\n')
-		if err != nil {
-			break
+	query := url.Values{"language": {recording.Language}}
+	if recording.Normalize {
+		query.Set("normalize", "1")
+	}
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+
+	client := http.Client{Timeout: time.Duration(helper.GetConfigInt("ASR_TIMEOUT_SECONDS", 3600)) * time.Second}
+	resp, err := client.Post(endpoint+separator+query.Encode(), "application/octet-stream", file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ASR service returned %s", resp.Status)
+	}
+
+	out, err := os.Create(filename + ".txt")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// Decode the file and read the resulting transcription
+func decodeFile(recording *model.Recording, filename string) ([]model.Utterance, error) {
+	if err := decode(recording, filename); err != nil {
+		return nil, err
+	}
+
+	return helper.ParseTranscription(filename + ".txt")
+}
+
+// Transcribe the file, splitting it into overlapping chunks of
+// CHUNK_SECONDS if it is longer than that. Up to CHUNK_CONCURRENCY
+// chunks are decoded in parallel.
+func transcribeFile(recording *model.Recording, filename string) ([]model.Utterance, error) {
+	// Recordings uploaded before durations were recorded
+	if recording.Duration == 0 {
+		if duration, err := helper.ProbeDuration(filename); err == nil {
+			recording.Duration = duration
+		} else {
+			log.Println("Failed to probe the duration:", err)
 		}
+	}
 
-		parts := strings.SplitN(line, " ", 2)
-		times := strings.SplitN(parts[0], "-", 2)
+	chunkLength := float64(helper.GetConfigInt("CHUNK_SECONDS", 0))
+	overlap := float64(helper.GetConfigInt("CHUNK_OVERLAP_SECONDS", 10))
 
-		var timesParsed []float32
+	if chunkLength <= 0 || overlap < 0 || overlap >= chunkLength {
+		return decodeFile(recording, filename)
+	}
 
-		for t := range times {
-			timeParsed, errP := strconv.ParseFloat(times[t], 32)
-			if errP != nil {
-				return errP
+	// Without the duration the chunks are unknown
+	duration := recording.Duration
+	if duration <= chunkLength {
+		return decodeFile(recording, filename)
+	}
+
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	offsets := chunkOffsets(duration, chunkLength, overlap)
+
+	concurrency := helper.GetConfigInt("CHUNK_CONCURRENCY", 2)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([][]model.Utterance, len(offsets))
+	errs := make([]error, len(offsets))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var finished int32
+
+	for i, offset := range offsets {
+		wg.Add(1)
+		go func(i int, offset float64) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			chunkFilename := filepath.Join(dir, fmt.Sprintf("chunk%04d.wav", i))
+			cmd := exec.Command("ffmpeg", "-v", "error", "-ss", fmt.Sprintf("%.3f", offset), "-t", fmt.Sprintf("%.3f", chunkLength),
+				"-i", filename, "-vn", "-acodec", "pcm_s16le", "-ar", "16000", "-ac", "1", chunkFilename)
+			if err := cmd.Run(); err != nil {
+				errs[i] = fmt.Errorf("failed to cut chunk %d: %v", i, err)
+				return
 			}
-			timesParsed = append(timesParsed, float32(timeParsed)/100.0)
-		}
 
-		if parts[1] != "" {
-			errD := db.Create(&model.Utterance{
-				RecordingID: recordingID,
-				Start:       timesParsed[0],
-				End:         timesParsed[1],
-				Text:        parts[1]}).Error
-			if errD != nil {
-				return errD
+			results[i], errs[i] = decodeFile(recording, chunkFilename)
+			if errs[i] == nil {
+				reportProgress(recording.ID, int(atomic.AddInt32(&finished, 1))*100/len(offsets))
 			}
+		}(i, offset)
+	}
+	wg.Wait()
+
+	for i := range errs {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
+	}
+
+	return stitchChunks(results, offsets, overlap), nil
+}
 
-		if err != nil {
+// Return where the chunks of a recording of the duration start, each
+// chunk overlapping the next one by overlap seconds
+func chunkOffsets(duration, chunkLength, overlap float64) []float64 {
+	var offsets []float64
+	for offset := 0.0; offset < duration; offset += chunkLength - overlap {
+		offsets = append(offsets, offset)
+		if offset+chunkLength >= duration {
 			break
 		}
 	}
-	if err != io.EOF {
-		return err
+	return offsets
+}
+
+// Save how far the transcription of the recording has come, for the
+// progress events of the web server. It stays below 100 until the
+// transcript is stored.
+func reportProgress(recordingID uint, percent int) {
+	if percent > 99 {
+		percent = 99
+	}
+	if err := db.Model(&model.Recording{}).Where("id = ?", recordingID).UpdateColumn("progress", percent).Error; err != nil {
+		log.Println("Failed to save the progress:", err)
+	}
+}
+
+// Shift the utterances of the chunks by their offsets and merge them.
+// An utterance in an overlap region is kept only by the chunk that owns
+// the middle of its time span, where the boundary between two chunks is
+// the middle of their overlap, so that nothing is duplicated or lost.
+func stitchChunks(chunks [][]model.Utterance, offsets []float64, overlap float64) []model.Utterance {
+	var utterances []model.Utterance
+
+	for i, chunk := range chunks {
+		from := float32(offsets[i] + overlap/2)
+		if i == 0 {
+			from = 0
+		}
+		to := float32(-1)
+		if i+1 < len(offsets) {
+			to = float32(offsets[i+1] + overlap/2)
+		}
+
+		for _, utt := range chunk {
+			utt.Start += float32(offsets[i])
+			utt.End += float32(offsets[i])
+
+			middle := (utt.Start + utt.End) / 2
+			if middle >= from && (to < 0 || middle < to) {
+				utterances = append(utterances, utt)
+			}
+		}
+	}
+
+	sort.SliceStable(utterances, func(i, j int) bool {
+		return utterances[i].Start < utterances[j].Start
+	})
+
+	return utterances
+}
+
+// Check whether the ASR engine can be used, by running ENGINE_HEALTH_CMD
+// if it is set, or by checking that DECODE_CMD is executable otherwise.
+// An ASR service at ASR_ENDPOINT is assumed to be available unless
+// ENGINE_HEALTH_CMD checks it. The result is recorded for the web
+// application.
+func checkEngine() bool {
+	var err error
+
+	if healthCmd := helper.GetConfig("ENGINE_HEALTH_CMD"); healthCmd != "" {
+		err = exec.Command(healthCmd).Run()
+	} else if helper.GetConfig("ASR_ENDPOINT") == "" {
+		_, err = exec.LookPath(helper.GetConfig("DECODE_CMD"))
+	}
+
+	status := model.EngineStatus{ID: 1, Healthy: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		status.Message = err.Error()
+	}
+
+	if errD := db.Save(&status).Error; errD != nil {
+		log.Println("Failed to record the engine status:", errD)
 	}
 
-	return nil
+	return err == nil
+}
+
+// Detect the language of a recording uploaded with language "auto".
+// Returns false if the detection is not confident enough, in which case
+// the most likely languages are kept for the user to choose from.
+// Languages that the decoder doesn't support are left out, so a recording
+// in one of them waits for the user too.
+func detectLanguage(recording *model.Recording, filename string) bool {
+	detected, err := helper.DetectLanguage(filename)
+	if err != nil {
+		log.Println(fmt.Sprintf("Failed to detect the language of recording %d: %v", recording.ID, err))
+	}
+
+	var candidates []helper.LanguageCandidate
+	for _, candidate := range detected {
+		if _, ok := helper.LanguageNames[candidate.Language]; ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	minConfidence, _ := strconv.ParseFloat(helper.GetConfig("LANGID_MIN_CONFIDENCE"), 64)
+	if minConfidence <= 0 {
+		minConfidence = 0.8
+	}
+
+	if len(candidates) > 0 && candidates[0].Confidence >= minConfidence {
+		recording.Language = candidates[0].Language
+		return true
+	}
+
+	if len(candidates) > 3 {
+		candidates = candidates[:3]
+	}
+	recording.LanguageCandidates = helper.FormatLanguageCandidates(candidates)
+
+	return false
 }
 
 func transcribe(recording *model.Recording) {
@@ -74,66 +314,433 @@ func transcribe(recording *model.Recording) {
 
 	log.Println("Transcribing", recordingName)
 
-	recording.Status = 2
-	if err := db.Save(&recording).Error; err != nil {
+	// Only the columns of the job are written, the user may edit the rest
+	// of the recording while it is being transcribed
+	now := time.Now()
+	recording.Status = model.StatusProcessing
+	recording.StartedAt = &now
+	recording.Progress = 0
+	if err := db.Model(recording).Updates(map[string]interface{}{
+		"status":     recording.Status,
+		"started_at": recording.StartedAt,
+		"progress":   recording.Progress}).Error; err != nil {
 		log.Println(fmt.Sprintf("Failed to update status for %s: %v", recordingName, err))
 		return
 	}
+	helper.RecordEvent(recording.ID, "processing started", "")
+	helper.LogJSON("info", "transcription started", map[string]interface{}{
+		"recording_id": recording.ID,
+		"user_id":      recording.UserID,
+		"language":     recording.Language})
 
-	recordingFilename := helper.RecordingFilename(recording.ID)
+	// The outcome, recorded as an event
+	var event, details string
 
-	cmd := exec.Command(helper.GetConfig("DECODE_CMD"), recordingFilename, recording.Language)
+	// The decoder needs a local file in its format
+	recordingFilename, cleanup, err := helper.FetchDecoderAudio(recording)
 
-	if err := cmd.Run(); err != nil {
-		log.Println(fmt.Sprintf("Failed to transcribe %s: %v", recordingName, err))
-		recording.Status = 4
-	} else {
-		transcriptionFilename := recordingFilename + ".txt"
-
-		if err = loadTranscription(transcriptionFilename, recording.ID); err != nil {
-			log.Println(fmt.Sprintf("Failed to load %s: %v", transcriptionFilename, err))
-			recording.Status = 4
+	if err != nil {
+		log.Println(fmt.Sprintf("Failed to prepare the audio of %s: %v", recordingName, err))
+		recording.Status = model.StatusFailed
+		event, details = "failed", err.Error()
+	} else if silent, errS := helper.IsSilent(recordingFilename); errS == nil && silent {
+		log.Println(fmt.Sprintf("No sound in %s, skipping", recordingName))
+		recording.Status = model.StatusNoSpeech
+		event, details = "no speech", "The audio is silent"
+	} else if recording.Language == "auto" && !detectLanguage(recording, recordingFilename) {
+		log.Println(fmt.Sprintf("Language of %s is uncertain, waiting for confirmation", recordingName))
+		recording.Status = model.StatusLanguageUnconfirmed
+		event, details = "language confirmation needed", recording.LanguageCandidates
+	} else if utterances, err := transcribeFile(recording, recordingFilename); err != nil {
+		// Don't blame the recording if the engine went down
+		if checkEngine() {
+			log.Println(fmt.Sprintf("Failed to transcribe %s: %v", recordingName, err))
+			recording.Status = model.StatusFailed
+			event, details = "failed", err.Error()
 		} else {
-			recording.Status = 3
+			log.Println(fmt.Sprintf("ASR engine unavailable, requeueing %s: %v", recordingName, err))
+			recording.Status = model.StatusQueued
+			event, details = "retried", "The ASR engine is unavailable"
 		}
+	} else if len(utterances) == 0 {
+		log.Println(fmt.Sprintf("No speech found in %s", recordingName))
+		recording.Status = model.StatusNoSpeech
+		event, details = "no speech", "The transcription is empty"
+	} else if err := helper.StoreUtterances(recording, utterances); err != nil {
+		log.Println(fmt.Sprintf("Failed to store the transcription of %s: %v", recordingName, err))
+		recording.Status = model.StatusFailed
+		event, details = "failed", err.Error()
+	} else {
+		recording.Status = model.StatusDone
+		now = time.Now()
+		recording.FinishedAt = &now
+		event, details = "transcribed", fmt.Sprintf("%d utterances", len(utterances))
+	}
+
+	if cleanup != nil {
+		cleanup()
+	}
+
+	updates := map[string]interface{}{
+		"status":              recording.Status,
+		"progress":            recording.Progress,
+		"finished_at":         recording.FinishedAt,
+		"duration":            recording.Duration,
+		"language":            recording.Language,
+		"language_candidates": recording.LanguageCandidates}
+
+	// Keep the recording deleted if the user deleted it in the meantime,
+	// restoring it brings back the outcome
+	var current model.Recording
+	if db.First(&current, recording.ID).Error == nil && current.Status == model.StatusDeleted {
+		recording.RestoreStatus = recording.Status
+		recording.Status = model.StatusDeleted
+		recording.RemovedAt = current.RemovedAt
+		updates["status"], updates["restore_status"] = recording.Status, recording.RestoreStatus
 	}
 
-	if err := db.Save(&recording).Error; err != nil {
+	if err := db.Model(recording).Updates(updates).Error; err != nil {
 		log.Println(fmt.Sprintf("Failed to update status for %s: %v", recordingName, err))
 	} else {
 		log.Println("Done transcribing", recordingName)
+		helper.RecordEvent(recording.ID, event, details)
 
-		if recording.Status == 3 {
-			var user model.User
-			db.First(&user, recording.UserID)
+		level := "info"
+		if recording.Status == model.StatusFailed {
+			level = "error"
+		}
+		helper.LogJSON(level, "transcription finished", map[string]interface{}{
+			"recording_id": recording.ID,
+			"user_id":      recording.UserID,
+			"status":       recording.Status.String(),
+			"event":        event,
+			"details":      details,
+			"seconds":      time.Since(*recording.StartedAt).Seconds()})
+
+		// The user is only emailed if they asked for it
+		notify := helper.WantsEmailNotification(recording)
+
+		if notify && (recording.Status == model.StatusDone || recording.Status == model.StatusNoSpeech) {
+			if errM := helper.SendTranscriptionNotification(recording); errM != nil {
+				log.Println("Failed to send email", errM)
+			} else {
+				log.Println("Notification sent for", recordingName)
+			}
+		} else if recording.Status == model.StatusFailed {
+			helper.SendEmail(helper.SupportEmail(), "Transcription Error", fmt.Sprintf("id: %d", recording.ID))
 
-			if user.Email != "" {
-				link := fmt.Sprintf("%s/recording/view/%d", helper.GetConfig("URL_BASE"), recording.ID)
-				body := fmt.Sprintf("To see the transcription, go to:<br/>\n<a href=\"%s\">%s</a>", link, link)
-				if errM := helper.SendEmail(user.Email, "Transcription Notification", body); errM != nil {
+			if notify {
+				if errM := helper.SendFailureNotification(recording); errM != nil {
 					log.Println("Failed to send email", errM)
-				} else {
-					log.Println("Email sent to", user.Email)
 				}
 			}
+		}
+
+		if recording.Status == model.StatusDone || recording.Status == model.StatusFailed {
+			go helper.SendWebhook(recording)
+		}
+
+		switch event {
+		case "transcribed":
+			transcriptionsDone.Inc()
+			transcriptionSeconds.Observe(recording.FinishedAt.Sub(*recording.StartedAt).Seconds())
+		case "failed":
+			transcriptionsFailed.Inc()
+		}
+	}
+}
+
+// ID of this worker in the claims of the recordings, WORKER_ID or the
+// host name. It should stay the same when the worker is restarted.
+func workerID() string {
+	if id := helper.GetConfig("WORKER_ID"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// How often the worker reports that it is still transcribing its
+// recordings
+const heartbeatInterval = time.Minute
+
+// Claims without a heartbeat for WORKER_STALE_MINUTES (10 by default)
+// were abandoned by a worker that stopped
+func staleClaimTime() time.Time {
+	return time.Now().Add(-time.Duration(helper.GetConfigInt("WORKER_STALE_MINUTES", 10)) * time.Minute)
+}
+
+// Take the recording from the queue, unless another worker was faster
+func claimRecording(recording *model.Recording) bool {
+	result := db.Model(&model.Recording{}).Where("id = ? AND status = ?", recording.ID, model.StatusQueued).
+		Updates(map[string]interface{}{
+			"status":       model.StatusProcessing,
+			"worker_id":    workerID(),
+			"heartbeat_at": time.Now()})
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// Renew the claims of the recordings that the worker is transcribing
+func sendHeartbeats(inProgress *sync.Map) {
+	var ids []uint
+	inProgress.Range(func(id, _ interface{}) bool {
+		ids = append(ids, id.(uint))
+		return true
+	})
+	if len(ids) == 0 {
+		return
+	}
+
+	err := db.Model(&model.Recording{}).Where("id IN ? AND status = ? AND worker_id = ?", ids, model.StatusProcessing, workerID()).
+		UpdateColumn("heartbeat_at", time.Now()).Error
+	if err != nil {
+		log.Println("Failed to renew the claims of the recordings:", err)
+	}
+}
+
+// Put recordings that are being transcribed back into the queue
+func requeueRecordings(recordings []model.Recording, reason string) {
+	for r := range recordings {
+		if err := db.Model(&recordings[r]).Update("status", model.StatusQueued).Error; err != nil {
+			log.Println(fmt.Sprintf("Failed to requeue recording %d: %v", recordings[r].ID, err))
+			continue
+		}
+		helper.RecordEvent(recordings[r].ID, "retried", reason)
+		log.Println("Requeued interrupted recording", recordings[r].ID)
+	}
+}
+
+// Put the recordings that this worker was transcribing when it stopped
+// back into the queue, along with the ones abandoned by other workers.
+// The recordings of the other workers that are still running are left
+// alone.
+func resumeInterruptedRecordings() {
+	var recordings []model.Recording
+	db.Where("status = ? AND worker_id = ?", model.StatusProcessing, workerID()).Find(&recordings)
+
+	requeueRecordings(recordings, "The worker was restarted")
+	requeueAbandonedRecordings()
+}
+
+// Put the recordings back into the queue whose workers stopped sending
+// heartbeats. The worker may still finish in the meantime, so a recording
+// is only requeued if its claim is still stale.
+func requeueAbandonedRecordings() {
+	stale := staleClaimTime()
+
+	var recordings []model.Recording
+	db.Where("status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)", model.StatusProcessing, stale).Find(&recordings)
+
+	for r := range recordings {
+		result := db.Model(&recordings[r]).Where("status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)", model.StatusProcessing, stale).
+			Update("status", model.StatusQueued)
+		if result.Error != nil {
+			log.Println(fmt.Sprintf("Failed to requeue recording %d: %v", recordings[r].ID, result.Error))
+		} else if result.RowsAffected == 1 {
+			helper.RecordEvent(recordings[r].ID, "retried", "The worker stopped responding")
+			log.Println("Requeued abandoned recording", recordings[r].ID)
+		}
+	}
+}
+
+// Wait for the transcriptions in progress to finish, for at most timeout.
+// The ones that don't finish in time are put back into the queue, since
+// they are abandoned when the worker exits.
+func finishTranscriptions(jobs *sync.WaitGroup, inProgress *sync.Map, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	var ids []uint
+	inProgress.Range(func(id, _ interface{}) bool {
+		ids = append(ids, id.(uint))
+		return true
+	})
+
+	var recordings []model.Recording
+	if len(ids) > 0 {
+		db.Where("id IN ? AND status = ?", ids, model.StatusProcessing).Find(&recordings)
+	}
+
+	requeueRecordings(recordings, "The worker was stopped")
+}
+
+// Delete the recordings whose retention period has passed
+func purgeExpiredRecordings() {
+	var recordings []model.Recording
+	db.Where("delete_after < ?", time.Now()).Find(&recordings)
+
+	for r := range recordings {
+		if err := helper.DeleteRecording(&recordings[r]); err != nil {
+			log.Println(fmt.Sprintf("Failed to delete expired recording %d: %v", recordings[r].ID, err))
 		} else {
-			helper.SendEmail("pavel.denisov@ims.uni-stuttgart.de", "Transcription Error", fmt.Sprintf("id: %d", recording.ID))
+			log.Println("Deleted expired recording", recordings[r].ID)
 		}
 	}
 }
 
+// Permanently delete the recordings that were deleted by their users
+// longer than the grace period ago
+func purgeDeletedRecordings() {
+	var recordings []model.Recording
+	db.Where("status = ? AND removed_at < ?", model.StatusDeleted, time.Now().Add(-helper.DeletionGracePeriod())).
+		Find(&recordings)
+
+	for r := range recordings {
+		if err := helper.DeleteRecording(&recordings[r]); err != nil {
+			log.Println(fmt.Sprintf("Failed to purge deleted recording %d: %v", recordings[r].ID, err))
+		} else {
+			log.Println("Purged deleted recording", recordings[r].ID)
+		}
+	}
+}
+
+// Find the queued recording to transcribe next, the one with the highest
+// priority, where every PRIORITY_AGING_MINUTES in the queue add one level
+// so that low-priority recordings are not starved
+func nextRecordings() []model.Recording {
+	aging := helper.GetConfigInt("PRIORITY_AGING_MINUTES", 30) * 60
+	if aging <= 0 {
+		aging = 1800
+	}
+	order := fmt.Sprintf("priority + floor(extract(epoch from now() - created_at) / %d) desc, created_at asc", aging)
+
+	var recordings []model.Recording
+	db.Where(&model.Recording{Status: model.StatusQueued}).Order(order).Limit(1).Find(&recordings)
+	return recordings
+}
+
 func main() {
 	helper.ConnectDB()
 	db = helper.DB
+	helper.ConnectStorage()
+	helper.LoadLanguages()
+
+	// Serve the profiling endpoints of net/http/pprof if configured,
+	// this should be a local address since they are not protected
+	if addr := helper.GetConfig("WORKER_PPROF_ADDR"); addr != "" {
+		go func() {
+			log.Println("Profiling endpoints stopped:", http.ListenAndServe(addr, nil))
+		}()
+	}
+
+	// Serve the metrics for Prometheus if configured, to the same scrapers
+	// as the web application
+	if addr := helper.GetConfig("WORKER_METRICS_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			client, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if !helper.MetricsAllowed(r, client) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			helper.MetricsHandler.ServeHTTP(w, r)
+		})
+		go func() {
+			log.Println("Metrics endpoint stopped:", http.ListenAndServe(addr, mux))
+		}()
+	}
+
+	resumeInterruptedRecordings()
+
+	// Up to WORKER_CONCURRENCY recordings are transcribed at the same time
+	concurrency := helper.GetConfigInt("WORKER_CONCURRENCY", 1)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	// On SIGINT or SIGTERM, stop claiming recordings and give the ones being
+	// transcribed WORKER_SHUTDOWN_SECONDS to finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Sleep for d, returns false if the worker is being stopped
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	var jobs sync.WaitGroup
+	var inProgress sync.Map
+
+	// Keep the claims of the recordings in progress fresh and take over
+	// the ones that other workers abandoned
+	go func() {
+		for range time.Tick(heartbeatInterval) {
+			sendHeartbeats(&inProgress)
+			requeueAbandonedRecordings()
+		}
+	}()
 
+	healthy := true
+	var lastPurge time.Time
+
+queue:
 	for {
-		var recordings []model.Recording
-		db.Where(&model.Recording{Status: 1}).Limit(1).Find(&recordings)
+		if time.Since(lastPurge) > time.Hour {
+			purgeExpiredRecordings()
+			purgeDeletedRecordings()
+			lastPurge = time.Now()
+		}
+
+		// Don't claim any recordings while the engine is unavailable
+		if !checkEngine() {
+			if healthy {
+				log.Println("ASR engine unavailable, pausing")
+				healthy = false
+			}
+			if !sleep(time.Duration(helper.GetConfigInt("ENGINE_RETRY_SECONDS", 30)) * time.Second) {
+				break
+			}
+			continue
+		} else if !healthy {
+			log.Println("ASR engine available again, resuming")
+			healthy = true
+		}
+
+		// Wait for a free slot
+		select {
+		case <-stop:
+			break queue
+		case slots <- struct{}{}:
+		}
+
+		recordings := nextRecordings()
 
 		if len(recordings) == 0 {
-			time.Sleep(10 * time.Second)
+			<-slots
+			if !sleep(10 * time.Second) {
+				break
+			}
+		} else if !claimRecording(&recordings[0]) {
+			<-slots
 		} else {
-			transcribe(&recordings[0])
+			jobs.Add(1)
+			inProgress.Store(recordings[0].ID, true)
+			go func(recording model.Recording) {
+				defer func() {
+					inProgress.Delete(recording.ID)
+					<-slots
+					jobs.Done()
+				}()
+				transcribe(&recording)
+			}(recordings[0])
 		}
 	}
+
+	log.Println("Stopping, waiting for the transcriptions in progress")
+	finishTranscriptions(&jobs, &inProgress, time.Duration(helper.GetConfigInt("WORKER_SHUTDOWN_SECONDS", 60))*time.Second)
 }
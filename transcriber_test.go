@@ -0,0 +1,357 @@
+//go:build worker
+// +build worker
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"simple-web-asr/helper"
+	"simple-web-asr/model"
+)
+
+func TestNextRecordingsOrder(t *testing.T) {
+	for _, c := range []struct {
+		aging string
+		order string
+	}{
+		{"", "ORDER BY priority + floor(extract(epoch from now() - created_at) / 1800) desc, created_at asc"},
+		{"5", "ORDER BY priority + floor(extract(epoch from now() - created_at) / 300) desc, created_at asc"},
+		{"-1", "ORDER BY priority + floor(extract(epoch from now() - created_at) / 1800) desc, created_at asc"},
+	} {
+		setConfig(t, "PRIORITY_AGING_MINUTES", c.aging)
+		recorder := dryRun(t)
+
+		nextRecordings()
+
+		if len(recorder.statements) != 1 {
+			t.Fatalf("got %d statements, want 1", len(recorder.statements))
+		}
+		sql := recorder.statements[0]
+		if !strings.Contains(sql, "WHERE recordings.status = 1") {
+			t.Errorf("aging %q: the query doesn't select queued recordings: %s", c.aging, sql)
+		}
+		if !strings.Contains(sql, c.order) {
+			t.Errorf("aging %q: got %s, want %s", c.aging, sql, c.order)
+		}
+	}
+}
+
+func TestChunkOffsets(t *testing.T) {
+	for _, c := range []struct {
+		duration float64
+		offsets  []float64
+	}{
+		{100, []float64{0, 20, 40, 60, 80}},
+		{90, []float64{0, 20, 40, 60}},
+		{31, []float64{0, 20}},
+	} {
+		if got := chunkOffsets(c.duration, 30, 10); !reflect.DeepEqual(got, c.offsets) {
+			t.Errorf("duration %v: got %v, want %v", c.duration, got, c.offsets)
+		}
+	}
+}
+
+func TestStitchChunks(t *testing.T) {
+	const duration, chunkLength, overlap = 100.0, 30.0, 10.0
+
+	// An utterance every 1.5 seconds, so that some cross the chunk boundaries
+	var spoken []model.Utterance
+	for start := float32(0); start+1 <= duration; start += 1.5 {
+		spoken = append(spoken, model.Utterance{Start: start, End: start + 1})
+	}
+
+	// Every chunk hears the utterances that fit in it, relative to its start
+	offsets := chunkOffsets(duration, chunkLength, overlap)
+	chunks := make([][]model.Utterance, len(offsets))
+	for i, offset := range offsets {
+		for _, utt := range spoken {
+			if float64(utt.Start) >= offset && float64(utt.End) <= offset+chunkLength {
+				utt.Start -= float32(offset)
+				utt.End -= float32(offset)
+				chunks[i] = append(chunks[i], utt)
+			}
+		}
+	}
+
+	stitched := stitchChunks(chunks, offsets, overlap)
+
+	if len(stitched) != len(spoken) {
+		t.Fatalf("got %d utterances, want %d", len(stitched), len(spoken))
+	}
+	for i := range stitched {
+		if stitched[i].Start != spoken[i].Start || stitched[i].End != spoken[i].End {
+			t.Errorf("utterance %d: got %v-%v, want %v-%v", i, stitched[i].Start, stitched[i].End, spoken[i].Start, spoken[i].End)
+		}
+		if i > 0 && stitched[i].Start < stitched[i-1].End {
+			t.Errorf("utterance %d starts at %v, before the previous one ends at %v", i, stitched[i].Start, stitched[i-1].End)
+		}
+	}
+}
+
+// fakeEngine is an ASR service that can be taken down and brought back,
+// with a health check command that reports its state
+type fakeEngine struct {
+	dir string
+}
+
+func newFakeEngine(t *testing.T) *fakeEngine {
+	dir := t.TempDir()
+	engine := &fakeEngine{dir: dir}
+
+	healthCmd := filepath.Join(dir, "health")
+	script := "#!/bin/sh\ntest -e " + filepath.Join(dir, "up") + "\n"
+	if err := ioutil.WriteFile(healthCmd, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !engine.healthy() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("0.00 1.00 hello\n"))
+	}))
+	t.Cleanup(server.Close)
+
+	setConfig(t, "ENGINE_HEALTH_CMD", healthCmd)
+	setConfig(t, "ASR_ENDPOINT", server.URL)
+	return engine
+}
+
+func (e *fakeEngine) healthy() bool {
+	_, err := os.Stat(filepath.Join(e.dir, "up"))
+	return err == nil
+}
+
+func (e *fakeEngine) set(up bool) {
+	if up {
+		ioutil.WriteFile(filepath.Join(e.dir, "up"), nil, 0644)
+	} else {
+		os.Remove(filepath.Join(e.dir, "up"))
+	}
+}
+
+func TestCheckEngineFlapping(t *testing.T) {
+	engine := newFakeEngine(t)
+	recorder := dryRun(t)
+
+	for i, up := range []bool{true, false, false, true, false, true} {
+		engine.set(up)
+		if got := checkEngine(); got != up {
+			t.Errorf("check %d: got %v, want %v", i+1, got, up)
+		}
+	}
+
+	// Every check is recorded for the web application
+	saved := 0
+	for _, statement := range recorder.statements {
+		if strings.Contains(statement, "engine_statuses") {
+			saved++
+		}
+	}
+	if saved != 6 {
+		t.Errorf("recorded %d checks, want 6: %q", saved, recorder.statements)
+	}
+}
+
+func TestTranscribeRequeuesWhileEngineDown(t *testing.T) {
+	engine := newFakeEngine(t)
+	recorder := dryRun(t)
+
+	previous := helper.Store
+	helper.Store = &helper.LocalStorage{Dir: t.TempDir()}
+	t.Cleanup(func() { helper.Store = previous })
+
+	recording := model.Recording{Title: "talk", Language: "en", StoragePath: "talk.dat", Duration: 1}
+	recording.ID = 7
+	// Already in the format of the decoder, so that it is not converted
+	if err := helper.Store.Save(helper.ConvertedRecordingName(&recording), strings.NewReader("RIFF")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The engine goes down while the recording is being transcribed
+	engine.set(false)
+	transcribe(&recording)
+
+	if recording.Status != model.StatusQueued {
+		t.Errorf("got status %v, want %v", recording.Status, model.StatusQueued)
+	}
+	retried := false
+	for _, statement := range recorder.statements {
+		retried = retried || strings.Contains(statement, "'retried'")
+		if strings.Contains(statement, "'failed'") {
+			t.Errorf("the recording failed: %s", statement)
+		}
+	}
+	if !retried {
+		t.Errorf("the recording wasn't retried: %q", recorder.statements)
+	}
+}
+
+func TestFinishTranscriptions(t *testing.T) {
+	recorder := dryRun(t)
+
+	var jobs sync.WaitGroup
+	var inProgress sync.Map
+	jobs.Add(1)
+	inProgress.Store(uint(7), true)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		inProgress.Delete(uint(7))
+		jobs.Done()
+	}()
+
+	finishTranscriptions(&jobs, &inProgress, time.Second)
+
+	if len(recorder.statements) > 0 {
+		t.Errorf("the finished transcription was requeued: %q", recorder.statements)
+	}
+}
+
+func TestFinishTranscriptionsTimeout(t *testing.T) {
+	recorder := dryRun(t)
+
+	var jobs sync.WaitGroup
+	var inProgress sync.Map
+	jobs.Add(1)
+	defer jobs.Done()
+	inProgress.Store(uint(7), true)
+
+	stuck := model.Recording{Status: model.StatusProcessing}
+	stuck.ID = 7
+	recorder.rows["recordings"] = []model.Recording{stuck}
+
+	start := time.Now()
+	finishTranscriptions(&jobs, &inProgress, 50*time.Millisecond)
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for the stuck transcription", waited)
+	}
+
+	for _, want := range []string{
+		fmt.Sprintf("FROM recordings WHERE id IN (7) AND status = %d", model.StatusProcessing),
+		fmt.Sprintf("UPDATE recordings SET status=%d", model.StatusQueued),
+		"'The worker was stopped'",
+	} {
+		found := false
+		for _, statement := range recorder.statements {
+			found = found || strings.Contains(statement, want)
+		}
+		if !found {
+			t.Errorf("got %q, want %s", recorder.statements, want)
+		}
+	}
+}
+
+func TestResumeInterruptedRecordings(t *testing.T) {
+	setConfig(t, "WORKER_ID", "worker-1")
+	recorder := dryRun(t)
+
+	interrupted := model.Recording{Status: model.StatusProcessing}
+	interrupted.ID = 3
+	recorder.rows["recordings: worker_id = 'worker-1'"] = []model.Recording{interrupted}
+
+	resumeInterruptedRecordings()
+
+	requeued, abandoned := false, false
+	for _, statement := range recorder.statements {
+		requeued = requeued || strings.HasPrefix(statement, fmt.Sprintf("UPDATE recordings SET status=%d", model.StatusQueued)) && strings.Contains(statement, "id = 3")
+		abandoned = abandoned || strings.Contains(statement, "FROM recordings") && strings.Contains(statement, "heartbeat_at <")
+	}
+	if !requeued {
+		t.Errorf("the recording isn't requeued: %q", recorder.statements)
+	}
+	if !abandoned {
+		t.Errorf("the abandoned recordings aren't looked for: %q", recorder.statements)
+	}
+}
+
+// Another worker transcribes the recording, so it stays as it is
+func TestResumeInterruptedRecordingsOfOtherWorkers(t *testing.T) {
+	setConfig(t, "WORKER_ID", "worker-1")
+	recorder := dryRun(t)
+
+	resumeInterruptedRecordings()
+
+	for _, statement := range recorder.statements {
+		if strings.Contains(statement, "FROM recordings") && !strings.Contains(statement, "worker_id = 'worker-1'") && !strings.Contains(statement, "heartbeat_at <") {
+			t.Errorf("all the recordings in progress are requeued: %s", statement)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	langid := filepath.Join(t.TempDir(), "langid")
+	setConfig(t, "LANGID_CMD", langid)
+	setConfig(t, "LANGID_MIN_CONFIDENCE", "0.8")
+
+	for _, c := range []struct {
+		output     string
+		detected   bool
+		language   string
+		candidates string
+	}{
+		{"de 0.95\nen 0.05", true, "de", ""},
+		{"de 0.5\nen 0.4\nru 0.05\nfr 0.05", false, "auto", "de:0.50,en:0.40,ru:0.05"},
+		// The decoder can't transcribe the confidently detected language
+		{"fr 0.9\nen 0.1", false, "auto", "en:0.10"},
+		{"", false, "auto", ""},
+	} {
+		script := "#!/bin/sh\nprintf '" + c.output + "\\n'\n"
+		if err := ioutil.WriteFile(langid, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		recording := model.Recording{Language: "auto"}
+		detected := detectLanguage(&recording, "recording.wav")
+		if detected != c.detected || recording.Language != c.language || recording.LanguageCandidates != c.candidates {
+			t.Errorf("%q: got %v, %q, %q", c.output, detected, recording.Language, recording.LanguageCandidates)
+		}
+	}
+}
+
+// The user may rename the recording while it is being transcribed
+func TestTranscribeKeepsUserEdits(t *testing.T) {
+	newFakeEngine(t).set(true)
+	setConfig(t, "LANGID_CMD", "")
+	recorder := dryRun(t)
+
+	previous := helper.Store
+	helper.Store = &helper.LocalStorage{Dir: t.TempDir()}
+	t.Cleanup(func() { helper.Store = previous })
+
+	// The language can't be detected, so it waits for the user
+	recording := model.Recording{Title: "talk", Language: "auto", StoragePath: "talk.dat", Duration: 1}
+	recording.ID = 7
+	if err := helper.Store.Save(helper.ConvertedRecordingName(&recording), strings.NewReader("RIFF")); err != nil {
+		t.Fatal(err)
+	}
+
+	transcribe(&recording)
+
+	if recording.Status != model.StatusLanguageUnconfirmed {
+		t.Fatalf("got status %v, want %v: %q", recording.Status, model.StatusLanguageUnconfirmed, recorder.statements)
+	}
+	updated := 0
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "UPDATE recordings SET") && strings.Contains(statement, "status=") {
+			updated++
+			if strings.Contains(statement, "title=") {
+				t.Errorf("the title is written: %s", statement)
+			}
+		}
+	}
+	if updated != 2 {
+		t.Errorf("got %d updates of the status, want 2: %q", updated, recorder.statements)
+	}
+}